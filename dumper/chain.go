@@ -0,0 +1,232 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChainLayer is one backup of a restore chain: the areas it holds and a
+// reader of its data, addressed by disk offset like the disk itself.
+type ChainLayer struct {
+	ChangeInfo *DiskChangeInfo
+	Data       io.ReaderAt
+}
+
+// chainExtent is a run of the disk whose newest version is in layer.
+type chainExtent struct {
+	start int64
+	end   int64
+	layer int
+}
+
+// chainReader reads every extent of a resolved chain from its layer.
+type chainReader struct {
+	chain   []ChainLayer
+	extents []chainExtent
+}
+
+// NOTE: 按从旧到新的顺序解析chain, 得到每段数据最新版本所在的layer, 以及所有layer变化区域的并集
+func resolveChain(chain []ChainLayer) ([]chainExtent, *DiskChangeInfo, error) {
+	type event struct {
+		pos   int64
+		layer int
+		delta int
+	}
+	var events []event
+	var length int64
+	for i, layer := range chain {
+		dc := layer.ChangeInfo
+		if dc == nil || layer.Data == nil {
+			return nil, nil, fmt.Errorf("chain layer %d has no ChangeInfo or Data", i)
+		}
+		if dc.Length > length {
+			length = dc.Length
+		}
+		for _, area := range dc.ChangedArea {
+			if area.Length <= 0 {
+				continue
+			}
+			start := dc.StartOffset + area.Start
+			events = append(events, event{start, i, 1}, event{start + area.Length, i, -1})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].pos < events[j].pos
+	})
+
+	// NOTE: layer数量通常很少, 每个边界处从新到旧找第一个覆盖该位置的layer即可
+	active := make([]int, len(chain))
+	var extents []chainExtent
+	for i := 0; i < len(events); {
+		pos := events[i].pos
+		for ; i < len(events) && events[i].pos == pos; i++ {
+			active[events[i].layer] += events[i].delta
+		}
+		if i == len(events) {
+			break
+		}
+		newest := -1
+		for layer := len(active) - 1; layer >= 0; layer-- {
+			if active[layer] > 0 {
+				newest = layer
+				break
+			}
+		}
+		if newest < 0 {
+			continue
+		}
+		end := events[i].pos
+		last := len(extents) - 1
+		if last >= 0 && extents[last].end == pos && extents[last].layer == newest {
+			extents[last].end = end
+		} else {
+			extents = append(extents, chainExtent{start: pos, end: end, layer: newest})
+		}
+	}
+
+	union := &DiskChangeInfo{Length: length}
+	for _, extent := range extents {
+		last := len(union.ChangedArea) - 1
+		if last >= 0 && union.ChangedArea[last].Start+union.ChangedArea[last].Length == extent.start {
+			union.ChangedArea[last].Length += extent.end - extent.start
+		} else {
+			union.ChangedArea = append(union.ChangedArea, ChangedArea{
+				Start:  extent.start,
+				Length: extent.end - extent.start,
+			})
+		}
+	}
+	return extents, union, nil
+}
+
+// ReadAt reads p from the layers that hold the newest version of each part.
+// Parts that no layer holds read as zeros.
+func (r *chainReader) ReadAt(p []byte, off int64) (n int, err error) {
+	end := off + int64(len(p))
+	i := sort.Search(len(r.extents), func(i int) bool {
+		return r.extents[i].end > off
+	})
+	pos := off
+	for ; pos < end && i < len(r.extents) && r.extents[i].start < end; i++ {
+		extent := r.extents[i]
+		for ; pos < extent.start; pos++ {
+			p[pos-off] = 0
+		}
+		stop := extent.end
+		if stop > end {
+			stop = end
+		}
+		_, err = r.chain[extent.layer].Data.ReadAt(p[pos-off:stop-off], pos)
+		if err != nil && err != io.EOF {
+			return int(pos - off), fmt.Errorf("chain layer %d at %d: %v", extent.layer, pos, err)
+		}
+		pos = stop
+	}
+	for ; pos < end; pos++ {
+		p[pos-off] = 0
+	}
+	return len(p), nil
+}
+
+// CopyChain writes the newest version of every area changed by the chain to
+// dst, each exactly once. chain starts with the full backup and goes on with
+// the incrementals, oldest first.
+func CopyChain(ctx context.Context, dst io.WriterAt, chain []ChainLayer, opts CopyOptions) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("CopyChain: empty chain")
+	}
+	extents, union, err := resolveChain(chain)
+	if err != nil {
+		return fmt.Errorf("CopyChain: %v", err)
+	}
+	src := &chainReader{
+		chain:   chain,
+		extents: extents,
+	}
+	return CopyChangedAreas(ctx, dst, src, union, opts)
+}
+
+// NOTE: 打开备份id以及沿Parent找到的所有祖先, backups从新到旧, chain从旧到新
+func openBackupChain(repo *repository.Repository, id string) (backups []*repository.Backup, chain []ChainLayer, err error) {
+	seen := make(map[string]bool)
+	for next := id; next != ""; {
+		if seen[next] {
+			closeBackups(backups)
+			return nil, nil, fmt.Errorf("backup %s is its own ancestor", next)
+		}
+		seen[next] = true
+		backup, err := repo.OpenBackup(next)
+		if err != nil {
+			closeBackups(backups)
+			return nil, nil, fmt.Errorf("OpenBackup: %v", err)
+		}
+		backups = append(backups, backup)
+		next = backup.Manifest().Parent
+	}
+
+	chain = make([]ChainLayer, len(backups))
+	for i, backup := range backups {
+		manifest := backup.Manifest()
+		dc := &DiskChangeInfo{
+			StartOffset: 0,
+			Length:      manifest.DiskSize(),
+		}
+		for _, extent := range manifest.Extents {
+			dc.ChangedArea = append(dc.ChangedArea, ChangedArea{
+				Start:  extent.Offset,
+				Length: extent.Length,
+			})
+		}
+		chain[len(backups)-1-i] = ChainLayer{ChangeInfo: dc, Data: backup}
+	}
+	return backups, chain, nil
+}
+
+func closeBackups(backups []*repository.Backup) {
+	for _, backup := range backups {
+		backup.Close()
+	}
+}
+
+// SynthesizeFullBackup merges backup id and the chain of incrementals it
+// belongs to into a new full backup in repo, without reading the disk again.
+// The new backup has no parent, holds the newest version of every area of the
+// chain and takes the geometry, metadata and changeId of id, so the next
+// incremental can be based on it and the old chain can be deleted. Data is
+// copied through the chunk store, so chunks that do not move are not stored
+// again.
+func SynthesizeFullBackup(ctx context.Context, repo *repository.Repository, id string, opts CopyOptions) (*repository.Manifest, error) {
+	backups, chain, err := openBackupChain(repo, id)
+	if err != nil {
+		return nil, fmt.Errorf("SynthesizeFullBackup: %v", err)
+	}
+	defer closeBackups(backups)
+
+	m := *backups[0].Manifest()
+	m.Parent = ""
+	m.BaseChangeId = ""
+	m.SyntheticOf = id
+	bw, err := repo.NewBackup(m)
+	if err != nil {
+		return nil, fmt.Errorf("SynthesizeFullBackup: %v", err)
+	}
+	err = CopyChain(ctx, bw, chain, opts)
+	if err != nil {
+		bw.Abort()
+		return nil, fmt.Errorf("SynthesizeFullBackup: %v", err)
+	}
+	stats := bw.Stats()
+	manifest, err := bw.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("SynthesizeFullBackup: %v", err)
+	}
+	log.Infof("Synthetic full backup %s of %s (%d backups): %d bytes, %d new chunks (%d bytes), %d reused chunks (%d bytes)",
+		manifest.ID, id, len(backups), manifest.DataSize(),
+		stats.NewChunks, stats.NewBytes, stats.ReusedChunks, stats.ReusedBytes)
+	return manifest, nil
+}
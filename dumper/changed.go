@@ -0,0 +1,199 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// FullChangeId asks QueryChangedDiskAreas for every allocated area of the
+// disk instead of the areas changed since an earlier changeId.
+const FullChangeId = "*"
+
+// NewVsphereClient logs in to the vCenter or ESXi host of conn. The server
+// certificate is checked against conn.VsphereThumbPrint.
+func NewVsphereClient(ctx context.Context, conn ConnParams) (*vim25.Client, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   conn.VsphereHostName,
+		Path:   vim25.Path,
+	}
+	if conn.VsphereHostPort != 0 {
+		u.Host += ":" + strconv.Itoa(conn.VsphereHostPort)
+	}
+
+	sc := soap.NewClient(u, false)
+	sc.SetThumbprint(u.Host, conn.VsphereThumbPrint)
+	c, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		return nil, fmt.Errorf("vim25.NewClient: %v", err)
+	}
+
+	err = session.NewManager(c).Login(ctx, url.UserPassword(conn.VsphereUsername, conn.VspherePassword))
+	if err != nil {
+		return nil, fmt.Errorf("Login: %v", err)
+	}
+	return c, nil
+}
+
+// findSnapshotDisk returns the disk of the snapshot with the given device key,
+// or the one whose backing chain contains diskPath when diskKey is 0.
+func findSnapshotDisk(ctx context.Context, c *vim25.Client, snapshot types.ManagedObjectReference, diskKey int32, diskPath string) (*types.VirtualDisk, error) {
+	var snap mo.VirtualMachineSnapshot
+	err := mo.RetrieveProperties(ctx, c, c.ServiceContent.PropertyCollector, snapshot, &snap)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveProperties(%v): %v", snapshot.Value, err)
+	}
+
+	for _, device := range snap.Config.Hardware.Device {
+		disk, ok := device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		if diskKey != 0 {
+			if disk.Key == diskKey {
+				return disk, nil
+			}
+			continue
+		}
+		// NOTE: 快照里的disk指向delta文件, 需要沿着parent链查找原始的disk路径
+		for backing := disk.Backing; backing != nil; backing = parentBacking(backing) {
+			if file, ok := backing.(types.BaseVirtualDeviceFileBackingInfo); ok && file.GetVirtualDeviceFileBackingInfo().FileName == diskPath {
+				return disk, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("disk %q (key %d) not found in snapshot %v", diskPath, diskKey, snapshot.Value)
+}
+
+func parentBacking(backing types.BaseVirtualDeviceBackingInfo) types.BaseVirtualDeviceBackingInfo {
+	var parent types.BaseVirtualDeviceBackingInfo
+	switch b := backing.(type) {
+	case *types.VirtualDiskFlatVer2BackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	case *types.VirtualDiskSparseVer2BackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	case *types.VirtualDiskSeSparseBackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	case *types.VirtualDiskRawDiskMappingVer1BackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	}
+	return parent
+}
+
+// QueryChangedDiskAreas asks vCenter which areas of a disk in the given
+// snapshot of vmMoRef changed since changeId, paging through the results until
+// the whole disk is covered. The disk is picked by diskKey, or by diskPath when
+// diskKey is 0. Use FullChangeId to get every allocated area.
+func QueryChangedDiskAreas(ctx context.Context, c *vim25.Client, vmMoRef string, snapMoRef string, diskKey int32, diskPath string, changeId string) (*DiskChangeInfo, error) {
+	snapshot := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: snapMoRef}
+	disk, err := findSnapshotDisk(ctx, c, snapshot, diskKey, diskPath)
+	if err != nil {
+		return nil, err
+	}
+	return queryChangedDiskAreas(ctx, c, vmMoRef, snapshot, disk, changeId)
+}
+
+func queryChangedDiskAreas(ctx context.Context, c *vim25.Client, vmMoRef string, snapshot types.ManagedObjectReference, disk *types.VirtualDisk, changeId string) (*DiskChangeInfo, error) {
+	vm := types.ManagedObjectReference{Type: "VirtualMachine", Value: vmMoRef}
+	capacity := disk.CapacityInBytes
+	if capacity == 0 {
+		capacity = disk.CapacityInKB * 1024
+	}
+
+	dc := &DiskChangeInfo{
+		StartOffset: 0,
+		Length:      capacity,
+	}
+	offset := int64(0)
+	for offset < capacity {
+		req := types.QueryChangedDiskAreas{
+			This:        vm,
+			Snapshot:    &snapshot,
+			DeviceKey:   disk.Key,
+			StartOffset: offset,
+			ChangeId:    changeId,
+		}
+		res, err := methods.QueryChangedDiskAreas(ctx, c, &req)
+		if err != nil {
+			return nil, fmt.Errorf("QueryChangedDiskAreas(offset %d): %v", offset, err)
+		}
+
+		for _, area := range res.Returnval.ChangedArea {
+			dc.ChangedArea = append(dc.ChangedArea, ChangedArea{
+				Start:  area.Start,
+				Length: area.Length,
+			})
+		}
+
+		next := res.Returnval.StartOffset + res.Returnval.Length
+		if next <= offset {
+			return nil, fmt.Errorf("QueryChangedDiskAreas(offset %d): no progress", offset)
+		}
+		offset = next
+	}
+
+	log.Infof("QueryChangedDiskAreas: %d changed areas since %q", len(dc.ChangedArea), changeId)
+	return dc, nil
+}
+
+// diskChangeId returns the changeId of disk, empty when CBT is not enabled.
+func diskChangeId(disk *types.VirtualDisk) string {
+	switch b := disk.Backing.(type) {
+	case *types.VirtualDiskFlatVer2BackingInfo:
+		return b.ChangeId
+	case *types.VirtualDiskSparseVer2BackingInfo:
+		return b.ChangeId
+	case *types.VirtualDiskSeSparseBackingInfo:
+		return b.ChangeId
+	case *types.VirtualDiskRawDiskMappingVer1BackingInfo:
+		return b.ChangeId
+	case *types.VirtualDiskRawDiskVer2BackingInfo:
+		return b.ChangeId
+	}
+	return ""
+}
+
+// NOTE: 直接向vCenter查询changed areas, 替代手工生成的CbtData json.
+// 同时记录快照中disk当前的changeId, 作为下一次增量备份的起点
+func (d *VadpDumper) QueryChangedDiskAreas(ctx context.Context, diskKey int32) (err error) {
+	c, err := NewVsphereClient(ctx, d.ConnParams)
+	if err != nil {
+		return err
+	}
+	defer session.NewManager(c).Logout(context.Background())
+
+	snapshot := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: d.VsphereSnapshotMoRef}
+	disk, err := findSnapshotDisk(ctx, c, snapshot, diskKey, d.DiskPath)
+	if err != nil {
+		return err
+	}
+	changeId := d.ChangeId
+	if changeId == "" {
+		changeId = FullChangeId
+	}
+	dc, err := queryChangedDiskAreas(ctx, c, d.VmMoRef, snapshot, disk, changeId)
+	if err != nil {
+		return err
+	}
+	d.ChangeInfo = dc
+	d.SnapshotChangeId = diskChangeId(disk)
+	return nil
+}
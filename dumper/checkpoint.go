@@ -0,0 +1,130 @@
+package dumper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointVersion is the version of the checkpoint file format.
+const CheckpointVersion = 1
+
+// DefaultCheckpointInterval is how often a copy saves its checkpoint when
+// VadpDumper.CheckpointInterval is zero.
+const DefaultCheckpointInterval = 5 * time.Second
+
+// Checkpoint is the progress of a DumpCloneDisk, saved so that a copy that
+// failed part way can be resumed by ResumeCloneDisk. Everything before
+// Position has been written to Target.
+type Checkpoint struct {
+	Version int `json:"version"`
+	// Target is the disk written to, a local path or the remote disk
+	Target string `json:"target"`
+	// ChangeId is the changeId of the source disk in the snapshot
+	ChangeId string `json:"changeId"`
+	// ChangeInfoDigest identifies the changed areas being copied
+	ChangeInfoDigest string       `json:"changeInfoDigest"`
+	Position         CopyPosition `json:"position"`
+	Done             bool         `json:"done"`
+	Updated          time.Time    `json:"updated"`
+}
+
+// LoadCheckpoint reads a checkpoint written by Save.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCheckpoint: %v", err)
+	}
+	cp := &Checkpoint{}
+	err = json.Unmarshal(buf, cp)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCheckpoint: %s: %v", path, err)
+	}
+	if cp.Version != CheckpointVersion {
+		return nil, fmt.Errorf("LoadCheckpoint: %s has unsupported version %d", path, cp.Version)
+	}
+	return cp, nil
+}
+
+// Save writes the checkpoint to path, replacing the previous one atomically.
+func (cp *Checkpoint) Save(path string) error {
+	cp.Updated = time.Now().UTC()
+	buf, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Checkpoint.Save: %v", err)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Checkpoint.Save: %v", err)
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Checkpoint.Save: %v", err)
+	}
+	return nil
+}
+
+// changeInfoDigest is a hash of the changed areas, so that a checkpoint is
+// only resumed with the areas it was saved for.
+func changeInfoDigest(dc *DiskChangeInfo) string {
+	buf, _ := json.Marshal(dc)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointer saves the progress of a copy at most once per interval. A
+// position is saved once the writes before it have returned; a target that
+// buffers writes must not lose them when the copy fails, which holds as long
+// as it is closed with Cleanup.
+type checkpointer struct {
+	path     string
+	interval time.Duration
+
+	mutex sync.Mutex
+	cp    Checkpoint
+	saved time.Time
+}
+
+func (c *checkpointer) progress(pos CopyPosition) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cp.Position = pos
+	if time.Since(c.saved) < c.interval {
+		return
+	}
+	c.saveLocked()
+}
+
+// NOTE: 保存失败只打印警告, 不影响拷贝本身, 最坏情况是恢复时多拷贝一些数据
+func (c *checkpointer) saveLocked() {
+	err := c.cp.Save(c.path)
+	if err != nil {
+		log.Warnf("Save checkpoint %s: %v", c.path, err)
+		return
+	}
+	c.saved = time.Now()
+}
+
+func (c *checkpointer) finish(done bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cp.Done = done
+	c.saveLocked()
+}
@@ -0,0 +1,125 @@
+package dumper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChecksumSHA256 is the hash of ChecksumManifest blocks.
+const ChecksumSHA256 = "sha256"
+
+// BlockChecksum is the hash of one block written by the copy engine.
+type BlockChecksum struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"`
+}
+
+// ChecksumManifest holds a hash of every block a copy wrote, so that the
+// target can be verified later. It is safe for concurrent use.
+type ChecksumManifest struct {
+	Algorithm string          `json:"algorithm"`
+	Blocks    []BlockChecksum `json:"blocks"`
+
+	mutex  sync.Mutex
+	sorted bool
+}
+
+// NewChecksumManifest returns an empty SHA-256 manifest.
+func NewChecksumManifest() *ChecksumManifest {
+	return &ChecksumManifest{Algorithm: ChecksumSHA256}
+}
+
+// ParseChecksumManifest reads a manifest written by Marshal.
+func ParseChecksumManifest(conf string) (*ChecksumManifest, error) {
+	m := &ChecksumManifest{}
+	err := json.Unmarshal([]byte(conf), m)
+	if err != nil {
+		return nil, fmt.Errorf("ParseChecksumManifest: %v", err)
+	}
+	if m.Algorithm != ChecksumSHA256 {
+		return nil, fmt.Errorf("ParseChecksumManifest: unknown algorithm %q", m.Algorithm)
+	}
+	return m, nil
+}
+
+func checksum(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+// add records the hash of p, the block at offset.
+func (m *ChecksumManifest) add(offset int64, p []byte) {
+	block := BlockChecksum{
+		Offset: offset,
+		Length: int64(len(p)),
+		Hash:   checksum(p),
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Blocks = append(m.Blocks, block)
+	m.sorted = false
+}
+
+// sortedBlocks returns the blocks in offset order; writers may add them in
+// any order.
+func (m *ChecksumManifest) sortedBlocks() []BlockChecksum {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.sorted {
+		sort.Slice(m.Blocks, func(i, j int) bool {
+			return m.Blocks[i].Offset < m.Blocks[j].Offset
+		})
+		m.sorted = true
+	}
+	return m.Blocks
+}
+
+// Marshal returns the manifest as JSON, blocks in offset order.
+func (m *ChecksumManifest) Marshal() ([]byte, error) {
+	blocks := m.sortedBlocks()
+	return json.Marshal(struct {
+		Algorithm string          `json:"algorithm"`
+		Blocks    []BlockChecksum `json:"blocks"`
+	}{m.Algorithm, blocks})
+}
+
+// VerifyChecksums reads every block of m back from target and returns the
+// ranges whose content does not match, merged where they touch. It returns an
+// error only when target cannot be read.
+func VerifyChecksums(ctx context.Context, target io.ReaderAt, m *ChecksumManifest) ([]ChangedArea, error) {
+	var mismatched []ChangedArea
+	var buf []byte
+	for _, block := range m.sortedBlocks() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if int64(cap(buf)) < block.Length {
+			buf = make([]byte, block.Length)
+		}
+		p := buf[:block.Length]
+		n, err := target.ReadAt(p, block.Offset)
+		if err != nil && !(err == io.EOF && n == len(p)) {
+			return nil, fmt.Errorf("VerifyChecksums: ReadAt(%d): %v", block.Offset, err)
+		}
+		if checksum(p) == block.Hash {
+			continue
+		}
+		log.Warnf("Checksum mismatch at %d, length %d", block.Offset, block.Length)
+		last := len(mismatched) - 1
+		if last >= 0 && mismatched[last].Start+mismatched[last].Length == block.Offset {
+			mismatched[last].Length += block.Length
+		} else {
+			mismatched = append(mismatched, ChangedArea{Start: block.Offset, Length: block.Length})
+		}
+	}
+	return mismatched, nil
+}
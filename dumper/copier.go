@@ -0,0 +1,363 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	log "github.com/sirupsen/logrus"
+)
+
+// NOTE: 默认每个块1MB(2048个扇区), 与原来串行拷贝时的读写大小一致
+const DefaultCopyBlockSize = int64(disklib.VIXDISKLIB_SECTOR_SIZE * 1024 * 2)
+
+// CopyOptions configures the copy engine used by DumpCloneDisk and
+// DumpRestoreDisk. Zero values are replaced by the defaults.
+type CopyOptions struct {
+	// Readers is the number of goroutines reading from the source, default 1.
+	Readers int
+	// Writers is the number of goroutines writing to the target, default 1.
+	// It is ignored when Ordered is set.
+	Writers int
+	// QueueDepth is how many blocks that have been read may wait for a
+	// writer, default Readers+Writers.
+	QueueDepth int
+	// BlockSize is the size of a single read or write in bytes, default
+	// DefaultCopyBlockSize. It should be a multiple of the sector size.
+	BlockSize int64
+	// Ordered writes the blocks in the order of the changed areas with a
+	// single writer. Otherwise blocks are written as soon as they are read.
+	Ordered bool
+	// Checksums, if set, gets the hash of every block written.
+	Checksums *ChecksumManifest
+	// Start skips everything before it, to resume a copy that got there.
+	Start CopyPosition
+	// Progress, if set, is called each time the position before which every
+	// block has been written advances. Calls do not overlap.
+	Progress func(CopyPosition)
+	// Zeroes, if set, gets every block that holds only zeros.
+	Zeroes *ZeroExtents
+	// SkipZeroes leaves blocks of zeros out instead of writing them. It is
+	// only correct for a target that reads as zeros where it was not written,
+	// such as a thin disk that was just created. DumpBackupDisk ignores it, as
+	// an incremental backup has to record the blocks that became zeros.
+	SkipZeroes bool
+	// Limiter, if set, throttles the reads of the source. It can be shared
+	// with other copies and its limits changed while the copy runs.
+	Limiter *virtual_disks.Limiter
+}
+
+// CopyPosition is a point in the changed areas of a copy: area Area up to
+// disk offset Offset. An area is done when Offset is its end.
+type CopyPosition struct {
+	Area   int   `json:"area"`
+	Offset int64 `json:"offset"`
+}
+
+func (o CopyOptions) withDefaults() CopyOptions {
+	if o.Readers <= 0 {
+		o.Readers = 1
+	}
+	if o.Writers <= 0 || o.Ordered {
+		o.Writers = 1
+	}
+	if o.QueueDepth <= 0 {
+		o.QueueDepth = o.Readers + o.Writers
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultCopyBlockSize
+	}
+	return o
+}
+
+type copyBlock struct {
+	seq    int64
+	area   int
+	offset int64
+	length int64
+	buf    []byte
+}
+
+// copier runs one copy. Buffers come from a fixed free list, so no more than
+// Readers+QueueDepth+Writers blocks are ever in memory.
+type copier struct {
+	opts CopyOptions
+	src  io.ReaderAt
+	dst  io.WriterAt
+
+	free   chan []byte
+	jobs   chan copyBlock
+	filled chan copyBlock
+	ready  chan copyBlock
+
+	errOnce sync.Once
+	err     error
+	cancel  context.CancelFunc
+
+	// done holds the blocks written after the first one that is not yet
+	// written, keyed by seq; nextDone is the seq of that block
+	progressMutex sync.Mutex
+	done          map[int64]CopyPosition
+	nextDone      int64
+}
+
+// CopyChangedAreas copies the changed areas of dc from src to dst, both at
+// dc.StartOffset plus the area start, using a pool of readers and writers
+// joined by a bounded queue. The first error stops the copy and is returned.
+func CopyChangedAreas(ctx context.Context, dst io.WriterAt, src io.ReaderAt, dc *DiskChangeInfo, opts CopyOptions) error {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := &copier{
+		opts:   opts,
+		src:    src,
+		dst:    dst,
+		free:   make(chan []byte, opts.Readers+opts.QueueDepth+opts.Writers),
+		jobs:   make(chan copyBlock),
+		filled: make(chan copyBlock, opts.QueueDepth),
+		cancel: cancel,
+		done:   make(map[int64]CopyPosition),
+	}
+	for i := 0; i < cap(c.free); i++ {
+		c.free <- make([]byte, opts.BlockSize)
+	}
+	c.ready = c.filled
+	if opts.Ordered {
+		c.ready = make(chan copyBlock, opts.QueueDepth)
+	}
+
+	go c.split(ctx, dc)
+
+	var readers, writers, reorder sync.WaitGroup
+	for i := 0; i < opts.Readers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			c.read(ctx)
+		}()
+	}
+	if opts.Ordered {
+		reorder.Add(1)
+		go func() {
+			defer reorder.Done()
+			c.reorder(ctx)
+		}()
+	}
+	for i := 0; i < opts.Writers; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			c.write(ctx)
+		}()
+	}
+
+	readers.Wait()
+	close(c.filled)
+	reorder.Wait()
+	writers.Wait()
+
+	if c.err != nil {
+		return c.err
+	}
+	return ctx.Err()
+}
+
+// readerAtContext is a source whose reads give up once ctx is done, such as
+// virtual_disks.DiskConnectHandle.
+type readerAtContext interface {
+	ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+}
+
+// writerAtContext is a destination whose writes give up once ctx is done.
+type writerAtContext interface {
+	WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+}
+
+func readAt(ctx context.Context, src io.ReaderAt, p []byte, off int64) (int, error) {
+	if r, ok := src.(readerAtContext); ok {
+		// NOTE: 取消后不再等待 VDDK 的重试
+		return r.ReadAtContext(ctx, p, off)
+	}
+	return src.ReadAt(p, off)
+}
+
+func writeAt(ctx context.Context, dst io.WriterAt, p []byte, off int64) (int, error) {
+	if w, ok := dst.(writerAtContext); ok {
+		return w.WriteAtContext(ctx, p, off)
+	}
+	return dst.WriteAt(p, off)
+}
+
+func (c *copier) fail(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+		c.cancel()
+	})
+}
+
+// split cuts the changed areas into blocks of at most BlockSize bytes.
+func (c *copier) split(ctx context.Context, dc *DiskChangeInfo) {
+	defer close(c.jobs)
+	seq := int64(0)
+	for i, area := range dc.ChangedArea {
+		if i < c.opts.Start.Area {
+			continue
+		}
+		log.Infof("CURRENT AREA: %+v", area)
+		offset := dc.StartOffset + area.Start
+		end := offset + area.Length
+		if i == c.opts.Start.Area && c.opts.Start.Offset > offset {
+			offset = c.opts.Start.Offset
+		}
+		for offset < end {
+			length := end - offset
+			if length > c.opts.BlockSize {
+				length = c.opts.BlockSize
+			}
+			select {
+			case c.jobs <- copyBlock{seq: seq, area: i, offset: offset, length: length}:
+			case <-ctx.Done():
+				return
+			}
+			seq++
+			offset += length
+		}
+	}
+}
+
+func (c *copier) read(ctx context.Context) {
+	for {
+		// NOTE: 先拿到缓冲区再取任务, 保证有序模式下正在等待的块一定能读完, 不会死锁
+		var buf []byte
+		select {
+		case buf = <-c.free:
+		case <-ctx.Done():
+			return
+		}
+		var job copyBlock
+		var ok bool
+		select {
+		case job, ok = <-c.jobs:
+		case <-ctx.Done():
+		}
+		if !ok {
+			c.free <- buf
+			return
+		}
+
+		job.buf = buf[:job.length]
+		if err := c.opts.Limiter.Wait(ctx, len(job.buf)); err != nil {
+			c.free <- buf
+			return
+		}
+		n, err := readAt(ctx, c.src, job.buf, job.offset)
+		if n == len(job.buf) && err == io.EOF {
+			err = nil
+		} else if n != len(job.buf) && (err == nil || err == io.EOF) {
+			// NOTE: 短读时缓冲区尾部是上一个块的旧数据, 不能当成完整的块写出去
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				c.free <- buf
+				return
+			}
+			c.fail(fmt.Errorf("ReadAt(%d): %v", job.offset, err))
+			return
+		}
+		select {
+		case c.filled <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reorder passes the blocks on to the writer in sequence.
+func (c *copier) reorder(ctx context.Context) {
+	defer close(c.ready)
+	pending := make(map[int64]copyBlock)
+	next := int64(0)
+	for block := range c.filled {
+		pending[block.seq] = block
+		for {
+			block, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			select {
+			case c.ready <- block:
+			case <-ctx.Done():
+				return
+			}
+			next++
+		}
+	}
+}
+
+func (c *copier) write(ctx context.Context) {
+	for {
+		var block copyBlock
+		var ok bool
+		select {
+		case block, ok = <-c.ready:
+		case <-ctx.Done():
+		}
+		if !ok {
+			return
+		}
+		zero := (c.opts.Zeroes != nil || c.opts.SkipZeroes) && virtual_disks.IsZero(block.buf)
+		if zero && c.opts.Zeroes != nil {
+			c.opts.Zeroes.add(block.offset, block.length)
+		}
+		if !zero || !c.opts.SkipZeroes {
+			writeLen, err := writeAt(ctx, c.dst, block.buf, block.offset)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				c.fail(fmt.Errorf("WriteAt(%d): %v", block.offset, err))
+				return
+			}
+			if writeLen != len(block.buf) {
+				c.fail(fmt.Errorf("WriteAt(%d): wrote %d of %d bytes", block.offset, writeLen, len(block.buf)))
+				return
+			}
+		}
+		if c.opts.Checksums != nil {
+			c.opts.Checksums.add(block.offset, block.buf)
+		}
+		if c.opts.Progress != nil {
+			c.progress(block)
+		}
+		c.free <- block.buf[:cap(block.buf)]
+	}
+}
+
+// progress reports the end of the longest run of written blocks from the
+// start of the copy.
+func (c *copier) progress(block copyBlock) {
+	c.progressMutex.Lock()
+	defer c.progressMutex.Unlock()
+	c.done[block.seq] = CopyPosition{Area: block.area, Offset: block.offset + block.length}
+	var last CopyPosition
+	advanced := false
+	for {
+		pos, ok := c.done[c.nextDone]
+		if !ok {
+			break
+		}
+		delete(c.done, c.nextDone)
+		c.nextDone++
+		last = pos
+		advanced = true
+	}
+	if advanced {
+		c.opts.Progress(last)
+	}
+}
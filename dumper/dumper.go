@@ -2,15 +2,22 @@ package dumper
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cloudsbit/virtual-disks/v2/pkg/compress"
 	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/qcow2"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vhd"
 	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -45,9 +52,13 @@ type VadpDumper struct {
 	DumpMode         DumpMode
 	RemoteConnParams *disklib.ConnectParams
 
-	remoteConnect  *disklib.VixDiskLibConnection
-	remoteHandle   *disklib.VixDiskLibHandle
-	remoteDiskInfo *disklib.VixDiskLibInfo
+	// Connections, if set, shares the remote connection with the other dumpers of the same VM snapshot
+	Connections *virtual_disks.ConnectionManager
+
+	remoteConnect    *disklib.VixDiskLibConnection
+	remoteConnection *virtual_disks.Connection
+	remoteHandle     *disklib.VixDiskLibHandle
+	remoteDiskInfo   *disklib.VixDiskLibInfo
 
 	readHandle  *virtual_disks.DiskConnectHandle
 	writeHandle *virtual_disks.DiskConnectHandle
@@ -55,8 +66,26 @@ type VadpDumper struct {
 	LocalConnParams *disklib.ConnectParams
 	localConnect    *disklib.VixDiskLibConnection
 	localHandle     *disklib.VixDiskLibHandle
+	// nativeHandles are the local VMDKs and raw images opened without VDDK
+	nativeHandles []*virtual_disks.DiskConnectHandle
 
 	ChangeInfo *DiskChangeInfo
+	// SnapshotChangeId is the changeId of the disk in the snapshot, set by QueryChangedDiskAreas
+	SnapshotChangeId string
+	// CopyOptions configures the readers and writers of DumpCloneDisk and DumpRestoreDisk
+	CopyOptions CopyOptions
+	// Checksums holds the hash of every block written by the last DumpCloneDisk or DumpRestoreDisk
+	Checksums *ChecksumManifest
+	// CheckpointPath, if set, is where DumpCloneDisk saves its progress for ResumeCloneDisk
+	CheckpointPath string
+	// CheckpointInterval is how often the checkpoint is saved, DefaultCheckpointInterval if zero
+	CheckpointInterval time.Duration
+	// ZeroExtents holds the all-zero blocks found by the last DumpCloneDisk or DumpRestoreDisk
+	ZeroExtents *ZeroExtents
+	// targetPath identifies the disk behind writeHandle in checkpoints
+	targetPath string
+	// targetCreated is set while writeHandle is a disk created empty and not yet copied to, where zeros need not be written
+	targetCreated bool
 }
 
 func GetThumbPrintForServer(host string, port int) (string, error) {
@@ -201,7 +230,7 @@ func (d *VadpDumper) SetLocalConnParams(diskName string, readOnly bool) {
 // https://code.vmware.com/docs/4076/virtual-disk-development-kit-programming-guide/doc/vddkFunctions.6.13.html
 func VddkLibInit(ver VddkVersion) error {
 	//FIXME: Init函数里面的参数待增加优化...
-	return disklib.Init(ver.Major, ver.Minor, ver.LibPath)
+	return disklib.Init(ver.Major, ver.Minor, ver.LibPath, log.StandardLogger())
 }
 
 // NOTE: 去初始化，也只调用一次
@@ -217,19 +246,11 @@ func (d *VadpDumper) PrepareForAccess() error {
 	}
 	params := *d.RemoteConnParams
 
-	var errVix disklib.VddkError
-	for i := 0; i < 10; i++ {
-		errVix = disklib.PrepareForAccess(params)
-		if errVix == nil {
-			return nil
-		}
-		log.Warnf("PrepareForAccess: %v", errVix)
-
-		disklib.EndAccess(params)
-		time.Sleep(time.Duration(2) * time.Second)
+	errVix := retryPolicy().PrepareForAccess(context.Background(), params)
+	if errVix != nil {
+		return fmt.Errorf("PrepareForAccess error: %w\n", errVix)
 	}
-
-	return fmt.Errorf("PrepareForAccess error: %v\n", errVix)
+	return nil
 }
 
 // NOTE:
@@ -240,17 +261,21 @@ func (d *VadpDumper) EndAccess() error {
 	}
 	params := *d.RemoteConnParams
 
-	var errVix disklib.VddkError
-	for i := 0; i < 30; i++ {
-		errVix = disklib.EndAccess(params)
-		if errVix == nil {
-			d.libCleanup(params)
-			return nil
-		}
-		log.Warnf("EndAccess: %v", errVix)
-		time.Sleep(time.Duration(2) * time.Second)
+	errVix := retryPolicy().EndAccess(context.Background(), params)
+	if errVix != nil {
+		return fmt.Errorf("EndAccess error: %w\n", errVix)
 	}
-	return fmt.Errorf("EndAccess error: %v\n", errVix)
+	d.libCleanup(params)
+	return nil
+}
+
+// NOTE: 重试策略使用disklib.DefaultRetryPolicy, 未设置日志时记录到标准日志
+func retryPolicy() disklib.RetryPolicy {
+	policy := disklib.DefaultRetryPolicy
+	if policy.Logger == nil {
+		policy.Logger = log.StandardLogger()
+	}
+	return policy
 }
 
 func (d *VadpDumper) libCleanup(params disklib.ConnectParams) {
@@ -261,33 +286,52 @@ func (d *VadpDumper) libCleanup(params disklib.ConnectParams) {
 	}
 }
 
+// NOTE: 关闭后清空句柄, Cleanup可以重复调用; 共享的连接只释放引用, 不能Disconnect
 func (d *VadpDumper) Cleanup() error {
 	if d.remoteHandle != nil {
 		vErr := disklib.Close(*d.remoteHandle)
 		if vErr != nil {
 			log.Warnf(vErr.Error()+" with error code: %d", vErr.VixErrorCode())
 		}
+		d.remoteHandle = nil
 	}
-	if d.remoteConnect != nil {
+	if d.remoteConnection != nil {
+		vErr := d.remoteConnection.Release()
+		if vErr != nil {
+			log.Warnf(vErr.Error()+" with error code: %d", vErr.VixErrorCode())
+		}
+		d.remoteConnection = nil
+	} else if d.remoteConnect != nil {
 		vErr := disklib.Disconnect(*d.remoteConnect)
 		if vErr != nil {
 			log.Warnf(vErr.Error()+" with error code: %d", vErr.VixErrorCode())
 		}
 	}
+	d.remoteConnect = nil
 
 	if d.localHandle != nil {
 		vErr := disklib.Close(*d.localHandle)
 		if vErr != nil {
 			log.Warnf(vErr.Error()+" with error code: %d", vErr.VixErrorCode())
 		}
+		d.localHandle = nil
 	}
 	if d.localConnect != nil {
 		vErr := disklib.Disconnect(*d.localConnect)
 		if vErr != nil {
 			log.Warnf(vErr.Error()+" with error code: %d", vErr.VixErrorCode())
 		}
+		d.localConnect = nil
 	}
 
+	for _, handle := range d.nativeHandles {
+		err := handle.Close()
+		if err != nil {
+			log.Warnf("Close native disk: %v", err)
+		}
+	}
+	d.nativeHandles = nil
+
 	return nil
 }
 
@@ -303,23 +347,42 @@ func (d *VadpDumper) OpenRemoteDisk() (err error) {
 	}
 	params := *d.RemoteConnParams
 
-	conn, errVix := disklib.ConnectEx(params)
-	if errVix != nil {
-		return fmt.Errorf("disklib.ConnectEx: %v", errVix)
+	var conn disklib.VixDiskLibConnection
+	if d.Connections != nil {
+		// NOTE: 共享连接时, PrepareForAccess和EndAccess由ConnectionManager负责
+		connection, errVix := d.Connections.Acquire(params)
+		if errVix != nil {
+			return fmt.Errorf("ConnectionManager.Acquire: %w", errVix)
+		}
+		conn = connection.Conn()
+		d.remoteConnection = connection
+		defer func() {
+			if err != nil {
+				connection.Release()
+				d.remoteConnection = nil
+				d.remoteConnect = nil
+			}
+		}()
+	} else {
+		var errVix disklib.VddkError
+		conn, errVix = retryPolicy().ConnectEx(context.Background(), params)
+		if errVix != nil {
+			return fmt.Errorf("disklib.ConnectEx: %w", errVix)
+		}
+		defer func() {
+			if err != nil {
+				disklib.Disconnect(conn)
+				d.remoteConnect = nil
+			}
+		}()
 	}
 
 	d.remoteConnect = &conn
 	log.Infof("Connect to remote disk success\n")
 
-	defer func() {
-		if err != nil {
-			disklib.Disconnect(conn)
-		}
-	}()
-
-	dli, errVix := disklib.Open(conn, params)
+	dli, errVix := retryPolicy().Open(context.Background(), conn, params)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Open: %v\n", errVix)
+		return fmt.Errorf("disklib.Open: %w\n", errVix)
 	}
 
 	d.remoteHandle = &dli
@@ -328,12 +391,13 @@ func (d *VadpDumper) OpenRemoteDisk() (err error) {
 	defer func() {
 		if err != nil {
 			disklib.Close(dli)
+			d.remoteHandle = nil
 		}
 	}()
 
 	diskInfo, errVix := disklib.GetInfo(dli)
 	if errVix != nil {
-		return fmt.Errorf("disklib.GetInfo: %v", errVix)
+		return fmt.Errorf("disklib.GetInfo: %w", errVix)
 	}
 
 	d.remoteDiskInfo = &diskInfo
@@ -342,6 +406,8 @@ func (d *VadpDumper) OpenRemoteDisk() (err error) {
 	diskHandle := virtual_disks.NewDiskHandle(dli, conn, params, diskInfo)
 	if d.DumpMode == DumpResotre {
 		d.writeHandle = &diskHandle
+		d.targetPath = fmt.Sprintf("%s/%s/%s", d.VsphereHostName, d.VmMoRef, d.DiskPath)
+		d.targetCreated = false
 	} else {
 		d.readHandle = &diskHandle
 	}
@@ -374,7 +440,7 @@ func (d *VadpDumper) QueryAllocatedBlocks() (err error) {
 
 		blockList, errVix := d.readHandle.QueryAllocatedBlocks(startSector, numSectors, chunkSize)
 		if errVix != nil {
-			return fmt.Errorf("QueryAllocatedBlocks: %v", errVix)
+			return fmt.Errorf("QueryAllocatedBlocks: %w", errVix)
 		}
 
 		for _, block := range blockList {
@@ -412,12 +478,21 @@ func (d *VadpDumper) SaveMetaData() (err error) {
 		return ErrDiskHandle
 	}
 
+	metadata, err := d.readMetaData()
+	if err != nil {
+		return err
+	}
+	return d.writeMetaData(metadata)
+}
+
+// NOTE: 读取readHandle上所有的metadata, value不包含结尾的'\x00'
+func (d *VadpDumper) readMetaData() (metadata map[string]string, err error) {
 	var requireLen uint
 
 	// 获取需要的长度
 	errVix := d.readHandle.GetMetadataKeys(nil, 0, &requireLen)
 	if errVix != nil && errVix.VixErrorCode() != disklib.VIX_E_BUFFER_TOOSMALL {
-		return fmt.Errorf("GetMetadataKeys: %v", errVix.Error())
+		return nil, fmt.Errorf("GetMetadataKeys: %v", errVix.Error())
 	}
 	log.Infof("SaveMetaData: %v\n", requireLen)
 
@@ -427,12 +502,13 @@ func (d *VadpDumper) SaveMetaData() (err error) {
 
 	errVix = d.readHandle.GetMetadataKeys(buf, bufLen, nil)
 	if errVix != nil {
-		return fmt.Errorf("GetMetadataKeys: %v", errVix.Error())
+		return nil, fmt.Errorf("GetMetadataKeys: %v", errVix.Error())
 	}
 
 	keys := NullTermToStrings(buf)
 	log.Infof("MetadataKeysXXX: [%s]\n", keys)
 
+	metadata = make(map[string]string)
 	for _, key := range keys {
 		if len(strings.TrimSpace(key)) == 0 {
 			continue
@@ -440,7 +516,7 @@ func (d *VadpDumper) SaveMetaData() (err error) {
 
 		errVix := d.readHandle.ReadMetadata(key, nil, 0, &requireLen)
 		if errVix != nil && errVix.VixErrorCode() != disklib.VIX_E_BUFFER_TOOSMALL {
-			return fmt.Errorf("ReadMetadata: %v", errVix.Error())
+			return nil, fmt.Errorf("ReadMetadata: %v", errVix.Error())
 		}
 		log.Infof("Key: %v, RequireLen: %v", key, requireLen)
 
@@ -449,16 +525,23 @@ func (d *VadpDumper) SaveMetaData() (err error) {
 
 		errVix = d.readHandle.ReadMetadata(key, buf, bufLen, nil)
 		if errVix != nil {
-			return fmt.Errorf("ReadMetadata: %v", errVix.Error())
+			return nil, fmt.Errorf("ReadMetadata: %v", errVix.Error())
 		}
 		log.Infof("Key: %v, Buf: %v", key, string(buf[:]))
 
-		errVix = d.writeHandle.WriteMetadata(key, buf)
+		metadata[key] = string(bytes.TrimRight(buf, "\x00"))
+	}
+
+	return metadata, nil
+}
+
+func (d *VadpDumper) writeMetaData(metadata map[string]string) (err error) {
+	for key, value := range metadata {
+		errVix := d.writeHandle.WriteMetadata(key, append([]byte(value), 0))
 		if errVix != nil {
 			return fmt.Errorf("WriteMetadata: %v", errVix.Error())
 		}
 	}
-
 	return nil
 }
 
@@ -470,7 +553,7 @@ func (d *VadpDumper) ReadLocalDisk() (err error) {
 
 	conn, errVix := disklib.Connect(params)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Connect: %v\n", errVix)
+		return fmt.Errorf("disklib.Connect: %w\n", errVix)
 	}
 
 	d.localConnect = &conn
@@ -479,7 +562,7 @@ func (d *VadpDumper) ReadLocalDisk() (err error) {
 	// Open local disk
 	dli, errVix := disklib.Open(conn, params)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Open: %v\n", errVix)
+		return fmt.Errorf("disklib.Open: %w\n", errVix)
 	}
 
 	d.localHandle = &dli
@@ -487,7 +570,7 @@ func (d *VadpDumper) ReadLocalDisk() (err error) {
 
 	info, errVix := disklib.GetInfo(dli)
 	if errVix != nil {
-		return fmt.Errorf("disklib.GetInfo: %v", errVix)
+		return fmt.Errorf("disklib.GetInfo: %w", errVix)
 	}
 	log.Infof("Get local disk GetInfo: %+v\n", info)
 
@@ -504,7 +587,7 @@ func (d *VadpDumper) CreateLocalDisk(diskName string, diskLen uint64) (err error
 
 	conn, errVix := disklib.Connect(params)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Connect: %v\n", errVix)
+		return fmt.Errorf("disklib.Connect: %w\n", errVix)
 	}
 
 	d.localConnect = &conn
@@ -523,16 +606,16 @@ func (d *VadpDumper) CreateLocalDisk(diskName string, diskLen uint64) (err error
 	)
 
 	// create local disk
-	errVix = disklib.Create(conn, diskName, createParams, "")
+	errVix = disklib.Create(context.Background(), conn, diskName, createParams, nil)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Create: %v\n", errVix)
+		return fmt.Errorf("disklib.Create: %w\n", errVix)
 	}
 	log.Infof("Create local disk success\n")
 
 	// Open local disk
 	dli, errVix := disklib.Open(conn, params)
 	if errVix != nil {
-		return fmt.Errorf("disklib.Open: %v", errVix)
+		return fmt.Errorf("disklib.Open: %w", errVix)
 	}
 
 	d.localHandle = &dli
@@ -540,12 +623,126 @@ func (d *VadpDumper) CreateLocalDisk(diskName string, diskLen uint64) (err error
 
 	info, errVix := disklib.GetInfo(dli)
 	if errVix != nil {
-		return fmt.Errorf("disklib.GetInfo: %v", errVix)
+		return fmt.Errorf("disklib.GetInfo: %w", errVix)
 	}
 	log.Infof("Get local disk GetInfo: %+v\n", info)
 
 	diskHandle := virtual_disks.NewDiskHandle(dli, conn, params, info)
 	d.writeHandle = &diskHandle
+	d.targetPath = diskName
+	d.targetCreated = true
+	return nil
+}
+
+// NOTE: 以写方式打开已经存在的本地盘, 用于ResumeCloneDisk继续写入上次中断的目标盘
+func (d *VadpDumper) OpenLocalDisk(diskName string) (err error) {
+	if d.LocalConnParams == nil {
+		return ErrConnParam
+	}
+	params := *d.LocalConnParams
+
+	conn, errVix := disklib.Connect(params)
+	if errVix != nil {
+		return fmt.Errorf("disklib.Connect: %w\n", errVix)
+	}
+	d.localConnect = &conn
+
+	dli, errVix := disklib.Open(conn, params)
+	if errVix != nil {
+		return fmt.Errorf("disklib.Open: %w", errVix)
+	}
+	d.localHandle = &dli
+	log.Infof("Open local disk success\n")
+
+	info, errVix := disklib.GetInfo(dli)
+	if errVix != nil {
+		return fmt.Errorf("disklib.GetInfo: %w", errVix)
+	}
+
+	diskHandle := virtual_disks.NewDiskHandle(dli, conn, params, info)
+	d.writeHandle = &diskHandle
+	d.targetPath = diskName
+	d.targetCreated = false
+	return nil
+}
+
+// NOTE: 以下两个函数不依赖VDDK, 直接读写本地monolithicSparse格式的vmdk文件
+func (d *VadpDumper) ReadNativeLocalDisk(diskName string) (err error) {
+	diskHandle, errVix := vmdk.Open(diskName, true)
+	if errVix != nil {
+		return fmt.Errorf("vmdk.Open: %w", errVix)
+	}
+	log.Infof("Open native local disk success\n")
+
+	d.nativeHandles = append(d.nativeHandles, &diskHandle)
+	d.readHandle = &diskHandle
+	return nil
+}
+
+func (d *VadpDumper) CreateNativeLocalDisk(diskName string, diskLen uint64) (err error) {
+	adapterType := disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC
+	hwVersion := uint16(7)
+	capacity := disklib.VixDiskLibSectorType(diskLen / disklib.VIXDISKLIB_SECTOR_SIZE)
+
+	diskHandle, errVix := vmdk.Create(diskName, capacity, adapterType, hwVersion)
+	if errVix != nil {
+		return fmt.Errorf("vmdk.Create: %w", errVix)
+	}
+	log.Infof("Create native local disk success\n")
+
+	d.nativeHandles = append(d.nativeHandles, &diskHandle)
+	d.writeHandle = &diskHandle
+	d.targetPath = diskName
+	d.targetCreated = true
+	return nil
+}
+
+func (d *VadpDumper) OpenNativeLocalDisk(diskName string) (err error) {
+	diskHandle, errVix := vmdk.Open(diskName, false)
+	if errVix != nil {
+		return fmt.Errorf("vmdk.Open: %w", errVix)
+	}
+	log.Infof("Open native local disk for writing success\n")
+
+	d.nativeHandles = append(d.nativeHandles, &diskHandle)
+	d.writeHandle = &diskHandle
+	d.targetPath = diskName
+	d.targetCreated = false
+	return nil
+}
+
+// NOTE: 以下两个函数读写本地raw镜像. 创建的镜像是稀疏的, 全零的块会被打洞;
+// 读取时通过SEEK_DATA/SEEK_HOLE得到已分配的区域
+func (d *VadpDumper) ReadRawLocalDisk(diskName string) (err error) {
+	backend, errVix := virtual_disks.OpenFileBackend(diskName, true)
+	if errVix != nil {
+		return fmt.Errorf("virtual_disks.OpenFileBackend: %w", errVix)
+	}
+	diskHandle, errVix := virtual_disks.NewBackendDiskHandle(backend)
+	if errVix != nil {
+		backend.Close()
+		return fmt.Errorf("virtual_disks.NewBackendDiskHandle: %w", errVix)
+	}
+	log.Infof("Open raw local disk success\n")
+
+	d.nativeHandles = append(d.nativeHandles, &diskHandle)
+	d.readHandle = &diskHandle
+	return nil
+}
+
+func (d *VadpDumper) CreateRawLocalDisk(diskName string, diskLen uint64) (err error) {
+	capacity := disklib.VixDiskLibSectorType(diskLen / disklib.VIXDISKLIB_SECTOR_SIZE)
+	backend, errVix := virtual_disks.CreateSparseFileBackend(diskName, capacity)
+	if errVix != nil {
+		return fmt.Errorf("virtual_disks.CreateSparseFileBackend: %w", errVix)
+	}
+	diskHandle := virtual_disks.NewDiskHandleWithInfo(backend, virtual_disks.DefaultInfo(capacity))
+	log.Infof("Create raw local disk success\n")
+
+	d.nativeHandles = append(d.nativeHandles, &diskHandle)
+	d.writeHandle = &diskHandle
+	d.targetPath = diskName
+	d.targetCreated = true
 	return nil
 }
 
@@ -564,54 +761,322 @@ func (d *VadpDumper) WriteToVmdk(buf []byte, offset int64) (n int, err error) {
 }
 
 func (d *VadpDumper) DumpCloneDisk(dc *DiskChangeInfo) (err error) {
-	//sectorPer   := 1024
-	//sectorSize  := disklib.VIXDISKLIB_SECTOR_SIZE
+	if d.readHandle == nil || d.writeHandle == nil {
+		return ErrDiskHandle
+	}
+	return d.cloneDisk(dc, CopyPosition{})
+}
 
-	// NOTE:
-	// 每次读的大小为1MB, 也就是(2048个扇区, 每个扇区512Byte)
-	sectorSize := int64(disklib.VIXDISKLIB_SECTOR_SIZE * 1024 * 2)
-	startOffset := dc.StartOffset
-
-	//FIXME:
-	// 待明确的地方， ReadAt的用法，没有限制长度的参数，读写数据是否有保证?
-	block := make([]byte, sectorSize)
-	buffer := block
-	for _, area := range dc.ChangedArea {
-		log.Infof("CURRENT AREA: %+v", area)
-
-		currOffset := startOffset + area.Start
-		offsetLen := area.Length
-
-		maxOffset := currOffset + offsetLen
-		for currOffset < maxOffset {
-			if maxOffset-currOffset < sectorSize {
-				buffer = make([]byte, maxOffset-currOffset)
-			} else {
-				buffer = block
-			}
+// NOTE: 从CheckpointPath中的checkpoint继续上次中断的DumpCloneDisk, 已经写入的部分不再拷贝.
+// 目标盘需要先用OpenLocalDisk/OpenNativeLocalDisk重新打开, dc和源盘的changeId必须与中断前相同.
+// 恢复后Checksums只包含本次写入的块
+func (d *VadpDumper) ResumeCloneDisk(dc *DiskChangeInfo) (err error) {
+	if d.readHandle == nil || d.writeHandle == nil {
+		return ErrDiskHandle
+	}
+	if d.CheckpointPath == "" {
+		return fmt.Errorf("ResumeCloneDisk: no CheckpointPath")
+	}
+	cp, err := LoadCheckpoint(d.CheckpointPath)
+	if err != nil {
+		return err
+	}
+	if cp.Target != d.targetPath {
+		return fmt.Errorf("ResumeCloneDisk: checkpoint is for target %q, not %q", cp.Target, d.targetPath)
+	}
+	if cp.ChangeId != d.SnapshotChangeId {
+		return fmt.Errorf("ResumeCloneDisk: checkpoint is for changeId %q, not %q", cp.ChangeId, d.SnapshotChangeId)
+	}
+	if cp.ChangeInfoDigest != changeInfoDigest(dc) {
+		return fmt.Errorf("ResumeCloneDisk: checkpoint is for other changed areas")
+	}
+	if cp.Done {
+		log.Infof("ResumeCloneDisk: %s is already done", d.targetPath)
+		return nil
+	}
+	log.Infof("ResumeCloneDisk: resume %s at area %d, offset %d", d.targetPath, cp.Position.Area, cp.Position.Offset)
+	return d.cloneDisk(dc, cp.Position)
+}
 
-			readLen, err := d.ReadFromVmdk(buffer, currOffset)
-			if err != nil {
-				return fmt.Errorf("ReadFromVmdk: %v", err)
-			}
-			writeLen, err := d.WriteToVmdk(buffer, currOffset)
-			if err != nil {
-				return fmt.Errorf("WriteToVmdk: %v", err)
-			}
+func (d *VadpDumper) cloneDisk(dc *DiskChangeInfo, start CopyPosition) (err error) {
+	// NOTE: 读写由CopyOptions配置的多个worker并行完成, 默认每次读写1MB,
+	// 每个写入的块的hash记录在Checksums中, 供DumpVerifyDisk校验
+	// 全零的块记录在ZeroExtents中, 新建的目标盘不需要写入这些块
+	d.Checksums = NewChecksumManifest()
+	d.ZeroExtents = NewZeroExtents()
+	opts := d.CopyOptions
+	opts.Checksums = d.Checksums
+	opts.Zeroes = d.ZeroExtents
+	opts.SkipZeroes = opts.SkipZeroes || d.targetCreated
+	// NOTE: 开始写入后目标盘不再是空盘, 之后的拷贝(如增量)必须写入全零的块
+	d.targetCreated = false
+	opts.Start = start
+	defer func() {
+		log.Infof("Found %d bytes of zero blocks, skipped: %v", d.ZeroExtents.Bytes(), opts.SkipZeroes)
+	}()
+	if d.CheckpointPath == "" {
+		return CopyChangedAreas(context.Background(), d.writeHandle, d.readHandle, dc, opts)
+	}
 
-			currOffset += int64(readLen)
-			if readLen != writeLen || int64(readLen) != sectorSize {
-				log.Warnf("readLen: %v, writeLen: %v, sectorSize: %v", readLen, writeLen, sectorSize)
-			}
-		}
+	interval := d.CheckpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	cp := &checkpointer{
+		path:     d.CheckpointPath,
+		interval: interval,
+		cp: Checkpoint{
+			Version:          CheckpointVersion,
+			Target:           d.targetPath,
+			ChangeId:         d.SnapshotChangeId,
+			ChangeInfoDigest: changeInfoDigest(dc),
+			Position:         start,
+		},
+	}
+	cp.finish(false)
+	opts.Progress = cp.progress
+	err = CopyChangedAreas(context.Background(), d.writeHandle, d.readHandle, dc, opts)
+	cp.finish(err == nil)
+	return err
+}
+
+// NOTE: 通过writeHandle读回目标盘, 与上一次DumpCloneDisk/DumpRestoreDisk记录的Checksums比较,
+// 返回不一致的区域. 需要用重新打开的盘校验时使用VerifyChecksums
+func (d *VadpDumper) DumpVerifyDisk() (mismatched []ChangedArea, err error) {
+	if d.writeHandle == nil {
+		return nil, ErrDiskHandle
+	}
+	if d.Checksums == nil {
+		return nil, fmt.Errorf("DumpVerifyDisk: no checksums, nothing was copied")
+	}
+	return VerifyChecksums(context.Background(), d.writeHandle, d.Checksums)
+}
+
+// NOTE: 将远端磁盘以streamOptimized格式的vmdk顺序写入w, 不需要本地可seek的文件
+func (d *VadpDumper) DumpStreamOptimized(w io.Writer) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+
+	adapterType := disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC
+	if d.remoteDiskInfo != nil {
+		adapterType = d.remoteDiskInfo.AdapterType
+	}
+	hwVersion := uint16(7)
+
+	err = vmdk.ExportStreamOptimized(w, d.readHandle, adapterType, hwVersion)
+	if err != nil {
+		return fmt.Errorf("ExportStreamOptimized: %v", err)
 	}
 	return nil
 }
 
-func (d *VadpDumper) DumpBackupDisk() (err error) {
+// NOTE: 将磁盘已分配的cluster写成qcow2 v3镜像, 可以直接交给KVM使用, 不需要再用qemu-img转换
+func (d *VadpDumper) DumpQcow2(w io.WriterAt) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	err = qcow2.Export(w, d.readHandle)
+	if err != nil {
+		return fmt.Errorf("qcow2.Export: %v", err)
+	}
+	return nil
+}
+
+// NOTE: 将磁盘写成动态VHDX, 只保存包含已分配区域的payload block, 供Hyper-V使用
+func (d *VadpDumper) DumpVHDX(w io.WriterAt) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	err = vhd.ExportVHDX(w, d.readHandle, vhd.DefaultBlockSize)
+	if err != nil {
+		return fmt.Errorf("vhd.ExportVHDX: %v", err)
+	}
+	return nil
+}
+
+// NOTE: 将磁盘写成固定大小的VHD, 大小按MB向上取整以满足Azure的要求
+func (d *VadpDumper) DumpFixedVHD(w io.WriterAt) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	err = vhd.ExportFixed(w, d.readHandle)
+	if err != nil {
+		return fmt.Errorf("vhd.ExportFixed: %v", err)
+	}
+	return nil
+}
+
+// NOTE: 将磁盘已分配的区域写入path处新建的稀疏raw镜像, 未分配和全零的区域都是空洞
+func (d *VadpDumper) DumpSparseRaw(path string) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	err = virtual_disks.ExportSparseRaw(path, d.readHandle)
+	if err != nil {
+		return fmt.Errorf("ExportSparseRaw: %v", err)
+	}
+	return nil
+}
+
+// NOTE: 将磁盘的全部内容按原始格式顺序读出, 用compression指定的算法(compress.Zstd等)压缩后写入w,
+// 与DumpStreamOptimized不同, 得到的是可以直接解压为raw镜像的流
+func (d *VadpDumper) DumpCompressedStream(w io.Writer, compression string) (err error) {
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	zw, err := compress.NewWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	src := io.NewSectionReader(d.readHandle, 0, d.readHandle.Capacity())
+	_, err = io.CopyBuffer(zw, src, make([]byte, DefaultCopyBlockSize))
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("DumpCompressedStream: %v", err)
+	}
+	return nil
+}
+
+// NOTE: 将DumpCompressedStream得到的流解压后写入writeHandle
+func (d *VadpDumper) DumpRestoreCompressedStream(r io.Reader, compression string) (err error) {
+	if d.writeHandle == nil {
+		return ErrDiskHandle
+	}
+	zr, err := compress.NewReader(r, compression)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	dst := io.NewOffsetWriter(d.writeHandle, 0)
+	n, err := io.CopyBuffer(dst, zr, make([]byte, DefaultCopyBlockSize))
+	if err != nil {
+		return fmt.Errorf("DumpRestoreCompressedStream: %v", err)
+	}
+	if n != d.writeHandle.Capacity() {
+		return fmt.Errorf("DumpRestoreCompressedStream: stream holds %d bytes, the disk %d", n, d.writeHandle.Capacity())
+	}
+	return nil
+}
+
+// NOTE: 将readHandle中的数据备份到repo中, ChangeInfo为空时备份所有已分配的块(全量),
+// parent不为空时表示基于parent的增量备份, ChangeInfo应该是相对parent的changeId查询得到的
+func (d *VadpDumper) DumpBackupDisk(repo *repository.Repository, parent string) (manifest *repository.Manifest, err error) {
+	if d.readHandle == nil {
+		return nil, ErrDiskHandle
+	}
+	if d.ChangeInfo == nil {
+		if parent != "" {
+			return nil, fmt.Errorf("DumpBackupDisk: incremental backup of %s needs ChangeInfo", parent)
+		}
+		err = d.queryAllocatedAreas()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := d.readMetaData()
+	if err != nil {
+		return nil, err
+	}
+	m := repository.Manifest{
+		Parent:   parent,
+		Metadata: metadata,
+		ChangeId: d.SnapshotChangeId,
+	}
+	m.SetInfo(d.readHandle.Info())
+	if parent != "" {
+		m.BaseChangeId = d.ChangeId
+	}
+
+	bw, err := repo.NewBackup(m)
+	if err != nil {
+		return nil, fmt.Errorf("NewBackup: %v", err)
+	}
+	opts := d.CopyOptions
+	// NOTE: 增量备份里变成全零的块也要写入, 否则恢复时会读到父备份里的旧数据
+	opts.SkipZeroes = false
+	err = CopyChangedAreas(context.Background(), bw, d.readHandle, d.ChangeInfo, opts)
+	if err != nil {
+		bw.Abort()
+		return nil, err
+	}
+	stats := bw.Stats()
+	manifest, err = bw.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Commit: %v", err)
+	}
+	log.Infof("Backup %s: %d extents, %d bytes, %d new chunks (%d bytes, %d stored), %d reused chunks (%d bytes)",
+		manifest.ID, len(manifest.Extents), manifest.DataSize(),
+		stats.NewChunks, stats.NewBytes, stats.StoredBytes, stats.ReusedChunks, stats.ReusedBytes)
+	return manifest, nil
+}
+
+// NOTE: 与QueryAllocatedBlocks相同, 但不依赖remoteDiskInfo, 本地盘也可以使用, 并且包含末尾不足1MB的部分
+func (d *VadpDumper) queryAllocatedAreas() (err error) {
+	blockSize := disklib.VixDiskLibSectorType(2 * 1024) // 1MB block size
+	blockList, errVix := virtual_disks.QueryAllocatedExtents(d.readHandle, blockSize)
+	if errVix != nil {
+		return fmt.Errorf("QueryAllocatedExtents: %w", errVix)
+	}
+
+	d.ChangeInfo = &DiskChangeInfo{
+		StartOffset: 0,
+		Length:      d.readHandle.Capacity(),
+	}
+	for _, block := range blockList {
+		d.ChangeInfo.ChangedArea = append(d.ChangeInfo.ChangedArea, ChangedArea{
+			Start:  int64(block.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE,
+			Length: int64(block.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE,
+		})
+	}
 	return nil
 }
 
 func (d *VadpDumper) DumpRestoreDisk(dc *DiskChangeInfo) (err error) {
-	return d.DumpCloneDisk(dc)
+	if d.readHandle == nil {
+		return ErrDiskHandle
+	}
+	return d.DumpRestoreChain([]ChainLayer{{ChangeInfo: dc, Data: d.readHandle}})
+}
+
+// NOTE: 从一个全量加N个增量的备份链恢复到writeHandle, chain按从旧到新排列,
+// 每个位置只写入一次最新的数据, 重叠的旧数据不会被读取或写入
+func (d *VadpDumper) DumpRestoreChain(chain []ChainLayer) (err error) {
+	if d.writeHandle == nil {
+		return ErrDiskHandle
+	}
+	for i, layer := range chain {
+		if layer.ChangeInfo != nil && layer.ChangeInfo.Length > d.writeHandle.Capacity() {
+			return fmt.Errorf("DumpRestoreChain: layer %d of %d bytes does not fit the disk of %d bytes", i, layer.ChangeInfo.Length, d.writeHandle.Capacity())
+		}
+	}
+	d.Checksums = NewChecksumManifest()
+	d.ZeroExtents = NewZeroExtents()
+	opts := d.CopyOptions
+	opts.Checksums = d.Checksums
+	opts.Zeroes = d.ZeroExtents
+	opts.SkipZeroes = opts.SkipZeroes || d.targetCreated
+	d.targetCreated = false
+	return CopyChain(context.Background(), d.writeHandle, chain, opts)
+}
+
+// NOTE: 从repo中的备份id恢复到writeHandle, 包括metadata. id是增量时沿Parent找到全量,
+// 整条链一起恢复
+func (d *VadpDumper) DumpRestoreBackup(repo *repository.Repository, id string) (err error) {
+	if d.writeHandle == nil {
+		return ErrDiskHandle
+	}
+	backups, chain, err := openBackupChain(repo, id)
+	if err != nil {
+		return err
+	}
+	defer closeBackups(backups)
+	err = d.DumpRestoreChain(chain)
+	if err != nil {
+		return err
+	}
+	return d.writeMetaData(backups[0].Manifest().Metadata)
 }
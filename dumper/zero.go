@@ -0,0 +1,55 @@
+package dumper
+
+import (
+	"sort"
+	"sync"
+)
+
+// ZeroExtents collects the blocks of a copy that held only zeros. It is safe
+// for concurrent use.
+type ZeroExtents struct {
+	mutex sync.Mutex
+	areas []ChangedArea
+}
+
+// NewZeroExtents returns an empty collection.
+func NewZeroExtents() *ZeroExtents {
+	return &ZeroExtents{}
+}
+
+func (z *ZeroExtents) add(offset int64, length int64) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.areas = append(z.areas, ChangedArea{Start: offset, Length: length})
+}
+
+// Areas returns the zero blocks in offset order, merged where they touch.
+func (z *ZeroExtents) Areas() []ChangedArea {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	sort.Slice(z.areas, func(i, j int) bool {
+		return z.areas[i].Start < z.areas[j].Start
+	})
+	var merged []ChangedArea
+	for _, area := range z.areas {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Start+merged[last].Length == area.Start {
+			merged[last].Length += area.Length
+			continue
+		}
+		merged = append(merged, area)
+	}
+	z.areas = merged
+	return append([]ChangedArea(nil), merged...)
+}
+
+// Bytes is the total length of the zero blocks.
+func (z *ZeroExtents) Bytes() int64 {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	var total int64
+	for _, area := range z.areas {
+		total += area.Length
+	}
+	return total
+}
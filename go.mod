@@ -3,8 +3,14 @@ module github.com/cloudsbit/virtual-disks/v2
 go 1.20
 
 require (
+	github.com/klauspost/compress v1.17.4
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.1
+	github.com/vmware/govmomi v0.37.3
 )
 
-require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+require (
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+)
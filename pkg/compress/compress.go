@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package compress holds the compression algorithms used for data at rest:
+// chunks in a backup repository and disk streams written by the dumper.
+// Algorithms are looked up by name, and more can be added with Register.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Algorithm names
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+	LZ4  = "lz4"
+)
+
+// Codec is a compression algorithm. Encode and Decode work on whole blocks
+// and must be safe for concurrent use; NewWriter and NewReader work on
+// streams.
+type Codec interface {
+	Name() string
+	// Encode appends the compressed src to dst. It may fail with
+	// ErrIncompressible when src does not compress.
+	Encode(dst []byte, src []byte) ([]byte, error)
+	// Decode returns the decompressed src, which must be size bytes long.
+	Decode(src []byte, size int) ([]byte, error)
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// ErrIncompressible is returned by Encode when a block does not compress.
+// Such blocks are best stored with None.
+var ErrIncompressible = errors.New("compress: block does not compress")
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = make(map[string]Codec)
+)
+
+func init() {
+	Register(noneCodec{})
+	Register(gzipCodec{})
+	Register(newZstdCodec())
+	Register(lz4Codec{})
+}
+
+// Register makes c available under c.Name(), replacing any codec of that name.
+func Register(c Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[c.Name()] = c
+}
+
+// Lookup returns the codec called name. The empty name is None.
+func Lookup(name string) (Codec, error) {
+	if name == "" {
+		name = None
+	}
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compress: unknown algorithm %q", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of all registered codecs, sorted.
+func Names() []string {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewWriter compresses what is written to it into w with the named algorithm.
+// Close must be called to flush the stream; it does not close w.
+func NewWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	c, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewWriter(w)
+}
+
+// NewReader decompresses r with the named algorithm.
+func NewReader(r io.Reader, name string) (io.ReadCloser, error) {
+	c, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(r)
+}
+
+func checkSize(name string, p []byte, size int) ([]byte, error) {
+	if len(p) != size {
+		return nil, fmt.Errorf("compress: %s block holds %d bytes, expected %d", name, len(p), size)
+	}
+	return p, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return None
+}
+
+func (noneCodec) Encode(dst []byte, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decode(src []byte, size int) ([]byte, error) {
+	return checkSize(None, src, size)
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return Gzip
+}
+
+func (gzipCodec) Encode(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compress: gzip: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(src []byte, size int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("compress: gzip: %v", err)
+	}
+	p := make([]byte, size)
+	_, err = io.ReadFull(zr, p)
+	if err == nil {
+		// The block must end exactly at size
+		var extra [1]byte
+		if n, _ := zr.Read(extra[:]); n != 0 {
+			err = fmt.Errorf("block holds more than %d bytes", size)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compress: gzip: %v", err)
+	}
+	return p, nil
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCodec shares one encoder and decoder for blocks; EncodeAll and
+// DecodeAll may be called concurrently.
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() zstdCodec {
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+	return zstdCodec{encoder: encoder, decoder: decoder}
+}
+
+func (zstdCodec) Name() string {
+	return Zstd
+}
+
+func (c zstdCodec) Encode(dst []byte, src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, dst), nil
+}
+
+func (c zstdCodec) Decode(src []byte, size int) ([]byte, error) {
+	p, err := c.decoder.DecodeAll(src, make([]byte, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("compress: zstd: %v", err)
+	}
+	return checkSize(Zstd, p, size)
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string {
+	return LZ4
+}
+
+func (lz4Codec) Encode(dst []byte, src []byte) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, lz4.CompressBlockBound(len(src)))...)
+	n, err := lz4.CompressBlock(src, dst[start:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("compress: lz4: %v", err)
+	}
+	if n == 0 {
+		return nil, ErrIncompressible
+	}
+	return dst[:start+n], nil
+}
+
+func (lz4Codec) Decode(src []byte, size int) ([]byte, error) {
+	p := make([]byte, size)
+	n, err := lz4.UncompressBlock(src, p)
+	if err != nil {
+		return nil, fmt.Errorf("compress: lz4: %v", err)
+	}
+	return checkSize(LZ4, p[:n], size)
+}
+
+func (lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
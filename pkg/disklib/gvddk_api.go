@@ -27,34 +27,47 @@ import "fmt"
 import "C"
 
 import (
+	"context"
+	"runtime/cgo"
 	"unsafe"
+
+	"github.com/sirupsen/logrus"
 )
 
-//export GoLogWarn
-func GoLogWarn(buf *C.char) {
-	fmt.Println(C.GoString(buf))
+//export GoLog
+func GoLog(level C.int, buf *C.char) {
+	logVddkMessage(int(level), C.GoString(buf))
 }
 
-func Init(majorVersion uint32, minorVersion uint32, dir string) VddkError {
-	libDir := C.CString(dir)
-	defer C.free(unsafe.Pointer(libDir))
-	result := C.Init(C.uint32(majorVersion), C.uint32(minorVersion), libDir)
-	if result != 0 {
-		return NewVddkError(uint64(result), fmt.Sprintf("Initialize failed. The error code is %d.", result))
+//export GoProgress
+func GoProgress(handle C.uintptr_t, percentCompleted C.int) C._Bool {
+	state := cgo.Handle(handle).Value().(*progressState)
+	if state.progress != nil {
+		state.progress(int(percentCompleted))
 	}
-	return nil
+	// Returning false asks VDDK to abort the operation
+	return C._Bool(state.ctx.Err() == nil)
+}
+
+// Init initializes VDDK. When logger is not nil, VDDK's info, warning and
+// panic messages are sent to it instead of VDDK's default log.
+func Init(majorVersion uint32, minorVersion uint32, dir string, logger logrus.FieldLogger) VddkError {
+	return InitEx(majorVersion, minorVersion, dir, "", logger)
 }
 
-func InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string) VddkError {
+// InitEx is Init with a VDDK configuration file.
+func InitEx(majorVersion uint32, minorVersion uint32, dir string, configFile string, logger logrus.FieldLogger) VddkError {
 	var result C.VixError
+	setVddkLogger(logger)
 	libDir := C.CString(dir)
 	defer C.free(unsafe.Pointer(libDir))
+	withLogger := C._Bool(logger != nil)
 	if configFile == "" {
-		result = C.Init(C.uint32(majorVersion), C.uint32(minorVersion), libDir)
+		result = C.Init(C.uint32(majorVersion), C.uint32(minorVersion), libDir, withLogger)
 	} else {
 		config := C.CString(configFile)
 		defer C.free(unsafe.Pointer(config))
-		result = C.InitEx(C.uint32(majorVersion), C.uint32(minorVersion), libDir, config)
+		result = C.InitEx(C.uint32(majorVersion), C.uint32(minorVersion), libDir, config, withLogger)
 	}
 
 	if result != 0 {
@@ -221,20 +234,21 @@ func Cleanup(appGlobal ConnectParams, numCleanUp uint32, numRemaining uint32) Vd
 	return nil
 }
 
-func Clone(dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
-	params VixDiskLibCreateParams, progressCallbackData string, overWrite bool) VddkError {
+// Clone reports progress to progress, which may be nil, and is aborted when ctx is done.
+func Clone(ctx context.Context, dstConnection VixDiskLibConnection, dstPath string, srcConnection VixDiskLibConnection, srcPath string,
+	params VixDiskLibCreateParams, progress ProgressFunc, overWrite bool) VddkError {
+	if err := checkCancelled(ctx, "Clone a virtual disk"); err != nil {
+		return err
+	}
 	dst := C.CString(dstPath)
 	defer C.free(unsafe.Pointer(dst))
 	src := C.CString(srcPath)
 	defer C.free(unsafe.Pointer(src))
 	createParams := prepareCreateParams(params)
-	cstr := C.CString(progressCallbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.Clone(dstConnection.conn, dst, srcConnection.conn, src, createParams, unsafe.Pointer(&cstr), C._Bool(overWrite))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Clone a virtual disk failed. The error code is %d.", res))
-	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.Clone(dstConnection.conn, dst, srcConnection.conn, src, createParams, C.uintptr_t(handle), C._Bool(overWrite))
+	return progressResult(ctx, res, "Clone a virtual disk")
 }
 
 func prepareCreateParams(createSpec VixDiskLibCreateParams) *C.VixDiskLibCreateParams {
@@ -250,29 +264,31 @@ func prepareCreateParams(createSpec VixDiskLibCreateParams) *C.VixDiskLibCreateP
 	return &createParams
 }
 
-func Create(connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progressCallbackData string) VddkError {
+// Create reports progress to progress, which may be nil, and is aborted when ctx is done.
+func Create(ctx context.Context, connection VixDiskLibConnection, path string, createParams VixDiskLibCreateParams, progress ProgressFunc) VddkError {
+	if err := checkCancelled(ctx, "Create a virtual disk"); err != nil {
+		return err
+	}
 	pathName := C.CString(path)
 	defer C.free(unsafe.Pointer(pathName))
 	createSpec := prepareCreateParams(createParams)
-	cstr := C.CString(progressCallbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.Create(connection.conn, pathName, createSpec, unsafe.Pointer(&cstr))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Create a virtual disk failed. The error code is %d.", res))
-	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.Create(connection.conn, pathName, createSpec, C.uintptr_t(handle))
+	return progressResult(ctx, res, "Create a virtual disk")
 }
 
-func CreateChild(diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progressCallbackData string) VddkError {
+// CreateChild reports progress to progress, which may be nil, and is aborted when ctx is done.
+func CreateChild(ctx context.Context, diskHandle VixDiskLibHandle, childPath string, diskType VixDiskLibDiskType, progress ProgressFunc) VddkError {
+	if err := checkCancelled(ctx, "Create child virtual disk"); err != nil {
+		return err
+	}
 	child := C.CString(childPath)
 	defer C.free(unsafe.Pointer(child))
-	cstr := C.CString(progressCallbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.CreateChild(diskHandle.dli, child, C.VixDiskLibDiskType(diskType), unsafe.Pointer(&cstr))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Create child virtual disk failed. The error code is %d.", res))
-	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.CreateChild(diskHandle.dli, child, C.VixDiskLibDiskType(diskType), C.uintptr_t(handle))
+	return progressResult(ctx, res, "Create child virtual disk")
 }
 
 func createDiskInfo(diskInfo *VixDiskLibInfo) (*C.VixDiskLibInfo, []*C.char) {
@@ -296,16 +312,17 @@ func createDiskInfo(diskInfo *VixDiskLibInfo) (*C.VixDiskLibInfo, []*C.char) {
 	return dliInfo, cParams
 }
 
-func Grow(connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, callbackData string) VddkError {
+// Grow reports progress to progress, which may be nil, and is aborted when ctx is done.
+func Grow(ctx context.Context, connection VixDiskLibConnection, path string, capacity VixDiskLibSectorType, updateGeometry bool, progress ProgressFunc) VddkError {
+	if err := checkCancelled(ctx, "Grow"); err != nil {
+		return err
+	}
 	filePath := C.CString(path)
 	defer C.free(unsafe.Pointer(filePath))
-	cstr := C.CString(callbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.Grow(connection.conn, filePath, C.VixDiskLibSectorType(capacity), C._Bool(updateGeometry), unsafe.Pointer(&cstr))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Grow failed. The error code is %d.", res))
-	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.Grow(connection.conn, filePath, C.VixDiskLibSectorType(capacity), C._Bool(updateGeometry), C.uintptr_t(handle))
+	return progressResult(ctx, res, "Grow")
 }
 
 func ListTransportModes() string {
@@ -345,24 +362,26 @@ func Unlink(connection VixDiskLibConnection, path string) VddkError {
 	return nil
 }
 
-func Shrink(diskHandle VixDiskLibHandle, progressCallbackData string) VddkError {
-	cstr := C.CString(progressCallbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.Shrink(diskHandle.dli, unsafe.Pointer(&cstr))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Shrink failed. The error code is %d.", res))
+// Shrink reports progress to progress, which may be nil, and is aborted when ctx is done.
+func Shrink(ctx context.Context, diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	if err := checkCancelled(ctx, "Shrink"); err != nil {
+		return err
 	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.Shrink(diskHandle.dli, C.uintptr_t(handle))
+	return progressResult(ctx, res, "Shrink")
 }
 
-func Defragment(diskHandle VixDiskLibHandle, progressCallbackData string) VddkError {
-	cstr := C.CString(progressCallbackData)
-	defer C.free(unsafe.Pointer(cstr))
-	res := C.Defragment(diskHandle.dli, unsafe.Pointer(&cstr))
-	if res != 0 {
-		return NewVddkError(uint64(res), fmt.Sprintf("Defragment failed. The error code is %d.", res))
+// Defragment reports progress to progress, which may be nil, and is aborted when ctx is done.
+func Defragment(ctx context.Context, diskHandle VixDiskLibHandle, progress ProgressFunc) VddkError {
+	if err := checkCancelled(ctx, "Defragment"); err != nil {
+		return err
 	}
-	return nil
+	handle := newProgressHandle(ctx, progress)
+	defer handle.Delete()
+	res := C.Defragment(diskHandle.dli, C.uintptr_t(handle))
+	return progressResult(ctx, res, "Defragment")
 }
 
 func GetTransportMode(diskHandle VixDiskLibHandle) string {
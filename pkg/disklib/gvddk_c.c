@@ -15,29 +15,84 @@ limitations under the License.
 */
 
 #include "gvddk_c.h"
+#include <stdarg.h>
+#include <stdlib.h>
 #include <string.h>
 
+/*
+ * forwardLog formats a VDDK log message and hands it to the Go logger. Messages
+ * that do not fit in the stack buffer are formatted again into the heap.
+ */
+static void forwardLog(int level, const char *fmt, va_list args)
+{
+    char buf[1024];
+    char *msg;
+    va_list copy;
+    int n;
+
+    va_copy(copy, args);
+    n = vsnprintf(buf, sizeof(buf), fmt, copy);
+    va_end(copy);
+    if (n < 0) {
+        return;
+    }
+    if ((size_t)n < sizeof(buf)) {
+        GoLog(level, buf);
+        return;
+    }
+    msg = malloc(n + 1);
+    if (msg == NULL) {
+        GoLog(level, buf);
+        return;
+    }
+    vsnprintf(msg, n + 1, fmt, args);
+    GoLog(level, msg);
+    free(msg);
+}
+
 void LogFunc(const char *fmt, va_list args)
 {
-    char *buf = malloc(1024);
-    sprintf(buf, fmt, args);
-    GoLogWarn(buf);
+    forwardLog(GVDDK_LOG_INFO, fmt, args);
+}
+
+void WarnFunc(const char *fmt, va_list args)
+{
+    forwardLog(GVDDK_LOG_WARN, fmt, args);
+}
+
+/*
+ * VDDK does not expect the panic function to return, so abort once the
+ * message has been logged.
+ */
+void PanicFunc(const char *fmt, va_list args)
+{
+    forwardLog(GVDDK_LOG_PANIC, fmt, args);
+    abort();
 }
 
+/*
+ * ProgressFunc forwards progress to the Go side. progressData carries the
+ * cgo.Handle of the Go callback and context; returning false aborts the
+ * operation.
+ */
 bool ProgressFunc(void *progressData, int percentCompleted)
 {
-    return true;
+    return GoProgress((uintptr_t)progressData, percentCompleted);
 }
 
-VixError Init(uint32 major, uint32 minor, char* libDir)
+VixError Init(uint32 major, uint32 minor, char* libDir, bool withLogger)
 {
-    VixError result = VixDiskLib_InitEx(major, minor, NULL, NULL, NULL, libDir, NULL);
-    return result;
+    return InitEx(major, minor, libDir, NULL, withLogger);
 }
 
-VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile)
+VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile, bool withLogger)
 {
-    VixError result = VixDiskLib_InitEx(major, minor, NULL, NULL, NULL, libDir, configFile);
+    VixError result;
+    if (withLogger) {
+        result = VixDiskLib_InitEx(major, minor, &LogFunc, &WarnFunc, &PanicFunc, libDir, configFile);
+    } else {
+        result = VixDiskLib_InitEx(major, minor, NULL, NULL, NULL, libDir, configFile);
+    }
     return result;
 }
 
@@ -92,24 +147,24 @@ void Params_helper(VixDiskLibConnectParams *cnxParams, char* arg1, char* arg2, c
     return;
 }
 
-VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, void *progressCallbackData)
+VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, uintptr_t progressHandle)
 {
     VixError vixError;
-    vixError = VixDiskLib_Create(connection, path, createParams, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_Create(connection, path, createParams, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle);
     return vixError;
 }
 
-VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, void *progressCallbackData)
+VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, uintptr_t progressHandle)
 {
     VixError vixError;
-    vixError = VixDiskLib_CreateChild(diskHandle, childPath, diskType, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_CreateChild(diskHandle, childPath, diskType, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle);
     return vixError;
 }
 
-VixError Defragment(VixDiskLibHandle diskHandle, void *progressCallbackData)
+VixError Defragment(VixDiskLibHandle diskHandle, uintptr_t progressHandle)
 {
     VixError vixError;
-    vixError = VixDiskLib_Defragment(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    vixError = VixDiskLib_Defragment(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle);
     return vixError;
 }
 
@@ -120,17 +175,17 @@ VixError GetInfo(VixDiskLibHandle diskHandle, VixDiskLibInfo *info)
     return error;
 }
 
-VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, void *progressCallbackData)
+VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, uintptr_t progressHandle)
 {
     VixError error;
-    error = VixDiskLib_Grow(connection, path, capacity, updateGeometry, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    error = VixDiskLib_Grow(connection, path, capacity, updateGeometry, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle);
     return error;
 }
 
-VixError Shrink(VixDiskLibHandle diskHandle, void *progressCallbackData)
+VixError Shrink(VixDiskLibHandle diskHandle, uintptr_t progressHandle)
 {
     VixError error;
-    error = VixDiskLib_Shrink(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData);
+    error = VixDiskLib_Shrink(diskHandle, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle);
     return error;
 }
 
@@ -158,10 +213,10 @@ VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen,
 }
 
 VixError Clone(VixDiskLibConnection dstConn, char *dstPath, VixDiskLibConnection srcConn, char *srcPath, VixDiskLibCreateParams *createParams,
-               void *progressCallbackData, bool overWrite)
+               uintptr_t progressHandle, bool overWrite)
 {
     VixError error;
-    error = VixDiskLib_Clone(dstConn, dstPath, srcConn, srcPath, createParams, (VixDiskLibProgressFunc)&ProgressFunc, progressCallbackData, overWrite);
+    error = VixDiskLib_Clone(dstConn, dstPath, srcConn, srcPath, createParams, (VixDiskLibProgressFunc)&ProgressFunc, (void *)progressHandle, overWrite);
     return error;
 }
 
@@ -16,6 +16,7 @@ limitations under the License.
 
 #include <stdio.h>
 #include <stdbool.h>
+#include <stdint.h>
 #include "vixDiskLib.h"
 
 typedef struct {
@@ -28,27 +29,34 @@ typedef struct {
     void*  blockList; /* opaque to Go */
 } BlockListDescriptor;
 
+#define GVDDK_LOG_INFO  0
+#define GVDDK_LOG_WARN  1
+#define GVDDK_LOG_PANIC 2
+
 void LogFunc(const char *fmt, va_list args);
-void GoLogWarn(char * msg);
-VixError Init(uint32 major, uint32 minor, char* libDir);
-VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile);
+void WarnFunc(const char *fmt, va_list args);
+void PanicFunc(const char *fmt, va_list args);
+void GoLog(int level, char *msg);
+bool GoProgress(uintptr_t handle, int percentCompleted);
+VixError Init(uint32 major, uint32 minor, char* libDir, bool withLogger);
+VixError InitEx(uint32 major, uint32 minor, char* libDir, char* configFile, bool withLogger);
 VixError Connect(VixDiskLibConnectParams *cnxParams, VixDiskLibConnection *connection);
 VixError ConnectEx(VixDiskLibConnectParams *cnxParams, bool readOnly, char *snapshotRef, char* transportModes, VixDiskLibConnection *connection);
 DiskHandle Open(VixDiskLibConnection conn, char* path, uint32 flags);
 VixError PrepareForAccess(VixDiskLibConnectParams *cnxParams, char* identity);
 void Params_helper(VixDiskLibConnectParams *cnxParams, char* arg1, char* arg2, char* arg3, bool isFcd, bool isSession);
-VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, void *progressCallbackData);
+VixError Create(VixDiskLibConnection connection, char *path, VixDiskLibCreateParams *createParams, uintptr_t progressHandle);
 bool ProgressFunc(void *progressData, int percentCompleted);
-VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, void *progressCallbackData);
-VixError Defragment(VixDiskLibHandle diskHandle, void *progressCallbackData);
+VixError CreateChild(VixDiskLibHandle diskHandle, char *childPath, VixDiskLibDiskType diskType, uintptr_t progressHandle);
+VixError Defragment(VixDiskLibHandle diskHandle, uintptr_t progressHandle);
 VixError GetInfo(VixDiskLibHandle diskHandle, VixDiskLibInfo *info);
-VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, void *progressCallbackData);
-VixError Shrink(VixDiskLibHandle diskHandle, void *progressCallbackData);
+VixError Grow(VixDiskLibConnection connection, char* path, VixDiskLibSectorType capacity, bool updateGeometry, uintptr_t progressHandle);
+VixError Shrink(VixDiskLibHandle diskHandle, uintptr_t progressHandle);
 VixError CheckRepair(VixDiskLibConnection connection, char *file, bool repair);
 VixError Cleanup(VixDiskLibConnectParams *connectParams, uint32 numCleanedUp, uint32 numRemaining);
 VixError GetMetadataKeys(VixDiskLibHandle diskHandle, char *buf, size_t bufLen, size_t *required);
 VixError Clone(VixDiskLibConnection dstConn, char *dstPath, VixDiskLibConnection srcConn, char *srcPath, VixDiskLibCreateParams *createParams,
-               void *progressCallbackData, bool overWrite);
+               uintptr_t progressHandle, bool overWrite);
 VixError QueryAllocatedBlocks(VixDiskLibHandle diskHandle, VixDiskLibSectorType startSector,
                               VixDiskLibSectorType numSectors, VixDiskLibSectorType chunkSize, BlockListDescriptor *bld);
 VixError BlockListCopyAndFree(BlockListDescriptor *bld, VixDiskLibBlock *ba);
@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disklib
+
+// errorNames maps every code of gvddk_errors.go to its symbolic name.
+var errorNames = map[uint64]string{
+	VIX_OK:                                     "VIX_OK",
+	VIX_E_FAIL:                                 "VIX_E_FAIL",
+	VIX_E_OUT_OF_MEMORY:                        "VIX_E_OUT_OF_MEMORY",
+	VIX_E_INVALID_ARG:                          "VIX_E_INVALID_ARG",
+	VIX_E_FILE_NOT_FOUND:                       "VIX_E_FILE_NOT_FOUND",
+	VIX_E_OBJECT_IS_BUSY:                       "VIX_E_OBJECT_IS_BUSY",
+	VIX_E_NOT_SUPPORTED:                        "VIX_E_NOT_SUPPORTED",
+	VIX_E_FILE_ERROR:                           "VIX_E_FILE_ERROR",
+	VIX_E_DISK_FULL:                            "VIX_E_DISK_FULL",
+	VIX_E_INCORRECT_FILE_TYPE:                  "VIX_E_INCORRECT_FILE_TYPE",
+	VIX_E_CANCELLED:                            "VIX_E_CANCELLED",
+	VIX_E_FILE_READ_ONLY:                       "VIX_E_FILE_READ_ONLY",
+	VIX_E_FILE_ALREADY_EXISTS:                  "VIX_E_FILE_ALREADY_EXISTS",
+	VIX_E_FILE_ACCESS_ERROR:                    "VIX_E_FILE_ACCESS_ERROR",
+	VIX_E_REQUIRES_LARGE_FILES:                 "VIX_E_REQUIRES_LARGE_FILES",
+	VIX_E_FILE_ALREADY_LOCKED:                  "VIX_E_FILE_ALREADY_LOCKED",
+	VIX_E_VMDB:                                 "VIX_E_VMDB",
+	VIX_E_NOT_SUPPORTED_ON_REMOTE_OBJECT:       "VIX_E_NOT_SUPPORTED_ON_REMOTE_OBJECT",
+	VIX_E_FILE_TOO_BIG:                         "VIX_E_FILE_TOO_BIG",
+	VIX_E_FILE_NAME_INVALID:                    "VIX_E_FILE_NAME_INVALID",
+	VIX_E_ALREADY_EXISTS:                       "VIX_E_ALREADY_EXISTS",
+	VIX_E_BUFFER_TOOSMALL:                      "VIX_E_BUFFER_TOOSMALL",
+	VIX_E_OBJECT_NOT_FOUND:                     "VIX_E_OBJECT_NOT_FOUND",
+	VIX_E_HOST_NOT_CONNECTED:                   "VIX_E_HOST_NOT_CONNECTED",
+	VIX_E_INVALID_UTF8_STRING:                  "VIX_E_INVALID_UTF8_STRING",
+	VIX_E_OPERATION_ALREADY_IN_PROGRESS:        "VIX_E_OPERATION_ALREADY_IN_PROGRESS",
+	VIX_E_UNFINISHED_JOB:                       "VIX_E_UNFINISHED_JOB",
+	VIX_E_NEED_KEY:                             "VIX_E_NEED_KEY",
+	VIX_E_LICENSE:                              "VIX_E_LICENSE",
+	VIX_E_VM_HOST_DISCONNECTED:                 "VIX_E_VM_HOST_DISCONNECTED",
+	VIX_E_AUTHENTICATION_FAIL:                  "VIX_E_AUTHENTICATION_FAIL",
+	VIX_E_HOST_CONNECTION_LOST:                 "VIX_E_HOST_CONNECTION_LOST",
+	VIX_E_DUPLICATE_NAME:                       "VIX_E_DUPLICATE_NAME",
+	VIX_E_ARGUMENT_TOO_BIG:                     "VIX_E_ARGUMENT_TOO_BIG",
+	VIX_E_INVALID_HANDLE:                       "VIX_E_INVALID_HANDLE",
+	VIX_E_NOT_SUPPORTED_ON_HANDLE_TYPE:         "VIX_E_NOT_SUPPORTED_ON_HANDLE_TYPE",
+	VIX_E_TOO_MANY_HANDLES:                     "VIX_E_TOO_MANY_HANDLES",
+	VIX_E_NOT_FOUND:                            "VIX_E_NOT_FOUND",
+	VIX_E_TYPE_MISMATCH:                        "VIX_E_TYPE_MISMATCH",
+	VIX_E_INVALID_XML:                          "VIX_E_INVALID_XML",
+	VIX_E_TIMEOUT_WAITING_FOR_TOOLS:            "VIX_E_TIMEOUT_WAITING_FOR_TOOLS",
+	VIX_E_UNRECOGNIZED_COMMAND:                 "VIX_E_UNRECOGNIZED_COMMAND",
+	VIX_E_OP_NOT_SUPPORTED_ON_GUEST:            "VIX_E_OP_NOT_SUPPORTED_ON_GUEST",
+	VIX_E_PROGRAM_NOT_STARTED:                  "VIX_E_PROGRAM_NOT_STARTED",
+	VIX_E_CANNOT_START_READ_ONLY_VM:            "VIX_E_CANNOT_START_READ_ONLY_VM",
+	VIX_E_VM_NOT_RUNNING:                       "VIX_E_VM_NOT_RUNNING",
+	VIX_E_VM_IS_RUNNING:                        "VIX_E_VM_IS_RUNNING",
+	VIX_E_CANNOT_CONNECT_TO_VM:                 "VIX_E_CANNOT_CONNECT_TO_VM",
+	VIX_E_POWEROP_SCRIPTS_NOT_AVAILABLE:        "VIX_E_POWEROP_SCRIPTS_NOT_AVAILABLE",
+	VIX_E_NO_GUEST_OS_INSTALLED:                "VIX_E_NO_GUEST_OS_INSTALLED",
+	VIX_E_VM_INSUFFICIENT_HOST_MEMORY:          "VIX_E_VM_INSUFFICIENT_HOST_MEMORY",
+	VIX_E_SUSPEND_ERROR:                        "VIX_E_SUSPEND_ERROR",
+	VIX_E_VM_NOT_ENOUGH_CPUS:                   "VIX_E_VM_NOT_ENOUGH_CPUS",
+	VIX_E_HOST_USER_PERMISSIONS:                "VIX_E_HOST_USER_PERMISSIONS",
+	VIX_E_GUEST_USER_PERMISSIONS:               "VIX_E_GUEST_USER_PERMISSIONS",
+	VIX_E_TOOLS_NOT_RUNNING:                    "VIX_E_TOOLS_NOT_RUNNING",
+	VIX_E_GUEST_OPERATIONS_PROHIBITED:          "VIX_E_GUEST_OPERATIONS_PROHIBITED",
+	VIX_E_ANON_GUEST_OPERATIONS_PROHIBITED:     "VIX_E_ANON_GUEST_OPERATIONS_PROHIBITED",
+	VIX_E_ROOT_GUEST_OPERATIONS_PROHIBITED:     "VIX_E_ROOT_GUEST_OPERATIONS_PROHIBITED",
+	VIX_E_MISSING_ANON_GUEST_ACCOUNT:           "VIX_E_MISSING_ANON_GUEST_ACCOUNT",
+	VIX_E_CANNOT_AUTHENTICATE_WITH_GUEST:       "VIX_E_CANNOT_AUTHENTICATE_WITH_GUEST",
+	VIX_E_UNRECOGNIZED_COMMAND_IN_GUEST:        "VIX_E_UNRECOGNIZED_COMMAND_IN_GUEST",
+	VIX_E_CONSOLE_GUEST_OPERATIONS_PROHIBITED:  "VIX_E_CONSOLE_GUEST_OPERATIONS_PROHIBITED",
+	VIX_E_MUST_BE_CONSOLE_USER:                 "VIX_E_MUST_BE_CONSOLE_USER",
+	VIX_E_VMX_MSG_DIALOG_AND_NO_UI:             "VIX_E_VMX_MSG_DIALOG_AND_NO_UI",
+	VIX_E_OPERATION_NOT_ALLOWED_FOR_LOGIN_TYPE: "VIX_E_OPERATION_NOT_ALLOWED_FOR_LOGIN_TYPE",
+	VIX_E_LOGIN_TYPE_NOT_SUPPORTED:             "VIX_E_LOGIN_TYPE_NOT_SUPPORTED",
+	VIX_E_EMPTY_PASSWORD_NOT_ALLOWED_IN_GUEST:  "VIX_E_EMPTY_PASSWORD_NOT_ALLOWED_IN_GUEST",
+	VIX_E_INTERACTIVE_SESSION_NOT_PRESENT:      "VIX_E_INTERACTIVE_SESSION_NOT_PRESENT",
+	VIX_E_INTERACTIVE_SESSION_USER_MISMATCH:    "VIX_E_INTERACTIVE_SESSION_USER_MISMATCH",
+	VIX_E_CANNOT_POWER_ON_VM:                   "VIX_E_CANNOT_POWER_ON_VM",
+	VIX_E_NO_DISPLAY_SERVER:                    "VIX_E_NO_DISPLAY_SERVER",
+	VIX_E_TOO_MANY_LOGONS:                      "VIX_E_TOO_MANY_LOGONS",
+	VIX_E_INVALID_AUTHENTICATION_SESSION:       "VIX_E_INVALID_AUTHENTICATION_SESSION",
+	VIX_E_VM_NOT_FOUND:                         "VIX_E_VM_NOT_FOUND",
+	VIX_E_NOT_SUPPORTED_FOR_VM_VERSION:         "VIX_E_NOT_SUPPORTED_FOR_VM_VERSION",
+	VIX_E_CANNOT_READ_VM_CONFIG:                "VIX_E_CANNOT_READ_VM_CONFIG",
+	VIX_E_TEMPLATE_VM:                          "VIX_E_TEMPLATE_VM",
+	VIX_E_VM_ALREADY_LOADED:                    "VIX_E_VM_ALREADY_LOADED",
+	VIX_E_VM_ALREADY_UP_TO_DATE:                "VIX_E_VM_ALREADY_UP_TO_DATE",
+	VIX_E_VM_UNSUPPORTED_GUEST:                 "VIX_E_VM_UNSUPPORTED_GUEST",
+	VIX_E_UNRECOGNIZED_PROPERTY:                "VIX_E_UNRECOGNIZED_PROPERTY",
+	VIX_E_INVALID_PROPERTY_VALUE:               "VIX_E_INVALID_PROPERTY_VALUE",
+	VIX_E_READ_ONLY_PROPERTY:                   "VIX_E_READ_ONLY_PROPERTY",
+	VIX_E_MISSING_REQUIRED_PROPERTY:            "VIX_E_MISSING_REQUIRED_PROPERTY",
+	VIX_E_INVALID_SERIALIZED_DATA:              "VIX_E_INVALID_SERIALIZED_DATA",
+	VIX_E_PROPERTY_TYPE_MISMATCH:               "VIX_E_PROPERTY_TYPE_MISMATCH",
+	VIX_E_BAD_VM_INDEX:                         "VIX_E_BAD_VM_INDEX",
+	VIX_E_INVALID_MESSAGE_HEADER:               "VIX_E_INVALID_MESSAGE_HEADER",
+	VIX_E_INVALID_MESSAGE_BODY:                 "VIX_E_INVALID_MESSAGE_BODY",
+	VIX_E_SNAPSHOT_INVAL:                       "VIX_E_SNAPSHOT_INVAL",
+	VIX_E_SNAPSHOT_DUMPER:                      "VIX_E_SNAPSHOT_DUMPER",
+	VIX_E_SNAPSHOT_DISKLIB:                     "VIX_E_SNAPSHOT_DISKLIB",
+	VIX_E_SNAPSHOT_NOTFOUND:                    "VIX_E_SNAPSHOT_NOTFOUND",
+	VIX_E_SNAPSHOT_EXISTS:                      "VIX_E_SNAPSHOT_EXISTS",
+	VIX_E_SNAPSHOT_VERSION:                     "VIX_E_SNAPSHOT_VERSION",
+	VIX_E_SNAPSHOT_NOPERM:                      "VIX_E_SNAPSHOT_NOPERM",
+	VIX_E_SNAPSHOT_CONFIG:                      "VIX_E_SNAPSHOT_CONFIG",
+	VIX_E_SNAPSHOT_NOCHANGE:                    "VIX_E_SNAPSHOT_NOCHANGE",
+	VIX_E_SNAPSHOT_CHECKPOINT:                  "VIX_E_SNAPSHOT_CHECKPOINT",
+	VIX_E_SNAPSHOT_LOCKED:                      "VIX_E_SNAPSHOT_LOCKED",
+	VIX_E_SNAPSHOT_INCONSISTENT:                "VIX_E_SNAPSHOT_INCONSISTENT",
+	VIX_E_SNAPSHOT_NAMETOOLONG:                 "VIX_E_SNAPSHOT_NAMETOOLONG",
+	VIX_E_SNAPSHOT_VIXFILE:                     "VIX_E_SNAPSHOT_VIXFILE",
+	VIX_E_SNAPSHOT_DISKLOCKED:                  "VIX_E_SNAPSHOT_DISKLOCKED",
+	VIX_E_SNAPSHOT_DUPLICATEDDISK:              "VIX_E_SNAPSHOT_DUPLICATEDDISK",
+	VIX_E_SNAPSHOT_INDEPENDENTDISK:             "VIX_E_SNAPSHOT_INDEPENDENTDISK",
+	VIX_E_SNAPSHOT_NONUNIQUE_NAME:              "VIX_E_SNAPSHOT_NONUNIQUE_NAME",
+	VIX_E_SNAPSHOT_MEMORY_ON_INDEPENDENT_DISK:  "VIX_E_SNAPSHOT_MEMORY_ON_INDEPENDENT_DISK",
+	VIX_E_SNAPSHOT_MAXSNAPSHOTS:                "VIX_E_SNAPSHOT_MAXSNAPSHOTS",
+	VIX_E_SNAPSHOT_MIN_FREE_SPACE:              "VIX_E_SNAPSHOT_MIN_FREE_SPACE",
+	VIX_E_SNAPSHOT_HIERARCHY_TOODEEP:           "VIX_E_SNAPSHOT_HIERARCHY_TOODEEP",
+	VIX_E_SNAPSHOT_NOT_REVERTABLE:              "VIX_E_SNAPSHOT_NOT_REVERTABLE",
+	VIX_E_HOST_DISK_INVALID_VALUE:              "VIX_E_HOST_DISK_INVALID_VALUE",
+	VIX_E_HOST_DISK_SECTORSIZE:                 "VIX_E_HOST_DISK_SECTORSIZE",
+	VIX_E_HOST_FILE_ERROR_EOF:                  "VIX_E_HOST_FILE_ERROR_EOF",
+	VIX_E_HOST_NETBLKDEV_HANDSHAKE:             "VIX_E_HOST_NETBLKDEV_HANDSHAKE",
+	VIX_E_HOST_SOCKET_CREATION_ERROR:           "VIX_E_HOST_SOCKET_CREATION_ERROR",
+	VIX_E_HOST_SERVER_NOT_FOUND:                "VIX_E_HOST_SERVER_NOT_FOUND",
+	VIX_E_HOST_NETWORK_CONN_REFUSED:            "VIX_E_HOST_NETWORK_CONN_REFUSED",
+	VIX_E_HOST_TCP_SOCKET_ERROR:                "VIX_E_HOST_TCP_SOCKET_ERROR",
+	VIX_E_HOST_TCP_CONN_LOST:                   "VIX_E_HOST_TCP_CONN_LOST",
+	VIX_E_HOST_NBD_HASHFILE_VOLUME:             "VIX_E_HOST_NBD_HASHFILE_VOLUME",
+	VIX_E_HOST_NBD_HASHFILE_INIT:               "VIX_E_HOST_NBD_HASHFILE_INIT",
+	VIX_E_DISK_INVAL:                           "VIX_E_DISK_INVAL",
+	VIX_E_DISK_NOINIT:                          "VIX_E_DISK_NOINIT",
+	VIX_E_DISK_NOIO:                            "VIX_E_DISK_NOIO",
+	VIX_E_DISK_PARTIALCHAIN:                    "VIX_E_DISK_PARTIALCHAIN",
+	VIX_E_DISK_NEEDSREPAIR:                     "VIX_E_DISK_NEEDSREPAIR",
+	VIX_E_DISK_OUTOFRANGE:                      "VIX_E_DISK_OUTOFRANGE",
+	VIX_E_DISK_CID_MISMATCH:                    "VIX_E_DISK_CID_MISMATCH",
+	VIX_E_DISK_CANTSHRINK:                      "VIX_E_DISK_CANTSHRINK",
+	VIX_E_DISK_PARTMISMATCH:                    "VIX_E_DISK_PARTMISMATCH",
+	VIX_E_DISK_UNSUPPORTEDDISKVERSION:          "VIX_E_DISK_UNSUPPORTEDDISKVERSION",
+	VIX_E_DISK_OPENPARENT:                      "VIX_E_DISK_OPENPARENT",
+	VIX_E_DISK_NOTSUPPORTED:                    "VIX_E_DISK_NOTSUPPORTED",
+	VIX_E_DISK_NEEDKEY:                         "VIX_E_DISK_NEEDKEY",
+	VIX_E_DISK_NOKEYOVERRIDE:                   "VIX_E_DISK_NOKEYOVERRIDE",
+	VIX_E_DISK_NOTENCRYPTED:                    "VIX_E_DISK_NOTENCRYPTED",
+	VIX_E_DISK_NOKEY:                           "VIX_E_DISK_NOKEY",
+	VIX_E_DISK_INVALIDPARTITIONTABLE:           "VIX_E_DISK_INVALIDPARTITIONTABLE",
+	VIX_E_DISK_NOTNORMAL:                       "VIX_E_DISK_NOTNORMAL",
+	VIX_E_DISK_NOTENCDESC:                      "VIX_E_DISK_NOTENCDESC",
+	VIX_E_DISK_NEEDVMFS:                        "VIX_E_DISK_NEEDVMFS",
+	VIX_E_DISK_RAWTOOBIG:                       "VIX_E_DISK_RAWTOOBIG",
+	VIX_E_DISK_TOOMANYOPENFILES:                "VIX_E_DISK_TOOMANYOPENFILES",
+	VIX_E_DISK_TOOMANYREDO:                     "VIX_E_DISK_TOOMANYREDO",
+	VIX_E_DISK_RAWTOOSMALL:                     "VIX_E_DISK_RAWTOOSMALL",
+	VIX_E_DISK_INVALIDCHAIN:                    "VIX_E_DISK_INVALIDCHAIN",
+	VIX_E_DISK_KEY_NOTFOUND:                    "VIX_E_DISK_KEY_NOTFOUND",
+	VIX_E_DISK_SUBSYSTEM_INIT_FAIL:             "VIX_E_DISK_SUBSYSTEM_INIT_FAIL",
+	VIX_E_DISK_INVALID_CONNECTION:              "VIX_E_DISK_INVALID_CONNECTION",
+	VIX_E_DISK_ENCODING:                        "VIX_E_DISK_ENCODING",
+	VIX_E_DISK_CANTREPAIR:                      "VIX_E_DISK_CANTREPAIR",
+	VIX_E_DISK_INVALIDDISK:                     "VIX_E_DISK_INVALIDDISK",
+	VIX_E_DISK_NOLICENSE:                       "VIX_E_DISK_NOLICENSE",
+	VIX_E_DISK_NODEVICE:                        "VIX_E_DISK_NODEVICE",
+	VIX_E_DISK_UNSUPPORTEDDEVICE:               "VIX_E_DISK_UNSUPPORTEDDEVICE",
+	VIX_E_DISK_CAPACITY_MISMATCH:               "VIX_E_DISK_CAPACITY_MISMATCH",
+	VIX_E_DISK_PARENT_NOTALLOWED:               "VIX_E_DISK_PARENT_NOTALLOWED",
+	VIX_E_DISK_ATTACH_ROOTLINK:                 "VIX_E_DISK_ATTACH_ROOTLINK",
+	VIX_E_CRYPTO_UNKNOWN_ALGORITHM:             "VIX_E_CRYPTO_UNKNOWN_ALGORITHM",
+	VIX_E_CRYPTO_BAD_BUFFER_SIZE:               "VIX_E_CRYPTO_BAD_BUFFER_SIZE",
+	VIX_E_CRYPTO_INVALID_OPERATION:             "VIX_E_CRYPTO_INVALID_OPERATION",
+	VIX_E_CRYPTO_RANDOM_DEVICE:                 "VIX_E_CRYPTO_RANDOM_DEVICE",
+	VIX_E_CRYPTO_NEED_PASSWORD:                 "VIX_E_CRYPTO_NEED_PASSWORD",
+	VIX_E_CRYPTO_BAD_PASSWORD:                  "VIX_E_CRYPTO_BAD_PASSWORD",
+	VIX_E_CRYPTO_NOT_IN_DICTIONARY:             "VIX_E_CRYPTO_NOT_IN_DICTIONARY",
+	VIX_E_CRYPTO_NO_CRYPTO:                     "VIX_E_CRYPTO_NO_CRYPTO",
+	VIX_E_CRYPTO_ERROR:                         "VIX_E_CRYPTO_ERROR",
+	VIX_E_CRYPTO_BAD_FORMAT:                    "VIX_E_CRYPTO_BAD_FORMAT",
+	VIX_E_CRYPTO_LOCKED:                        "VIX_E_CRYPTO_LOCKED",
+	VIX_E_CRYPTO_EMPTY:                         "VIX_E_CRYPTO_EMPTY",
+	VIX_E_CRYPTO_KEYSAFE_LOCATOR:               "VIX_E_CRYPTO_KEYSAFE_LOCATOR",
+	VIX_E_CANNOT_CONNECT_TO_HOST:               "VIX_E_CANNOT_CONNECT_TO_HOST",
+	VIX_E_NOT_FOR_REMOTE_HOST:                  "VIX_E_NOT_FOR_REMOTE_HOST",
+	VIX_E_INVALID_HOSTNAME_SPECIFICATION:       "VIX_E_INVALID_HOSTNAME_SPECIFICATION",
+	VIX_E_SCREEN_CAPTURE_ERROR:                 "VIX_E_SCREEN_CAPTURE_ERROR",
+	VIX_E_SCREEN_CAPTURE_BAD_FORMAT:            "VIX_E_SCREEN_CAPTURE_BAD_FORMAT",
+	VIX_E_SCREEN_CAPTURE_COMPRESSION_FAIL:      "VIX_E_SCREEN_CAPTURE_COMPRESSION_FAIL",
+	VIX_E_SCREEN_CAPTURE_LARGE_DATA:            "VIX_E_SCREEN_CAPTURE_LARGE_DATA",
+	VIX_E_GUEST_VOLUMES_NOT_FROZEN:             "VIX_E_GUEST_VOLUMES_NOT_FROZEN",
+	VIX_E_NOT_A_FILE:                           "VIX_E_NOT_A_FILE",
+	VIX_E_NOT_A_DIRECTORY:                      "VIX_E_NOT_A_DIRECTORY",
+	VIX_E_NO_SUCH_PROCESS:                      "VIX_E_NO_SUCH_PROCESS",
+	VIX_E_FILE_NAME_TOO_LONG:                   "VIX_E_FILE_NAME_TOO_LONG",
+	VIX_E_OPERATION_DISABLED:                   "VIX_E_OPERATION_DISABLED",
+	VIX_E_TOOLS_INSTALL_NO_IMAGE:               "VIX_E_TOOLS_INSTALL_NO_IMAGE",
+	VIX_E_TOOLS_INSTALL_IMAGE_INACCESIBLE:      "VIX_E_TOOLS_INSTALL_IMAGE_INACCESIBLE",
+	VIX_E_TOOLS_INSTALL_NO_DEVICE:              "VIX_E_TOOLS_INSTALL_NO_DEVICE",
+	VIX_E_TOOLS_INSTALL_DEVICE_NOT_CONNECTED:   "VIX_E_TOOLS_INSTALL_DEVICE_NOT_CONNECTED",
+	VIX_E_TOOLS_INSTALL_CANCELLED:              "VIX_E_TOOLS_INSTALL_CANCELLED",
+	VIX_E_TOOLS_INSTALL_INIT_FAILED:            "VIX_E_TOOLS_INSTALL_INIT_FAILED",
+	VIX_E_TOOLS_INSTALL_AUTO_NOT_SUPPORTED:     "VIX_E_TOOLS_INSTALL_AUTO_NOT_SUPPORTED",
+	VIX_E_TOOLS_INSTALL_GUEST_NOT_READY:        "VIX_E_TOOLS_INSTALL_GUEST_NOT_READY",
+	VIX_E_TOOLS_INSTALL_SIG_CHECK_FAILED:       "VIX_E_TOOLS_INSTALL_SIG_CHECK_FAILED",
+	VIX_E_TOOLS_INSTALL_ERROR:                  "VIX_E_TOOLS_INSTALL_ERROR",
+	VIX_E_TOOLS_INSTALL_ALREADY_UP_TO_DATE:     "VIX_E_TOOLS_INSTALL_ALREADY_UP_TO_DATE",
+	VIX_E_TOOLS_INSTALL_IN_PROGRESS:            "VIX_E_TOOLS_INSTALL_IN_PROGRESS",
+	VIX_E_TOOLS_INSTALL_IMAGE_COPY_FAILED:      "VIX_E_TOOLS_INSTALL_IMAGE_COPY_FAILED",
+	VIX_E_WRAPPER_WORKSTATION_NOT_INSTALLED:    "VIX_E_WRAPPER_WORKSTATION_NOT_INSTALLED",
+	VIX_E_WRAPPER_VERSION_NOT_FOUND:            "VIX_E_WRAPPER_VERSION_NOT_FOUND",
+	VIX_E_WRAPPER_SERVICEPROVIDER_NOT_FOUND:    "VIX_E_WRAPPER_SERVICEPROVIDER_NOT_FOUND",
+	VIX_E_WRAPPER_PLAYER_NOT_INSTALLED:         "VIX_E_WRAPPER_PLAYER_NOT_INSTALLED",
+	VIX_E_WRAPPER_RUNTIME_NOT_INSTALLED:        "VIX_E_WRAPPER_RUNTIME_NOT_INSTALLED",
+	VIX_E_WRAPPER_MULTIPLE_SERVICEPROVIDERS:    "VIX_E_WRAPPER_MULTIPLE_SERVICEPROVIDERS",
+	VIX_E_MNTAPI_MOUNTPT_NOT_FOUND:             "VIX_E_MNTAPI_MOUNTPT_NOT_FOUND",
+	VIX_E_MNTAPI_MOUNTPT_IN_USE:                "VIX_E_MNTAPI_MOUNTPT_IN_USE",
+	VIX_E_MNTAPI_DISK_NOT_FOUND:                "VIX_E_MNTAPI_DISK_NOT_FOUND",
+	VIX_E_MNTAPI_DISK_NOT_MOUNTED:              "VIX_E_MNTAPI_DISK_NOT_MOUNTED",
+	VIX_E_MNTAPI_DISK_IS_MOUNTED:               "VIX_E_MNTAPI_DISK_IS_MOUNTED",
+	VIX_E_MNTAPI_DISK_NOT_SAFE:                 "VIX_E_MNTAPI_DISK_NOT_SAFE",
+	VIX_E_MNTAPI_DISK_CANT_OPEN:                "VIX_E_MNTAPI_DISK_CANT_OPEN",
+	VIX_E_MNTAPI_CANT_READ_PARTS:               "VIX_E_MNTAPI_CANT_READ_PARTS",
+	VIX_E_MNTAPI_UMOUNT_APP_NOT_FOUND:          "VIX_E_MNTAPI_UMOUNT_APP_NOT_FOUND",
+	VIX_E_MNTAPI_UMOUNT:                        "VIX_E_MNTAPI_UMOUNT",
+	VIX_E_MNTAPI_NO_MOUNTABLE_PARTITONS:        "VIX_E_MNTAPI_NO_MOUNTABLE_PARTITONS",
+	VIX_E_MNTAPI_PARTITION_RANGE:               "VIX_E_MNTAPI_PARTITION_RANGE",
+	VIX_E_MNTAPI_PERM:                          "VIX_E_MNTAPI_PERM",
+	VIX_E_MNTAPI_DICT:                          "VIX_E_MNTAPI_DICT",
+	VIX_E_MNTAPI_DICT_LOCKED:                   "VIX_E_MNTAPI_DICT_LOCKED",
+	VIX_E_MNTAPI_OPEN_HANDLES:                  "VIX_E_MNTAPI_OPEN_HANDLES",
+	VIX_E_MNTAPI_CANT_MAKE_VAR_DIR:             "VIX_E_MNTAPI_CANT_MAKE_VAR_DIR",
+	VIX_E_MNTAPI_NO_ROOT:                       "VIX_E_MNTAPI_NO_ROOT",
+	VIX_E_MNTAPI_LOOP_FAILED:                   "VIX_E_MNTAPI_LOOP_FAILED",
+	VIX_E_MNTAPI_DAEMON:                        "VIX_E_MNTAPI_DAEMON",
+	VIX_E_MNTAPI_INTERNAL:                      "VIX_E_MNTAPI_INTERNAL",
+	VIX_E_MNTAPI_SYSTEM:                        "VIX_E_MNTAPI_SYSTEM",
+	VIX_E_MNTAPI_NO_CONNECTION_DETAILS:         "VIX_E_MNTAPI_NO_CONNECTION_DETAILS",
+	VIX_E_MNTAPI_INCOMPATIBLE_VERSION:          "VIX_E_MNTAPI_INCOMPATIBLE_VERSION",
+	VIX_E_MNTAPI_OS_ERROR:                      "VIX_E_MNTAPI_OS_ERROR",
+	VIX_E_MNTAPI_DRIVE_LETTER_IN_USE:           "VIX_E_MNTAPI_DRIVE_LETTER_IN_USE",
+	VIX_E_MNTAPI_DRIVE_LETTER_ALREADY_ASSIGNED: "VIX_E_MNTAPI_DRIVE_LETTER_ALREADY_ASSIGNED",
+	VIX_E_MNTAPI_VOLUME_NOT_MOUNTED:            "VIX_E_MNTAPI_VOLUME_NOT_MOUNTED",
+	VIX_E_MNTAPI_VOLUME_ALREADY_MOUNTED:        "VIX_E_MNTAPI_VOLUME_ALREADY_MOUNTED",
+	VIX_E_MNTAPI_FORMAT_FAILURE:                "VIX_E_MNTAPI_FORMAT_FAILURE",
+	VIX_E_MNTAPI_NO_DRIVER:                     "VIX_E_MNTAPI_NO_DRIVER",
+	VIX_E_MNTAPI_ALREADY_OPENED:                "VIX_E_MNTAPI_ALREADY_OPENED",
+	VIX_E_MNTAPI_ITEM_NOT_FOUND:                "VIX_E_MNTAPI_ITEM_NOT_FOUND",
+	VIX_E_MNTAPI_UNSUPPROTED_BOOT_LOADER:       "VIX_E_MNTAPI_UNSUPPROTED_BOOT_LOADER",
+	VIX_E_MNTAPI_UNSUPPROTED_OS:                "VIX_E_MNTAPI_UNSUPPROTED_OS",
+	VIX_E_MNTAPI_CODECONVERSION:                "VIX_E_MNTAPI_CODECONVERSION",
+	VIX_E_MNTAPI_REGWRITE_ERROR:                "VIX_E_MNTAPI_REGWRITE_ERROR",
+	VIX_E_MNTAPI_UNSUPPORTED_FT_VOLUME:         "VIX_E_MNTAPI_UNSUPPORTED_FT_VOLUME",
+	VIX_E_MNTAPI_PARTITION_NOT_FOUND:           "VIX_E_MNTAPI_PARTITION_NOT_FOUND",
+	VIX_E_MNTAPI_PUTFILE_ERROR:                 "VIX_E_MNTAPI_PUTFILE_ERROR",
+	VIX_E_MNTAPI_GETFILE_ERROR:                 "VIX_E_MNTAPI_GETFILE_ERROR",
+	VIX_E_MNTAPI_REG_NOT_OPENED:                "VIX_E_MNTAPI_REG_NOT_OPENED",
+	VIX_E_MNTAPI_REGDELKEY_ERROR:               "VIX_E_MNTAPI_REGDELKEY_ERROR",
+	VIX_E_MNTAPI_CREATE_PARTITIONTABLE_ERROR:   "VIX_E_MNTAPI_CREATE_PARTITIONTABLE_ERROR",
+	VIX_E_MNTAPI_OPEN_FAILURE:                  "VIX_E_MNTAPI_OPEN_FAILURE",
+	VIX_E_MNTAPI_VOLUME_NOT_WRITABLE:           "VIX_E_MNTAPI_VOLUME_NOT_WRITABLE",
+	VIX_ASYNC:                                  "VIX_ASYNC",
+	VIX_E_ASYNC_MIXEDMODE_UNSUPPORTED:          "VIX_E_ASYNC_MIXEDMODE_UNSUPPORTED",
+	VIX_E_NET_HTTP_UNSUPPORTED_PROTOCOL:        "VIX_E_NET_HTTP_UNSUPPORTED_PROTOCOL",
+	VIX_E_NET_HTTP_URL_MALFORMAT:               "VIX_E_NET_HTTP_URL_MALFORMAT",
+	VIX_E_NET_HTTP_COULDNT_RESOLVE_PROXY:       "VIX_E_NET_HTTP_COULDNT_RESOLVE_PROXY",
+	VIX_E_NET_HTTP_COULDNT_RESOLVE_HOST:        "VIX_E_NET_HTTP_COULDNT_RESOLVE_HOST",
+	VIX_E_NET_HTTP_COULDNT_CONNECT:             "VIX_E_NET_HTTP_COULDNT_CONNECT",
+	VIX_E_NET_HTTP_HTTP_RETURNED_ERROR:         "VIX_E_NET_HTTP_HTTP_RETURNED_ERROR",
+	VIX_E_NET_HTTP_OPERATION_TIMEDOUT:          "VIX_E_NET_HTTP_OPERATION_TIMEDOUT",
+	VIX_E_NET_HTTP_SSL_CONNECT_ERROR:           "VIX_E_NET_HTTP_SSL_CONNECT_ERROR",
+	VIX_E_NET_HTTP_TOO_MANY_REDIRECTS:          "VIX_E_NET_HTTP_TOO_MANY_REDIRECTS",
+	VIX_E_NET_HTTP_TRANSFER:                    "VIX_E_NET_HTTP_TRANSFER",
+	VIX_E_NET_HTTP_SSL_SECURITY:                "VIX_E_NET_HTTP_SSL_SECURITY",
+	VIX_E_NET_HTTP_GENERIC:                     "VIX_E_NET_HTTP_GENERIC",
+}
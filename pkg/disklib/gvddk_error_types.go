@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disklib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Categories of VIX errors, for use with errors.Is. A VddkError is the
+// category of its code, e.g. errors.Is(err, ErrNotFound) holds for
+// VIX_E_FILE_NOT_FOUND, VIX_E_VM_NOT_FOUND and VIX_E_DISK_KEY_NOTFOUND.
+var (
+	ErrNotFound       = errors.New("vddk: not found")
+	ErrAuth           = errors.New("vddk: authentication or permission failure")
+	ErrConnectionLost = errors.New("vddk: connection lost")
+	ErrTimeout        = errors.New("vddk: timed out")
+	ErrBusy           = errors.New("vddk: object busy or locked")
+	ErrOutOfRange     = errors.New("vddk: out of range")
+	ErrCancelled      = errors.New("vddk: cancelled")
+	ErrInvalidArg     = errors.New("vddk: invalid argument")
+)
+
+// errorKinds gives the category of the codes that have one.
+var errorKinds = map[uint64]error{
+	VIX_E_FILE_NOT_FOUND:    ErrNotFound,
+	VIX_E_OBJECT_NOT_FOUND:  ErrNotFound,
+	VIX_E_NOT_FOUND:         ErrNotFound,
+	VIX_E_VM_NOT_FOUND:      ErrNotFound,
+	VIX_E_SNAPSHOT_NOTFOUND: ErrNotFound,
+	VIX_E_DISK_KEY_NOTFOUND: ErrNotFound,
+
+	VIX_E_AUTHENTICATION_FAIL:                  ErrAuth,
+	VIX_E_HOST_USER_PERMISSIONS:                ErrAuth,
+	VIX_E_GUEST_USER_PERMISSIONS:               ErrAuth,
+	VIX_E_CANNOT_AUTHENTICATE_WITH_GUEST:       ErrAuth,
+	VIX_E_OPERATION_NOT_ALLOWED_FOR_LOGIN_TYPE: ErrAuth,
+	VIX_E_LOGIN_TYPE_NOT_SUPPORTED:             ErrAuth,
+	VIX_E_INVALID_AUTHENTICATION_SESSION:       ErrAuth,
+
+	VIX_E_VM_HOST_DISCONNECTED:       ErrConnectionLost,
+	VIX_E_HOST_CONNECTION_LOST:       ErrConnectionLost,
+	VIX_E_HOST_SOCKET_CREATION_ERROR: ErrConnectionLost,
+	VIX_E_HOST_NETWORK_CONN_REFUSED:  ErrConnectionLost,
+	VIX_E_HOST_TCP_SOCKET_ERROR:      ErrConnectionLost,
+	VIX_E_HOST_TCP_CONN_LOST:         ErrConnectionLost,
+	VIX_E_CANNOT_CONNECT_TO_HOST:     ErrConnectionLost,
+	VIX_E_NET_HTTP_COULDNT_CONNECT:   ErrConnectionLost,
+	VIX_E_NET_HTTP_TRANSFER:          ErrConnectionLost,
+
+	VIX_E_NET_HTTP_OPERATION_TIMEDOUT: ErrTimeout,
+
+	VIX_E_OBJECT_IS_BUSY:      ErrBusy,
+	VIX_E_FILE_ALREADY_LOCKED: ErrBusy,
+
+	VIX_E_DISK_OUTOFRANGE: ErrOutOfRange,
+	VIX_E_CANCELLED:       ErrCancelled,
+	VIX_E_INVALID_ARG:     ErrInvalidArg,
+}
+
+// ErrorName returns the symbolic name of a VIX error code, e.g.
+// "VIX_E_FILE_NOT_FOUND" for 4.
+func ErrorName(code uint64) string {
+	name, ok := errorNames[code]
+	if !ok {
+		return fmt.Sprintf("VIX_E_UNKNOWN(%d)", code)
+	}
+	return name
+}
+
+func (this vddkErrorImpl) VixErrorName() string {
+	return ErrorName(this.err_code)
+}
+
+// Is reports whether target is the category of the error code.
+func (this vddkErrorImpl) Is(target error) bool {
+	kind, ok := errorKinds[this.err_code]
+	return ok && kind == target
+}
+
+// OpError records what was being done when VDDK failed: the operation, the
+// disk, the sectors and the transport mode, each left empty when it does not
+// apply. It is a VddkError itself and unwraps to the error of VDDK, so
+// errors.Is works on it with the categories above.
+type OpError struct {
+	Op          string
+	Path        string
+	StartSector uint64
+	NumSectors  uint64
+	Transport   string
+	Err         VddkError
+}
+
+// WrapError returns err with its context, or nil if err is nil.
+func WrapError(err VddkError, op string, path string, transport string) VddkError {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Path: path, Transport: transport, Err: err}
+}
+
+func (this *OpError) Error() string {
+	msg := this.Op
+	if this.Path != "" {
+		msg += " " + this.Path
+	}
+	if this.NumSectors > 0 {
+		msg += fmt.Sprintf(" sectors %d-%d", this.StartSector, this.StartSector+this.NumSectors-1)
+	}
+	if this.Transport != "" {
+		msg += " over " + this.Transport
+	}
+	return fmt.Sprintf("%s: %s (%s)", msg, this.Err.Error(), this.VixErrorName())
+}
+
+func (this *OpError) Unwrap() error {
+	return this.Err
+}
+
+func (this *OpError) VixErrorCode() uint64 {
+	return this.Err.VixErrorCode()
+}
+
+func (this *OpError) VixErrorName() string {
+	return ErrorName(this.Err.VixErrorCode())
+}
@@ -22,6 +22,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/url"
+	"os"
 )
 import "crypto/sha1"
 
@@ -110,6 +111,8 @@ type VixDiskLibConnection struct {
 type VddkError interface {
 	Error() string
 	VixErrorCode() uint64
+	// VixErrorName returns the VIX_E_* name of the code
+	VixErrorName() string
 }
 
 type vddkErrorImpl struct {
@@ -195,6 +198,16 @@ func NewConnectParams(vmxSpec string, serverName string, thumbPrint string, user
 	return params
 }
 
+// Path returns the path of the disk to open.
+func (cp ConnectParams) Path() string {
+	return cp.path
+}
+
+// TransportMode returns the transport modes asked for, e.g. "nbd" or "hotadd:nbd".
+func (cp ConnectParams) TransportMode() string {
+	return cp.mode
+}
+
 func (cp *ConnectParams) SetSnapshotRef(snapRef string) {
 	cp.snapshotRef = snapRef
 }
@@ -203,6 +216,49 @@ func (cp *ConnectParams) SetTransportMode(mode string) {
 	cp.mode = mode
 }
 
+// ConnectionKey identifies what a connection made from ConnectParams is bound
+// to: the server, the VM or FCD, the snapshot and the transport mode. Disks of
+// the same VM snapshot share a key, whatever their path and open flags.
+type ConnectionKey struct {
+	serverName  string
+	userName    string
+	vmxSpec     string
+	fcdId       string
+	ds          string
+	fcdssId     string
+	snapshotRef string
+	mode        string
+	identity    string
+	readOnly    bool
+}
+
+// ConnectionKey returns the key of the connection ConnectEx makes for cp.
+func (cp ConnectParams) ConnectionKey() ConnectionKey {
+	return ConnectionKey{
+		serverName:  cp.serverName,
+		userName:    cp.userName,
+		vmxSpec:     cp.vmxSpec,
+		fcdId:       cp.fcdId,
+		ds:          cp.ds,
+		fcdssId:     cp.fcdssId,
+		snapshotRef: cp.snapshotRef,
+		mode:        cp.mode,
+		identity:    cp.identity,
+		readOnly:    cp.readOnly,
+	}
+}
+
+func (key ConnectionKey) String() string {
+	object := key.vmxSpec
+	if key.fcdId != "" {
+		object = key.fcdId
+		if key.fcdssId != "" {
+			object += "@" + key.fcdssId
+		}
+	}
+	return fmt.Sprintf("%s/%s snapshot %q mode %q", key.serverName, object, key.snapshotRef, key.mode)
+}
+
 func NewVddkError(err_code uint64, err_msg string) VddkError {
 	vddkError := vddkErrorImpl{
 		err_code: err_code,
@@ -211,6 +267,21 @@ func NewVddkError(err_code uint64, err_msg string) VddkError {
 	return vddkError
 }
 
+// NewFileError maps an error from a local file operation to the closest VIX
+// file error code.
+func NewFileError(op string, err error) VddkError {
+	var code uint64 = VIX_E_FILE_ERROR
+	switch {
+	case os.IsNotExist(err):
+		code = VIX_E_FILE_NOT_FOUND
+	case os.IsExist(err):
+		code = VIX_E_FILE_ALREADY_EXISTS
+	case os.IsPermission(err):
+		code = VIX_E_FILE_ACCESS_ERROR
+	}
+	return NewVddkError(code, fmt.Sprintf("%s failed: %v. The error code is %d.", op, err, code))
+}
+
 func NewCreateParams(diskType VixDiskLibDiskType, adapterType VixDiskLibAdapterType, hwVersion uint16, capacity VixDiskLibSectorType) VixDiskLibCreateParams {
 	params := VixDiskLibCreateParams{
 		diskType:    diskType,
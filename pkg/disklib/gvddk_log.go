@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disklib
+
+// #include "gvddk_c.h"
+import "C"
+import (
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VDDK log levels as passed from the C callbacks
+const (
+	vddkLogInfo  = C.GVDDK_LOG_INFO
+	vddkLogWarn  = C.GVDDK_LOG_WARN
+	vddkLogPanic = C.GVDDK_LOG_PANIC
+)
+
+// VDDK's log callbacks are process wide, so is the logger they report to.
+var vddkLogger = struct {
+	sync.RWMutex
+	logger logrus.FieldLogger
+}{}
+
+func setVddkLogger(logger logrus.FieldLogger) {
+	vddkLogger.Lock()
+	defer vddkLogger.Unlock()
+	if logger != nil {
+		logger = logger.WithField("component", "vddk")
+	}
+	vddkLogger.logger = logger
+}
+
+// logVddkMessage writes a message from VDDK to the logger set by Init or
+// InitEx. Panic messages are logged at error level, since VDDK aborts the
+// process right after reporting them.
+func logVddkMessage(level int, msg string) {
+	vddkLogger.RLock()
+	logger := vddkLogger.logger
+	vddkLogger.RUnlock()
+	if logger == nil {
+		return
+	}
+	msg = strings.TrimRight(msg, "\r\n")
+	switch level {
+	case vddkLogWarn:
+		logger.Warn(msg)
+	case vddkLogPanic:
+		logger.WithField("panic", true).Error(msg)
+	default:
+		logger.Info(msg)
+	}
+}
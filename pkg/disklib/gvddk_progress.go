@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disklib
+
+// #include "gvddk_c.h"
+import "C"
+import (
+	"context"
+	"fmt"
+	"runtime/cgo"
+)
+
+// ProgressFunc is called by long running operations (Create, Clone, Grow,
+// Shrink, Defragment and CreateChild) with the percentage completed so far.
+type ProgressFunc func(percentCompleted int)
+
+type progressState struct {
+	ctx      context.Context
+	progress ProgressFunc
+}
+
+// newProgressHandle packs ctx and progress into a handle that can be handed to
+// C as the progress callback data. The caller must Delete the handle once the
+// operation has returned.
+func newProgressHandle(ctx context.Context, progress ProgressFunc) cgo.Handle {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return cgo.NewHandle(&progressState{
+		ctx:      ctx,
+		progress: progress,
+	})
+}
+
+// checkCancelled refuses to start an operation whose context is already done.
+func checkCancelled(ctx context.Context, op string) VddkError {
+	if ctx != nil && ctx.Err() != nil {
+		return NewVddkError(VIX_E_CANCELLED, fmt.Sprintf("%s cancelled: %v. The error code is %d.", op, ctx.Err(), VIX_E_CANCELLED))
+	}
+	return nil
+}
+
+// progressResult turns the result of an operation that took a progress
+// callback into a VddkError, noting when it was the context that stopped it.
+func progressResult(ctx context.Context, res C.VixError, op string) VddkError {
+	if res == 0 {
+		return nil
+	}
+	if ctx != nil && ctx.Err() != nil {
+		return NewVddkError(uint64(res), fmt.Sprintf("%s cancelled: %v. The error code is %d.", op, ctx.Err(), res))
+	}
+	return NewVddkError(uint64(res), fmt.Sprintf("%s failed. The error code is %d.", op, res))
+}
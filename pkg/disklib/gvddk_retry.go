@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disklib
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IsTransientCode reports whether a VIX error code is worth retrying: a lost
+// or refused host connection, a network timeout, or a busy or locked object.
+// Every other code is fatal and is not retried.
+func IsTransientCode(code uint64) bool {
+	switch errorKinds[code] {
+	case ErrConnectionLost, ErrTimeout, ErrBusy:
+		return true
+	}
+	return false
+}
+
+// IsTransient reports whether err is a VddkError worth retrying.
+func IsTransient(err VddkError) bool {
+	return err != nil && IsTransientCode(err.VixErrorCode())
+}
+
+// RetryPolicy retries operations that fail with a transient error, waiting
+// with exponential backoff between the attempts. Fatal errors are returned
+// right away.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one. Zero or
+	// one means no retries.
+	MaxAttempts int
+	// InitialDelay is the wait before the first retry
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between two attempts
+	MaxDelay time.Duration
+	// Multiplier is applied to the wait after every retry, 2 if zero
+	Multiplier float64
+	// Jitter randomizes every wait by up to this fraction of it, e.g. 0.2
+	// for +/-20%, so that the disks of a backup do not retry in lockstep
+	Jitter float64
+	// Logger, if set, is told about every retry
+	Logger logrus.FieldLogger
+}
+
+// DefaultRetryPolicy is used by virtual_disks and the dumper for connecting,
+// opening and IO. Change it before opening any disk to tune the retries of the
+// whole process.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// NoRetry makes every operation fail on its first error.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// Do calls fn until it succeeds, fails with a fatal error or MaxAttempts is
+// reached, and returns the last error. It stops waiting once ctx is done.
+func (this RetryPolicy) Do(ctx context.Context, op string, fn func() VddkError) VddkError {
+	delay := this.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsTransient(err) || attempt >= this.MaxAttempts {
+			return err
+		}
+		wait := this.jitter(delay)
+		if this.Logger != nil {
+			this.Logger.Warnf("%s failed with transient error code %d, retrying in %v (attempt %d of %d): %s",
+				op, err.VixErrorCode(), wait, attempt, this.MaxAttempts, err.Error())
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay = this.next(delay)
+	}
+}
+
+func (this RetryPolicy) next(delay time.Duration) time.Duration {
+	multiplier := this.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay = time.Duration(float64(delay) * multiplier)
+	if this.MaxDelay > 0 && delay > this.MaxDelay {
+		delay = this.MaxDelay
+	}
+	return delay
+}
+
+func (this RetryPolicy) jitter(delay time.Duration) time.Duration {
+	if this.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration((rand.Float64()*2-1)*this.Jitter*float64(delay))
+}
+
+// Connect is Connect retried under the policy.
+func (this RetryPolicy) Connect(ctx context.Context, appGlobal ConnectParams) (conn VixDiskLibConnection, err VddkError) {
+	err = this.Do(ctx, "Connect", func() VddkError {
+		conn, err = Connect(appGlobal)
+		return err
+	})
+	return conn, err
+}
+
+// ConnectEx is ConnectEx retried under the policy.
+func (this RetryPolicy) ConnectEx(ctx context.Context, appGlobal ConnectParams) (conn VixDiskLibConnection, err VddkError) {
+	err = this.Do(ctx, "ConnectEx", func() VddkError {
+		conn, err = ConnectEx(appGlobal)
+		return err
+	})
+	return conn, err
+}
+
+// PrepareForAccess is PrepareForAccess retried under the policy. EndAccess is
+// run after every transient failure, so that the next attempt starts clean.
+func (this RetryPolicy) PrepareForAccess(ctx context.Context, appGlobal ConnectParams) VddkError {
+	return this.Do(ctx, "PrepareForAccess", func() VddkError {
+		err := PrepareForAccess(appGlobal)
+		if IsTransient(err) {
+			EndAccess(appGlobal)
+		}
+		return err
+	})
+}
+
+// EndAccess is EndAccess retried under the policy.
+func (this RetryPolicy) EndAccess(ctx context.Context, appGlobal ConnectParams) VddkError {
+	return this.Do(ctx, "EndAccess", func() VddkError {
+		return EndAccess(appGlobal)
+	})
+}
+
+// Open is Open retried under the policy.
+func (this RetryPolicy) Open(ctx context.Context, conn VixDiskLibConnection, params ConnectParams) (dli VixDiskLibHandle, err VddkError) {
+	err = this.Do(ctx, "Open", func() VddkError {
+		dli, err = Open(conn, params)
+		return err
+	})
+	return dli, err
+}
+
+// Read is Read retried under the policy.
+func (this RetryPolicy) Read(ctx context.Context, diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	return this.Do(ctx, "Read", func() VddkError {
+		return Read(diskHandle, startSector, numSectors, buf)
+	})
+}
+
+// Write is Write retried under the policy.
+func (this RetryPolicy) Write(ctx context.Context, diskHandle VixDiskLibHandle, startSector uint64, numSectors uint64, buf []byte) VddkError {
+	return this.Do(ctx, "Write", func() VddkError {
+		return Write(diskHandle, startSector, numSectors, buf)
+	})
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption seals backup data with AES-256-GCM. Data is encrypted
+// with a random data key, and the data key is stored wrapped by a key
+// encryption key that a KeyProvider holds: a local key file, or a KMS.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// AlgorithmAESGCM is AES-256-GCM with a random 96-bit nonce per message.
+const AlgorithmAESGCM = "aes-256-gcm"
+
+// KeySize is the size of data keys and key file keys in bytes.
+const KeySize = 32
+
+// ErrDecrypt is returned when sealed data fails authentication: it was
+// changed, or sealed with another key or for another place.
+var ErrDecrypt = errors.New("encryption: message authentication failed")
+
+// KeyProvider wraps and unwraps data keys with a key encryption key that it
+// keeps out of the backup storage.
+type KeyProvider interface {
+	// KeyID names the key encryption key. It is stored next to wrapped keys
+	// so that UnwrapKey can tell a key it does not hold.
+	KeyID() string
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKey returns a random data key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	return key, nil
+}
+
+// Cipher seals and opens messages with one key. It is safe for concurrent use.
+type Cipher struct {
+	aead cipher.AEAD
+	key  []byte
+}
+
+// NewCipher returns a Cipher for a KeySize byte key.
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption: key of %d bytes, expected %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	return &Cipher{aead: aead, key: key}, nil
+}
+
+// Seal encrypts and authenticates plaintext, and authenticates additional,
+// which binds the message to where it is stored. The nonce is prepended to
+// the result.
+func (this *Cipher) Seal(plaintext []byte, additional []byte) ([]byte, error) {
+	nonceSize := this.aead.NonceSize()
+	sealed := make([]byte, nonceSize, nonceSize+len(plaintext)+this.aead.Overhead())
+	_, err := rand.Read(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	return this.aead.Seal(sealed, sealed, plaintext, additional), nil
+}
+
+// Open decrypts a message returned by Seal with the same additional data.
+func (this *Cipher) Open(sealed []byte, additional []byte) ([]byte, error) {
+	nonceSize := this.aead.NonceSize()
+	if len(sealed) < nonceSize+this.aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := this.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// DeriveKey returns a key for purpose derived from the key of the cipher, so
+// that one data key can serve several uses.
+func (this *Cipher) DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, this.key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyFile is a KeyProvider whose key encryption key is read from a local
+// file holding KeySize bytes in hex.
+type KeyFile struct {
+	id     string
+	cipher *Cipher
+}
+
+// GenerateKeyFile writes a new random key to path, which must not exist, and
+// returns it as a KeyFile.
+func GenerateKeyFile(path string) (*KeyFile, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	return newKeyFile(key)
+}
+
+// OpenKeyFile reads the key in path.
+func OpenKeyFile(path string) (*KeyFile, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %s: %v", path, err)
+	}
+	return newKeyFile(key)
+}
+
+func newKeyFile(key []byte) (*KeyFile, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// The ID is a fingerprint of the key, not its path, so the file can move
+	sum := sha256.Sum256(append([]byte("keyfile:"), key...))
+	return &KeyFile{
+		id:     "keyfile:" + hex.EncodeToString(sum[:8]),
+		cipher: c,
+	}, nil
+}
+
+// KeyID returns the fingerprint of the key.
+func (this *KeyFile) KeyID() string {
+	return this.id
+}
+
+// WrapKey encrypts key with the key of the file.
+func (this *KeyFile) WrapKey(key []byte) ([]byte, error) {
+	return this.cipher.Seal(key, []byte(this.id))
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey.
+func (this *KeyFile) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != this.id {
+		return nil, fmt.Errorf("encryption: key %s is not in this key file (%s)", keyID, this.id)
+	}
+	return this.cipher.Open(wrapped, []byte(this.id))
+}
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// KMSClient is the part of a key management service that KMS needs: encrypt
+// and decrypt small secrets with a key that never leaves the service. Clients
+// for a real service implement it on top of its SDK.
+type KMSClient interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// KMS is a KeyProvider that wraps data keys with a key held by a KMS.
+type KMS struct {
+	client KMSClient
+	keyID  string
+}
+
+// NewKMS returns a KeyProvider that wraps data keys with key keyID of client.
+func NewKMS(client KMSClient, keyID string) *KMS {
+	return &KMS{
+		client: client,
+		keyID:  keyID,
+	}
+}
+
+// KeyID returns the ID of the KMS key.
+func (this *KMS) KeyID() string {
+	return this.keyID
+}
+
+// WrapKey has the KMS encrypt key.
+func (this *KMS) WrapKey(key []byte) ([]byte, error) {
+	wrapped, err := this.client.Encrypt(this.keyID, key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: KMS encrypt with %s: %v", this.keyID, err)
+	}
+	return wrapped, nil
+}
+
+// UnwrapKey has the KMS decrypt a key wrapped by WrapKey. keyID may differ
+// from the key of the provider, for example after a key rotation, as long as
+// the KMS still holds it.
+func (this *KMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := this.client.Decrypt(keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: KMS decrypt with %s: %v", keyID, err)
+	}
+	return key, nil
+}
+
+// MemoryKMS is an in-process stand-in for a KMS, for tests and for trying
+// out encryption before a real KMS is wired up. Its keys are lost when the
+// process exits.
+type MemoryKMS struct {
+	mutex sync.Mutex
+	keys  map[string]*Cipher
+}
+
+// NewMemoryKMS returns a MemoryKMS without keys.
+func NewMemoryKMS() *MemoryKMS {
+	return &MemoryKMS{keys: make(map[string]*Cipher)}
+}
+
+// CreateKey adds a random key and returns its ID.
+func (this *MemoryKMS) CreateKey() (string, error) {
+	key, err := NewKey()
+	if err != nil {
+		return "", err
+	}
+	c, err := NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	id := fmt.Sprintf("memory-kms:%d:%s", len(this.keys)+1, hex.EncodeToString(key[:4]))
+	this.keys[id] = c
+	return id, nil
+}
+
+// DeleteKey forgets key keyID; what it wrapped can no longer be unwrapped.
+func (this *MemoryKMS) DeleteKey(keyID string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.keys, keyID)
+}
+
+func (this *MemoryKMS) key(keyID string) (*Cipher, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	c, ok := this.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found", keyID)
+	}
+	return c, nil
+}
+
+// Encrypt seals plaintext with key keyID.
+func (this *MemoryKMS) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	c, err := this.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(plaintext, []byte(keyID))
+}
+
+// Decrypt opens what Encrypt sealed with key keyID.
+func (this *MemoryKMS) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	c, err := this.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(ciphertext, []byte(keyID))
+}
@@ -0,0 +1,396 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client is a minimal NBD client of one export. It negotiates structured
+// replies and the base:allocation context when the server offers them.
+// Requests are sent one at a time; a Client is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	mutex      sync.Mutex
+	cookie     uint64
+	size       int64
+	flags      uint16
+	structured bool
+	allocation bool
+	contextID  uint32
+}
+
+// Dial connects to the NBD server at address and opens export name.
+func Dial(network string, address string, name string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("nbd: %v", err)
+	}
+	return NewClient(conn, name)
+}
+
+// NewClient runs the handshake on conn and opens export name. conn is closed
+// if the handshake fails.
+func NewClient(conn net.Conn, name string) (*Client, error) {
+	this := &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	err := this.negotiate(name)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nbd: %v", err)
+	}
+	return this, nil
+}
+
+func (this *Client) negotiate(name string) error {
+	var hello struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+	if err := binary.Read(this.r, binary.BigEndian, &hello); err != nil {
+		return err
+	}
+	if hello.Magic != nbdMagic || hello.OptMagic != optMagic || hello.Flags&flagFixedNewstyle == 0 {
+		return fmt.Errorf("server does not speak the fixed newstyle handshake")
+	}
+	if err := binary.Write(this.w, binary.BigEndian, uint32(hello.Flags&(flagFixedNewstyle|flagNoZeroes))); err != nil {
+		return err
+	}
+
+	replyType, _, err := this.option(optStructuredReply, nil)
+	if err != nil {
+		return err
+	}
+	this.structured = replyType == repAck
+
+	export := appendString(nil, name)
+	if this.structured {
+		_, listed, err := this.metaContext(optListMetaContext, export)
+		if err != nil {
+			return err
+		}
+		if listed {
+			this.contextID, this.allocation, err = this.metaContext(optSetMetaContext, export)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := this.sendOption(optGo, binary.BigEndian.AppendUint16(export, 0)); err != nil {
+		return err
+	}
+	for {
+		replyType, data, err := this.optionReply(optGo)
+		if err != nil {
+			return err
+		}
+		switch {
+		case replyType == repAck:
+			return nil
+		case replyType == repInfo && len(data) >= 12 && binary.BigEndian.Uint16(data) == infoExport:
+			this.size = int64(binary.BigEndian.Uint64(data[2:]))
+			this.flags = binary.BigEndian.Uint16(data[10:])
+		case replyType&(1<<31) != 0:
+			return fmt.Errorf("export %q: error %#x %s", name, replyType, data)
+		}
+	}
+}
+
+// metaContext sends option, LIST or SET_META_CONTEXT, for AllocationContext on
+// export and returns the id the server gave the context, if it has it. The id
+// in a reply to LIST must be 0.
+func (this *Client) metaContext(option uint32, export []byte) (uint32, bool, error) {
+	data := binary.BigEndian.AppendUint32(append([]byte(nil), export...), 1)
+	if err := this.sendOption(option, appendString(data, AllocationContext)); err != nil {
+		return 0, false, err
+	}
+	var id uint32
+	found := false
+	for {
+		replyType, data, err := this.optionReply(option)
+		if err != nil {
+			return 0, false, err
+		}
+		if replyType != repMetaContext {
+			return id, found, nil
+		}
+		if len(data) < 4 {
+			return 0, false, fmt.Errorf("short meta context reply")
+		}
+		if option == optListMetaContext && binary.BigEndian.Uint32(data) != 0 {
+			return 0, false, fmt.Errorf("meta context %q listed with id %d instead of 0", data[4:], binary.BigEndian.Uint32(data))
+		}
+		if string(data[4:]) == AllocationContext {
+			id = binary.BigEndian.Uint32(data)
+			found = true
+		}
+	}
+}
+
+func (this *Client) sendOption(option uint32, data []byte) error {
+	var header struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}
+	header.Magic = optMagic
+	header.Option = option
+	header.Length = uint32(len(data))
+	binary.Write(this.w, binary.BigEndian, header)
+	this.w.Write(data)
+	return this.w.Flush()
+}
+
+func (this *Client) optionReply(option uint32) (uint32, []byte, error) {
+	var reply optionReply
+	if err := binary.Read(this.r, binary.BigEndian, &reply); err != nil {
+		return 0, nil, err
+	}
+	if reply.Magic != optReplyMagic || reply.Option != option {
+		return 0, nil, fmt.Errorf("bad reply to option %d", option)
+	}
+	if reply.Length > maxOptionLength {
+		return 0, nil, fmt.Errorf("reply of %d bytes to option %d is too long", reply.Length, option)
+	}
+	data, err := readFull(this.r, reply.Length)
+	return reply.Type, data, err
+}
+
+// option sends an option that gets a single reply.
+func (this *Client) option(option uint32, data []byte) (uint32, []byte, error) {
+	if err := this.sendOption(option, data); err != nil {
+		return 0, nil, err
+	}
+	return this.optionReply(option)
+}
+
+// Size is the size of the export in bytes.
+func (this *Client) Size() int64 {
+	return this.size
+}
+
+// ReadOnly reports whether the server refuses writes to the export.
+func (this *Client) ReadOnly() bool {
+	return this.flags&transReadOnly != 0
+}
+
+// NOTE: 发送一个请求并读取回复, onChunk处理结构化回复中的数据块
+func (this *Client) do(cmd uint16, flags uint16, offset int64, length uint32, data []byte, simpleData []byte,
+	onChunk func(replyType uint16, payload []byte) error) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cookie++
+	req := request{
+		Magic:  requestMagic,
+		Flags:  flags,
+		Type:   cmd,
+		Cookie: this.cookie,
+		Offset: uint64(offset),
+		Length: length,
+	}
+	binary.Write(this.w, binary.BigEndian, req)
+	this.w.Write(data)
+	if err := this.w.Flush(); err != nil {
+		return fmt.Errorf("nbd: %v", err)
+	}
+	if cmd == cmdDisc {
+		return nil
+	}
+
+	var replyErr error
+	for {
+		var magic uint32
+		if err := binary.Read(this.r, binary.BigEndian, &magic); err != nil {
+			return fmt.Errorf("nbd: %v", err)
+		}
+		if magic == simpleReplyMagic {
+			var reply struct {
+				Error  uint32
+				Cookie uint64
+			}
+			if err := binary.Read(this.r, binary.BigEndian, &reply); err != nil {
+				return fmt.Errorf("nbd: %v", err)
+			}
+			if reply.Cookie != req.Cookie {
+				return fmt.Errorf("nbd: reply to cookie %d, expected %d", reply.Cookie, req.Cookie)
+			}
+			if reply.Error != 0 {
+				return fmt.Errorf("nbd: command %d failed with error %d", cmd, reply.Error)
+			}
+			if _, err := io.ReadFull(this.r, simpleData); err != nil {
+				return fmt.Errorf("nbd: %v", err)
+			}
+			return nil
+		}
+		if magic != structuredReplyMagic {
+			return fmt.Errorf("nbd: bad reply magic %#x", magic)
+		}
+		var reply struct {
+			Flags  uint16
+			Type   uint16
+			Cookie uint64
+			Length uint32
+		}
+		if err := binary.Read(this.r, binary.BigEndian, &reply); err != nil {
+			return fmt.Errorf("nbd: %v", err)
+		}
+		if reply.Cookie != req.Cookie || reply.Length > MaxRequestLength+8 {
+			return fmt.Errorf("nbd: bad reply to cookie %d", req.Cookie)
+		}
+		payload, err := readFull(this.r, reply.Length)
+		if err != nil {
+			return fmt.Errorf("nbd: %v", err)
+		}
+		switch {
+		case reply.Type == replyTypeNone:
+		case reply.Type&(1<<15) != 0:
+			if len(payload) < 6 {
+				return fmt.Errorf("nbd: truncated error reply")
+			}
+			replyErr = fmt.Errorf("nbd: command %d failed with error %d: %s", cmd, binary.BigEndian.Uint32(payload), payload[6:])
+		case onChunk != nil:
+			if err := onChunk(reply.Type, payload); err != nil && replyErr == nil {
+				replyErr = fmt.Errorf("nbd: %v", err)
+			}
+		default:
+			return fmt.Errorf("nbd: unexpected reply type %d", reply.Type)
+		}
+		if reply.Flags&replyFlagDone != 0 {
+			return replyErr
+		}
+	}
+}
+
+// ReadAt reads len(p) bytes at off, in requests of at most MaxRequestLength.
+func (this *Client) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		count := len(p) - n
+		if count > MaxRequestLength {
+			count = MaxRequestLength
+		}
+		buf := p[n : n+count]
+		start := off + int64(n)
+		err = this.do(cmdRead, 0, start, uint32(count), nil, buf, func(replyType uint16, payload []byte) error {
+			if len(payload) < 8 {
+				return fmt.Errorf("truncated read reply")
+			}
+			at := int64(binary.BigEndian.Uint64(payload)) - start
+			switch replyType {
+			case replyTypeOffsetData:
+				payload = payload[8:]
+				if at < 0 || at+int64(len(payload)) > int64(count) {
+					return fmt.Errorf("read reply out of range")
+				}
+				copy(buf[at:], payload)
+			case replyTypeOffsetHole:
+				if len(payload) < 12 {
+					return fmt.Errorf("truncated read reply")
+				}
+				holeLen := int64(binary.BigEndian.Uint32(payload[8:]))
+				if at < 0 || at+holeLen > int64(count) {
+					return fmt.Errorf("read reply out of range")
+				}
+				for i := range buf[at : at+holeLen] {
+					buf[at+int64(i)] = 0
+				}
+			default:
+				return fmt.Errorf("unexpected read reply type %d", replyType)
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// WriteAt writes p at off, in requests of at most MaxRequestLength.
+func (this *Client) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		count := len(p) - n
+		if count > MaxRequestLength {
+			count = MaxRequestLength
+		}
+		err = this.do(cmdWrite, 0, off+int64(n), uint32(count), p[n:n+count], nil, nil)
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// Flush asks the server to write everything it has acknowledged to stable
+// storage.
+func (this *Client) Flush() error {
+	return this.do(cmdFlush, 0, 0, 0, nil, nil, nil)
+}
+
+// Trim tells the server that the range is no longer needed.
+func (this *Client) Trim(off int64, length int64) error {
+	return this.do(cmdTrim, 0, off, uint32(length), nil, nil, nil)
+}
+
+// BlockStatus returns the allocation of the range starting at off. The
+// extents may cover less than length.
+func (this *Client) BlockStatus(off int64, length uint32) ([]Extent, error) {
+	if !this.allocation {
+		return nil, fmt.Errorf("nbd: server does not offer %s", AllocationContext)
+	}
+	var extents []Extent
+	err := this.do(cmdBlockStatus, 0, off, length, nil, nil, func(replyType uint16, payload []byte) error {
+		if replyType != replyTypeBlockStatus || len(payload) < 4 || binary.BigEndian.Uint32(payload) != this.contextID {
+			return fmt.Errorf("unexpected block status reply")
+		}
+		pos := off
+		for payload = payload[4:]; len(payload) >= 8; payload = payload[8:] {
+			extent := Extent{
+				Offset: pos,
+				Length: int64(binary.BigEndian.Uint32(payload)),
+				Flags:  binary.BigEndian.Uint32(payload[4:]),
+			}
+			extents = append(extents, extent)
+			pos += extent.Length
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// Close disconnects from the server.
+func (this *Client) Close() error {
+	this.do(cmdDisc, 0, 0, 0, nil, nil, nil)
+	return this.conn.Close()
+}
@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nbd serves disks over the Network Block Device protocol, so that
+// Linux nbd-client, qemu-img and qemu-nbd can use a disk opened by this
+// library. Only the fixed newstyle handshake is spoken.
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Magic numbers of the handshake and of the transmission phase
+const (
+	nbdMagic             = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic             = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic        = 0x0003e889045565a9
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// Handshake flags of the server and of the client
+const (
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// Options of the handshake phase
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+	optListMetaContext = 9
+	optSetMetaContext  = 10
+)
+
+// Option reply types
+const (
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repMetaContext = 4
+	repErrUnsup    = 1<<31 | 1
+	repErrInvalid  = 1<<31 | 3
+	repErrUnknown  = 1<<31 | 6
+	repErrTooBig   = 1<<31 | 9
+)
+
+// Information types of repInfo
+const (
+	infoExport    = 0
+	infoName      = 1
+	infoBlockSize = 3
+)
+
+// Transmission flags of an export
+const (
+	transHasFlags  = 1 << 0
+	transReadOnly  = 1 << 1
+	transSendFlush = 1 << 2
+	transSendFUA   = 1 << 3
+	transSendTrim  = 1 << 5
+)
+
+// Commands and command flags
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdBlockStatus = 7
+
+	cmdFlagFUA    = 1 << 0
+	cmdFlagReqOne = 1 << 3
+)
+
+// Structured reply flags and chunk types
+const (
+	replyFlagDone = 1 << 0
+
+	replyTypeNone        = 0
+	replyTypeOffsetData  = 1
+	replyTypeOffsetHole  = 2
+	replyTypeBlockStatus = 5
+	replyTypeError       = 1<<15 | 1
+)
+
+// Error values of replies, the Linux errno values the protocol uses
+const (
+	errPerm     = 1
+	errIO       = 5
+	errInval    = 22
+	errNoSpc    = 28
+	errOverflow = 75
+)
+
+// States of a block status descriptor of the base:allocation context
+const (
+	// StateHole means the extent is not allocated
+	StateHole = 1 << 0
+	// StateZero means the extent reads as zeros
+	StateZero = 1 << 1
+)
+
+// AllocationContext is the only metadata context served, which maps block
+// status to QueryAllocatedBlocks.
+const AllocationContext = "base:allocation"
+
+// allocationContextID is the id the server gives AllocationContext.
+const allocationContextID = 1
+
+// MaxRequestLength is the largest READ or WRITE the server accepts.
+const MaxRequestLength = 32 * 1024 * 1024
+
+// maxOptionLength is the largest option the server reads.
+const maxOptionLength = 64 * 1024
+
+// request is the header of a transmission request.
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Cookie uint64
+	Offset uint64
+	Length uint32
+}
+
+// simpleReply is the header of a simple reply.
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Cookie uint64
+}
+
+// structuredReply is the header of one chunk of a structured reply.
+type structuredReply struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Cookie uint64
+	Length uint32
+}
+
+// optionReply is the header of a reply to an option.
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+// Extent is a run of the disk with the same block status.
+type Extent struct {
+	Offset int64
+	Length int64
+	// Flags is a combination of StateHole and StateZero
+	Flags uint32
+}
+
+func readFull(r io.Reader, n uint32) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// readString reads a string prefixed by its 32 bit length from data.
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint32(len(data)) < n {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,679 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/sirupsen/logrus"
+)
+
+// Disk is what an export serves. DiskReaderWriter and DiskConnectHandle
+// implement it. A disk that also has a Flush() error method is flushed on
+// NBD_CMD_FLUSH and FUA writes, and one with a Trim(off, length int64) error
+// method is trimmed on NBD_CMD_TRIM; otherwise both succeed without doing
+// anything.
+type Disk interface {
+	virtual_disks.DiskSource
+	WriteAt(p []byte, off int64) (n int, err error)
+}
+
+type flusher interface {
+	Flush() error
+}
+
+type trimmer interface {
+	Trim(off int64, length int64) error
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("nbd: server closed")
+
+type export struct {
+	name     string
+	disk     Disk
+	readOnly bool
+}
+
+func (this *export) flags() uint16 {
+	flags := uint16(transHasFlags | transSendFlush | transSendFUA | transSendTrim)
+	if this.readOnly {
+		flags |= transReadOnly
+	}
+	return flags
+}
+
+// Server serves a set of named exports to any number of connections. Block
+// status is only offered through the base:allocation metadata context, which
+// needs structured replies.
+type Server struct {
+	logger logrus.FieldLogger
+
+	mutex     sync.Mutex
+	exports   map[string]*export
+	names     []string
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a server without exports.
+func NewServer(logger logrus.FieldLogger) *Server {
+	return &Server{
+		logger:    logger,
+		exports:   make(map[string]*export),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// AddExport serves disk under name. A client asking for the empty name gets
+// the first export added.
+func (this *Server) AddExport(name string, disk Disk, readOnly bool) error {
+	if len(name) > 4096 {
+		return fmt.Errorf("nbd: export name of %d bytes is too long", len(name))
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.exports[name]; ok {
+		return fmt.Errorf("nbd: export %q already exists", name)
+	}
+	this.exports[name] = &export{name: name, disk: disk, readOnly: readOnly}
+	this.names = append(this.names, name)
+	return nil
+}
+
+func (this *Server) lookup(name string) *export {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	exp, ok := this.exports[name]
+	if !ok && name == "" && len(this.names) > 0 {
+		exp = this.exports[this.names[0]]
+	}
+	return exp
+}
+
+func (this *Server) exportNames() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string(nil), this.names...)
+}
+
+// Serve accepts connections on l and serves each of them in its own
+// goroutine, until Close is called or Accept fails.
+func (this *Server) Serve(l net.Listener) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return ErrServerClosed
+	}
+	this.listeners[l] = true
+	this.mutex.Unlock()
+	defer func() {
+		this.mutex.Lock()
+		delete(this.listeners, l)
+		this.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			this.mutex.Lock()
+			closed := this.closed
+			this.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("nbd: %v", err)
+		}
+		go func() {
+			err := this.ServeConn(conn)
+			if err != nil {
+				this.logger.Warnf("NBD connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn runs the handshake and the transmission phase on conn and closes
+// it when the client disconnects.
+func (this *Server) ServeConn(conn net.Conn) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	this.conns[conn] = true
+	this.wg.Add(1)
+	this.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		this.mutex.Lock()
+		delete(this.conns, conn)
+		this.mutex.Unlock()
+		this.wg.Done()
+	}()
+
+	c := &serverConn{
+		server: this,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+	}
+	exp, err := c.negotiate()
+	if err != nil || exp == nil {
+		return err
+	}
+	this.logger.Infof("NBD export %q opened by %s", exp.name, conn.RemoteAddr())
+	err = c.transmit(exp)
+	this.mutex.Lock()
+	closed := this.closed
+	this.mutex.Unlock()
+	if closed {
+		return nil
+	}
+	return err
+}
+
+// Close stops all listeners and connections and waits for the connections to
+// finish. The disks are left open.
+func (this *Server) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	for l := range this.listeners {
+		l.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+	return nil
+}
+
+type serverConn struct {
+	server     *Server
+	r          *bufio.Reader
+	w          *bufio.Writer
+	noZeroes   bool
+	structured bool
+	// metaExport is the export base:allocation was set for, if it was
+	metaExport *string
+}
+
+// NOTE: 握手阶段, 返回nil export表示客户端放弃了连接
+func (this *serverConn) negotiate() (*export, error) {
+	var hello [18]byte
+	binary.BigEndian.PutUint64(hello[0:], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:], optMagic)
+	binary.BigEndian.PutUint16(hello[16:], flagFixedNewstyle|flagNoZeroes)
+	this.w.Write(hello[:])
+	if err := this.w.Flush(); err != nil {
+		return nil, err
+	}
+	var clientFlags uint32
+	if err := binary.Read(this.r, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+	if clientFlags&flagFixedNewstyle == 0 {
+		return nil, fmt.Errorf("client does not support the fixed newstyle handshake")
+	}
+	this.noZeroes = clientFlags&flagNoZeroes != 0
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(this.r, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		if header.Magic != optMagic {
+			return nil, fmt.Errorf("bad option magic %#x", header.Magic)
+		}
+		if header.Length > maxOptionLength {
+			if _, err := io.CopyN(io.Discard, this.r, int64(header.Length)); err != nil {
+				return nil, err
+			}
+			if err := this.optionReply(header.Option, repErrTooBig, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := readFull(this.r, header.Length)
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Option {
+		case optExportName:
+			exp := this.server.lookup(string(data))
+			if exp == nil {
+				return nil, fmt.Errorf("unknown export %q", data)
+			}
+			reply := binary.BigEndian.AppendUint64(nil, uint64(exp.disk.Capacity()))
+			reply = binary.BigEndian.AppendUint16(reply, exp.flags())
+			if !this.noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			this.w.Write(reply)
+			return exp, this.w.Flush()
+		case optAbort:
+			return nil, this.optionReply(header.Option, repAck, nil)
+		case optList:
+			err = this.list(header.Option, data)
+		case optInfo, optGo:
+			var exp *export
+			exp, err = this.info(header.Option, data)
+			if exp != nil && header.Option == optGo {
+				return exp, err
+			}
+		case optStructuredReply:
+			if len(data) != 0 {
+				err = this.optionReply(header.Option, repErrInvalid, nil)
+				break
+			}
+			this.structured = true
+			err = this.optionReply(header.Option, repAck, nil)
+		case optListMetaContext, optSetMetaContext:
+			err = this.metaContext(header.Option, data)
+		default:
+			err = this.optionReply(header.Option, repErrUnsup, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (this *serverConn) optionReply(option uint32, replyType uint32, data []byte) error {
+	err := binary.Write(this.w, binary.BigEndian, optionReply{
+		Magic:  optReplyMagic,
+		Option: option,
+		Type:   replyType,
+		Length: uint32(len(data)),
+	})
+	if err != nil {
+		return err
+	}
+	this.w.Write(data)
+	return this.w.Flush()
+}
+
+func (this *serverConn) list(option uint32, data []byte) error {
+	if len(data) != 0 {
+		return this.optionReply(option, repErrInvalid, nil)
+	}
+	for _, name := range this.server.exportNames() {
+		if err := this.optionReply(option, repServer, appendString(nil, name)); err != nil {
+			return err
+		}
+	}
+	return this.optionReply(option, repAck, nil)
+}
+
+// info answers NBD_OPT_INFO and NBD_OPT_GO. It returns the export once it has
+// been acknowledged.
+func (this *serverConn) info(option uint32, data []byte) (*export, error) {
+	name, data, err := readString(data)
+	if err != nil || len(data) < 2 || len(data) != 2+2*int(binary.BigEndian.Uint16(data)) {
+		return nil, this.optionReply(option, repErrInvalid, nil)
+	}
+	exp := this.server.lookup(name)
+	if exp == nil {
+		return nil, this.optionReply(option, repErrUnknown, []byte(fmt.Sprintf("unknown export %q", name)))
+	}
+	for i := 2; i < len(data); i += 2 {
+		if binary.BigEndian.Uint16(data[i:]) == infoName {
+			reply := binary.BigEndian.AppendUint16(nil, infoName)
+			if err := this.optionReply(option, repInfo, append(reply, exp.name...)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	reply := binary.BigEndian.AppendUint16(nil, infoBlockSize)
+	reply = binary.BigEndian.AppendUint32(reply, 1)
+	reply = binary.BigEndian.AppendUint32(reply, disklib.VIXDISKLIB_SECTOR_SIZE*disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	reply = binary.BigEndian.AppendUint32(reply, MaxRequestLength)
+	if err := this.optionReply(option, repInfo, reply); err != nil {
+		return nil, err
+	}
+	reply = binary.BigEndian.AppendUint16(nil, infoExport)
+	reply = binary.BigEndian.AppendUint64(reply, uint64(exp.disk.Capacity()))
+	reply = binary.BigEndian.AppendUint16(reply, exp.flags())
+	if err := this.optionReply(option, repInfo, reply); err != nil {
+		return nil, err
+	}
+	if this.metaExport != nil && *this.metaExport != exp.name {
+		this.metaExport = nil
+	}
+	return exp, this.optionReply(option, repAck, nil)
+}
+
+func (this *serverConn) metaContext(option uint32, data []byte) error {
+	if option == optSetMetaContext && !this.structured {
+		return this.optionReply(option, repErrInvalid, []byte("structured replies not negotiated"))
+	}
+	name, data, err := readString(data)
+	if err != nil || len(data) < 4 {
+		return this.optionReply(option, repErrInvalid, nil)
+	}
+	numQueries := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	var queries []string
+	for i := uint32(0); i < numQueries; i++ {
+		var query string
+		query, data, err = readString(data)
+		if err != nil {
+			return this.optionReply(option, repErrInvalid, nil)
+		}
+		queries = append(queries, query)
+	}
+	exp := this.server.lookup(name)
+	if exp == nil {
+		return this.optionReply(option, repErrUnknown, nil)
+	}
+
+	matched := false
+	if option == optListMetaContext && len(queries) == 0 {
+		matched = true
+	}
+	for _, query := range queries {
+		if query == AllocationContext || (option == optListMetaContext && query == "base:") {
+			matched = true
+		}
+	}
+	if option == optSetMetaContext {
+		this.metaExport = nil
+		if matched {
+			this.metaExport = &exp.name
+		}
+	}
+	if matched {
+		// NOTE: LIST的回复中context id必须为0, 只有SET才分配真实的id
+		var id uint32
+		if option == optSetMetaContext {
+			id = allocationContextID
+		}
+		reply := binary.BigEndian.AppendUint32(nil, id)
+		if err := this.optionReply(option, repMetaContext, append(reply, AllocationContext...)); err != nil {
+			return err
+		}
+	}
+	return this.optionReply(option, repAck, nil)
+}
+
+// NOTE: 传输阶段, 请求按顺序处理, 每个请求处理完再读下一个
+func (this *serverConn) transmit(exp *export) error {
+	size := exp.disk.Capacity()
+	for {
+		var req request
+		if err := binary.Read(this.r, binary.BigEndian, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != requestMagic {
+			return fmt.Errorf("bad request magic %#x", req.Magic)
+		}
+		offset := int64(req.Offset)
+		length := int64(req.Length)
+		inRange := offset >= 0 && offset <= size && length <= size-offset
+
+		var err error
+		switch req.Type {
+		case cmdRead:
+			if !inRange || length > MaxRequestLength {
+				err = this.replyError(req, errInval, "read out of range")
+				break
+			}
+			err = this.read(exp, req)
+		case cmdWrite:
+			if length > MaxRequestLength {
+				if _, err = io.CopyN(io.Discard, this.r, length); err == nil {
+					err = this.replyError(req, errOverflow, "write too long")
+				}
+				break
+			}
+			var data []byte
+			data, err = readFull(this.r, req.Length)
+			if err != nil {
+				return err
+			}
+			switch {
+			case exp.readOnly:
+				err = this.replyError(req, errPerm, "export is read only")
+			case !inRange:
+				err = this.replyError(req, errNoSpc, "write out of range")
+			default:
+				err = this.write(exp, req, data)
+			}
+		case cmdDisc:
+			return this.w.Flush()
+		case cmdFlush:
+			err = this.flush(exp, req)
+		case cmdTrim:
+			switch {
+			case exp.readOnly:
+				err = this.replyError(req, errPerm, "export is read only")
+			case !inRange:
+				err = this.replyError(req, errInval, "trim out of range")
+			default:
+				err = this.trim(exp, req)
+			}
+		case cmdBlockStatus:
+			switch {
+			case this.metaExport == nil:
+				err = this.replyError(req, errInval, "no metadata context set")
+			case !inRange || length == 0:
+				err = this.replyError(req, errInval, "block status out of range")
+			default:
+				err = this.blockStatus(exp, req)
+			}
+		default:
+			err = this.replyError(req, errInval, fmt.Sprintf("unknown command %d", req.Type))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (this *serverConn) read(exp *export, req request) error {
+	data := make([]byte, req.Length)
+	_, err := exp.disk.ReadAt(data, int64(req.Offset))
+	if err != nil && err != io.EOF {
+		this.server.logger.Errorf("NBD read of %d bytes at %d from %q failed: %v", req.Length, req.Offset, exp.name, err)
+		return this.replyError(req, errIO, err.Error())
+	}
+	if !this.structured {
+		return this.simpleReply(req, 0, data)
+	}
+	payload := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(data)), req.Offset)
+	return this.chunk(req, replyFlagDone, replyTypeOffsetData, append(payload, data...))
+}
+
+func (this *serverConn) write(exp *export, req request, data []byte) error {
+	_, err := exp.disk.WriteAt(data, int64(req.Offset))
+	if err == nil && req.Flags&cmdFlagFUA != 0 {
+		err = flushDisk(exp.disk)
+	}
+	if err != nil {
+		this.server.logger.Errorf("NBD write of %d bytes at %d to %q failed: %v", req.Length, req.Offset, exp.name, err)
+		return this.replyError(req, errIO, err.Error())
+	}
+	return this.replyOK(req)
+}
+
+func flushDisk(disk Disk) error {
+	if f, ok := disk.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (this *serverConn) flush(exp *export, req request) error {
+	if err := flushDisk(exp.disk); err != nil {
+		return this.replyError(req, errIO, err.Error())
+	}
+	return this.replyOK(req)
+}
+
+func (this *serverConn) trim(exp *export, req request) error {
+	if t, ok := exp.disk.(trimmer); ok {
+		if err := t.Trim(int64(req.Offset), int64(req.Length)); err != nil {
+			return this.replyError(req, errIO, err.Error())
+		}
+	}
+	return this.replyOK(req)
+}
+
+func (this *serverConn) blockStatus(exp *export, req request) error {
+	extents := allocationExtents(exp.disk, int64(req.Offset), int64(req.Length), this.server.logger)
+	if req.Flags&cmdFlagReqOne != 0 {
+		extents = extents[:1]
+	}
+	payload := binary.BigEndian.AppendUint32(make([]byte, 0, 4+8*len(extents)), allocationContextID)
+	for _, extent := range extents {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(extent.Length))
+		payload = binary.BigEndian.AppendUint32(payload, extent.Flags)
+	}
+	return this.chunk(req, replyFlagDone, replyTypeBlockStatus, payload)
+}
+
+// allocationExtents maps QueryAllocatedBlocks of the chunks around
+// [offset, offset+length) to extents covering exactly that range. Chunks that
+// are not allocated read as zeros. The tail of the disk that is not a whole
+// chunk, and everything when the query fails, is reported allocated.
+func allocationExtents(disk Disk, offset int64, length int64, logger logrus.FieldLogger) []Extent {
+	const chunkSize = disklib.VIXDISKLIB_MIN_CHUNK_SIZE
+	const chunkBytes = chunkSize * disklib.VIXDISKLIB_SECTOR_SIZE
+	end := offset + length
+	numChunks := disklib.VixDiskLibSectorType(disk.Capacity() / chunkBytes)
+	firstChunk := disklib.VixDiskLibSectorType(offset / chunkBytes)
+	lastChunk := disklib.VixDiskLibSectorType((end + chunkBytes - 1) / chunkBytes)
+	if lastChunk > numChunks {
+		lastChunk = numChunks
+	}
+
+	var allocated []Extent
+	for chunk := firstChunk; chunk < lastChunk; {
+		count := lastChunk - chunk
+		if count > disklib.VIXDISKLIB_MAX_CHUNK_NUMBER {
+			count = disklib.VIXDISKLIB_MAX_CHUNK_NUMBER
+		}
+		blocks, vErr := disk.QueryAllocatedBlocks(chunk*chunkSize, count*chunkSize, chunkSize)
+		if vErr != nil {
+			logger.Warnf("QueryAllocatedBlocks failed, reporting everything allocated: %s", vErr.Error())
+			return []Extent{{Offset: offset, Length: length}}
+		}
+		for _, block := range blocks {
+			allocated = append(allocated, Extent{
+				Offset: int64(block.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE,
+				Length: int64(block.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE,
+			})
+		}
+		chunk += count
+	}
+	if tail := int64(numChunks) * chunkBytes; tail < end {
+		allocated = append(allocated, Extent{Offset: tail, Length: end - tail})
+	}
+
+	var extents []Extent
+	add := func(start int64, stop int64, flags uint32) {
+		if start < offset {
+			start = offset
+		}
+		if stop > end {
+			stop = end
+		}
+		if start >= stop {
+			return
+		}
+		last := len(extents) - 1
+		if last >= 0 && extents[last].Flags == flags && extents[last].Offset+extents[last].Length == start {
+			extents[last].Length += stop - start
+			return
+		}
+		extents = append(extents, Extent{Offset: start, Length: stop - start, Flags: flags})
+	}
+	pos := offset
+	for _, extent := range allocated {
+		add(pos, extent.Offset, StateHole|StateZero)
+		add(extent.Offset, extent.Offset+extent.Length, 0)
+		if extent.Offset+extent.Length > pos {
+			pos = extent.Offset + extent.Length
+		}
+	}
+	add(pos, end, StateHole|StateZero)
+	return extents
+}
+
+func (this *serverConn) replyOK(req request) error {
+	if this.structured {
+		return this.chunk(req, replyFlagDone, replyTypeNone, nil)
+	}
+	return this.simpleReply(req, 0, nil)
+}
+
+func (this *serverConn) replyError(req request, errno uint32, msg string) error {
+	if this.structured {
+		payload := binary.BigEndian.AppendUint32(nil, errno)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(msg)))
+		return this.chunk(req, replyFlagDone, replyTypeError, append(payload, msg...))
+	}
+	return this.simpleReply(req, errno, nil)
+}
+
+func (this *serverConn) simpleReply(req request, errno uint32, data []byte) error {
+	err := binary.Write(this.w, binary.BigEndian, simpleReply{
+		Magic:  simpleReplyMagic,
+		Error:  errno,
+		Cookie: req.Cookie,
+	})
+	if err != nil {
+		return err
+	}
+	this.w.Write(data)
+	return this.w.Flush()
+}
+
+func (this *serverConn) chunk(req request, flags uint16, replyType uint16, payload []byte) error {
+	err := binary.Write(this.w, binary.BigEndian, structuredReply{
+		Magic:  structuredReplyMagic,
+		Flags:  flags,
+		Type:   replyType,
+		Cookie: req.Cookie,
+		Length: uint32(len(payload)),
+	})
+	if err != nil {
+		return err
+	}
+	this.w.Write(payload)
+	return this.w.Flush()
+}
@@ -0,0 +1,321 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package qcow2 writes disks as qcow2 version 3 images, the native format of
+// QEMU and KVM.
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// Magic is the first four bytes of a qcow2 image, "QFI\xfb".
+const Magic = 0x514649fb
+
+// Version is the version of the images written.
+const Version = 3
+
+// DefaultClusterBits gives the 64KB clusters qemu-img uses by default.
+const DefaultClusterBits = 16
+
+// refcountOrder gives 16 bit refcounts, the only width before version 3.
+const refcountOrder = 4
+
+// headerLength is the size of the version 3 header without extensions.
+const headerLength = 104
+
+// Flags of L1 and L2 entries
+const (
+	// FlagCopied marks a cluster whose refcount is exactly one
+	FlagCopied = 1 << 63
+	// FlagZero marks an L2 entry whose cluster reads as zeros
+	FlagZero = 1 << 0
+	// OffsetMask selects the host offset of an L1 or L2 entry
+	OffsetMask = 0x00fffffffffffe00
+)
+
+// Header is the version 3 qcow2 header, big endian on disk.
+type Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// Writer writes a qcow2 image to an io.WriterAt in a single pass. Clusters
+// must be written in increasing order; each L2 table is written once the
+// writer has moved past the clusters it maps, and the refcounts, which are
+// one for every cluster of the image, are appended by Close.
+//
+// The image is laid out as the header, the L1 table, then data clusters and
+// L2 tables in the order they are needed, then the refcount blocks and the
+// refcount table.
+type Writer struct {
+	w           io.WriterAt
+	header      Header
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+	l2          []uint64
+	l2Index     int64
+	next        int64 // offset of the next free cluster
+	nextCluster int64 // the lowest guest cluster that may be written
+	closed      bool
+}
+
+// NewWriter starts an image of size bytes on w.
+func NewWriter(w io.WriterAt, size int64) (*Writer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("qcow2: invalid size %d", size)
+	}
+	clusterSize := int64(1) << DefaultClusterBits
+	l2Entries := clusterSize / 8
+	l1Size := (size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	l1Clusters := (l1Size*8 + clusterSize - 1) / clusterSize
+	this := &Writer{
+		w: w,
+		header: Header{
+			Magic:         Magic,
+			Version:       Version,
+			ClusterBits:   DefaultClusterBits,
+			Size:          uint64(size),
+			L1Size:        uint32(l1Size),
+			L1TableOffset: uint64(clusterSize),
+			RefcountOrder: refcountOrder,
+			HeaderLength:  headerLength,
+		},
+		clusterSize: clusterSize,
+		l2Entries:   l2Entries,
+		l1:          make([]uint64, l1Size),
+		l2Index:     -1,
+		next:        (1 + l1Clusters) * clusterSize,
+	}
+	return this, nil
+}
+
+// ClusterSize is the size of the clusters of the image in bytes.
+func (this *Writer) ClusterSize() int64 {
+	return this.clusterSize
+}
+
+// WriteCluster stores p as the guest cluster at off, which must be cluster
+// aligned and past every cluster written before. p may be shorter than a
+// cluster only for the last cluster of the disk.
+func (this *Writer) WriteCluster(off int64, p []byte) error {
+	if this.closed {
+		return fmt.Errorf("qcow2: writer is closed")
+	}
+	if off%this.clusterSize != 0 || off < 0 || off >= int64(this.header.Size) || int64(len(p)) > this.clusterSize {
+		return fmt.Errorf("qcow2: invalid cluster write of %d bytes at %d", len(p), off)
+	}
+	cluster, err := this.startCluster(off)
+	if err != nil {
+		return err
+	}
+	if int64(len(p)) < this.clusterSize {
+		padded := make([]byte, this.clusterSize)
+		copy(padded, p)
+		p = padded
+	}
+	if _, err := this.w.WriteAt(p, this.next); err != nil {
+		return fmt.Errorf("qcow2: %v", err)
+	}
+	this.l2[cluster%this.l2Entries] = uint64(this.next) | FlagCopied
+	this.next += this.clusterSize
+	return nil
+}
+
+// WriteZeroCluster records the guest cluster at off as reading zeros, without
+// storing any data for it. The ordering rules of WriteCluster apply.
+func (this *Writer) WriteZeroCluster(off int64) error {
+	if this.closed {
+		return fmt.Errorf("qcow2: writer is closed")
+	}
+	if off%this.clusterSize != 0 || off < 0 || off >= int64(this.header.Size) {
+		return fmt.Errorf("qcow2: invalid zero cluster at %d", off)
+	}
+	cluster, err := this.startCluster(off)
+	if err != nil {
+		return err
+	}
+	this.l2[cluster%this.l2Entries] = FlagZero
+	return nil
+}
+
+// startCluster checks the order of a write to the cluster at off and makes
+// sure the L2 table that maps it is loaded.
+func (this *Writer) startCluster(off int64) (int64, error) {
+	cluster := off / this.clusterSize
+	if cluster < this.nextCluster {
+		return 0, fmt.Errorf("qcow2: cluster %d written out of order", cluster)
+	}
+	l2Index := cluster / this.l2Entries
+	if l2Index != this.l2Index {
+		if err := this.flushL2(); err != nil {
+			return 0, err
+		}
+		this.l2Index = l2Index
+		this.l2 = make([]uint64, this.l2Entries)
+		this.l1[l2Index] = uint64(this.next) | FlagCopied
+		this.next += this.clusterSize
+	}
+	this.nextCluster = cluster + 1
+	return cluster, nil
+}
+
+func (this *Writer) flushL2() error {
+	if this.l2Index < 0 {
+		return nil
+	}
+	buf := make([]byte, this.clusterSize)
+	for i, entry := range this.l2 {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	if _, err := this.w.WriteAt(buf, int64(this.l1[this.l2Index]&OffsetMask)); err != nil {
+		return fmt.Errorf("qcow2: %v", err)
+	}
+	return nil
+}
+
+// Close writes the last L2 table, the L1 table, the refcounts and the header.
+func (this *Writer) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	if err := this.flushL2(); err != nil {
+		return err
+	}
+	l1 := make([]byte, len(this.l1)*8)
+	for i, entry := range this.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], entry)
+	}
+	if _, err := this.w.WriteAt(l1, int64(this.header.L1TableOffset)); err != nil {
+		return fmt.Errorf("qcow2: %v", err)
+	}
+
+	// NOTE: 引用计数块和引用计数表本身也要计数, 迭代到块数不再变化为止
+	entriesPerBlock := this.clusterSize * 8 / (1 << refcountOrder)
+	dataClusters := this.next / this.clusterSize
+	var blocks, tableClusters int64
+	for {
+		total := dataClusters + blocks + tableClusters
+		newBlocks := (total + entriesPerBlock - 1) / entriesPerBlock
+		newTableClusters := (newBlocks*8 + this.clusterSize - 1) / this.clusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	total := dataClusters + blocks + tableClusters
+	table := make([]byte, tableClusters*this.clusterSize)
+	block := make([]byte, this.clusterSize)
+	for i := int64(0); i < blocks; i++ {
+		for j := int64(0); j < entriesPerBlock; j++ {
+			var refcount uint16
+			if i*entriesPerBlock+j < total {
+				refcount = 1
+			}
+			binary.BigEndian.PutUint16(block[j*2:], refcount)
+		}
+		offset := this.next + i*this.clusterSize
+		if _, err := this.w.WriteAt(block, offset); err != nil {
+			return fmt.Errorf("qcow2: %v", err)
+		}
+		binary.BigEndian.PutUint64(table[i*8:], uint64(offset))
+	}
+	this.header.RefcountTableOffset = uint64(this.next + blocks*this.clusterSize)
+	this.header.RefcountTableClusters = uint32(tableClusters)
+	if _, err := this.w.WriteAt(table, int64(this.header.RefcountTableOffset)); err != nil {
+		return fmt.Errorf("qcow2: %v", err)
+	}
+
+	// The header is followed by the end of header extensions, eight zero bytes
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, this.header)
+	header.Write(make([]byte, 8))
+	if _, err := this.w.WriteAt(header.Bytes(), 0); err != nil {
+		return fmt.Errorf("qcow2: %v", err)
+	}
+	return nil
+}
+
+// Export writes the allocated clusters of src to w as a qcow2 image. Clusters
+// that QueryAllocatedBlocks does not report are left out and read as zeros;
+// allocated clusters that hold only zeros are recorded as zero clusters,
+// without data.
+func Export(w io.WriterAt, src virtual_disks.DiskSource) error {
+	q, err := NewWriter(w, src.Capacity())
+	if err != nil {
+		return err
+	}
+	clusterSize := q.ClusterSize()
+	extents, vErr := virtual_disks.QueryAllocatedExtents(src, disklib.VixDiskLibSectorType(clusterSize/disklib.VIXDISKLIB_SECTOR_SIZE))
+	if vErr != nil {
+		return vErr
+	}
+
+	buf := make([]byte, clusterSize)
+	next := int64(0)
+	for _, extent := range extents {
+		start := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		off := start / clusterSize * clusterSize
+		if off < next {
+			off = next
+		}
+		for ; off < end && off < src.Capacity(); off += clusterSize {
+			p := buf
+			if src.Capacity()-off < clusterSize {
+				p = buf[:src.Capacity()-off]
+			}
+			_, err := src.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ReadAt(%d): %v", off, err)
+			}
+			if virtual_disks.IsZero(p) {
+				err = q.WriteZeroCluster(off)
+			} else {
+				err = q.WriteCluster(off, p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		next = off
+	}
+	return q.Close()
+}
@@ -0,0 +1,379 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// Stats counts the chunks a backup writer stored and the ones it found
+// already in the store. StoredBytes is what the new chunks take in the store
+// after compression.
+type Stats struct {
+	NewChunks    int
+	NewBytes     int64
+	StoredBytes  int64
+	ReusedChunks int
+	ReusedBytes  int64
+}
+
+// BackupWriter receives the extents of a new backup and stores them as chunks.
+// It is an io.WriterAt, so it can be the target of a disk copy, and is safe
+// for concurrent use.
+type BackupWriter struct {
+	repo     *Repository
+	manifest Manifest
+	mutex    sync.Mutex
+	stats    Stats
+	done     bool
+}
+
+// NewBackup starts a new backup. The geometry, metadata, changeIds and parent
+// are taken from m; its ID, Created and Extents are filled in by the writer.
+func (r *Repository) NewBackup(m Manifest) (*BackupWriter, error) {
+	if m.Parent != "" {
+		parent, err := r.Manifest(m.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if parent.Capacity != m.Capacity {
+			return nil, fmt.Errorf("repository: capacity %d does not match %d of parent %s", m.Capacity, parent.Capacity, m.Parent)
+		}
+	}
+	id, err := newBackupID()
+	if err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+	err = os.Mkdir(r.backupDir(id), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+
+	m.Version = ManifestVersion
+	m.ID = id
+	m.Extents = nil
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]string)
+	}
+	return &BackupWriter{
+		repo:     r,
+		manifest: m,
+	}, nil
+}
+
+// ID returns the ID of the backup being written.
+func (w *BackupWriter) ID() string {
+	return w.manifest.ID
+}
+
+// Stats returns what the writer has stored so far.
+func (w *BackupWriter) Stats() Stats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.stats
+}
+
+// WriteAt stores p as the disk bytes at off. Extents written to the same
+// backup must not overlap.
+func (w *BackupWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > w.manifest.DiskSize() {
+		return 0, fmt.Errorf("repository: write of %d bytes at %d is past the end of the disk", len(p), off)
+	}
+	if w.isDone() {
+		return 0, fmt.Errorf("repository: backup %s is closed", w.manifest.ID)
+	}
+
+	var stats Stats
+	extent := Extent{Offset: off, Length: int64(len(p))}
+	pos := 0
+	for _, length := range w.repo.config.Chunking.split(p, off) {
+		chunk := p[pos : pos+length]
+		hash := w.repo.chunks.hash(chunk)
+		compression, stored, written, err := w.repo.chunks.put(hash, chunk, w.repo.codec)
+		if err != nil {
+			return pos, err
+		}
+		if written {
+			stats.NewChunks++
+			stats.NewBytes += int64(length)
+			stats.StoredBytes += stored
+		} else {
+			stats.ReusedChunks++
+			stats.ReusedBytes += int64(length)
+		}
+		extent.Chunks = append(extent.Chunks, ChunkRef{Hash: hash, Length: int64(length), Compression: compression})
+		pos += length
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done {
+		return 0, fmt.Errorf("repository: backup %s is closed", w.manifest.ID)
+	}
+	w.stats.NewChunks += stats.NewChunks
+	w.stats.NewBytes += stats.NewBytes
+	w.stats.StoredBytes += stats.StoredBytes
+	w.stats.ReusedChunks += stats.ReusedChunks
+	w.stats.ReusedBytes += stats.ReusedBytes
+	extents := w.manifest.Extents
+	last := len(extents) - 1
+	if last >= 0 && extents[last].End() == off {
+		extents[last].Length += extent.Length
+		extents[last].Chunks = append(extents[last].Chunks, extent.Chunks...)
+	} else {
+		w.manifest.Extents = append(extents, extent)
+	}
+	return len(p), nil
+}
+
+func (w *BackupWriter) isDone() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.done
+}
+
+// Commit sorts the extents and writes the manifest. The backup is only listed
+// once Commit has succeeded.
+func (w *BackupWriter) Commit() (*Manifest, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done {
+		return nil, fmt.Errorf("repository: backup %s is closed", w.manifest.ID)
+	}
+	w.done = true
+
+	extents := w.manifest.Extents
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].Offset < extents[j].Offset
+	})
+	for i := 1; i < len(extents); i++ {
+		if extents[i].Offset < extents[i-1].End() {
+			w.abort()
+			return nil, fmt.Errorf("repository: extents at %d and %d overlap", extents[i-1].Offset, extents[i].Offset)
+		}
+	}
+
+	w.manifest.Created = time.Now().UTC()
+	err := w.repo.writeManifest(&w.manifest)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	m := w.manifest
+	return &m, nil
+}
+
+// Abort throws the backup away. It does nothing after Commit. Chunks that
+// were stored for it stay in the store until Prune.
+func (w *BackupWriter) Abort() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done {
+		return
+	}
+	w.done = true
+	w.abort()
+}
+
+func (w *BackupWriter) abort() {
+	os.RemoveAll(w.repo.backupDir(w.manifest.ID))
+}
+
+// BackupDisk stores the allocated extents of src as a new backup described by
+// m, reading one chunk size aligned MB at a time. It works for any opened disk,
+// for example a DiskReaderWriter.
+func (r *Repository) BackupDisk(src virtual_disks.DiskSource, m Manifest) (*Manifest, *Stats, error) {
+	extents, vErr := virtual_disks.QueryAllocatedExtents(src, backupChunkSectors)
+	if vErr != nil {
+		return nil, nil, vErr
+	}
+	bw, err := r.NewBackup(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, backupChunkSectors*disklib.VIXDISKLIB_SECTOR_SIZE)
+	for _, extent := range extents {
+		off := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		for off < end {
+			n := int64(len(buf))
+			if end-off < n {
+				n = end - off
+			}
+			_, err = src.ReadAt(buf[:n], off)
+			if err == nil {
+				_, err = bw.WriteAt(buf[:n], off)
+			}
+			if err != nil {
+				bw.Abort()
+				return nil, nil, fmt.Errorf("repository: backup at %d: %v", off, err)
+			}
+			off += n
+		}
+	}
+	stats := bw.Stats()
+	manifest, err := bw.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, &stats, nil
+}
+
+// backupChunkSectors is the granularity BackupDisk queries and reads in.
+const backupChunkSectors = 2048
+
+// Backup is a committed backup opened for reading. It reads as the disk with
+// every byte outside its extents set to zero, and implements
+// virtual_disks.DiskSource so that it can be exported or copied like a disk.
+type Backup struct {
+	repo     *Repository
+	manifest *Manifest
+	// chunkOffsets[i][j] is the offset of chunk j of extent i in the extent
+	chunkOffsets [][]int64
+	mutex        sync.Mutex
+	cachedHash   string
+	cachedChunk  []byte
+}
+
+// OpenBackup opens backup id for reading.
+func (r *Repository) OpenBackup(id string) (*Backup, error) {
+	m, err := r.Manifest(id)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{
+		repo:         r,
+		manifest:     m,
+		chunkOffsets: make([][]int64, len(m.Extents)),
+	}
+	for i, extent := range m.Extents {
+		var off int64
+		b.chunkOffsets[i] = make([]int64, len(extent.Chunks))
+		for j, chunk := range extent.Chunks {
+			b.chunkOffsets[i][j] = off
+			off += chunk.Length
+		}
+		if off != extent.Length {
+			return nil, fmt.Errorf("repository: backup %s: chunks of extent at %d hold %d bytes, expected %d", id, extent.Offset, off, extent.Length)
+		}
+	}
+	return b, nil
+}
+
+// Manifest returns the manifest of the backup.
+func (b *Backup) Manifest() *Manifest {
+	return b.manifest
+}
+
+// Capacity returns the size of the disk in bytes.
+func (b *Backup) Capacity() int64 {
+	return b.manifest.DiskSize()
+}
+
+// chunk returns the content of a chunk, keeping the last one read since disk
+// reads are usually smaller than chunks.
+func (b *Backup) chunk(ref ChunkRef) ([]byte, error) {
+	b.mutex.Lock()
+	if b.cachedHash == ref.Hash {
+		chunk := b.cachedChunk
+		b.mutex.Unlock()
+		return chunk, nil
+	}
+	b.mutex.Unlock()
+
+	chunk, err := b.repo.chunks.get(ref)
+	if err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	b.cachedHash = ref.Hash
+	b.cachedChunk = chunk
+	b.mutex.Unlock()
+	return chunk, nil
+}
+
+// ReadAt reads the disk bytes at off. Bytes the backup does not hold read as
+// zeros.
+func (b *Backup) ReadAt(p []byte, off int64) (n int, err error) {
+	capacity := b.Capacity()
+	if off >= capacity {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > capacity {
+		p = p[:capacity-off]
+		err = io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	end := off + int64(len(p))
+	extents := b.manifest.Extents
+	for i := findExtent(extents, off); i < len(extents) && extents[i].Offset < end; i++ {
+		extent := extents[i]
+		offsets := b.chunkOffsets[i]
+		// First chunk that ends past off
+		j := sort.Search(len(offsets), func(j int) bool {
+			return extent.Offset+offsets[j]+extent.Chunks[j].Length > off
+		})
+		for ; j < len(offsets) && extent.Offset+offsets[j] < end; j++ {
+			chunk, readErr := b.chunk(extent.Chunks[j])
+			if readErr != nil {
+				return 0, fmt.Errorf("repository: backup %s: %v", b.manifest.ID, readErr)
+			}
+			chunkStart := extent.Offset + offsets[j]
+			start := chunkStart
+			if start < off {
+				start = off
+			}
+			stop := chunkStart + int64(len(chunk))
+			if stop > end {
+				stop = end
+			}
+			copy(p[start-off:stop-off], chunk[start-chunkStart:stop-chunkStart])
+		}
+	}
+	return len(p), err
+}
+
+// QueryAllocatedBlocks reports the chunks that overlap an extent of the backup.
+func (b *Backup) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	extents := b.manifest.Extents
+	return virtual_disks.AllocatedBlocks(b.manifest.Capacity, startSector, numSectors, chunkSize, func(start disklib.VixDiskLibSectorType, length disklib.VixDiskLibSectorType) bool {
+		off := int64(start) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(start+length) * disklib.VIXDISKLIB_SECTOR_SIZE
+		i := findExtent(extents, off)
+		return i < len(extents) && extents[i].Offset < end
+	})
+}
+
+// Close releases the backup. The chunk files are opened per read, so there is
+// nothing to flush.
+func (b *Backup) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cachedHash = ""
+	b.cachedChunk = nil
+	return nil
+}
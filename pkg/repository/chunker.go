@@ -0,0 +1,150 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Chunking modes
+const (
+	// ChunkingFixed cuts chunks at multiples of ChunkSize on the disk, so that
+	// the same aligned block dedups no matter which backup it is in.
+	ChunkingFixed = "fixed"
+	// ChunkingCDC cuts chunks where a rolling gear hash of the content says
+	// so, so that data that moved on the disk still dedups.
+	ChunkingCDC = "cdc"
+)
+
+// Default chunk sizes
+const (
+	DefaultChunkSize    = 256 * 1024
+	DefaultMinChunkSize = 64 * 1024
+	DefaultMaxChunkSize = 1024 * 1024
+)
+
+// Chunking configures how backup data is cut into chunks. For ChunkingCDC, a
+// cut point is expected every ChunkSize bytes past MinChunkSize, and ChunkSize
+// must be a power of two.
+type Chunking struct {
+	Mode         string `json:"mode"`
+	ChunkSize    int    `json:"chunkSize"`
+	MinChunkSize int    `json:"minChunkSize,omitempty"`
+	MaxChunkSize int    `json:"maxChunkSize,omitempty"`
+}
+
+func (c Chunking) withDefaults() Chunking {
+	if c.Mode == "" {
+		c.Mode = ChunkingFixed
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+	if c.Mode == ChunkingCDC {
+		if c.MinChunkSize == 0 {
+			c.MinChunkSize = c.ChunkSize / 4
+		}
+		if c.MaxChunkSize == 0 {
+			c.MaxChunkSize = c.ChunkSize * 4
+		}
+	}
+	return c
+}
+
+func (c Chunking) validate() error {
+	switch c.Mode {
+	case ChunkingFixed:
+		if c.ChunkSize <= 0 {
+			return fmt.Errorf("repository: invalid chunk size %d", c.ChunkSize)
+		}
+	case ChunkingCDC:
+		if c.ChunkSize <= 0 || c.ChunkSize&(c.ChunkSize-1) != 0 {
+			return fmt.Errorf("repository: average chunk size %d is not a power of two", c.ChunkSize)
+		}
+		if c.MinChunkSize <= 0 || c.MinChunkSize > c.ChunkSize || c.MaxChunkSize < c.ChunkSize {
+			return fmt.Errorf("repository: invalid chunk sizes %d <= %d <= %d", c.MinChunkSize, c.ChunkSize, c.MaxChunkSize)
+		}
+	default:
+		return fmt.Errorf("repository: unknown chunking mode %q", c.Mode)
+	}
+	return nil
+}
+
+// split returns the lengths of the chunks that p, the disk bytes at off, is
+// cut into.
+func (c Chunking) split(p []byte, off int64) []int {
+	var lengths []int
+	if c.Mode == ChunkingFixed {
+		size := int64(c.ChunkSize)
+		for len(p) > 0 {
+			n := int(size - off%size)
+			if n > len(p) {
+				n = len(p)
+			}
+			lengths = append(lengths, n)
+			p = p[n:]
+			off += int64(n)
+		}
+		return lengths
+	}
+
+	// The top bits of the gear hash depend on the last 64 bytes, the low bits
+	// only on the last few
+	maskBits := uint(bits.TrailingZeros(uint(c.ChunkSize)))
+	mask := (uint64(1)<<maskBits - 1) << (64 - maskBits)
+	for len(p) > 0 {
+		n := cdcCut(p, c.MinChunkSize, c.MaxChunkSize, mask)
+		lengths = append(lengths, n)
+		p = p[n:]
+	}
+	return lengths
+}
+
+// cdcCut returns the length of the next content defined chunk of p.
+func cdcCut(p []byte, min int, max int, mask uint64) int {
+	if len(p) <= min {
+		return len(p)
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+	var hash uint64
+	for i := min; i < len(p); i++ {
+		hash = (hash << 1) + gearTable[p[i]]
+		if hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(p)
+}
+
+// gearTable holds the random values of the gear hash. They are derived from a
+// fixed seed with splitmix64 and must never change, or chunks cut before the
+// change stop matching those cut after it.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5ca1ab1e0ddba11)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+// ManifestVersion is the version of the manifest format written by this package.
+const ManifestVersion = 1
+
+// ChunkRef names a chunk in the chunk store of the repository. Length is the
+// uncompressed length and Compression the algorithm the chunk is stored with.
+type ChunkRef struct {
+	Hash        string `json:"hash"`
+	Length      int64  `json:"length"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// Extent is a run of disk bytes stored in a backup. Offset and Length are in
+// bytes on the disk; the bytes are the concatenation of Chunks.
+type Extent struct {
+	Offset int64      `json:"offset"`
+	Length int64      `json:"length"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// End returns the disk offset just past the extent.
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// Manifest describes one backup of a disk: the disk geometry, its metadata,
+// the changeId it was taken at and the extents it holds. Extents are sorted
+// by Offset and never overlap.
+type Manifest struct {
+	Version int       `json:"version"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// Parent is the ID of the backup this one is an incremental of, empty for
+	// a full backup.
+	Parent string `json:"parent,omitempty"`
+	// SyntheticOf is the ID of the incremental whose chain was merged into this
+	// full backup, empty for a backup of a disk.
+	SyntheticOf string `json:"syntheticOf,omitempty"`
+
+	Capacity    disklib.VixDiskLibSectorType  `json:"capacity"`
+	BiosGeo     disklib.VixDiskLibGeometry    `json:"biosGeometry"`
+	PhysGeo     disklib.VixDiskLibGeometry    `json:"physGeometry"`
+	AdapterType disklib.VixDiskLibAdapterType `json:"adapterType"`
+	Metadata    map[string]string             `json:"metadata"`
+
+	// ChangeId is the changeId of the disk when the backup was taken, the one
+	// to query changes since for the next incremental.
+	ChangeId string `json:"changeId,omitempty"`
+	// BaseChangeId is the changeId the extents of an incremental are relative to.
+	BaseChangeId string `json:"baseChangeId,omitempty"`
+
+	Extents []Extent `json:"extents"`
+}
+
+// Info returns the geometry of the backed up disk as a VixDiskLibInfo.
+func (m *Manifest) Info() disklib.VixDiskLibInfo {
+	return disklib.VixDiskLibInfo{
+		BiosGeo:     m.BiosGeo,
+		PhysGeo:     m.PhysGeo,
+		Capacity:    m.Capacity,
+		AdapterType: m.AdapterType,
+		NumLinks:    1,
+	}
+}
+
+// SetInfo copies the geometry of info into the manifest.
+func (m *Manifest) SetInfo(info disklib.VixDiskLibInfo) {
+	m.Capacity = info.Capacity
+	m.BiosGeo = info.BiosGeo
+	m.PhysGeo = info.PhysGeo
+	m.AdapterType = info.AdapterType
+}
+
+// DiskSize returns the capacity of the disk in bytes.
+func (m *Manifest) DiskSize() int64 {
+	return int64(m.Capacity) * disklib.VIXDISKLIB_SECTOR_SIZE
+}
+
+// DataSize returns how many bytes of disk data the backup holds, before dedup.
+func (m *Manifest) DataSize() int64 {
+	var size int64
+	for _, extent := range m.Extents {
+		size += extent.Length
+	}
+	return size
+}
+
+// findExtent returns the index of the first extent that ends after off.
+func findExtent(extents []Extent, off int64) int {
+	return sort.Search(len(extents), func(i int) bool {
+		return extents[i].End() > off
+	})
+}
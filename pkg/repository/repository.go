@@ -0,0 +1,390 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package repository stores disk backups in a directory. Backup data is cut
+// into chunks that are stored once, keyed by their SHA-256, however many
+// backups contain them. Every backup is a manifest with the disk geometry,
+// metadata, changeId and an extent map that references chunks. Chunks can be
+// stored compressed; the manifest records the algorithm of each. A repository
+// created with a KeyProvider seals every chunk and manifest with AES-256-GCM
+// under a data key that is stored wrapped in repository.json:
+//
+//	repository.json
+//	backups/<id>/manifest.json
+//	chunks/<hash[:2]>/<hash>[.<compression>]
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/compress"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/encryption"
+)
+
+const (
+	configFile   = "repository.json"
+	backupsDir   = "backups"
+	chunksDir    = "chunks"
+	manifestFile = "manifest.json"
+)
+
+// RepositoryVersion is the version of the repository layout.
+const RepositoryVersion = 1
+
+// Config is fixed when a repository is created. Compression is the algorithm
+// new chunks are stored with, one of the names known to package compress;
+// chunks it does not make smaller are stored uncompressed.
+type Config struct {
+	Version     int      `json:"version"`
+	Chunking    Chunking `json:"chunking"`
+	Compression string   `json:"compression,omitempty"`
+	// Encryption is filled in by Create when it is given a KeyProvider.
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+// Encryption records how the data of an encrypted repository is sealed and
+// the data key wrapped by the key encryption key KeyID.
+type Encryption struct {
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// Repository is a directory of backups.
+type Repository struct {
+	root   string
+	config Config
+	codec  compress.Codec
+	cipher *encryption.Cipher
+	chunks chunkStore
+}
+
+// Create makes a new, empty repository in root, which may already exist but
+// must not hold a repository. Zero fields of cfg get their defaults. If keys
+// is not nil, the repository is encrypted with a new data key wrapped by keys.
+func Create(root string, cfg Config, keys encryption.KeyProvider) (*Repository, error) {
+	cfg.Version = RepositoryVersion
+	cfg.Chunking = cfg.Chunking.withDefaults()
+	if cfg.Compression == "" {
+		cfg.Compression = compress.None
+	}
+	codec, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(filepath.Join(root, configFile))
+	if err == nil {
+		return nil, fmt.Errorf("repository: %s already holds a repository", root)
+	}
+	var c *encryption.Cipher
+	cfg.Encryption = nil
+	if keys != nil {
+		key, err := encryption.NewKey()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := keys.WrapKey(key)
+		if err != nil {
+			return nil, err
+		}
+		c, err = encryption.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Encryption = &Encryption{
+			Algorithm:  encryption.AlgorithmAESGCM,
+			KeyID:      keys.KeyID(),
+			WrappedKey: wrapped,
+		}
+	}
+	for _, dir := range []string{backupsDir, chunksDir} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("repository: %v", err)
+		}
+	}
+	err = writeJSON(filepath.Join(root, configFile), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newRepository(root, cfg, codec, c), nil
+}
+
+// Open opens the repository in root. keys must unwrap the data key of an
+// encrypted repository, and must be nil for one that is not encrypted.
+func Open(root string, keys encryption.KeyProvider) (*Repository, error) {
+	var cfg Config
+	err := readJSON(filepath.Join(root, configFile), &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Version != RepositoryVersion {
+		return nil, fmt.Errorf("repository: %s has unsupported version %d", root, cfg.Version)
+	}
+	codec, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	c, err := cfg.cipher(keys)
+	if err != nil {
+		return nil, fmt.Errorf("repository: %s: %v", root, err)
+	}
+	return newRepository(root, cfg, codec, c), nil
+}
+
+// cipher unwraps the data key of the repository with keys.
+func (c Config) cipher(keys encryption.KeyProvider) (*encryption.Cipher, error) {
+	if c.Encryption == nil {
+		if keys != nil {
+			return nil, fmt.Errorf("repository is not encrypted")
+		}
+		return nil, nil
+	}
+	if c.Encryption.Algorithm != encryption.AlgorithmAESGCM {
+		return nil, fmt.Errorf("unknown encryption %q", c.Encryption.Algorithm)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("repository is encrypted with key %s", c.Encryption.KeyID)
+	}
+	key, err := keys.UnwrapKey(c.Encryption.KeyID, c.Encryption.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewCipher(key)
+}
+
+func (c Config) validate() (compress.Codec, error) {
+	err := c.Chunking.validate()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := compress.Lookup(c.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+	return codec, nil
+}
+
+func newRepository(root string, cfg Config, codec compress.Codec, c *encryption.Cipher) *Repository {
+	r := &Repository{
+		root:   root,
+		config: cfg,
+		codec:  codec,
+		cipher: c,
+		chunks: chunkStore{dir: filepath.Join(root, chunksDir)},
+	}
+	if c != nil {
+		r.chunks.cipher = c
+		r.chunks.idKey = c.DeriveKey("chunk id")
+	}
+	return r
+}
+
+// Config returns the configuration of the repository.
+func (r *Repository) Config() Config {
+	return r.config
+}
+
+// Root returns the directory of the repository.
+func (r *Repository) Root() string {
+	return r.root
+}
+
+func (r *Repository) backupDir(id string) string {
+	return filepath.Join(r.root, backupsDir, id)
+}
+
+// checkBackupID rejects ids that would name a directory outside backups/.
+func checkBackupID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("repository: invalid backup id %q", id)
+	}
+	return nil
+}
+
+// Manifest reads the manifest of backup id.
+func (r *Repository) Manifest(id string) (*Manifest, error) {
+	if err := checkBackupID(id); err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(filepath.Join(r.backupDir(id), manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+	if r.cipher != nil {
+		buf, err = r.cipher.Open(buf, manifestAAD(id))
+		if err != nil {
+			return nil, fmt.Errorf("repository: backup %s: %v", id, err)
+		}
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, fmt.Errorf("repository: backup %s: %v", id, err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("repository: backup %s has unsupported manifest version %d", id, m.Version)
+	}
+	return m, nil
+}
+
+func (r *Repository) writeManifest(m *Manifest) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	if r.cipher != nil {
+		buf, err = r.cipher.Seal(buf, manifestAAD(m.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(filepath.Join(r.backupDir(m.ID), manifestFile), buf)
+}
+
+// manifestAAD binds a sealed manifest to its backup, so that it cannot be
+// swapped with the manifest of another backup.
+func manifestAAD(id string) []byte {
+	return []byte("manifest:" + id)
+}
+
+// List returns the manifests of all committed backups, oldest first.
+func (r *Repository) List() ([]*Manifest, error) {
+	entries, err := os.ReadDir(filepath.Join(r.root, backupsDir))
+	if err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+	var manifests []*Manifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// Backups that were never committed have no manifest
+		if _, err := os.Stat(filepath.Join(r.backupDir(entry.Name()), manifestFile)); err != nil {
+			continue
+		}
+		m, err := r.Manifest(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].Created.Before(manifests[j].Created)
+	})
+	return manifests, nil
+}
+
+// Delete removes backup id. It does not check whether other backups use it as
+// their parent. The chunks of the backup stay in the store until Prune.
+func (r *Repository) Delete(id string) error {
+	if err := checkBackupID(id); err != nil {
+		return err
+	}
+	err := os.RemoveAll(r.backupDir(id))
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	return nil
+}
+
+// Prune removes the chunks that no backup references any more and returns how
+// many it removed. It must not run while a backup is being written.
+func (r *Repository) Prune() (int, error) {
+	manifests, err := r.List()
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	for _, m := range manifests {
+		for _, extent := range m.Extents {
+			for _, chunk := range extent.Chunks {
+				used[chunk.Hash] = true
+			}
+		}
+	}
+	removed := 0
+	err = r.chunks.walk(func(hash string, compression string) error {
+		if used[hash] {
+			return nil
+		}
+		removed++
+		return r.chunks.remove(hash, compression)
+	})
+	return removed, err
+}
+
+func newBackupID() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+func readJSON(path string, v interface{}) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return fmt.Errorf("repository: %s: %v", path, err)
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	return writeFile(path, buf)
+}
+
+// writeFile replaces path atomically, so a reader sees either the old or the
+// new content.
+func writeFile(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("repository: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/compress"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/encryption"
+)
+
+// chunkStore keeps every unique chunk once, in a file named after the
+// SHA-256 of its uncompressed content under a directory for the first byte of
+// the hash. A compressed chunk has the name of its algorithm as extension.
+//
+// In an encrypted repository the hash is an HMAC-SHA-256 keyed from the data
+// key, so that the names do not tell whether the store holds known content,
+// and every chunk is sealed after compression.
+type chunkStore struct {
+	dir    string
+	cipher *encryption.Cipher
+	idKey  []byte
+}
+
+func (s chunkStore) hash(p []byte) string {
+	if s.idKey == nil {
+		sum := sha256.Sum256(p)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, s.idKey)
+	mac.Write(p)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkAAD binds a sealed chunk to its name.
+func chunkAAD(hash string, compression string) []byte {
+	return []byte("chunk:" + hash + "." + compression)
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s chunkStore) path(hash string, compression string) string {
+	name := hash
+	if compression != "" && compression != compress.None {
+		name += "." + compression
+	}
+	return filepath.Join(s.dir, hash[:2], name)
+}
+
+// lookup returns the compression of the stored chunk hash, if there is one.
+func (s chunkStore) lookup(hash string) (string, bool) {
+	for _, compression := range compress.Names() {
+		if _, err := os.Stat(s.path(hash, compression)); err == nil {
+			return compression, true
+		}
+	}
+	return "", false
+}
+
+// minSaving is how much smaller than the chunk its compressed form must be to
+// be worth decompressing on every read.
+const minSaving = 1.0 / 16
+
+// put stores chunk under hash unless a chunk with that hash is already there.
+// It compresses the chunk with codec when that saves at least minSaving, and
+// stores it uncompressed otherwise. It returns the compression of the chunk in
+// the store, how many bytes it wrote and whether this call wrote the chunk,
+// which is false if the chunk was already there. A chunk is written to a
+// temporary file and linked into place, so a reader never sees a partial chunk
+// and of two writers storing the same new chunk at once only one writes it.
+func (s chunkStore) put(hash string, chunk []byte, codec compress.Codec) (string, int64, bool, error) {
+	if compression, ok := s.lookup(hash); ok {
+		return compression, 0, false, nil
+	}
+	compression := compress.None
+	data := chunk
+	if codec.Name() != compress.None {
+		encoded, err := codec.Encode(nil, chunk)
+		if err != nil && err != compress.ErrIncompressible {
+			return "", 0, false, fmt.Errorf("repository: %v", err)
+		}
+		if err == nil && float64(len(encoded)) <= float64(len(chunk))*(1-minSaving) {
+			compression = codec.Name()
+			data = encoded
+		}
+	}
+	if s.cipher != nil {
+		var err error
+		data, err = s.cipher.Seal(data, chunkAAD(hash, compression))
+		if err != nil {
+			return "", 0, false, err
+		}
+	}
+
+	path := s.path(hash, compression)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("repository: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+	if err != nil {
+		return "", 0, false, fmt.Errorf("repository: %v", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, false, fmt.Errorf("repository: %v", err)
+	}
+	// A link fails if another writer stored the chunk first; filesystems
+	// without hard links fall back to a rename, which replaces it
+	err = os.Link(f.Name(), path)
+	if err == nil || os.IsExist(err) {
+		os.Remove(f.Name())
+		if err != nil {
+			return compression, 0, false, nil
+		}
+		return compression, int64(len(data)), true, nil
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, false, fmt.Errorf("repository: %v", err)
+	}
+	return compression, int64(len(data)), true, nil
+}
+
+// get returns the uncompressed content of the chunk ref names.
+func (s chunkStore) get(ref ChunkRef) ([]byte, error) {
+	codec, err := compress.Lookup(ref.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("repository: chunk %s: %v", ref.Hash, err)
+	}
+	data, err := os.ReadFile(s.path(ref.Hash, ref.Compression))
+	if err != nil {
+		return nil, fmt.Errorf("repository: chunk %s: %v", ref.Hash, err)
+	}
+	if s.cipher != nil {
+		data, err = s.cipher.Open(data, chunkAAD(ref.Hash, codec.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("repository: chunk %s: %v", ref.Hash, err)
+		}
+	}
+	p, err := codec.Decode(data, int(ref.Length))
+	if err != nil {
+		return nil, fmt.Errorf("repository: chunk %s: %v", ref.Hash, err)
+	}
+	return p, nil
+}
+
+// walk calls fn with the hash and compression of every chunk in the store.
+func (s chunkStore) walk(fn func(hash string, compression string) error) error {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.dir, dir.Name()))
+		if err != nil {
+			return fmt.Errorf("repository: %v", err)
+		}
+		for _, entry := range entries {
+			hash, compression, _ := strings.Cut(entry.Name(), ".")
+			if compression == "" {
+				compression = compress.None
+			}
+			// Skips temporary files
+			if !validHash(hash) {
+				continue
+			}
+			if _, err := compress.Lookup(compression); err != nil {
+				continue
+			}
+			err = fn(hash, compression)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s chunkStore) remove(hash string, compression string) error {
+	err := os.Remove(s.path(hash, compression))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("repository: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vhd writes disks as fixed VHD images and as dynamic VHDX images,
+// the formats of Hyper-V and Azure.
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// FooterSize is the size of the footer that ends a VHD.
+const FooterSize = 512
+
+// FooterCookie starts the footer of a VHD.
+const FooterCookie = "conectix"
+
+// DiskTypeFixed is the disk type of a fixed VHD.
+const DiskTypeFixed = 2
+
+// Footer is the footer of a VHD, big endian on disk.
+type Footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueId           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdEpoch is the origin of VHD time stamps.
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// chsGeometry is the geometry of the VHD specification for a disk of size
+// bytes.
+func chsGeometry(size int64) (cylinders uint16, heads uint8, sectorsPerTrack uint8) {
+	totalSectors := size / disklib.VIXDISKLIB_SECTOR_SIZE
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var spt, hds, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		hds = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		hds = (cylinderTimesHeads + 1023) / 1024
+		if hds < 4 {
+			hds = 4
+		}
+		if cylinderTimesHeads >= hds*1024 || hds > 16 {
+			spt = 31
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= hds*1024 {
+			spt = 63
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / hds), uint8(hds), uint8(spt)
+}
+
+// NewFixedFooter returns the footer of a fixed VHD of size bytes.
+func NewFixedFooter(size int64) Footer {
+	footer := Footer{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        0xffffffffffffffff,
+		TimeStamp:         uint32(time.Since(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		CreatorHostOS:     0x5769326b, // "Wi2k"
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          DiskTypeFixed,
+	}
+	copy(footer.Cookie[:], FooterCookie)
+	copy(footer.CreatorApplication[:], "vdsk")
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = chsGeometry(size)
+	rand.Read(footer.UniqueId[:])
+	return footer
+}
+
+// Bytes returns the footer with its checksum, the one's complement of the sum
+// of all its bytes.
+func (f Footer) Bytes() []byte {
+	f.Checksum = 0
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, f)
+	var sum uint32
+	for _, b := range buf.Bytes() {
+		sum += uint32(b)
+	}
+	f.Checksum = ^sum
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, f)
+	return buf.Bytes()
+}
+
+// ExportFixed writes src to w as a fixed VHD: the raw disk followed by the
+// footer. Only the allocated extents of src are written, and of them only the
+// megabytes that are not all zeros, so on a file system with sparse files the
+// rest costs nothing. The virtual size is rounded up to a whole megabyte,
+// which Azure requires; the padding reads as zeros.
+func ExportFixed(w io.WriterAt, src virtual_disks.DiskSource) error {
+	const mb = 1024 * 1024
+	size := (src.Capacity() + mb - 1) / mb * mb
+	extents, vErr := virtual_disks.QueryAllocatedExtents(src, disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	if vErr != nil {
+		return vErr
+	}
+	buf := make([]byte, mb)
+	for _, extent := range extents {
+		start := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		for off := start; off < end; {
+			p := buf
+			if end-off < int64(len(p)) {
+				p = buf[:end-off]
+			}
+			_, err := src.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ReadAt(%d): %v", off, err)
+			}
+			if !virtual_disks.IsZero(p) {
+				if _, err := w.WriteAt(p, off); err != nil {
+					return fmt.Errorf("vhd: %v", err)
+				}
+			}
+			off += int64(len(p))
+		}
+	}
+	footer := NewFixedFooter(size)
+	if _, err := w.WriteAt(footer.Bytes(), size); err != nil {
+		return fmt.Errorf("vhd: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// Signatures of the structures of a VHDX
+const (
+	VHDXSignature     = "vhdxfile"
+	headerSignature   = 0x64616568 // "head"
+	regionSignature   = 0x69676572 // "regi"
+	metadataSignature = "metadata"
+)
+
+// Fixed offsets and sizes of the VHDX layout written here: the file
+// identifier, two headers and two region tables in the first megabyte, then
+// an empty log, the metadata region and the BAT, each starting on a megabyte.
+const (
+	vhdxAlignment      = 1024 * 1024
+	HeaderOffset1      = 64 * 1024
+	HeaderOffset2      = 128 * 1024
+	RegionTableOffset1 = 192 * 1024
+	RegionTableOffset2 = 256 * 1024
+	headerSize         = 4 * 1024
+	regionTableSize    = 64 * 1024
+	logOffset          = 1 * vhdxAlignment
+	logLength          = 1 * vhdxAlignment
+	metadataOffset     = 2 * vhdxAlignment
+	metadataLength     = 1 * vhdxAlignment
+	batOffset          = 3 * vhdxAlignment
+	// metadata items start after the 64KB of the metadata table
+	metadataItemsOffset = 64 * 1024
+)
+
+// DefaultBlockSize is the payload block size of the VHDX images written,
+// the one Hyper-V picks for dynamic disks.
+const DefaultBlockSize = 32 * 1024 * 1024
+
+// LogicalSectorSize and PhysicalSectorSize are the sector sizes a VHDX
+// advertises.
+const (
+	LogicalSectorSize  = disklib.VIXDISKLIB_SECTOR_SIZE
+	PhysicalSectorSize = 4096
+)
+
+// States of BAT entries
+const (
+	PayloadBlockNotPresent   = 0
+	PayloadBlockZero         = 2
+	PayloadBlockFullyPresent = 6
+	SBBlockNotPresent        = 0
+)
+
+// batStateMask selects the state of a BAT entry; the rest is the file offset
+// of the block in megabytes, shifted left by 20 bits.
+const batStateMask = 7
+
+// GUIDs of the regions and metadata items
+var (
+	BATRegionGUID          = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	MetadataRegionGUID     = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	FileParametersGUID     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	VirtualDiskSizeGUID    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	VirtualDiskIdGUID      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	LogicalSectorSizeGUID  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	PhysicalSectorSizeGUID = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// Flags of metadata table entries
+const (
+	metadataIsVirtualDisk = 1 << 1
+	metadataIsRequired    = 1 << 2
+)
+
+// GUID is a GUID in the mixed endian layout of the VHDX specification.
+type GUID [16]byte
+
+// mustParseGUID parses the usual text form of a GUID, whose first three
+// groups are stored little endian.
+func mustParseGUID(s string) GUID {
+	var g GUID
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic(fmt.Sprintf("invalid GUID %s", s))
+	}
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(g[8:], raw[8:])
+	return g
+}
+
+func newGUID() GUID {
+	var g GUID
+	rand.Read(g[:])
+	return g
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// VHDXHeader is a VHDX header, little endian on disk and padded to 4KB.
+type VHDXHeader struct {
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGuid  GUID
+	DataWriteGuid  GUID
+	LogGuid        GUID
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+// RegionTableHeader starts a VHDX region table.
+type RegionTableHeader struct {
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+// RegionTableEntry locates a region of a VHDX.
+type RegionTableEntry struct {
+	Guid       GUID
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+// MetadataTableHeader starts the metadata region of a VHDX.
+type MetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+// MetadataTableEntry locates a metadata item, relative to the start of the
+// metadata region.
+type MetadataTableEntry struct {
+	ItemId   GUID
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// withChecksum serializes v little endian into size bytes and stores the
+// CRC-32C of them at checksumOffset.
+func withChecksum(v interface{}, size int, checksumOffset int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v)
+	out := make([]byte, size)
+	copy(out, buf.Bytes())
+	binary.LittleEndian.PutUint32(out[checksumOffset:], 0)
+	binary.LittleEndian.PutUint32(out[checksumOffset:], crc32.Checksum(out, castagnoli))
+	return out
+}
+
+// VHDXWriter writes a dynamic VHDX to an io.WriterAt. Payload blocks may be
+// written in any order, each at most once, and are appended to the file as
+// they come; the BAT is written by Close. Every payload block written is
+// fully present, the others are zero or not present and read as zeros.
+type VHDXWriter struct {
+	w          io.WriterAt
+	size       int64
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+	batLength  int64
+	next       int64
+	closed     bool
+}
+
+// NewVHDXWriter starts a dynamic VHDX of size bytes on w, with payload blocks
+// of blockSize bytes, DefaultBlockSize if zero. blockSize must be a power of
+// two between 1MB and 256MB.
+func NewVHDXWriter(w io.WriterAt, size int64, blockSize int64) (*VHDXWriter, error) {
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < vhdxAlignment || blockSize > 256*vhdxAlignment || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("vhdx: invalid block size %d", blockSize)
+	}
+	if size <= 0 || size%LogicalSectorSize != 0 || size > 64*1024*1024*1024*1024 {
+		return nil, fmt.Errorf("vhdx: invalid size %d", size)
+	}
+	// NOTE: 每chunkRatio个数据块之后是一个sector bitmap块的BAT项, 动态盘的sector bitmap块都不存在
+	chunkRatio := (int64(1) << 23) * LogicalSectorSize / blockSize
+	dataBlocks := (size + blockSize - 1) / blockSize
+	batEntries := dataBlocks + (dataBlocks-1)/chunkRatio
+	batLength := (batEntries*8 + vhdxAlignment - 1) / vhdxAlignment * vhdxAlignment
+	this := &VHDXWriter{
+		w:          w,
+		size:       size,
+		blockSize:  blockSize,
+		chunkRatio: chunkRatio,
+		bat:        make([]uint64, batEntries),
+		batLength:  batLength,
+		next:       batOffset + batLength,
+	}
+	// Both PayloadBlockNotPresent and SBBlockNotPresent are zero
+	return this, nil
+}
+
+// BlockSize is the size of the payload blocks in bytes.
+func (this *VHDXWriter) BlockSize() int64 {
+	return this.blockSize
+}
+
+// batIndex is the BAT entry of payload block block.
+func (this *VHDXWriter) batIndex(block int64) int64 {
+	return block + block/this.chunkRatio
+}
+
+// WriteBlock stores p as payload block block. p may be shorter than a block,
+// the rest of the block reads as zeros.
+func (this *VHDXWriter) WriteBlock(block int64, p []byte) error {
+	if this.closed {
+		return fmt.Errorf("vhdx: writer is closed")
+	}
+	if block < 0 || block*this.blockSize >= this.size || int64(len(p)) > this.blockSize {
+		return fmt.Errorf("vhdx: invalid write of %d bytes to block %d", len(p), block)
+	}
+	index, err := this.startBlock(block)
+	if err != nil {
+		return err
+	}
+	if _, err := this.w.WriteAt(p, this.next); err != nil {
+		return fmt.Errorf("vhdx: %v", err)
+	}
+	// The tail of the block is written too, so that the file covers it
+	if int64(len(p)) < this.blockSize {
+		if _, err := this.w.WriteAt(make([]byte, this.blockSize-int64(len(p))), this.next+int64(len(p))); err != nil {
+			return fmt.Errorf("vhdx: %v", err)
+		}
+	}
+	this.bat[index] = uint64(this.next/vhdxAlignment)<<20 | PayloadBlockFullyPresent
+	this.next += this.blockSize
+	return nil
+}
+
+// WriteZeroBlock records payload block block as reading zeros, without
+// storing any data for it.
+func (this *VHDXWriter) WriteZeroBlock(block int64) error {
+	if this.closed {
+		return fmt.Errorf("vhdx: writer is closed")
+	}
+	if block < 0 || block*this.blockSize >= this.size {
+		return fmt.Errorf("vhdx: invalid zero block %d", block)
+	}
+	index, err := this.startBlock(block)
+	if err != nil {
+		return err
+	}
+	this.bat[index] = PayloadBlockZero
+	return nil
+}
+
+func (this *VHDXWriter) startBlock(block int64) (int64, error) {
+	index := this.batIndex(block)
+	if this.bat[index]&batStateMask != PayloadBlockNotPresent {
+		return 0, fmt.Errorf("vhdx: block %d written twice", block)
+	}
+	return index, nil
+}
+
+// Close writes the file identifier, the headers, the region tables, the
+// metadata and the BAT.
+func (this *VHDXWriter) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+
+	ident := make([]byte, 64*1024)
+	copy(ident, VHDXSignature)
+	for i, c := range utf16.Encode([]rune("virtual-disks")) {
+		binary.LittleEndian.PutUint16(ident[8+2*i:], c)
+	}
+	if err := this.writeAt(ident, 0); err != nil {
+		return err
+	}
+
+	header := VHDXHeader{
+		Signature:     headerSignature,
+		FileWriteGuid: newGUID(),
+		DataWriteGuid: newGUID(),
+		Version:       1,
+		LogLength:     logLength,
+		LogOffset:     logOffset,
+	}
+	for i, offset := range []int64{HeaderOffset1, HeaderOffset2} {
+		header.SequenceNumber = uint64(i + 1)
+		if err := this.writeAt(withChecksum(header, headerSize, 4), offset); err != nil {
+			return err
+		}
+	}
+
+	var regions bytes.Buffer
+	binary.Write(&regions, binary.LittleEndian, RegionTableHeader{Signature: regionSignature, EntryCount: 2})
+	binary.Write(&regions, binary.LittleEndian, RegionTableEntry{Guid: BATRegionGUID, FileOffset: batOffset, Length: uint32(this.batLength), Required: 1})
+	binary.Write(&regions, binary.LittleEndian, RegionTableEntry{Guid: MetadataRegionGUID, FileOffset: metadataOffset, Length: metadataLength, Required: 1})
+	regionTable := withChecksum(regions.Bytes(), regionTableSize, 4)
+	for _, offset := range []int64{RegionTableOffset1, RegionTableOffset2} {
+		if err := this.writeAt(regionTable, offset); err != nil {
+			return err
+		}
+	}
+
+	if err := this.writeAt(make([]byte, logLength), logOffset); err != nil {
+		return err
+	}
+	if err := this.writeAt(this.metadata(), metadataOffset); err != nil {
+		return err
+	}
+
+	bat := make([]byte, this.batLength)
+	for i, entry := range this.bat {
+		binary.LittleEndian.PutUint64(bat[i*8:], entry)
+	}
+	return this.writeAt(bat, batOffset)
+}
+
+// metadata returns the metadata region: the table followed by the items.
+func (this *VHDXWriter) metadata() []byte {
+	virtualDiskId := newGUID()
+	items := []struct {
+		id    GUID
+		flags uint32
+		data  []byte
+	}{
+		{FileParametersGUID, metadataIsRequired, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, uint32(this.blockSize)), 0)},
+		{VirtualDiskSizeGUID, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint64(nil, uint64(this.size))},
+		{VirtualDiskIdGUID, metadataIsVirtualDisk | metadataIsRequired, virtualDiskId[:]},
+		{LogicalSectorSizeGUID, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint32(nil, LogicalSectorSize)},
+		{PhysicalSectorSizeGUID, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint32(nil, PhysicalSectorSize)},
+	}
+	region := make([]byte, metadataLength)
+	var table bytes.Buffer
+	header := MetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(header.Signature[:], metadataSignature)
+	binary.Write(&table, binary.LittleEndian, header)
+	offset := uint32(metadataItemsOffset)
+	for _, item := range items {
+		binary.Write(&table, binary.LittleEndian, MetadataTableEntry{
+			ItemId: item.id,
+			Offset: offset,
+			Length: uint32(len(item.data)),
+			Flags:  item.flags,
+		})
+		copy(region[offset:], item.data)
+		offset += uint32(len(item.data))
+	}
+	copy(region, table.Bytes())
+	return region
+}
+
+func (this *VHDXWriter) writeAt(p []byte, off int64) error {
+	if _, err := this.w.WriteAt(p, off); err != nil {
+		return fmt.Errorf("vhdx: %v", err)
+	}
+	return nil
+}
+
+// ExportVHDX writes src to w as a dynamic VHDX with payload blocks of
+// blockSize bytes, DefaultBlockSize if zero. Only the payload blocks that hold
+// an allocated extent of src are stored, and those holding only zeros are
+// marked as zero blocks instead.
+func ExportVHDX(w io.WriterAt, src virtual_disks.DiskSource, blockSize int64) error {
+	x, err := NewVHDXWriter(w, src.Capacity(), blockSize)
+	if err != nil {
+		return err
+	}
+	blockSize = x.BlockSize()
+	extents, vErr := virtual_disks.QueryAllocatedExtents(src, disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	if vErr != nil {
+		return vErr
+	}
+
+	buf := make([]byte, blockSize)
+	next := int64(0)
+	for _, extent := range extents {
+		start := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		block := start / blockSize
+		if block < next {
+			block = next
+		}
+		for ; block*blockSize < end; block++ {
+			p := buf
+			if src.Capacity()-block*blockSize < blockSize {
+				p = buf[:src.Capacity()-block*blockSize]
+			}
+			_, err := src.ReadAt(p, block*blockSize)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ReadAt(%d): %v", block*blockSize, err)
+			}
+			if virtual_disks.IsZero(p) {
+				err = x.WriteZeroBlock(block)
+			} else {
+				err = x.WriteBlock(block, p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		next = block
+	}
+	return x.Close()
+}
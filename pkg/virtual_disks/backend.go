@@ -0,0 +1,299 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+// DiskBackend is the storage underneath a DiskConnectHandle. All IO is done in
+// whole sectors of disklib.VIXDISKLIB_SECTOR_SIZE bytes; DiskConnectHandle takes
+// care of unaligned offsets and lengths on top of it.
+type DiskBackend interface {
+	// ReadSectors reads numSectors sectors starting at startSector into buf.
+	ReadSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError
+	// WriteSectors writes numSectors sectors from buf starting at startSector.
+	WriteSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError
+	// GetInfo returns the geometry and capacity of the disk.
+	GetInfo() (disklib.VixDiskLibInfo, disklib.VddkError)
+	// QueryAllocatedBlocks follows the semantics of VixDiskLib_QueryAllocatedBlocks.
+	QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError)
+	GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError
+	ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError
+	WriteMetadata(key string, buf []byte) disklib.VddkError
+	// Close releases everything held by the backend.
+	Close() disklib.VddkError
+}
+
+// ContextDiskBackend is a DiskBackend whose IO gives up once ctx is done, for
+// example instead of waiting to retry. DiskConnectHandle passes the context of
+// ReadAtContext and WriteAtContext to backends that implement it.
+type ContextDiskBackend interface {
+	DiskBackend
+	ReadSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError
+	WriteSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError
+}
+
+// vddkBackend is the DiskBackend for a disk opened through libvixDiskLib.
+type vddkBackend struct {
+	dli    disklib.VixDiskLibHandle
+	conn   disklib.VixDiskLibConnection
+	params disklib.ConnectParams
+	retry  disklib.RetryPolicy
+}
+
+// NewVddkBackend wraps a disk handle opened with disklib.Open. Closing the
+// backend closes the handle, disconnects and ends access for params. Reads
+// and writes failing with a transient error are retried under
+// disklib.DefaultRetryPolicy, until the context of ReadSectorsContext or
+// WriteSectorsContext is done. Retrying on the same handle only delays the
+// failure once the connection is gone, e.g. after VIX_E_HOST_CONNECTION_LOST:
+// the disk has to be opened again for IO to go on.
+func NewVddkBackend(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection, params disklib.ConnectParams) DiskBackend {
+	return vddkBackend{
+		dli:    dli,
+		conn:   conn,
+		params: params,
+		retry:  disklib.DefaultRetryPolicy,
+	}
+}
+
+func (this vddkBackend) ReadSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	return this.ReadSectorsContext(context.Background(), startSector, numSectors, buf)
+}
+
+func (this vddkBackend) WriteSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	return this.WriteSectorsContext(context.Background(), startSector, numSectors, buf)
+}
+
+func (this vddkBackend) ReadSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	return this.ioError(this.retry.Read(ctx, this.dli, startSector, numSectors, buf), "Read", startSector, numSectors)
+}
+
+func (this vddkBackend) WriteSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	return this.ioError(this.retry.Write(ctx, this.dli, startSector, numSectors, buf), "Write", startSector, numSectors)
+}
+
+// ioError adds the disk, the sectors and the transport mode in use to err.
+func (this vddkBackend) ioError(err disklib.VddkError, op string, startSector uint64, numSectors uint64) disklib.VddkError {
+	if err == nil {
+		return nil
+	}
+	return &disklib.OpError{
+		Op:          op,
+		Path:        this.params.Path(),
+		StartSector: startSector,
+		NumSectors:  numSectors,
+		Transport:   disklib.GetTransportMode(this.dli),
+		Err:         err,
+	}
+}
+
+func (this vddkBackend) GetInfo() (disklib.VixDiskLibInfo, disklib.VddkError) {
+	return disklib.GetInfo(this.dli)
+}
+
+func (this vddkBackend) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	return disklib.QueryAllocatedBlocks(this.dli, startSector, numSectors, chunkSize)
+}
+
+func (this vddkBackend) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
+	return disklib.GetMetadataKeys(this.dli, buf, bufLen, requireLen)
+}
+
+func (this vddkBackend) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
+	return disklib.ReadMetadata(this.dli, key, buf, bufLen, requiredLen)
+}
+
+func (this vddkBackend) WriteMetadata(key string, buf []byte) disklib.VddkError {
+	return disklib.WriteMetadata(this.dli, key, buf)
+}
+
+func (this vddkBackend) Close() disklib.VddkError {
+	vErr := disklib.Close(this.dli)
+	if vErr != nil {
+		return wrapError(vErr, "Close", this.params)
+	}
+	vErr = disklib.Disconnect(this.conn)
+	if vErr != nil {
+		return wrapError(vErr, "Disconnect", this.params)
+	}
+	return wrapError(disklib.EndAccess(this.params), "EndAccess", this.params)
+}
+
+// CheckSectorRange validates an IO request against the capacity of a backend
+// the same way VDDK does.
+func CheckSectorRange(op string, capacity disklib.VixDiskLibSectorType, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if uint64(len(buf)) < numSectors*disklib.VIXDISKLIB_SECTOR_SIZE {
+		return disklib.NewVddkError(disklib.VIX_E_INVALID_ARG, fmt.Sprintf("%s failed. Buffer of %d bytes is too small for %d sectors.", op, len(buf), numSectors))
+	}
+	if startSector+numSectors > uint64(capacity) || startSector+numSectors < startSector {
+		return disklib.NewVddkError(disklib.VIX_E_DISK_OUTOFRANGE, fmt.Sprintf("%s failed. The error code is %d.", op, disklib.VIX_E_DISK_OUTOFRANGE))
+	}
+	return nil
+}
+
+// AllocatedBlocks builds the block list returned by QueryAllocatedBlocks for
+// backends that are not VDDK. isAllocated reports whether any sector of the
+// given chunk holds data. Adjacent allocated chunks are merged into one block.
+func AllocatedBlocks(capacity disklib.VixDiskLibSectorType, startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType,
+	chunkSize disklib.VixDiskLibSectorType, isAllocated func(start disklib.VixDiskLibSectorType, length disklib.VixDiskLibSectorType) bool) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	if chunkSize < disklib.VIXDISKLIB_MIN_CHUNK_SIZE || chunkSize > disklib.VIXDISKLIB_MAX_CHUNK_SIZE ||
+		startSector%chunkSize != 0 || numSectors%chunkSize != 0 ||
+		numSectors/chunkSize > disklib.VIXDISKLIB_MAX_CHUNK_NUMBER {
+		return nil, disklib.NewVddkError(disklib.VIX_E_INVALID_ARG, fmt.Sprintf("QueryAllocatedBlocks(%d, %d, %d) error: %d.", startSector, numSectors, chunkSize, disklib.VIX_E_INVALID_ARG))
+	}
+	if startSector+numSectors > capacity {
+		return nil, disklib.NewVddkError(disklib.VIX_E_DISK_OUTOFRANGE, fmt.Sprintf("QueryAllocatedBlocks(%d, %d, %d) error: %d.", startSector, numSectors, chunkSize, disklib.VIX_E_DISK_OUTOFRANGE))
+	}
+
+	retList := make([]disklib.VixDiskLibBlock, 0)
+	for chunk := startSector; chunk < startSector+numSectors; chunk += chunkSize {
+		if !isAllocated(chunk, chunkSize) {
+			continue
+		}
+		last := len(retList) - 1
+		if last >= 0 && retList[last].Offset()+retList[last].Length() == chunk {
+			retList[last].SetLength(retList[last].Length() + chunkSize)
+			continue
+		}
+		var block disklib.VixDiskLibBlock
+		block.SetOffset(chunk)
+		block.SetLength(chunkSize)
+		retList = append(retList, block)
+	}
+	return retList, nil
+}
+
+// DefaultInfo fills in a VixDiskLibInfo for a backend that has no geometry of
+// its own, using the usual 255 heads / 63 sectors translation.
+func DefaultInfo(capacity disklib.VixDiskLibSectorType) disklib.VixDiskLibInfo {
+	geo := disklib.VixDiskLibGeometry{
+		Cylinders: uint32(uint64(capacity) / (255 * 63)),
+		Heads:     255,
+		Sectors:   63,
+	}
+	return disklib.VixDiskLibInfo{
+		BiosGeo:     geo,
+		PhysGeo:     geo,
+		Capacity:    capacity,
+		AdapterType: disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC,
+		NumLinks:    1,
+	}
+}
+
+// MetadataTable keeps VDDK style disk metadata for backends that are not VDDK.
+type MetadataTable map[string]string
+
+func (this MetadataTable) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
+	var keys []byte
+	for key := range this {
+		keys = append(keys, key...)
+		keys = append(keys, 0)
+	}
+	keys = append(keys, 0)
+	if requireLen != nil {
+		*requireLen = uint(len(keys))
+		return disklib.NewVddkError(disklib.VIX_E_BUFFER_TOOSMALL, fmt.Sprintf("GetMetadataKeys failed. The error code is %d.", disklib.VIX_E_BUFFER_TOOSMALL))
+	}
+	if bufLen < uint(len(keys)) || uint(len(buf)) < uint(len(keys)) {
+		return disklib.NewVddkError(disklib.VIX_E_BUFFER_TOOSMALL, fmt.Sprintf("GetMetadataKeys failed. The error code is %d.", disklib.VIX_E_BUFFER_TOOSMALL))
+	}
+	copy(buf, keys)
+	return nil
+}
+
+func (this MetadataTable) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
+	val, ok := this[key]
+	if !ok {
+		return disklib.NewVddkError(disklib.VIX_E_DISK_KEY_NOTFOUND, fmt.Sprintf("Read meta data from virtual disk file failed. The error code is %d.", disklib.VIX_E_DISK_KEY_NOTFOUND))
+	}
+	if requiredLen != nil {
+		*requiredLen = uint(len(val) + 1)
+		return disklib.NewVddkError(disklib.VIX_E_BUFFER_TOOSMALL, fmt.Sprintf("Read meta data from virtual disk file failed. The error code is %d.", disklib.VIX_E_BUFFER_TOOSMALL))
+	}
+	if bufLen < uint(len(val)+1) || uint(len(buf)) < uint(len(val)+1) {
+		return disklib.NewVddkError(disklib.VIX_E_BUFFER_TOOSMALL, fmt.Sprintf("Read meta data from virtual disk file failed. The error code is %d.", disklib.VIX_E_BUFFER_TOOSMALL))
+	}
+	copy(buf, val)
+	buf[len(val)] = 0
+	return nil
+}
+
+func (this MetadataTable) WriteMetadata(key string, buf []byte) {
+	// Values come in NUL terminated, as they would for VixDiskLib_WriteMetadata
+	for i, b := range buf {
+		if b == 0 {
+			buf = buf[:i]
+			break
+		}
+	}
+	this[key] = string(buf)
+}
+
+// DiskSource is the read side of an opened disk, which is all an exporter
+// needs. Both DiskReaderWriter and DiskConnectHandle implement it.
+type DiskSource interface {
+	ReadAt(p []byte, off int64) (n int, err error)
+	Capacity() int64
+	QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError)
+}
+
+// QueryAllocatedExtents walks the whole disk with QueryAllocatedBlocks,
+// VIXDISKLIB_MAX_CHUNK_NUMBER chunks at a time. The tail of a disk whose
+// capacity is not a multiple of chunkSize cannot be queried and is always
+// reported as allocated.
+func QueryAllocatedExtents(src DiskSource, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	capacity := disklib.VixDiskLibSectorType(src.Capacity() / disklib.VIXDISKLIB_SECTOR_SIZE)
+	numChunks := capacity / chunkSize
+	retList := make([]disklib.VixDiskLibBlock, 0)
+	appendBlock := func(block disklib.VixDiskLibBlock) {
+		last := len(retList) - 1
+		if last >= 0 && retList[last].Offset()+retList[last].Length() == block.Offset() {
+			retList[last].SetLength(retList[last].Length() + block.Length())
+			return
+		}
+		retList = append(retList, block)
+	}
+
+	var offset disklib.VixDiskLibSectorType = 0
+	for numChunks > 0 {
+		onceCount := numChunks
+		if onceCount > disklib.VIXDISKLIB_MAX_CHUNK_NUMBER {
+			onceCount = disklib.VIXDISKLIB_MAX_CHUNK_NUMBER
+		}
+		blockList, err := src.QueryAllocatedBlocks(offset, onceCount*chunkSize, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blockList {
+			appendBlock(block)
+		}
+		numChunks -= onceCount
+		offset += onceCount * chunkSize
+	}
+	if offset < capacity {
+		var tail disklib.VixDiskLibBlock
+		tail.SetOffset(offset)
+		tail.SetLength(capacity - offset)
+		appendBlock(tail)
+	}
+	return retList, nil
+}
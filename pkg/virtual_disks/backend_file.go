@@ -0,0 +1,215 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+// Raw images have nowhere to keep disk metadata, so it goes to a JSON file
+// next to the image.
+const fileMetadataSuffix = ".metadata"
+
+type fileBackend struct {
+	mutex    *sync.Mutex
+	file     *os.File
+	path     string
+	readOnly bool
+	sparse   bool
+	capacity disklib.VixDiskLibSectorType
+	metadata MetadataTable
+}
+
+// OpenFileBackend opens a raw, flat disk image. The capacity of the disk is the
+// size of the file rounded down to whole sectors.
+func OpenFileBackend(path string, readOnly bool) (DiskBackend, disklib.VddkError) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, disklib.NewFileError("Open virtual disk file", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, disklib.NewFileError("Open virtual disk file", err)
+	}
+	metadata, vErr := loadFileMetadata(path)
+	if vErr != nil {
+		file.Close()
+		return nil, vErr
+	}
+	return newFileBackend(file, path, readOnly, false, disklib.VixDiskLibSectorType(stat.Size()/disklib.VIXDISKLIB_SECTOR_SIZE), metadata), nil
+}
+
+// CreateFileBackend creates a sparse raw image of capacity sectors and opens it
+// for writing. An existing file at path is an error.
+func CreateFileBackend(path string, capacity disklib.VixDiskLibSectorType) (DiskBackend, disklib.VddkError) {
+	return createFileBackend(path, capacity, false)
+}
+
+// CreateSparseFileBackend is CreateFileBackend for a raw image that stays
+// sparse: blocks of SparseBlockSize bytes written as zeros become holes.
+func CreateSparseFileBackend(path string, capacity disklib.VixDiskLibSectorType) (DiskBackend, disklib.VddkError) {
+	return createFileBackend(path, capacity, true)
+}
+
+func createFileBackend(path string, capacity disklib.VixDiskLibSectorType, sparse bool) (DiskBackend, disklib.VddkError) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, disklib.NewFileError("Create a virtual disk", err)
+	}
+	err = file.Truncate(int64(capacity) * disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, disklib.NewFileError("Create a virtual disk", err)
+	}
+	return newFileBackend(file, path, false, sparse, capacity, make(MetadataTable)), nil
+}
+
+func newFileBackend(file *os.File, path string, readOnly bool, sparse bool, capacity disklib.VixDiskLibSectorType, metadata MetadataTable) fileBackend {
+	var mutex sync.Mutex
+	return fileBackend{
+		mutex:    &mutex,
+		file:     file,
+		path:     path,
+		readOnly: readOnly,
+		sparse:   sparse,
+		capacity: capacity,
+		metadata: metadata,
+	}
+}
+
+func loadFileMetadata(path string) (MetadataTable, disklib.VddkError) {
+	metadata := make(MetadataTable)
+	data, err := os.ReadFile(path + fileMetadataSuffix)
+	if os.IsNotExist(err) {
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, disklib.NewFileError("Read meta data from virtual disk file", err)
+	}
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, disklib.NewVddkError(disklib.VIX_E_DISK_INVAL, fmt.Sprintf("Read meta data from virtual disk file failed: %v.", err))
+	}
+	return metadata, nil
+}
+
+func (this fileBackend) ReadSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	vErr := CheckSectorRange("Read from virtual disk file", this.capacity, startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	_, err := this.file.ReadAt(buf[:numSectors*disklib.VIXDISKLIB_SECTOR_SIZE], int64(startSector)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Read from virtual disk file", err)
+	}
+	return nil
+}
+
+func (this fileBackend) WriteSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if this.readOnly {
+		return disklib.NewVddkError(disklib.VIX_E_FILE_READ_ONLY, fmt.Sprintf("Write to virtual disk file failed. The error code is %d.", disklib.VIX_E_FILE_READ_ONLY))
+	}
+	vErr := CheckSectorRange("Write to virtual disk file", this.capacity, startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	p := buf[:numSectors*disklib.VIXDISKLIB_SECTOR_SIZE]
+	off := int64(startSector) * disklib.VIXDISKLIB_SECTOR_SIZE
+	var err error
+	if this.sparse {
+		err = writeSparse(this.file, p, off)
+	} else {
+		_, err = this.file.WriteAt(p, off)
+	}
+	if err != nil {
+		return disklib.NewFileError("Write to virtual disk file", err)
+	}
+	return nil
+}
+
+func (this fileBackend) GetInfo() (disklib.VixDiskLibInfo, disklib.VddkError) {
+	return DefaultInfo(this.capacity), nil
+}
+
+// QueryAllocatedBlocks reports the chunks that hold data according to
+// SEEK_DATA and SEEK_HOLE, so the holes of a sparse raw image are left out.
+// Where the file system cannot tell, every chunk is allocated.
+func (this fileBackend) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	start := int64(startSector) * disklib.VIXDISKLIB_SECTOR_SIZE
+	ranges, err := dataRanges(this.file, start, start+int64(numSectors)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return nil, disklib.NewFileError("Query allocated blocks", err)
+	}
+	return AllocatedBlocks(this.capacity, startSector, numSectors, chunkSize, func(start disklib.VixDiskLibSectorType, length disklib.VixDiskLibSectorType) bool {
+		chunkStart := int64(start) * disklib.VIXDISKLIB_SECTOR_SIZE
+		chunkEnd := int64(start+length) * disklib.VIXDISKLIB_SECTOR_SIZE
+		i := sort.Search(len(ranges), func(i int) bool {
+			return ranges[i][1] > chunkStart
+		})
+		return i < len(ranges) && ranges[i][0] < chunkEnd
+	})
+}
+
+func (this fileBackend) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.metadata.GetMetadataKeys(buf, bufLen, requireLen)
+}
+
+func (this fileBackend) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.metadata.ReadMetadata(key, buf, bufLen, requiredLen)
+}
+
+func (this fileBackend) WriteMetadata(key string, buf []byte) disklib.VddkError {
+	if this.readOnly {
+		return disklib.NewVddkError(disklib.VIX_E_FILE_READ_ONLY, fmt.Sprintf("Write meta data failed. The error code is %d.", disklib.VIX_E_FILE_READ_ONLY))
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.metadata.WriteMetadata(key, buf)
+	data, err := json.Marshal(this.metadata)
+	if err != nil {
+		return disklib.NewVddkError(disklib.VIX_E_FAIL, fmt.Sprintf("Write meta data failed: %v.", err))
+	}
+	err = os.WriteFile(this.path+fileMetadataSuffix, data, 0644)
+	if err != nil {
+		return disklib.NewFileError("Write meta data", err)
+	}
+	return nil
+}
+
+func (this fileBackend) Close() disklib.VddkError {
+	err := this.file.Close()
+	if err != nil {
+		return disklib.NewFileError("Close virtual disk", err)
+	}
+	return nil
+}
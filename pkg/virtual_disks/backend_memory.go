@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"sync"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+// Grains of the in-memory disk are allocated on first write, so an untouched
+// memory disk costs nothing no matter how big it claims to be.
+const memoryGrainSectors = disklib.VIXDISKLIB_MIN_CHUNK_SIZE
+
+type memoryBackend struct {
+	mutex    *sync.Mutex
+	capacity disklib.VixDiskLibSectorType
+	grains   map[uint64][]byte
+	metadata MetadataTable
+}
+
+// NewMemoryBackend returns a thin, zero filled disk of capacity sectors that
+// lives in memory. Mostly useful for tests.
+func NewMemoryBackend(capacity disklib.VixDiskLibSectorType) DiskBackend {
+	var mutex sync.Mutex
+	return memoryBackend{
+		mutex:    &mutex,
+		capacity: capacity,
+		grains:   make(map[uint64][]byte),
+		metadata: make(MetadataTable),
+	}
+}
+
+func (this memoryBackend) ReadSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	vErr := CheckSectorRange("Read from virtual disk file", this.capacity, startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for sector := startSector; sector < startSector+numSectors; sector++ {
+		dst := buf[(sector-startSector)*disklib.VIXDISKLIB_SECTOR_SIZE : (sector-startSector+1)*disklib.VIXDISKLIB_SECTOR_SIZE]
+		grain, ok := this.grains[sector/memoryGrainSectors]
+		if !ok {
+			for i := range dst {
+				dst[i] = 0
+			}
+			continue
+		}
+		grainOff := (sector % memoryGrainSectors) * disklib.VIXDISKLIB_SECTOR_SIZE
+		copy(dst, grain[grainOff:grainOff+disklib.VIXDISKLIB_SECTOR_SIZE])
+	}
+	return nil
+}
+
+func (this memoryBackend) WriteSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	vErr := CheckSectorRange("Write to virtual disk file", this.capacity, startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for sector := startSector; sector < startSector+numSectors; sector++ {
+		src := buf[(sector-startSector)*disklib.VIXDISKLIB_SECTOR_SIZE : (sector-startSector+1)*disklib.VIXDISKLIB_SECTOR_SIZE]
+		grain, ok := this.grains[sector/memoryGrainSectors]
+		if !ok {
+			grain = make([]byte, memoryGrainSectors*disklib.VIXDISKLIB_SECTOR_SIZE)
+			this.grains[sector/memoryGrainSectors] = grain
+		}
+		grainOff := (sector % memoryGrainSectors) * disklib.VIXDISKLIB_SECTOR_SIZE
+		copy(grain[grainOff:grainOff+disklib.VIXDISKLIB_SECTOR_SIZE], src)
+	}
+	return nil
+}
+
+func (this memoryBackend) GetInfo() (disklib.VixDiskLibInfo, disklib.VddkError) {
+	return DefaultInfo(this.capacity), nil
+}
+
+func (this memoryBackend) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return AllocatedBlocks(this.capacity, startSector, numSectors, chunkSize, func(start disklib.VixDiskLibSectorType, length disklib.VixDiskLibSectorType) bool {
+		for grain := uint64(start) / memoryGrainSectors; grain*memoryGrainSectors < uint64(start+length); grain++ {
+			if _, ok := this.grains[grain]; ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (this memoryBackend) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.metadata.GetMetadataKeys(buf, bufLen, requireLen)
+}
+
+func (this memoryBackend) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.metadata.ReadMetadata(key, buf, bufLen, requiredLen)
+}
+
+func (this memoryBackend) WriteMetadata(key string, buf []byte) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.metadata.WriteMetadata(key, buf)
+	return nil
+}
+
+func (this memoryBackend) Close() disklib.VddkError {
+	return nil
+}
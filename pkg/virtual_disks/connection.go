@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/sirupsen/logrus"
+)
+
+// ConnectionManager shares one VixDiskLibConnection between all the disks
+// opened through it with the same disklib.ConnectionKey, so that backing up a
+// VM with many disks takes one vCenter session instead of one per disk. The
+// first disk of a key runs PrepareForAccess and ConnectEx, every disk holds a
+// reference to the connection, and closing the last one disconnects and runs
+// EndAccess. A ConnectionManager is safe for concurrent use.
+type ConnectionManager struct {
+	mutex       sync.Mutex
+	connections map[disklib.ConnectionKey]*Connection
+	logger      logrus.FieldLogger
+}
+
+// Connection is a connection held by a ConnectionManager.
+type Connection struct {
+	manager *ConnectionManager
+	key     disklib.ConnectionKey
+	params  disklib.ConnectParams
+	conn    disklib.VixDiskLibConnection
+	refs    int
+	// ready is closed once connecting is done, err is its result
+	ready chan struct{}
+	err   disklib.VddkError
+	// closed is made when the last reference is released and closed once
+	// EndAccess is done, so that the key is not connected again before that
+	closed chan struct{}
+}
+
+// NewConnectionManager returns a ConnectionManager holding no connections.
+func NewConnectionManager(logger logrus.FieldLogger) *ConnectionManager {
+	return &ConnectionManager{
+		connections: make(map[disklib.ConnectionKey]*Connection),
+		logger:      logger,
+	}
+}
+
+// Acquire returns the connection for params, connecting first if there is
+// none. Callers asking for a key that is being connected wait for it and get
+// the same result. Every successful Acquire must be matched by one Release.
+func (this *ConnectionManager) Acquire(params disklib.ConnectParams) (*Connection, disklib.VddkError) {
+	return this.AcquireContext(context.Background(), params)
+}
+
+// AcquireContext is Acquire that stops retrying to connect once ctx is done.
+func (this *ConnectionManager) AcquireContext(ctx context.Context, params disklib.ConnectParams) (*Connection, disklib.VddkError) {
+	key := params.ConnectionKey()
+	this.mutex.Lock()
+	for {
+		connection, ok := this.connections[key]
+		if !ok {
+			break
+		}
+		if connection.closed != nil {
+			closed := connection.closed
+			this.mutex.Unlock()
+			<-closed
+			this.mutex.Lock()
+			continue
+		}
+		connection.refs++
+		this.mutex.Unlock()
+		<-connection.ready
+		if connection.err != nil {
+			return nil, connection.err
+		}
+		return connection, nil
+	}
+	connection := &Connection{
+		manager: this,
+		key:     key,
+		params:  params,
+		refs:    1,
+		ready:   make(chan struct{}),
+	}
+	this.connections[key] = connection
+	this.mutex.Unlock()
+
+	connection.conn, connection.err = connect(ctx, params, this.logger)
+	if connection.err != nil {
+		this.mutex.Lock()
+		delete(this.connections, key)
+		this.mutex.Unlock()
+		close(connection.ready)
+		return nil, connection.err
+	}
+	this.logger.Infof("Connected to %s", key)
+	close(connection.ready)
+	return connection, nil
+}
+
+// NOTE: 与openSteps相同, 失败时撤销已完成的步骤
+func connect(ctx context.Context, params disklib.ConnectParams, logger logrus.FieldLogger) (disklib.VixDiskLibConnection, disklib.VddkError) {
+	retry := retryPolicy(logger)
+	err := retry.PrepareForAccess(ctx, params)
+	if err != nil {
+		return disklib.VixDiskLibConnection{}, wrapError(err, "PrepareForAccess", params)
+	}
+	conn, err := retry.ConnectEx(ctx, params)
+	if err != nil {
+		disklib.EndAccess(params)
+		return disklib.VixDiskLibConnection{}, wrapError(err, "ConnectEx", params)
+	}
+	return conn, nil
+}
+
+// Connections returns the number of connections currently held.
+func (this *ConnectionManager) Connections() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.connections)
+}
+
+// Open is virtual_disks.Open on a shared connection. Closing the returned
+// DiskReaderWriter closes the disk and releases the connection.
+func (this *ConnectionManager) Open(params disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return this.OpenContext(context.Background(), params, logger)
+}
+
+// OpenContext is Open that gives up when ctx is done, see virtual_disks.OpenContext.
+func (this *ConnectionManager) OpenContext(ctx context.Context, params disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return openAsync(ctx, func() (DiskReaderWriter, disklib.VddkError) {
+		return this.openSteps(ctx, params, logger)
+	})
+}
+
+func (this *ConnectionManager) openSteps(ctx context.Context, params disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	connection, err := this.AcquireContext(ctx, params)
+	if err != nil {
+		return DiskReaderWriter{}, err
+	}
+	if err = contextError(ctx, "Open"); err != nil {
+		connection.Release()
+		return DiskReaderWriter{}, err
+	}
+	dli, err := retryPolicy(logger).Open(ctx, connection.conn, params)
+	if err != nil {
+		connection.Release()
+		return DiskReaderWriter{}, wrapError(err, "Open", params)
+	}
+	info, err := disklib.GetInfo(dli)
+	if err != nil {
+		err = wrapError(err, "GetInfo", params)
+	} else {
+		err = contextError(ctx, "GetInfo")
+	}
+	if err != nil {
+		disklib.Close(dli)
+		connection.Release()
+		return DiskReaderWriter{}, err
+	}
+	diskHandle := NewDiskHandleWithInfo(NewSharedVddkBackend(dli, connection), info)
+	return NewDiskReaderWriter(diskHandle, logger), nil
+}
+
+// Conn returns the underlying VDDK connection.
+func (this *Connection) Conn() disklib.VixDiskLibConnection {
+	return this.conn
+}
+
+// Key returns the key the connection is shared under.
+func (this *Connection) Key() disklib.ConnectionKey {
+	return this.key
+}
+
+// Release drops one reference to the connection. Releasing the last one
+// disconnects and runs EndAccess, whose error is returned.
+func (this *Connection) Release() disklib.VddkError {
+	manager := this.manager
+	manager.mutex.Lock()
+	if this.refs <= 0 {
+		manager.mutex.Unlock()
+		return disklib.NewVddkError(disklib.VIX_E_INVALID_ARG, fmt.Sprintf("Release of %s failed. The connection is not held. The error code is %d.", this.key, disklib.VIX_E_INVALID_ARG))
+	}
+	this.refs--
+	if this.refs > 0 {
+		manager.mutex.Unlock()
+		return nil
+	}
+	this.closed = make(chan struct{})
+	manager.mutex.Unlock()
+
+	vErr := wrapError(disklib.Disconnect(this.conn), "Disconnect", this.params)
+	if err := disklib.EndAccess(this.params); vErr == nil {
+		vErr = wrapError(err, "EndAccess", this.params)
+	}
+	manager.mutex.Lock()
+	delete(manager.connections, this.key)
+	manager.mutex.Unlock()
+	close(this.closed)
+	manager.logger.Infof("Disconnected from %s", this.key)
+	return vErr
+}
+
+// sharedVddkBackend is a vddkBackend whose connection belongs to a
+// ConnectionManager.
+type sharedVddkBackend struct {
+	vddkBackend
+	connection *Connection
+	closed     *int32
+}
+
+// NewSharedVddkBackend wraps a disk handle opened with disklib.Open on a
+// shared connection. Closing the backend closes the handle and releases the
+// connection; closing it again does nothing.
+func NewSharedVddkBackend(dli disklib.VixDiskLibHandle, connection *Connection) DiskBackend {
+	var closed int32
+	return sharedVddkBackend{
+		vddkBackend: vddkBackend{
+			dli:    dli,
+			conn:   connection.conn,
+			params: connection.params,
+			retry:  disklib.DefaultRetryPolicy,
+		},
+		connection: connection,
+		closed:     &closed,
+	}
+}
+
+func (this sharedVddkBackend) Close() disklib.VddkError {
+	if !atomic.CompareAndSwapInt32(this.closed, 0, 1) {
+		return nil
+	}
+	vErr := wrapError(disklib.Close(this.dli), "Close", this.params)
+	if err := this.connection.Release(); vErr == nil {
+		vErr = err
+	}
+	return vErr
+}
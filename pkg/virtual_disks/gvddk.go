@@ -18,6 +18,7 @@ package virtual_disks
 
 import "C"
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
@@ -28,6 +29,13 @@ import (
 )
 
 func OpenFCD(serverName string, thumbPrint string, userName string, password string, fcdId string, fcdssid string, datastore string,
+	flags uint32, readOnly bool, transportMode string, identity string, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return OpenFCDContext(context.Background(), serverName, thumbPrint, userName, password, fcdId, fcdssid, datastore,
+		flags, readOnly, transportMode, identity, logger)
+}
+
+// OpenFCDContext is OpenFCD that gives up when ctx is done, see OpenContext.
+func OpenFCDContext(ctx context.Context, serverName string, thumbPrint string, userName string, password string, fcdId string, fcdssid string, datastore string,
 	flags uint32, readOnly bool, transportMode string, identity string, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
 	globalParams := disklib.NewConnectParams("",
 		serverName,
@@ -44,27 +52,88 @@ func OpenFCD(serverName string, thumbPrint string, userName string, password str
 		readOnly,
 		"",
 		transportMode)
-	return Open(globalParams, logger)
+	return OpenContext(ctx, globalParams, logger)
 }
 
 func Open(globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
-	err := disklib.PrepareForAccess(globalParams)
-	if err != nil {
+	return OpenContext(context.Background(), globalParams, logger)
+}
+
+type openResult struct {
+	diskReaderWriter DiskReaderWriter
+	err              disklib.VddkError
+}
+
+// OpenContext is Open that gives up when ctx is done. ctx is checked between
+// the prepare, connect, open and info steps. A step that is already running in
+// VDDK cannot be interrupted, so OpenContext returns right away and the disk is
+// closed in the background once that step finishes.
+func OpenContext(ctx context.Context, globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	return openAsync(ctx, func() (DiskReaderWriter, disklib.VddkError) {
+		return openSteps(ctx, globalParams, logger)
+	})
+}
+
+// openAsync runs steps in the background and returns when they are done or
+// ctx is done, whichever comes first. A disk opened after ctx is done is
+// closed.
+func openAsync(ctx context.Context, steps func() (DiskReaderWriter, disklib.VddkError)) (DiskReaderWriter, disklib.VddkError) {
+	if err := contextError(ctx, "Open"); err != nil {
 		return DiskReaderWriter{}, err
 	}
-	conn, err := disklib.ConnectEx(globalParams)
+	done := make(chan openResult, 1)
+	go func() {
+		diskReaderWriter, err := steps()
+		done <- openResult{diskReaderWriter, err}
+	}()
+	select {
+	case result := <-done:
+		return result.diskReaderWriter, result.err
+	case <-ctx.Done():
+		go func() {
+			result := <-done
+			if result.err == nil {
+				result.diskReaderWriter.Close()
+			}
+		}()
+		return DiskReaderWriter{}, contextError(ctx, "Open")
+	}
+}
+
+func openSteps(ctx context.Context, globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	retry := retryPolicy(logger)
+	err := retry.PrepareForAccess(ctx, globalParams)
 	if err != nil {
+		return DiskReaderWriter{}, wrapError(err, "PrepareForAccess", globalParams)
+	}
+	if err = contextError(ctx, "Connect"); err != nil {
 		disklib.EndAccess(globalParams)
 		return DiskReaderWriter{}, err
 	}
-	dli, err := disklib.Open(conn, globalParams)
+	conn, err := retry.ConnectEx(ctx, globalParams)
 	if err != nil {
+		disklib.EndAccess(globalParams)
+		return DiskReaderWriter{}, wrapError(err, "ConnectEx", globalParams)
+	}
+	if err = contextError(ctx, "Open"); err != nil {
 		disklib.Disconnect(conn)
 		disklib.EndAccess(globalParams)
 		return DiskReaderWriter{}, err
 	}
+	dli, err := retry.Open(ctx, conn, globalParams)
+	if err != nil {
+		disklib.Disconnect(conn)
+		disklib.EndAccess(globalParams)
+		return DiskReaderWriter{}, wrapError(err, "Open", globalParams)
+	}
 	info, err := disklib.GetInfo(dli)
 	if err != nil {
+		err = wrapError(err, "GetInfo", globalParams)
+	} else {
+		err = contextError(ctx, "GetInfo")
+	}
+	if err != nil {
+		disklib.Close(dli)
 		disklib.Disconnect(conn)
 		disklib.EndAccess(globalParams)
 		return DiskReaderWriter{}, err
@@ -73,6 +142,40 @@ func Open(globalParams disklib.ConnectParams, logger logrus.FieldLogger) (DiskRe
 	return NewDiskReaderWriter(diskHandle, logger), nil
 }
 
+// wrapError adds the operation, the disk path and the transport mode of
+// params to err.
+func wrapError(err disklib.VddkError, op string, params disklib.ConnectParams) disklib.VddkError {
+	return disklib.WrapError(err, op, params.Path(), params.TransportMode())
+}
+
+// retryPolicy returns disklib.DefaultRetryPolicy, logging to logger unless it
+// has a logger of its own.
+func retryPolicy(logger logrus.FieldLogger) disklib.RetryPolicy {
+	retry := disklib.DefaultRetryPolicy
+	if retry.Logger == nil {
+		retry.Logger = logger
+	}
+	return retry
+}
+
+// contextError returns a VIX_E_CANCELLED error once ctx is done.
+func contextError(ctx context.Context, op string) disklib.VddkError {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return disklib.NewVddkError(disklib.VIX_E_CANCELLED, fmt.Sprintf("%s cancelled: %v. The error code is %d.", op, ctx.Err(), disklib.VIX_E_CANCELLED))
+}
+
+// OpenBackend wraps an already opened DiskBackend in a DiskReaderWriter. Closing
+// the DiskReaderWriter closes the backend.
+func OpenBackend(backend DiskBackend, logger logrus.FieldLogger) (DiskReaderWriter, disklib.VddkError) {
+	diskHandle, err := NewBackendDiskHandle(backend)
+	if err != nil {
+		return DiskReaderWriter{}, err
+	}
+	return NewDiskReaderWriter(diskHandle, logger), nil
+}
+
 type DiskReaderWriter struct {
 	diskHandle DiskConnectHandle
 	offset     *int64
@@ -127,10 +230,26 @@ func (this DiskReaderWriter) WriteAt(p []byte, off int64) (n int, err error) {
 	return this.diskHandle.WriteAt(p, off)
 }
 
+// ReadAtContext is ReadAt that stops between batches of ContextBatchSize bytes
+// once ctx is done.
+func (this DiskReaderWriter) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	return this.diskHandle.ReadAtContext(ctx, p, off)
+}
+
+// WriteAtContext is WriteAt that stops between batches of ContextBatchSize
+// bytes once ctx is done.
+func (this DiskReaderWriter) WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	return this.diskHandle.WriteAtContext(ctx, p, off)
+}
+
 func (this DiskReaderWriter) Close() error {
 	return this.diskHandle.Close()
 }
 
+func (this DiskReaderWriter) Capacity() int64 {
+	return this.diskHandle.Capacity()
+}
+
 func (this DiskReaderWriter) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
 	return this.diskHandle.QueryAllocatedBlocks(startSector, numSectors, chunkSize)
 }
@@ -149,23 +268,43 @@ func NewDiskReaderWriter(diskHandle DiskConnectHandle, logger logrus.FieldLogger
 }
 
 type DiskConnectHandle struct {
-	mutex  *sync.Mutex
-	dli    disklib.VixDiskLibHandle
-	conn   disklib.VixDiskLibConnection
-	params disklib.ConnectParams
-	info   disklib.VixDiskLibInfo
+	mutex   *sync.Mutex
+	backend DiskBackend
+	info    disklib.VixDiskLibInfo
+	limiter *Limiter
 }
 
 func NewDiskHandle(dli disklib.VixDiskLibHandle, conn disklib.VixDiskLibConnection, params disklib.ConnectParams,
 	info disklib.VixDiskLibInfo) DiskConnectHandle {
+	return NewDiskHandleWithInfo(NewVddkBackend(dli, conn, params), info)
+}
+
+// NewDiskHandleWithInfo builds a DiskConnectHandle on top of any DiskBackend
+// whose info is already known.
+func NewDiskHandleWithInfo(backend DiskBackend, info disklib.VixDiskLibInfo) DiskConnectHandle {
 	var mutex sync.Mutex
 	return DiskConnectHandle{
-		mutex:  &mutex,
-		dli:    dli,
-		conn:   conn,
-		params: params,
-		info:   info,
+		mutex:   &mutex,
+		backend: backend,
+		info:    info,
+	}
+}
+
+// NewBackendDiskHandle builds a DiskConnectHandle on top of any DiskBackend.
+func NewBackendDiskHandle(backend DiskBackend) (DiskConnectHandle, disklib.VddkError) {
+	info, err := backend.GetInfo()
+	if err != nil {
+		return DiskConnectHandle{}, err
 	}
+	return NewDiskHandleWithInfo(backend, info), nil
+}
+
+// WithLimiter returns a handle to the same disk whose ReadAt and WriteAt, and
+// their Context variants, are throttled by limiter. A nil limiter removes the
+// throttling.
+func (this DiskConnectHandle) WithLimiter(limiter *Limiter) DiskConnectHandle {
+	this.limiter = limiter
+	return this
 }
 
 func mapError(vddkError disklib.VddkError) error {
@@ -182,6 +321,14 @@ func aligned(len int, off int64) bool {
 }
 
 func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
+	err = this.limiter.Wait(context.Background(), len(p))
+	if err != nil {
+		return 0, err
+	}
+	return this.readAt(context.Background(), p, off)
+}
+
+func (this DiskConnectHandle) readAt(ctx context.Context, p []byte, off int64) (n int, err error) {
 	capacity := this.Capacity()
 	if off >= capacity {
 		return 0, io.EOF
@@ -203,7 +350,7 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 	// Start missing aligned part
 	if off%disklib.VIXDISKLIB_SECTOR_SIZE != 0 {
 		tmpBuf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
-		err := disklib.Read(this.dli, (uint64)(startSector), 1, tmpBuf)
+		err := this.readSectors(ctx, (uint64)(startSector), 1, tmpBuf)
 		if err != nil {
 			return 0, mapError(err)
 		}
@@ -223,7 +370,7 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 	if numAlignedSectors > 0 {
 		desOff := total
 		desEnd := total + numAlignedSectors*disklib.VIXDISKLIB_SECTOR_SIZE
-		err := disklib.Read(this.dli, (uint64)(startSector), (uint64)(numAlignedSectors), p[desOff:desEnd])
+		err := this.readSectors(ctx, (uint64)(startSector), (uint64)(numAlignedSectors), p[desOff:desEnd])
 		if err != nil {
 			return total, mapError(err)
 		}
@@ -233,7 +380,7 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 	// End missing aligned part
 	if (len(p) - total) > 0 {
 		tmpBuf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
-		err := disklib.Read(this.dli, (uint64)(startSector), 1, tmpBuf)
+		err := this.readSectors(ctx, (uint64)(startSector), 1, tmpBuf)
 		if err != nil {
 			return total, mapError(err)
 		}
@@ -246,6 +393,14 @@ func (this DiskConnectHandle) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
+	err = this.limiter.Wait(context.Background(), len(p))
+	if err != nil {
+		return 0, err
+	}
+	return this.writeAt(context.Background(), p, off)
+}
+
+func (this DiskConnectHandle) writeAt(ctx context.Context, p []byte, off int64) (n int, err error) {
 	capacity := this.Capacity()
 	// Just error if either the beginning or the end of the write extends beyond the end
 	if off > capacity || off+int64(len(p)) > capacity {
@@ -265,7 +420,7 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 	// Start missing aligned part
 	if off%disklib.VIXDISKLIB_SECTOR_SIZE != 0 {
 		tmpBuf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
-		err := disklib.Read(this.dli, uint64(startSector), 1, tmpBuf)
+		err := this.readSectors(ctx, uint64(startSector), 1, tmpBuf)
 		if err != nil {
 			return 0, mapError(err)
 		}
@@ -277,7 +432,7 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 		desEnd := desOff + count
 		srcEnd = srcOff + count
 		copy(tmpBuf[desOff:desEnd], p[srcOff:srcEnd])
-		err = disklib.Write(this.dli, uint64(startSector), 1, tmpBuf)
+		err = this.writeSectors(ctx, uint64(startSector), 1, tmpBuf)
 		if err != nil {
 			return 0, mapError(err)
 		}
@@ -289,7 +444,7 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 	if (int64(len(p))-total)/disklib.VIXDISKLIB_SECTOR_SIZE > 0 {
 		numSector := (int64(len(p)) - total) / disklib.VIXDISKLIB_SECTOR_SIZE
 		srcEnd = srcOff + numSector*disklib.VIXDISKLIB_SECTOR_SIZE
-		err := disklib.Write(this.dli, uint64(startSector), uint64(numSector), p[srcOff:srcEnd])
+		err := this.writeSectors(ctx, uint64(startSector), uint64(numSector), p[srcOff:srcEnd])
 		if err != nil {
 			return int(total), mapError(err)
 		}
@@ -302,12 +457,12 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 		count := int64(len(p)) - total
 		srcEnd = srcOff + count
 		tmpBuf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
-		err := disklib.Read(this.dli, uint64(startSector), 1, tmpBuf)
+		err := this.readSectors(ctx, uint64(startSector), 1, tmpBuf)
 		if err != nil {
 			return int(total), mapError(err)
 		}
 		copy(tmpBuf[:count], p[srcOff:srcEnd])
-		err = disklib.Write(this.dli, uint64(startSector), 1, tmpBuf)
+		err = this.writeSectors(ctx, uint64(startSector), 1, tmpBuf)
 		if err != nil {
 			return int(total), errors.Wrap(err, "Write into disk in part 3 failed part3.")
 		}
@@ -315,22 +470,103 @@ func (this DiskConnectHandle) WriteAt(p []byte, off int64) (n int, err error) {
 	return len(p), nil
 }
 
-func (this DiskConnectHandle) Close() error {
-	vErr := disklib.Close(this.dli)
-	if vErr != nil {
-		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+// readSectors reads from the backend, giving up once ctx is done if the
+// backend supports it.
+func (this DiskConnectHandle) readSectors(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if backend, ok := this.backend.(ContextDiskBackend); ok {
+		return backend.ReadSectorsContext(ctx, startSector, numSectors, buf)
 	}
+	return this.backend.ReadSectors(startSector, numSectors, buf)
+}
 
-	vErr = disklib.Disconnect(this.conn)
-	if vErr != nil {
-		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+// writeSectors writes to the backend, giving up once ctx is done if the
+// backend supports it.
+func (this DiskConnectHandle) writeSectors(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if backend, ok := this.backend.(ContextDiskBackend); ok {
+		return backend.WriteSectorsContext(ctx, startSector, numSectors, buf)
 	}
+	return this.backend.WriteSectors(startSector, numSectors, buf)
+}
 
-	vErr = disklib.EndAccess(this.params)
-	if vErr != nil {
-		return errors.New(fmt.Sprintf(vErr.Error()+" with error code: %d", vErr.VixErrorCode()))
+// ContextBatchSize is how many bytes ReadAtContext and WriteAtContext move in
+// one backend call before checking their context again.
+const ContextBatchSize = 1024 * 1024
+
+// batchLen returns the length of the batch that starts at off, cut at the next
+// ContextBatchSize boundary so that the middle batches stay sector aligned.
+func batchLen(off int64, remaining int) int {
+	n := ContextBatchSize - int(off%ContextBatchSize)
+	if n > remaining {
+		n = remaining
+	}
+	return n
+}
+
+// ReadAtContext is ReadAt split into batches of at most ContextBatchSize bytes.
+// When ctx is done between batches it returns the bytes read so far and
+// ctx.Err(). A read that runs past the end of the disk returns the bytes up to
+// the end and io.EOF.
+func (this DiskConnectHandle) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	capacity := this.Capacity()
+	if off >= capacity {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > capacity {
+		p = p[:capacity-off]
+		eof = io.EOF
+	}
+	total := 0
+	for total < len(p) {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		count := batchLen(off+int64(total), len(p)-total)
+		if err := this.limiter.Wait(ctx, count); err != nil {
+			return total, err
+		}
+		_, err := this.readAt(ctx, p[total:total+count], off+int64(total))
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, eof
+}
+
+// WriteAtContext is WriteAt split into batches of at most ContextBatchSize
+// bytes. When ctx is done between batches it returns the bytes written so far
+// and ctx.Err().
+func (this DiskConnectHandle) WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	capacity := this.Capacity()
+	if off > capacity || off+int64(len(p)) > capacity {
+		return 0, io.ErrShortWrite
 	}
+	total := 0
+	for total < len(p) {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		count := batchLen(off+int64(total), len(p)-total)
+		if err := this.limiter.Wait(ctx, count); err != nil {
+			return total, err
+		}
+		_, err := this.writeAt(ctx, p[total:total+count], off+int64(total))
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
 
+// Close closes the backend. A failure is returned as the disklib.VddkError of
+// the backend, so errors.Is and errors.As work on it.
+func (this DiskConnectHandle) Close() error {
+	vErr := this.backend.Close()
+	if vErr != nil {
+		return vErr
+	}
 	return nil
 }
 
@@ -338,19 +574,24 @@ func (this DiskConnectHandle) Capacity() int64 {
 	return int64(this.info.Capacity) * disklib.VIXDISKLIB_SECTOR_SIZE
 }
 
-// QueryAllocatedBlocks invokes the VDDK function of the same name.
+// Info returns the geometry the disk was opened with.
+func (this DiskConnectHandle) Info() disklib.VixDiskLibInfo {
+	return this.info
+}
+
+// QueryAllocatedBlocks asks the backend which chunks of the disk hold data.
 func (this DiskConnectHandle) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
-	return disklib.QueryAllocatedBlocks(this.dli, startSector, numSectors, chunkSize)
+	return this.backend.QueryAllocatedBlocks(startSector, numSectors, chunkSize)
 }
 
 func (this DiskConnectHandle) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
-	return disklib.GetMetadataKeys(this.dli, buf, bufLen, requireLen)
+	return this.backend.GetMetadataKeys(buf, bufLen, requireLen)
 }
 
 func (this DiskConnectHandle) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
-	return disklib.ReadMetadata(this.dli, key, buf, bufLen, requiredLen)
+	return this.backend.ReadMetadata(key, buf, bufLen, requiredLen)
 }
 
 func (this DiskConnectHandle) WriteMetadata(key string, buf []byte) disklib.VddkError {
-	return disklib.WriteMetadata(this.dli, key, buf)
+	return this.backend.WriteMetadata(key, buf)
 }
@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+// SparseBlockSize is the granularity at which a sparse raw image turns zeros
+// into holes, the block size of common file systems.
+const SparseBlockSize = 4096
+
+var errPunchHoleUnsupported = errors.New("punching holes is not supported")
+
+var zeroPage = make([]byte, 64*1024)
+
+// IsZero reports whether p holds only zeros.
+func IsZero(p []byte) bool {
+	for len(p) > len(zeroPage) {
+		if !bytes.Equal(p[:len(zeroPage)], zeroPage) {
+			return false
+		}
+		p = p[len(zeroPage):]
+	}
+	return bytes.Equal(p, zeroPage[:len(p)])
+}
+
+// NOTE: 按文件系统块把buf分成全零和非零的连续段, 非零段正常写入, 全零段打洞;
+// 文件系统不支持打洞时退回到写零
+func writeSparse(file *os.File, buf []byte, off int64) error {
+	end := off + int64(len(buf))
+	for pos := off; pos < end; {
+		runZero := false
+		runEnd := pos
+		for runEnd < end {
+			next := (runEnd/SparseBlockSize + 1) * SparseBlockSize
+			if next > end {
+				next = end
+			}
+			zero := IsZero(buf[runEnd-off : next-off])
+			if runEnd == pos {
+				runZero = zero
+			} else if zero != runZero {
+				break
+			}
+			runEnd = next
+		}
+		p := buf[pos-off : runEnd-off]
+		if runZero {
+			err := punchHole(file, pos, runEnd-pos)
+			if err == nil {
+				pos = runEnd
+				continue
+			}
+			if err != errPunchHoleUnsupported {
+				return err
+			}
+		}
+		if _, err := file.WriteAt(p, pos); err != nil {
+			return err
+		}
+		pos = runEnd
+	}
+	return nil
+}
+
+// ExportSparseRaw writes src to a new sparse raw image at path. Only the
+// allocated extents of src are read, the rest of the image is left as a hole
+// by extending the file past it, and zero filled blocks inside the extents
+// become holes too. Read back with OpenFileBackend, the image reports its
+// allocation through SEEK_DATA and SEEK_HOLE.
+func ExportSparseRaw(path string, src DiskSource) error {
+	capacity := disklib.VixDiskLibSectorType(src.Capacity() / disklib.VIXDISKLIB_SECTOR_SIZE)
+	backend, vErr := CreateSparseFileBackend(path, capacity)
+	if vErr != nil {
+		return vErr
+	}
+	dst := NewDiskHandleWithInfo(backend, DefaultInfo(capacity))
+	err := copyAllocated(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyAllocated(dst io.WriterAt, src DiskSource) error {
+	extents, vErr := QueryAllocatedExtents(src, disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	if vErr != nil {
+		return vErr
+	}
+	buf := make([]byte, 1024*1024)
+	for _, extent := range extents {
+		start := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		for off := start; off < end; {
+			p := buf
+			if end-off < int64(len(p)) {
+				p = buf[:end-off]
+			}
+			_, err := src.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ReadAt(%d): %v", off, err)
+			}
+			// The new image reads as zeros already
+			if IsZero(p) {
+				off += int64(len(p))
+				continue
+			}
+			_, err = dst.WriteAt(p, off)
+			if err != nil {
+				return fmt.Errorf("WriteAt(%d): %v", off, err)
+			}
+			off += int64(len(p))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek and fallocate arguments of Linux that package syscall does not name
+const (
+	seekData        = 3
+	seekHole        = 4
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// dataRanges returns the ranges of [start, end) that hold data according to
+// SEEK_DATA and SEEK_HOLE. A file system without them reports everything as
+// data.
+func dataRanges(file *os.File, start int64, end int64) ([][2]int64, error) {
+	var ranges [][2]int64
+	for off := start; off < end; {
+		data, err := file.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return [][2]int64{{start, end}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data >= end {
+			break
+		}
+		hole, err := file.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > end {
+			hole = end
+		}
+		ranges = append(ranges, [2]int64{data, hole})
+		off = hole
+	}
+	return ranges, nil
+}
+
+// punchHole deallocates length bytes at off, which read as zeros afterwards.
+// It fails with errPunchHoleUnsupported where the file system cannot do it.
+func punchHole(file *os.File, off int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, off, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errPunchHoleUnsupported
+	}
+	return err
+}
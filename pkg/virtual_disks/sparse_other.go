@@ -0,0 +1,30 @@
+//go:build !linux
+
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import "os"
+
+// dataRanges reports everything as data where SEEK_DATA is not known.
+func dataRanges(file *os.File, start int64, end int64) ([][2]int64, error) {
+	return [][2]int64{{start, end}}, nil
+}
+
+func punchHole(file *os.File, off int64, length int64) error {
+	return errPunchHoleUnsupported
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtual_disks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxLimiterSleep bounds a single sleep of Limiter.Wait, so that a change of
+// the limits is picked up by operations that are already waiting.
+const maxLimiterSleep = 100 * time.Millisecond
+
+// Limiter caps the throughput of disk IO in bytes per second and operations
+// per second. A limit of zero means unlimited. Up to one second worth of
+// unused budget is kept for bursts; an operation bigger than the budget is
+// let through and paid for by the ones after it. The limits can be changed
+// while IO is running. A Limiter is safe for concurrent use and may be shared
+// by several disks, and a nil Limiter does not limit anything.
+type Limiter struct {
+	mutex       sync.Mutex
+	bytesPerSec int64
+	opsPerSec   float64
+	bytes       float64
+	ops         float64
+	last        time.Time
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSec bytes and opsPerSec
+// operations per second.
+func NewLimiter(bytesPerSec int64, opsPerSec float64) *Limiter {
+	this := &Limiter{last: time.Now()}
+	this.SetLimits(bytesPerSec, opsPerSec)
+	return this
+}
+
+// SetLimits changes the limits. Operations waiting in Wait are released at the
+// new rate.
+func (this *Limiter) SetLimits(bytesPerSec int64, opsPerSec float64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.refillLocked(time.Now())
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	if opsPerSec < 0 {
+		opsPerSec = 0
+	}
+	this.bytesPerSec = bytesPerSec
+	this.opsPerSec = opsPerSec
+	this.refillLocked(time.Now())
+}
+
+// Limits returns the current limits.
+func (this *Limiter) Limits() (bytesPerSec int64, opsPerSec float64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.bytesPerSec, this.opsPerSec
+}
+
+// NOTE: 按经过的时间补充配额, 最多保留1秒的配额; 不限速时清空欠账
+func (this *Limiter) refillLocked(now time.Time) {
+	elapsed := now.Sub(this.last).Seconds()
+	this.last = now
+	if this.bytesPerSec == 0 {
+		this.bytes = 0
+	} else {
+		rate := float64(this.bytesPerSec)
+		this.bytes += elapsed * rate
+		if this.bytes > rate {
+			this.bytes = rate
+		}
+	}
+	if this.opsPerSec == 0 {
+		this.ops = 0
+	} else {
+		this.ops += elapsed * this.opsPerSec
+		if this.ops > this.opsPerSec {
+			this.ops = this.opsPerSec
+		}
+	}
+}
+
+// Wait blocks until one operation of n bytes is allowed, or ctx is done.
+func (this *Limiter) Wait(ctx context.Context, n int) error {
+	if this == nil {
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		this.mutex.Lock()
+		this.refillLocked(time.Now())
+		var delay time.Duration
+		if this.bytes < 0 {
+			delay = time.Duration(-this.bytes / float64(this.bytesPerSec) * float64(time.Second))
+		}
+		if this.ops < 0 {
+			opsDelay := time.Duration(-this.ops / this.opsPerSec * float64(time.Second))
+			if opsDelay > delay {
+				delay = opsDelay
+			}
+		}
+		if delay <= 0 {
+			if this.bytesPerSec != 0 {
+				this.bytes -= float64(n)
+			}
+			if this.opsPerSec != 0 {
+				this.ops--
+			}
+			this.mutex.Unlock()
+			return nil
+		}
+		this.mutex.Unlock()
+
+		if delay > maxLimiterSleep {
+			delay = maxLimiterSleep
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
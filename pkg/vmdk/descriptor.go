@@ -0,0 +1,233 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmdk
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+const ddbPrefix = "ddb."
+
+// Descriptor is the text descriptor embedded in a hosted sparse extent.
+type Descriptor struct {
+	Version    int
+	CID        uint32
+	ParentCID  uint32
+	CreateType string
+	Extents    []ExtentLine
+	// DDB holds the disk database without the "ddb." prefix, which is how
+	// VDDK reports it through GetMetadataKeys.
+	DDB     virtual_disks.MetadataTable
+	ddbKeys []string
+}
+
+// ExtentLine is one line of the extent description section.
+type ExtentLine struct {
+	Access   string
+	Sectors  uint64
+	Type     string
+	FileName string
+	Offset   uint64
+}
+
+func newDescriptor(createType string, extents []ExtentLine) *Descriptor {
+	return &Descriptor{
+		Version:    1,
+		CID:        0xfffffffe,
+		ParentCID:  0xffffffff,
+		CreateType: createType,
+		Extents:    extents,
+		DDB:        make(virtual_disks.MetadataTable),
+	}
+}
+
+// Set adds or replaces a disk database entry, keeping the order entries were
+// first seen in.
+func (d *Descriptor) Set(key string, value string) {
+	if _, ok := d.DDB[key]; !ok {
+		d.ddbKeys = append(d.ddbKeys, key)
+	}
+	d.DDB[key] = value
+}
+
+func (d *Descriptor) unset(key string) {
+	delete(d.DDB, key)
+	for i, k := range d.ddbKeys {
+		if k == key {
+			d.ddbKeys = append(d.ddbKeys[:i], d.ddbKeys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the disk database keys in file order.
+func (d *Descriptor) Keys() []string {
+	return append([]string(nil), d.ddbKeys...)
+}
+
+func parseDescriptor(text string) (*Descriptor, error) {
+	d := newDescriptor("", nil)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if extent, ok, err := parseExtentLine(line); ok {
+			if err != nil {
+				return nil, err
+			}
+			d.Extents = append(d.Extents, extent)
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("malformed descriptor line %q", line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.Trim(strings.TrimSpace(line[eq+1:]), "\"")
+		switch {
+		case strings.HasPrefix(key, ddbPrefix):
+			d.Set(strings.TrimPrefix(key, ddbPrefix), value)
+		case key == "version":
+			d.Version, _ = strconv.Atoi(value)
+		case key == "CID":
+			cid, _ := strconv.ParseUint(value, 16, 32)
+			d.CID = uint32(cid)
+		case key == "parentCID":
+			cid, _ := strconv.ParseUint(value, 16, 32)
+			d.ParentCID = uint32(cid)
+		case key == "createType":
+			d.CreateType = value
+		}
+	}
+	return d, scanner.Err()
+}
+
+func parseExtentLine(line string) (ExtentLine, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return ExtentLine{}, false, nil
+	}
+	switch fields[0] {
+	case "RW", "RDONLY", "NOACCESS":
+	default:
+		return ExtentLine{}, false, nil
+	}
+	sectors, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ExtentLine{}, true, fmt.Errorf("malformed extent line %q", line)
+	}
+	// The file name is quoted and may contain spaces
+	open := strings.Index(line, "\"")
+	end := strings.LastIndex(line, "\"")
+	if open < 0 || end <= open {
+		return ExtentLine{}, true, fmt.Errorf("malformed extent line %q", line)
+	}
+	extent := ExtentLine{
+		Access:   fields[0],
+		Sectors:  sectors,
+		Type:     fields[2],
+		FileName: line[open+1 : end],
+	}
+	if rest := strings.Fields(line[end+1:]); len(rest) > 0 {
+		extent.Offset, _ = strconv.ParseUint(rest[0], 10, 64)
+	}
+	return extent, true, nil
+}
+
+func (d *Descriptor) String() string {
+	var b strings.Builder
+	b.WriteString("# Disk DescriptorFile\n")
+	fmt.Fprintf(&b, "version=%d\n", d.Version)
+	b.WriteString("encoding=\"UTF-8\"\n")
+	fmt.Fprintf(&b, "CID=%08x\n", d.CID)
+	fmt.Fprintf(&b, "parentCID=%08x\n", d.ParentCID)
+	fmt.Fprintf(&b, "createType=\"%s\"\n", d.CreateType)
+	b.WriteString("\n# Extent description\n")
+	for _, extent := range d.Extents {
+		fmt.Fprintf(&b, "%s %d %s \"%s\"", extent.Access, extent.Sectors, extent.Type, extent.FileName)
+		if extent.Offset != 0 {
+			fmt.Fprintf(&b, " %d", extent.Offset)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	for _, key := range d.ddbKeys {
+		fmt.Fprintf(&b, "%s%s = \"%s\"\n", ddbPrefix, key, d.DDB[key])
+	}
+	return b.String()
+}
+
+func adapterName(adapterType disklib.VixDiskLibAdapterType) string {
+	switch adapterType {
+	case disklib.VIXDISKLIB_ADAPTER_IDE:
+		return "ide"
+	case disklib.VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC:
+		return "buslogic"
+	default:
+		return "lsilogic"
+	}
+}
+
+func adapterType(name string) disklib.VixDiskLibAdapterType {
+	switch name {
+	case "ide":
+		return disklib.VIXDISKLIB_ADAPTER_IDE
+	case "buslogic":
+		return disklib.VIXDISKLIB_ADAPTER_SCSI_BUSLOGIC
+	case "lsilogic":
+		return disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC
+	default:
+		return disklib.VIXDISKLIB_ADAPTER_UNKNOWN
+	}
+}
+
+// info turns the disk database into the VixDiskLibInfo VDDK would report.
+func (d *Descriptor) info(capacity disklib.VixDiskLibSectorType) disklib.VixDiskLibInfo {
+	atoi := func(key string) uint32 {
+		v, _ := strconv.ParseUint(d.DDB[key], 10, 32)
+		return uint32(v)
+	}
+	geo := disklib.VixDiskLibGeometry{
+		Cylinders: atoi("geometry.cylinders"),
+		Heads:     atoi("geometry.heads"),
+		Sectors:   atoi("geometry.sectors"),
+	}
+	bios := geo
+	if _, ok := d.DDB["geometry.biosCylinders"]; ok {
+		bios = disklib.VixDiskLibGeometry{
+			Cylinders: atoi("geometry.biosCylinders"),
+			Heads:     atoi("geometry.biosHeads"),
+			Sectors:   atoi("geometry.biosSectors"),
+		}
+	}
+	return disklib.VixDiskLibInfo{
+		BiosGeo:     bios,
+		PhysGeo:     geo,
+		Capacity:    capacity,
+		AdapterType: adapterType(d.DDB["adapterType"]),
+		NumLinks:    1,
+		Uuid:        d.DDB["uuid"],
+	}
+}
@@ -0,0 +1,709 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vmdk reads and writes hosted sparse VMDK extents natively, without
+// going through libvixDiskLib. See the "Virtual Disk Format 5.0" specification
+// for the on-disk layout.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// Sparse extent header constants
+const (
+	SparseMagicNumber = 0x564d444b // "KDMV"
+
+	FlagValidNewLineDetection = 1 << 0
+	FlagRedundantGrainTable   = 1 << 1
+	FlagZeroedGrainTableEntry = 1 << 2
+	FlagCompressedGrains      = 1 << 16
+	FlagMarkers               = 1 << 17
+
+	// GDAtEnd in GDOffset means the grain directory is in the footer.
+	GDAtEnd = 0xffffffffffffffff
+
+	DefaultGrainSize      = 128 // sectors, 64KB
+	NumGTEsPerGT          = 512
+	DefaultDescriptorSize = 20 // sectors
+
+	// Grain table entries below this value do not point at data
+	gteUnallocated = 0
+	gteZeroed      = 1
+)
+
+// SparseExtentHeader is the first sector of a hosted sparse extent.
+type SparseExtentHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+func newSparseExtentHeader(version uint32, flags uint32, capacity uint64) SparseExtentHeader {
+	return SparseExtentHeader{
+		MagicNumber:        SparseMagicNumber,
+		Version:            version,
+		Flags:              flags,
+		Capacity:           capacity,
+		GrainSize:          DefaultGrainSize,
+		NumGTEsPerGT:       NumGTEsPerGT,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+}
+
+// Bytes returns the header as the sector written to disk.
+func (h SparseExtentHeader) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
+
+func parseSparseExtentHeader(sector []byte) (SparseExtentHeader, error) {
+	var h SparseExtentHeader
+	err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &h)
+	if err != nil {
+		return h, err
+	}
+	if h.MagicNumber != SparseMagicNumber {
+		return h, fmt.Errorf("bad magic number %#x", h.MagicNumber)
+	}
+	return h, nil
+}
+
+// numGrainTables returns how many grain tables a disk of the given capacity needs.
+func numGrainTables(capacity uint64, grainSize uint64) uint64 {
+	numGrains := (capacity + grainSize - 1) / grainSize
+	return (numGrains + NumGTEsPerGT - 1) / NumGTEsPerGT
+}
+
+func sectorsFor(numBytes uint64) uint64 {
+	return (numBytes + disklib.VIXDISKLIB_SECTOR_SIZE - 1) / disklib.VIXDISKLIB_SECTOR_SIZE
+}
+
+// gtSectors is the size of one grain table on disk.
+const gtSectors = NumGTEsPerGT * 4 / disklib.VIXDISKLIB_SECTOR_SIZE
+
+func formatError(err error) disklib.VddkError {
+	return disklib.NewVddkError(disklib.VIX_E_DISK_INVAL, fmt.Sprintf("Open virtual disk file failed: %v. The error code is %d.", err, disklib.VIX_E_DISK_INVAL))
+}
+
+// sparseDisk is a DiskBackend for a monolithicSparse VMDK file, or a read only
+// one for a streamOptimized file.
+type sparseDisk struct {
+	mutex    *sync.Mutex
+	file     *os.File
+	readOnly bool
+	header   SparseExtentHeader
+	desc     *Descriptor
+	// gd and rgd hold the primary and redundant grain directories. rgd is
+	// empty if the extent has no redundant tables.
+	gd  []uint32
+	rgd []uint32
+	// gts caches grain tables by grain directory index
+	gts map[uint64][]uint32
+	// nextSector is where the next grain or grain table is appended
+	nextSector *uint64
+}
+
+// OpenBackend opens an existing monolithicSparse VMDK file. streamOptimized
+// files can only be opened read only.
+func OpenBackend(path string, readOnly bool) (virtual_disks.DiskBackend, disklib.VddkError) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, disklib.NewFileError("Open virtual disk file", err)
+	}
+	disk, vErr := loadSparseDisk(file, readOnly)
+	if vErr != nil {
+		file.Close()
+		return nil, vErr
+	}
+	return disk, nil
+}
+
+// Open opens an existing monolithicSparse or, read only, streamOptimized VMDK
+// file and returns a handle with the same ReadAt/WriteAt/QueryAllocatedBlocks
+// surface as a VDDK disk.
+func Open(path string, readOnly bool) (virtual_disks.DiskConnectHandle, disklib.VddkError) {
+	backend, err := OpenBackend(path, readOnly)
+	if err != nil {
+		return virtual_disks.DiskConnectHandle{}, err
+	}
+	return virtual_disks.NewBackendDiskHandle(backend)
+}
+
+func loadSparseDisk(file *os.File, readOnly bool) (sparseDisk, disklib.VddkError) {
+	sector := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	_, err := file.ReadAt(sector, 0)
+	if err != nil {
+		return sparseDisk{}, disklib.NewFileError("Open virtual disk file", err)
+	}
+	header, err := parseSparseExtentHeader(sector)
+	if err != nil {
+		return sparseDisk{}, formatError(err)
+	}
+	if header.Flags&(FlagCompressedGrains|FlagMarkers) != 0 || header.GDOffset == GDAtEnd {
+		if !readOnly {
+			return sparseDisk{}, disklib.NewVddkError(disklib.VIX_E_NOT_SUPPORTED,
+				fmt.Sprintf("Open virtual disk file failed: stream optimized extents can only be opened read only. The error code is %d.", disklib.VIX_E_NOT_SUPPORTED))
+		}
+		if header.Flags&FlagCompressedGrains != 0 && header.CompressAlgorithm != CompressionDeflate {
+			return sparseDisk{}, formatError(fmt.Errorf("unsupported compression algorithm %d", header.CompressAlgorithm))
+		}
+	}
+	if header.GDOffset == GDAtEnd {
+		header, err = readFooter(file)
+		if err != nil {
+			return sparseDisk{}, formatError(err)
+		}
+	}
+	if header.GrainSize == 0 || header.NumGTEsPerGT != NumGTEsPerGT {
+		return sparseDisk{}, formatError(fmt.Errorf("unsupported grain size %d or %d entries per grain table", header.GrainSize, header.NumGTEsPerGT))
+	}
+
+	desc := newDescriptor("monolithicSparse", nil)
+	if header.DescriptorSize > 0 {
+		buf := make([]byte, header.DescriptorSize*disklib.VIXDISKLIB_SECTOR_SIZE)
+		_, err = file.ReadAt(buf, int64(header.DescriptorOffset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+		if err != nil {
+			return sparseDisk{}, disklib.NewFileError("Open virtual disk file", err)
+		}
+		if end := bytes.IndexByte(buf, 0); end >= 0 {
+			buf = buf[:end]
+		}
+		desc, err = parseDescriptor(string(buf))
+		if err != nil {
+			return sparseDisk{}, formatError(err)
+		}
+	}
+
+	numGTs := numGrainTables(header.Capacity, header.GrainSize)
+	gd, vErr := readDirectory(file, header.GDOffset, numGTs)
+	if vErr != nil {
+		return sparseDisk{}, vErr
+	}
+	var rgd []uint32
+	if header.Flags&FlagRedundantGrainTable != 0 && header.RGDOffset != 0 {
+		rgd, vErr = readDirectory(file, header.RGDOffset, numGTs)
+		if vErr != nil {
+			return sparseDisk{}, vErr
+		}
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return sparseDisk{}, disklib.NewFileError("Open virtual disk file", err)
+	}
+	nextSector := sectorsFor(uint64(stat.Size()))
+	return sparseDisk{
+		mutex:      &sync.Mutex{},
+		file:       file,
+		readOnly:   readOnly,
+		header:     header,
+		desc:       desc,
+		gd:         gd,
+		rgd:        rgd,
+		gts:        make(map[uint64][]uint32),
+		nextSector: &nextSector,
+	}, nil
+}
+
+// readFooter reads the footer of a streamOptimized extent, the copy of the
+// header that holds the offset of the grain directory. It sits in the second
+// to last sector, between the footer and end of stream markers.
+func readFooter(file *os.File) (SparseExtentHeader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return SparseExtentHeader{}, err
+	}
+	if stat.Size() < 3*disklib.VIXDISKLIB_SECTOR_SIZE {
+		return SparseExtentHeader{}, fmt.Errorf("file is too short to hold a footer")
+	}
+	sector := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	_, err = file.ReadAt(sector, stat.Size()-2*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return SparseExtentHeader{}, err
+	}
+	footer, err := parseSparseExtentHeader(sector)
+	if err != nil {
+		return footer, fmt.Errorf("footer: %v", err)
+	}
+	if footer.GDOffset == GDAtEnd {
+		return footer, fmt.Errorf("footer has no grain directory offset")
+	}
+	return footer, nil
+}
+
+func readDirectory(file *os.File, offset uint64, numEntries uint64) ([]uint32, disklib.VddkError) {
+	buf := make([]byte, sectorsFor(numEntries*4)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	_, err := file.ReadAt(buf, int64(offset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return nil, disklib.NewFileError("Read grain directory", err)
+	}
+	entries := make([]uint32, numEntries)
+	for i := range entries {
+		entries[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return entries, nil
+}
+
+// CreateBackend creates a new monolithicSparse VMDK file of capacity sectors
+// and opens it for writing. An existing file at path is an error.
+func CreateBackend(path string, capacity disklib.VixDiskLibSectorType, adapterType disklib.VixDiskLibAdapterType, hwVersion uint16) (virtual_disks.DiskBackend, disklib.VddkError) {
+	header := newSparseExtentHeader(1, FlagValidNewLineDetection|FlagRedundantGrainTable, uint64(capacity))
+	numGTs := numGrainTables(header.Capacity, header.GrainSize)
+	gdSectors := sectorsFor(numGTs * 4)
+
+	// header | descriptor | rgd | redundant GTs | gd | GTs | grains...
+	header.DescriptorOffset = 1
+	header.DescriptorSize = DefaultDescriptorSize
+	header.RGDOffset = header.DescriptorOffset + header.DescriptorSize
+	rgtStart := header.RGDOffset + gdSectors
+	header.GDOffset = rgtStart + numGTs*gtSectors
+	gtStart := header.GDOffset + gdSectors
+	overHead := gtStart + numGTs*gtSectors
+	header.OverHead = (overHead + header.GrainSize - 1) / header.GrainSize * header.GrainSize
+
+	desc := newDescriptor("monolithicSparse", []ExtentLine{{
+		Access:   "RW",
+		Sectors:  uint64(capacity),
+		Type:     "SPARSE",
+		FileName: filepath.Base(path),
+	}})
+	var cid [4]byte
+	rand.Read(cid[:])
+	desc.CID = binary.LittleEndian.Uint32(cid[:])
+	geo := virtual_disks.DefaultInfo(capacity).PhysGeo
+	if adapterType == disklib.VIXDISKLIB_ADAPTER_IDE {
+		geo.Heads = 16
+		geo.Cylinders = uint32(uint64(capacity) / (16 * 63))
+		if geo.Cylinders > 16383 {
+			geo.Cylinders = 16383
+		}
+	}
+	desc.Set("virtualHWVersion", strconv.Itoa(int(hwVersion)))
+	desc.Set("geometry.cylinders", strconv.Itoa(int(geo.Cylinders)))
+	desc.Set("geometry.heads", strconv.Itoa(int(geo.Heads)))
+	desc.Set("geometry.sectors", strconv.Itoa(int(geo.Sectors)))
+	desc.Set("adapterType", adapterName(adapterType))
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, disklib.NewFileError("Create a virtual disk", err)
+	}
+	vErr := writeSparseLayout(file, header, desc, rgtStart, gtStart, numGTs)
+	if vErr != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, vErr
+	}
+	disk, vErr := loadSparseDisk(file, false)
+	if vErr != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, vErr
+	}
+	return disk, nil
+}
+
+// Create creates a new monolithicSparse VMDK file and returns a handle to it.
+func Create(path string, capacity disklib.VixDiskLibSectorType, adapterType disklib.VixDiskLibAdapterType, hwVersion uint16) (virtual_disks.DiskConnectHandle, disklib.VddkError) {
+	backend, err := CreateBackend(path, capacity, adapterType, hwVersion)
+	if err != nil {
+		return virtual_disks.DiskConnectHandle{}, err
+	}
+	return virtual_disks.NewBackendDiskHandle(backend)
+}
+
+func writeSparseLayout(file *os.File, header SparseExtentHeader, desc *Descriptor, rgtStart uint64, gtStart uint64, numGTs uint64) disklib.VddkError {
+	// Grain tables start out empty, so extending the file takes care of them
+	err := file.Truncate(int64(header.OverHead) * disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Create a virtual disk", err)
+	}
+	_, err = file.WriteAt(header.Bytes(), 0)
+	if err != nil {
+		return disklib.NewFileError("Create a virtual disk", err)
+	}
+	vErr := writeDescriptor(file, header, desc)
+	if vErr != nil {
+		return vErr
+	}
+	rgd := make([]byte, numGTs*4)
+	gd := make([]byte, numGTs*4)
+	for i := uint64(0); i < numGTs; i++ {
+		binary.LittleEndian.PutUint32(rgd[i*4:], uint32(rgtStart+i*gtSectors))
+		binary.LittleEndian.PutUint32(gd[i*4:], uint32(gtStart+i*gtSectors))
+	}
+	_, err = file.WriteAt(rgd, int64(header.RGDOffset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Create a virtual disk", err)
+	}
+	_, err = file.WriteAt(gd, int64(header.GDOffset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Create a virtual disk", err)
+	}
+	return nil
+}
+
+func writeDescriptor(file *os.File, header SparseExtentHeader, desc *Descriptor) disklib.VddkError {
+	text := desc.String()
+	buf := make([]byte, header.DescriptorSize*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if len(text) > len(buf) {
+		return disklib.NewVddkError(disklib.VIX_E_BUFFER_TOOSMALL,
+			fmt.Sprintf("Write meta data failed: descriptor needs %d bytes, only %d available. The error code is %d.", len(text), len(buf), disklib.VIX_E_BUFFER_TOOSMALL))
+	}
+	copy(buf, text)
+	_, err := file.WriteAt(buf, int64(header.DescriptorOffset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Write meta data", err)
+	}
+	return nil
+}
+
+// grainTable returns the grain table for directory entry gdIndex, or nil if
+// it has not been allocated. Must be called with the mutex held.
+func (this sparseDisk) grainTable(gdIndex uint64) ([]uint32, disklib.VddkError) {
+	if gt, ok := this.gts[gdIndex]; ok {
+		return gt, nil
+	}
+	if this.gd[gdIndex] == 0 {
+		return nil, nil
+	}
+	gt, vErr := readDirectory(this.file, uint64(this.gd[gdIndex]), NumGTEsPerGT)
+	if vErr != nil {
+		return nil, vErr
+	}
+	this.gts[gdIndex] = gt
+	return gt, nil
+}
+
+func (this sparseDisk) grainOffset(grain uint64) (uint32, disklib.VddkError) {
+	gt, vErr := this.grainTable(grain / NumGTEsPerGT)
+	if vErr != nil || gt == nil {
+		return gteUnallocated, vErr
+	}
+	return gt[grain%NumGTEsPerGT], nil
+}
+
+// forEachGrain splits a sector range into per grain pieces.
+func (this sparseDisk) forEachGrain(startSector uint64, numSectors uint64, fn func(grain uint64, inGrain uint64, count uint64, bufOff uint64) disklib.VddkError) disklib.VddkError {
+	grainSize := this.header.GrainSize
+	for pos := startSector; pos < startSector+numSectors; {
+		grain := pos / grainSize
+		inGrain := pos % grainSize
+		count := grainSize - inGrain
+		if pos+count > startSector+numSectors {
+			count = startSector + numSectors - pos
+		}
+		vErr := fn(grain, inGrain, count, (pos-startSector)*disklib.VIXDISKLIB_SECTOR_SIZE)
+		if vErr != nil {
+			return vErr
+		}
+		pos += count
+	}
+	return nil
+}
+
+func (this sparseDisk) ReadSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	vErr := virtual_disks.CheckSectorRange("Read from virtual disk file", disklib.VixDiskLibSectorType(this.header.Capacity), startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.forEachGrain(startSector, numSectors, func(grain uint64, inGrain uint64, count uint64, bufOff uint64) disklib.VddkError {
+		dst := buf[bufOff : bufOff+count*disklib.VIXDISKLIB_SECTOR_SIZE]
+		gte, vErr := this.grainOffset(grain)
+		if vErr != nil {
+			return vErr
+		}
+		if gte == gteUnallocated || gte == gteZeroed {
+			for i := range dst {
+				dst[i] = 0
+			}
+			return nil
+		}
+		if this.header.Flags&FlagCompressedGrains != 0 {
+			return this.readCompressedGrain(grain, gte, inGrain, dst)
+		}
+		n, err := this.file.ReadAt(dst, int64(uint64(gte)+inGrain)*disklib.VIXDISKLIB_SECTOR_SIZE)
+		if err == io.EOF {
+			// A grain at the very end of the file may have been truncated
+			for i := n; i < len(dst); i++ {
+				dst[i] = 0
+			}
+			err = nil
+		}
+		if err != nil {
+			return disklib.NewFileError("Read from virtual disk file", err)
+		}
+		return nil
+	})
+}
+
+// readCompressedGrain inflates the grain whose marker is at sector gte and
+// copies the part of it from sector inGrain on into dst.
+func (this sparseDisk) readCompressedGrain(grain uint64, gte uint32, inGrain uint64, dst []byte) disklib.VddkError {
+	marker := make([]byte, 12)
+	_, err := this.file.ReadAt(marker, int64(gte)*disklib.VIXDISKLIB_SECTOR_SIZE)
+	if err != nil {
+		return disklib.NewFileError("Read from virtual disk file", err)
+	}
+	lba := binary.LittleEndian.Uint64(marker)
+	size := binary.LittleEndian.Uint32(marker[8:])
+	if lba != grain*this.header.GrainSize {
+		return formatError(fmt.Errorf("grain marker at sector %d is for sector %d, expected %d", gte, lba, grain*this.header.GrainSize))
+	}
+	compressed := make([]byte, size)
+	_, err = this.file.ReadAt(compressed, int64(gte)*disklib.VIXDISKLIB_SECTOR_SIZE+12)
+	if err != nil {
+		return disklib.NewFileError("Read from virtual disk file", err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return formatError(fmt.Errorf("grain at sector %d: %v", lba, err))
+	}
+	grainBytes := int64(this.header.GrainSize) * disklib.VIXDISKLIB_SECTOR_SIZE
+	data, err := io.ReadAll(io.LimitReader(zr, grainBytes))
+	if err != nil {
+		return formatError(fmt.Errorf("grain at sector %d: %v", lba, err))
+	}
+	// A grain at the end of the disk may hold less than a full grain
+	if int64(len(data)) < grainBytes {
+		data = append(data, make([]byte, grainBytes-int64(len(data)))...)
+	}
+	copy(dst, data[inGrain*disklib.VIXDISKLIB_SECTOR_SIZE:])
+	return nil
+}
+
+func (this sparseDisk) WriteSectors(startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	if this.readOnly {
+		return disklib.NewVddkError(disklib.VIX_E_FILE_READ_ONLY, fmt.Sprintf("Write to virtual disk file failed. The error code is %d.", disklib.VIX_E_FILE_READ_ONLY))
+	}
+	vErr := virtual_disks.CheckSectorRange("Write to virtual disk file", disklib.VixDiskLibSectorType(this.header.Capacity), startSector, numSectors, buf)
+	if vErr != nil {
+		return vErr
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.forEachGrain(startSector, numSectors, func(grain uint64, inGrain uint64, count uint64, bufOff uint64) disklib.VddkError {
+		src := buf[bufOff : bufOff+count*disklib.VIXDISKLIB_SECTOR_SIZE]
+		gte, vErr := this.grainOffset(grain)
+		if vErr != nil {
+			return vErr
+		}
+		if gte != gteUnallocated && gte != gteZeroed {
+			_, err := this.file.WriteAt(src, int64(uint64(gte)+inGrain)*disklib.VIXDISKLIB_SECTOR_SIZE)
+			if err != nil {
+				return disklib.NewFileError("Write to virtual disk file", err)
+			}
+			return nil
+		}
+		// Allocate the grain at the end of the file, then point the grain
+		// table at it once the data is down.
+		grainBuf := make([]byte, this.header.GrainSize*disklib.VIXDISKLIB_SECTOR_SIZE)
+		copy(grainBuf[inGrain*disklib.VIXDISKLIB_SECTOR_SIZE:], src)
+		offset := *this.nextSector
+		_, err := this.file.WriteAt(grainBuf, int64(offset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+		if err != nil {
+			return disklib.NewFileError("Write to virtual disk file", err)
+		}
+		*this.nextSector += this.header.GrainSize
+		return this.setGrainOffset(grain, uint32(offset))
+	})
+}
+
+// setGrainOffset updates a grain table entry in memory and in every copy of the
+// grain table on disk. Must be called with the mutex held.
+func (this sparseDisk) setGrainOffset(grain uint64, offset uint32) disklib.VddkError {
+	gdIndex := grain / NumGTEsPerGT
+	gt, vErr := this.grainTable(gdIndex)
+	if vErr != nil {
+		return vErr
+	}
+	if gt == nil {
+		gt, vErr = this.allocateGrainTable(gdIndex)
+		if vErr != nil {
+			return vErr
+		}
+	}
+	gt[grain%NumGTEsPerGT] = offset
+
+	entry := make([]byte, 4)
+	binary.LittleEndian.PutUint32(entry, offset)
+	tables := []uint32{this.gd[gdIndex]}
+	if len(this.rgd) > 0 {
+		tables = append(tables, this.rgd[gdIndex])
+	}
+	for _, table := range tables {
+		_, err := this.file.WriteAt(entry, int64(table)*disklib.VIXDISKLIB_SECTOR_SIZE+int64(grain%NumGTEsPerGT)*4)
+		if err != nil {
+			return disklib.NewFileError("Write grain table", err)
+		}
+	}
+	return nil
+}
+
+// allocateGrainTable appends empty grain tables for a directory entry that has
+// none yet. Extents created by this package preallocate every table, but other
+// tools are allowed not to.
+func (this sparseDisk) allocateGrainTable(gdIndex uint64) ([]uint32, disklib.VddkError) {
+	type directory struct {
+		entries []uint32
+		offset  uint64
+	}
+	dirs := []directory{{this.gd, this.header.GDOffset}}
+	if len(this.rgd) > 0 {
+		dirs = append(dirs, directory{this.rgd, this.header.RGDOffset})
+	}
+	empty := make([]byte, gtSectors*disklib.VIXDISKLIB_SECTOR_SIZE)
+	for _, dir := range dirs {
+		offset := *this.nextSector
+		_, err := this.file.WriteAt(empty, int64(offset)*disklib.VIXDISKLIB_SECTOR_SIZE)
+		if err != nil {
+			return nil, disklib.NewFileError("Write grain table", err)
+		}
+		*this.nextSector += gtSectors
+		dir.entries[gdIndex] = uint32(offset)
+		entry := make([]byte, 4)
+		binary.LittleEndian.PutUint32(entry, uint32(offset))
+		_, err = this.file.WriteAt(entry, int64(dir.offset)*disklib.VIXDISKLIB_SECTOR_SIZE+int64(gdIndex)*4)
+		if err != nil {
+			return nil, disklib.NewFileError("Write grain directory", err)
+		}
+	}
+	gt := make([]uint32, NumGTEsPerGT)
+	this.gts[gdIndex] = gt
+	return gt, nil
+}
+
+func (this sparseDisk) GetInfo() (disklib.VixDiskLibInfo, disklib.VddkError) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.desc.info(disklib.VixDiskLibSectorType(this.header.Capacity)), nil
+}
+
+func (this sparseDisk) QueryAllocatedBlocks(startSector disklib.VixDiskLibSectorType, numSectors disklib.VixDiskLibSectorType, chunkSize disklib.VixDiskLibSectorType) ([]disklib.VixDiskLibBlock, disklib.VddkError) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var vErr disklib.VddkError
+	blocks, qErr := virtual_disks.AllocatedBlocks(disklib.VixDiskLibSectorType(this.header.Capacity), startSector, numSectors, chunkSize,
+		func(start disklib.VixDiskLibSectorType, length disklib.VixDiskLibSectorType) bool {
+			for grain := uint64(start) / this.header.GrainSize; grain*this.header.GrainSize < uint64(start+length); grain++ {
+				gte, err := this.grainOffset(grain)
+				if err != nil {
+					vErr = err
+					return false
+				}
+				if gte != gteUnallocated && gte != gteZeroed {
+					return true
+				}
+			}
+			return false
+		})
+	if qErr != nil {
+		return nil, qErr
+	}
+	if vErr != nil {
+		return nil, vErr
+	}
+	return blocks, nil
+}
+
+func (this sparseDisk) GetMetadataKeys(buf []byte, bufLen uint, requireLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.desc.DDB.GetMetadataKeys(buf, bufLen, requireLen)
+}
+
+func (this sparseDisk) ReadMetadata(key string, buf []byte, bufLen uint, requiredLen *uint) disklib.VddkError {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.desc.DDB.ReadMetadata(key, buf, bufLen, requiredLen)
+}
+
+func (this sparseDisk) WriteMetadata(key string, buf []byte) disklib.VddkError {
+	if this.readOnly {
+		return disklib.NewVddkError(disklib.VIX_E_FILE_READ_ONLY, fmt.Sprintf("Write meta data failed. The error code is %d.", disklib.VIX_E_FILE_READ_ONLY))
+	}
+	if this.header.DescriptorSize == 0 {
+		return disklib.NewVddkError(disklib.VIX_E_NOT_SUPPORTED, fmt.Sprintf("Write meta data failed: extent has no embedded descriptor. The error code is %d.", disklib.VIX_E_NOT_SUPPORTED))
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	value := strings.TrimRight(string(buf), "\x00")
+	old, existed := this.desc.DDB[key]
+	this.desc.Set(key, value)
+	vErr := writeDescriptor(this.file, this.header, this.desc)
+	if vErr != nil {
+		if existed {
+			this.desc.Set(key, old)
+		} else {
+			this.desc.unset(key)
+		}
+	}
+	return vErr
+}
+
+func (this sparseDisk) Close() disklib.VddkError {
+	if !this.readOnly {
+		err := this.file.Sync()
+		if err != nil {
+			this.file.Close()
+			return disklib.NewFileError("Close virtual disk", err)
+		}
+	}
+	err := this.file.Close()
+	if err != nil {
+		return disklib.NewFileError("Close virtual disk", err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// Marker types of a streamOptimized extent
+const (
+	MarkerEOS    = 0
+	MarkerGT     = 1
+	MarkerGD     = 2
+	MarkerFooter = 3
+)
+
+// CompressionDeflate is the only compressAlgorithm defined for sparse extents.
+const CompressionDeflate = 1
+
+// StreamOptimizedWriter writes a streamOptimized VMDK to an io.Writer in a
+// single pass. Grains must be written in increasing LBA order; grain tables
+// and the grain directory are emitted as the stream goes and the footer is
+// written by Close.
+type StreamOptimizedWriter struct {
+	w        io.Writer
+	header   SparseExtentHeader
+	position uint64 // sectors written so far
+	gd       []uint32
+	gt       []uint32
+	gtIndex  uint64
+	gtDirty  bool
+	nextLBA  uint64
+	zbuf     bytes.Buffer
+	zw       *zlib.Writer
+	closed   bool
+}
+
+// NewStreamOptimizedWriter writes the header and descriptor of a
+// streamOptimized disk of capacity sectors to w.
+func NewStreamOptimizedWriter(w io.Writer, capacity disklib.VixDiskLibSectorType, adapterType disklib.VixDiskLibAdapterType, hwVersion uint16) (*StreamOptimizedWriter, error) {
+	header := newSparseExtentHeader(3, FlagValidNewLineDetection|FlagCompressedGrains|FlagMarkers, uint64(capacity))
+	header.CompressAlgorithm = CompressionDeflate
+	header.GDOffset = GDAtEnd
+
+	desc := newDescriptor("streamOptimized", []ExtentLine{{
+		Access:   "RW",
+		Sectors:  uint64(capacity),
+		Type:     "SPARSE",
+		FileName: "disk.vmdk",
+	}})
+	geo := virtual_disks.DefaultInfo(capacity).PhysGeo
+	desc.Set("virtualHWVersion", strconv.Itoa(int(hwVersion)))
+	desc.Set("geometry.cylinders", strconv.Itoa(int(geo.Cylinders)))
+	desc.Set("geometry.heads", strconv.Itoa(int(geo.Heads)))
+	desc.Set("geometry.sectors", strconv.Itoa(int(geo.Sectors)))
+	desc.Set("adapterType", adapterName(adapterType))
+	text := []byte(desc.String())
+
+	header.DescriptorOffset = 1
+	header.DescriptorSize = sectorsFor(uint64(len(text)))
+	header.OverHead = (1 + header.DescriptorSize + header.GrainSize - 1) / header.GrainSize * header.GrainSize
+
+	s := &StreamOptimizedWriter{
+		w:      w,
+		header: header,
+		gd:     make([]uint32, numGrainTables(header.Capacity, header.GrainSize)),
+		gt:     make([]uint32, NumGTEsPerGT),
+	}
+	s.zw = zlib.NewWriter(&s.zbuf)
+
+	err := s.write(header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = s.writePadded(text)
+	if err != nil {
+		return nil, err
+	}
+	err = s.write(make([]byte, (header.OverHead-s.position)*disklib.VIXDISKLIB_SECTOR_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GrainSize returns the grain size in bytes.
+func (s *StreamOptimizedWriter) GrainSize() int64 {
+	return int64(s.header.GrainSize) * disklib.VIXDISKLIB_SECTOR_SIZE
+}
+
+func (s *StreamOptimizedWriter) write(p []byte) error {
+	_, err := s.w.Write(p)
+	if err != nil {
+		return err
+	}
+	s.position += uint64(len(p)) / disklib.VIXDISKLIB_SECTOR_SIZE
+	return nil
+}
+
+// writePadded writes p followed by zeros up to the next sector boundary.
+func (s *StreamOptimizedWriter) writePadded(p []byte) error {
+	padded := make([]byte, sectorsFor(uint64(len(p)))*disklib.VIXDISKLIB_SECTOR_SIZE)
+	copy(padded, p)
+	return s.write(padded)
+}
+
+func (s *StreamOptimizedWriter) writeMarker(numSectors uint64, markerType uint32) error {
+	marker := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	binary.LittleEndian.PutUint64(marker[0:], numSectors)
+	binary.LittleEndian.PutUint32(marker[8:], 0)
+	binary.LittleEndian.PutUint32(marker[12:], markerType)
+	return s.write(marker)
+}
+
+// WriteGrain compresses and writes the grain that starts at sector lba, which
+// must be grain aligned and past every grain written before. data is at most
+// one grain long and is padded with zeros.
+func (s *StreamOptimizedWriter) WriteGrain(lba uint64, data []byte) error {
+	if s.closed {
+		return fmt.Errorf("WriteGrain: stream is closed")
+	}
+	if lba%s.header.GrainSize != 0 || lba < s.nextLBA || lba >= s.header.Capacity {
+		return fmt.Errorf("WriteGrain: grain at sector %d is out of order or out of range", lba)
+	}
+	if int64(len(data)) > s.GrainSize() {
+		return fmt.Errorf("WriteGrain: %d bytes is more than one grain", len(data))
+	}
+	grain := lba / s.header.GrainSize
+	if grain/NumGTEsPerGT != s.gtIndex {
+		err := s.flushGrainTable()
+		if err != nil {
+			return err
+		}
+		s.gtIndex = grain / NumGTEsPerGT
+	}
+
+	s.zbuf.Reset()
+	s.zw.Reset(&s.zbuf)
+	if len(data) < int(s.GrainSize()) {
+		padded := make([]byte, s.GrainSize())
+		copy(padded, data)
+		data = padded
+	}
+	_, err := s.zw.Write(data)
+	if err == nil {
+		err = s.zw.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 12+s.zbuf.Len())
+	binary.LittleEndian.PutUint64(record[0:], lba)
+	binary.LittleEndian.PutUint32(record[8:], uint32(s.zbuf.Len()))
+	copy(record[12:], s.zbuf.Bytes())
+	s.gt[grain%NumGTEsPerGT] = uint32(s.position)
+	s.gtDirty = true
+	s.nextLBA = lba + s.header.GrainSize
+	return s.writePadded(record)
+}
+
+// flushGrainTable writes the current grain table if any of its grains were
+// written. Grain tables with no grains are left out of the directory.
+func (s *StreamOptimizedWriter) flushGrainTable() error {
+	if !s.gtDirty {
+		return nil
+	}
+	err := s.writeMarker(gtSectors, MarkerGT)
+	if err != nil {
+		return err
+	}
+	s.gd[s.gtIndex] = uint32(s.position)
+	buf := make([]byte, gtSectors*disklib.VIXDISKLIB_SECTOR_SIZE)
+	for i, entry := range s.gt {
+		binary.LittleEndian.PutUint32(buf[i*4:], entry)
+		s.gt[i] = 0
+	}
+	s.gtDirty = false
+	return s.write(buf)
+}
+
+// Close writes the last grain table, the grain directory, the footer and the
+// end of stream marker. It does not close the underlying writer.
+func (s *StreamOptimizedWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.flushGrainTable()
+	if err != nil {
+		return err
+	}
+
+	gdSectors := sectorsFor(uint64(len(s.gd)) * 4)
+	err = s.writeMarker(gdSectors, MarkerGD)
+	if err != nil {
+		return err
+	}
+	footer := s.header
+	footer.GDOffset = s.position
+	buf := make([]byte, gdSectors*disklib.VIXDISKLIB_SECTOR_SIZE)
+	for i, entry := range s.gd {
+		binary.LittleEndian.PutUint32(buf[i*4:], entry)
+	}
+	err = s.write(buf)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeMarker(1, MarkerFooter)
+	if err != nil {
+		return err
+	}
+	err = s.write(footer.Bytes())
+	if err != nil {
+		return err
+	}
+	return s.writeMarker(0, MarkerEOS)
+}
+
+// ExportStreamOptimized reads the allocated extents of src and writes them to
+// w as a streamOptimized VMDK. Grains that read back as all zeros are left
+// out of the stream.
+func ExportStreamOptimized(w io.Writer, src virtual_disks.DiskSource, adapterType disklib.VixDiskLibAdapterType, hwVersion uint16) error {
+	capacity := disklib.VixDiskLibSectorType(src.Capacity() / disklib.VIXDISKLIB_SECTOR_SIZE)
+	s, err := NewStreamOptimizedWriter(w, capacity, adapterType, hwVersion)
+	if err != nil {
+		return err
+	}
+	extents, vErr := virtual_disks.QueryAllocatedExtents(src, DefaultGrainSize)
+	if vErr != nil {
+		return vErr
+	}
+
+	grainSize := s.GrainSize()
+	buf := make([]byte, grainSize)
+	for _, extent := range extents {
+		start := int64(extent.Offset()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		end := int64(extent.Offset()+extent.Length()) * disklib.VIXDISKLIB_SECTOR_SIZE
+		for off := start / grainSize * grainSize; off < end; off += grainSize {
+			n, err := src.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("ReadAt(%d): %v", off, err)
+			}
+			if virtual_disks.IsZero(buf[:n]) {
+				continue
+			}
+			err = s.WriteGrain(uint64(off/disklib.VIXDISKLIB_SECTOR_SIZE), buf[:n])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.Close()
+}
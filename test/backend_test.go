@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/sirupsen/logrus"
+)
+
+func checkUnalignedIO(t *testing.T, backend virtual_disks.DiskBackend) {
+	diskReaderWriter, err := virtual_disks.OpenBackend(backend, logrus.New())
+	if err != nil {
+		t.Fatalf("OpenBackend failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	defer diskReaderWriter.Close()
+
+	// I II III
+	buf := bytes.Repeat([]byte{'C'}, disklib.VIXDISKLIB_SECTOR_SIZE*3+14)
+	n, err2 := diskReaderWriter.WriteAt(buf, 500)
+	if err2 != nil || n != len(buf) {
+		t.Fatalf("WriteAt returned %d, %v", n, err2)
+	}
+	// II III over the middle of it
+	buf2 := bytes.Repeat([]byte{'D'}, disklib.VIXDISKLIB_SECTOR_SIZE+2)
+	n, err2 = diskReaderWriter.WriteAt(buf2, disklib.VIXDISKLIB_SECTOR_SIZE*2)
+	if err2 != nil || n != len(buf2) {
+		t.Fatalf("WriteAt returned %d, %v", n, err2)
+	}
+
+	expected := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE*5)
+	copy(expected[500:], buf)
+	copy(expected[disklib.VIXDISKLIB_SECTOR_SIZE*2:], buf2)
+	got := make([]byte, len(expected))
+	_, err2 = diskReaderWriter.ReadAt(got, 0)
+	if err2 != nil {
+		t.Fatalf("ReadAt failed: %v", err2)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Read back data does not match what was written")
+	}
+
+	// Reads past the end of the disk are cut short with io.EOF
+	capacity := int64(disklib.VIXDISKLIB_SECTOR_SIZE * 2048)
+	_, err2 = diskReaderWriter.ReadAt(got, capacity)
+	if err2 != io.EOF {
+		t.Errorf("ReadAt past the end returned %v, expected io.EOF", err2)
+	}
+	_, err2 = diskReaderWriter.WriteAt(got, capacity-10)
+	if err2 == nil {
+		t.Errorf("WriteAt past the end should fail")
+	}
+}
+
+func TestMemoryBackendIO(t *testing.T) {
+	checkUnalignedIO(t, virtual_disks.NewMemoryBackend(2048))
+}
+
+func TestFileBackendIO(t *testing.T) {
+	backend, err := virtual_disks.CreateFileBackend(filepath.Join(t.TempDir(), "disk.img"), 2048)
+	if err != nil {
+		t.Fatalf("CreateFileBackend failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	checkUnalignedIO(t, backend)
+}
+
+func TestMemoryBackendAllocatedBlocks(t *testing.T) {
+	backend := virtual_disks.NewMemoryBackend(4096)
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(backend)
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	buf := make([]byte, disklib.VIXDISKLIB_SECTOR_SIZE)
+	// Chunks 1, 2 and 5 of 128 sectors
+	for _, sector := range []int64{128, 300, 700} {
+		if _, err := diskHandle.WriteAt(buf, sector*disklib.VIXDISKLIB_SECTOR_SIZE); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	blocks, err := diskHandle.QueryAllocatedBlocks(0, 4096, 128)
+	if err != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %s", err.Error())
+	}
+	expected := [][2]disklib.VixDiskLibSectorType{{128, 256}, {640, 128}}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Got %d blocks, expected %d", len(blocks), len(expected))
+	}
+	for i, block := range blocks {
+		if block.Offset() != expected[i][0] || block.Length() != expected[i][1] {
+			t.Errorf("Block %d is (%d, %d), expected %v", i, block.Offset(), block.Length(), expected[i])
+		}
+	}
+
+	_, err = diskHandle.QueryAllocatedBlocks(0, 100, 128)
+	if err == nil || err.VixErrorCode() != disklib.VIX_E_INVALID_ARG {
+		t.Errorf("Unaligned QueryAllocatedBlocks should fail with VIX_E_INVALID_ARG, got %v", err)
+	}
+}
+
+func TestContextIO(t *testing.T) {
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(virtual_disks.NewMemoryBackend(8192))
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	// Unaligned and spanning several batches
+	data := bytes.Repeat([]byte("context"), 400000)
+	off := int64(virtual_disks.ContextBatchSize - 100)
+	if n, err := diskHandle.WriteAtContext(context.Background(), data, off); err != nil || n != len(data) {
+		t.Fatalf("WriteAtContext returned %d, %v", n, err)
+	}
+	got := make([]byte, len(data))
+	if n, err := diskHandle.ReadAtContext(context.Background(), got, off); err != nil || n != len(data) {
+		t.Fatalf("ReadAtContext returned %d, %v", n, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Data read back does not match")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := diskHandle.ReadAtContext(ctx, got, 0); n != 0 || err != context.Canceled {
+		t.Errorf("ReadAtContext with a cancelled context returned %d, %v", n, err)
+	}
+	if n, err := diskHandle.WriteAtContext(ctx, data, 0); n != 0 || err != context.Canceled {
+		t.Errorf("WriteAtContext with a cancelled context returned %d, %v", n, err)
+	}
+}
+
+func TestContextIOPastEnd(t *testing.T) {
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(virtual_disks.NewMemoryBackend(8192))
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	diskReaderWriter, err := virtual_disks.OpenBackend(virtual_disks.NewMemoryBackend(8192), logrus.New())
+	if err != nil {
+		t.Fatalf("OpenBackend failed: %s", err.Error())
+	}
+	defer diskReaderWriter.Close()
+
+	type readerAtContext interface {
+		ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+	}
+	for _, disk := range []readerAtContext{diskHandle, diskReaderWriter} {
+		buf := make([]byte, 4096)
+		off := diskHandle.Capacity() - 1000
+		if n, err := disk.ReadAtContext(context.Background(), buf, off); n != 1000 || err != io.EOF {
+			t.Errorf("ReadAtContext across the end of the disk returned %d, %v, expected 1000, EOF", n, err)
+		}
+		if n, err := disk.ReadAtContext(context.Background(), buf, diskHandle.Capacity()); n != 0 || err != io.EOF {
+			t.Errorf("ReadAtContext at the end of the disk returned %d, %v, expected 0, EOF", n, err)
+		}
+		if n, err := disk.ReadAtContext(context.Background(), buf[:1000], off); n != 1000 || err != nil {
+			t.Errorf("ReadAtContext up to the end of the disk returned %d, %v, expected 1000, nil", n, err)
+		}
+	}
+}
+
+// stallingBackend is a backend whose IO never finishes, as a VDDK read does
+// while it waits to retry, until its context is done.
+type stallingBackend struct {
+	virtual_disks.DiskBackend
+}
+
+func (this stallingBackend) ReadSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	<-ctx.Done()
+	return disklib.NewVddkError(disklib.VIX_E_CANCELLED, ctx.Err().Error())
+}
+
+func (this stallingBackend) WriteSectorsContext(ctx context.Context, startSector uint64, numSectors uint64, buf []byte) disklib.VddkError {
+	<-ctx.Done()
+	return disklib.NewVddkError(disklib.VIX_E_CANCELLED, ctx.Err().Error())
+}
+
+func TestContextIOReachesBackend(t *testing.T) {
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(stallingBackend{virtual_disks.NewMemoryBackend(8192)})
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	buf := make([]byte, 4096)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := diskHandle.ReadAtContext(ctx, buf, 0); !errors.Is(err, disklib.ErrCancelled) {
+		t.Errorf("ReadAtContext returned %v, expected a cancelled error", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := diskHandle.WriteAtContext(ctx, buf, 0); !errors.Is(err, disklib.ErrCancelled) {
+		t.Errorf("WriteAtContext returned %v, expected a cancelled error", err)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+// countingWriter keeps what is written to it and how often each byte was.
+type countingWriter struct {
+	mutex  sync.Mutex
+	data   []byte
+	writes []int
+}
+
+func (w *countingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	copy(w.data[off:], p)
+	for i := range p {
+		w.writes[off+int64(i)]++
+	}
+	return len(p), nil
+}
+
+func TestCopyChain(t *testing.T) {
+	const capacity = 4 * 1024 * 1024
+	layers := []struct {
+		startOffset int64
+		areas       []dumper.ChangedArea
+	}{
+		// The full backup
+		{0, []dumper.ChangedArea{{Start: 0, Length: 3 * 1024 * 1024}, {Start: 3*1024*1024 + 4096, Length: 8192}}},
+		{0, []dumper.ChangedArea{{Start: 512, Length: 1024}, {Start: 1024 * 1024, Length: 1024 * 1024}}},
+		// Overlaps both the full and the first incremental, and adds an area
+		{4096, []dumper.ChangedArea{{Start: 1024*1024 - 4096, Length: 512 * 1024}, {Start: 3*1024*1024 + 8192, Length: 65536}}},
+		{0, []dumper.ChangedArea{{Start: 1024 + 512, Length: 512}, {Start: 1024*1024 + 512, Length: 512}}},
+	}
+
+	expected := make([]byte, capacity)
+	covered := make([]bool, capacity)
+	var chain []dumper.ChainLayer
+	for i, layer := range layers {
+		data := make([]byte, capacity)
+		rand.New(rand.NewSource(int64(10 + i))).Read(data)
+		for _, area := range layer.areas {
+			start := layer.startOffset + area.Start
+			copy(expected[start:start+area.Length], data[start:])
+			for j := start; j < start+area.Length; j++ {
+				covered[j] = true
+			}
+		}
+		chain = append(chain, dumper.ChainLayer{
+			ChangeInfo: &dumper.DiskChangeInfo{StartOffset: layer.startOffset, Length: capacity, ChangedArea: layer.areas},
+			Data:       bytes.NewReader(data),
+		})
+	}
+
+	for _, opts := range []dumper.CopyOptions{
+		{},
+		{Readers: 4, Writers: 4, BlockSize: 64 * 1024},
+	} {
+		w := &countingWriter{data: make([]byte, capacity), writes: make([]int, capacity)}
+		if err := dumper.CopyChain(context.Background(), w, chain, opts); err != nil {
+			t.Fatalf("CopyChain(%+v) failed: %v", opts, err)
+		}
+		if !bytes.Equal(w.data, expected) {
+			t.Errorf("CopyChain(%+v) did not write the newest data", opts)
+		}
+		for i, n := range w.writes {
+			if (covered[i] && n != 1) || (!covered[i] && n != 0) {
+				t.Fatalf("CopyChain(%+v) wrote byte %d %d times", opts, i, n)
+			}
+		}
+	}
+
+	if err := dumper.CopyChain(context.Background(), &countingWriter{}, nil, dumper.CopyOptions{}); err == nil {
+		t.Errorf("CopyChain should refuse an empty chain")
+	}
+}
+
+func TestDumpRestoreBackupChain(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(4 * 2048)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(20)).Read(data[:2*1024*1024])
+	src.WriteAt(data[:2*1024*1024], 0)
+	src.WriteMetadata("uuid", []byte("60 00 C2 91\x00"))
+	src.Close()
+
+	repo, err := repository.Create(filepath.Join(dir, "repo"), repository.Config{}, nil)
+	if err != nil {
+		t.Fatalf("repository.Create failed: %v", err)
+	}
+	backup := func(parent string, dc *dumper.DiskChangeInfo) *repository.Manifest {
+		d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpBackup)
+		defer d.Cleanup()
+		if err := d.ReadNativeLocalDisk(srcPath); err != nil {
+			t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+		}
+		d.ChangeInfo = dc
+		manifest, err := d.DumpBackupDisk(repo, parent)
+		if err != nil {
+			t.Fatalf("DumpBackupDisk failed: %v", err)
+		}
+		return manifest
+	}
+	// Changes a range of the source and returns it as a changed area
+	change := func(seed int64, off int64, length int64) dumper.ChangedArea {
+		rand.New(rand.NewSource(seed)).Read(data[off : off+length])
+		src, vErr := vmdk.Open(srcPath, false)
+		if vErr != nil {
+			t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+		}
+		src.WriteAt(data[off:off+length], off)
+		src.Close()
+		return dumper.ChangedArea{Start: off, Length: length}
+	}
+
+	full := backup("", nil)
+	first := backup(full.ID, &dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{
+		change(21, 4096, 65536),
+		change(22, 3*1024*1024, 4096),
+	}})
+	second := backup(first.ID, &dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{
+		change(23, 8192, 4096),
+	}})
+
+	restore := func(id string) {
+		dstPath := filepath.Join(dir, id+".vmdk")
+		restoreDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpResotre)
+		if err := restoreDumper.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+			t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+		}
+		err := restoreDumper.DumpRestoreBackup(repo, id)
+		restoreDumper.Cleanup()
+		if err != nil {
+			t.Fatalf("DumpRestoreBackup failed: %v", err)
+		}
+
+		dst, vErr := vmdk.Open(dstPath, true)
+		if vErr != nil {
+			t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+		}
+		defer dst.Close()
+		got := make([]byte, dst.Capacity())
+		dst.ReadAt(got, 0)
+		if !bytes.Equal(got, data) {
+			t.Errorf("Restore of %s does not match the source", id)
+		}
+		buf := make([]byte, 64)
+		if vErr := dst.ReadMetadata("uuid", buf, uint(len(buf)), nil); vErr != nil || string(buf[:11]) != "60 00 C2 91" {
+			t.Errorf("Restored metadata is %q, %v", buf, vErr)
+		}
+	}
+	restore(second.ID)
+
+	synthetic, err := dumper.SynthesizeFullBackup(context.Background(), repo, second.ID, dumper.CopyOptions{Readers: 2, Writers: 2})
+	if err != nil {
+		t.Fatalf("SynthesizeFullBackup failed: %v", err)
+	}
+	if synthetic.Parent != "" || synthetic.SyntheticOf != second.ID || synthetic.Capacity != capacity || synthetic.ChangeId != second.ChangeId {
+		t.Errorf("Unexpected synthetic manifest %+v", synthetic)
+	}
+	// The 2MB of the full backup and the area the first incremental added past it
+	if synthetic.DataSize() != 2*1024*1024+4096 {
+		t.Errorf("Synthetic backup holds %d bytes", synthetic.DataSize())
+	}
+	// Chunks only the old chain used are pruned once it is deleted
+	chunksBefore, _ := filepath.Glob(filepath.Join(dir, "repo", "chunks", "*", "*"))
+	for _, id := range []string{second.ID, first.ID, full.ID} {
+		repo.Delete(id)
+	}
+	if _, err := repo.Prune(); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	chunksAfter, _ := filepath.Glob(filepath.Join(dir, "repo", "chunks", "*", "*"))
+	if len(chunksAfter) == 0 || len(chunksAfter) >= len(chunksBefore) {
+		t.Errorf("Prune kept %d of %d chunks", len(chunksAfter), len(chunksBefore))
+	}
+	restore(synthetic.ID)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// cbtVM adds QueryChangedDiskAreas, which vcsim does not implement, to a
+// simulated VM. Each call covers at most a third of the disk so that the
+// caller has to page.
+type cbtVM struct {
+	*simulator.VirtualMachine
+	capacity int64
+	areas    []types.DiskChangeExtent
+}
+
+func (vm *cbtVM) QueryChangedDiskAreas(req *types.QueryChangedDiskAreas) soap.HasFault {
+	body := &methods.QueryChangedDiskAreasBody{}
+	if req.ChangeId == "" || req.Snapshot == nil {
+		body.Fault_ = simulator.Fault("", &types.InvalidArgument{})
+		return body
+	}
+	length := vm.capacity/3 + 1
+	if req.StartOffset+length > vm.capacity {
+		length = vm.capacity - req.StartOffset
+	}
+	info := types.DiskChangeInfo{StartOffset: req.StartOffset, Length: length}
+	for _, area := range vm.areas {
+		if area.Start >= req.StartOffset && area.Start < req.StartOffset+length {
+			info.ChangedArea = append(info.ChangedArea, area)
+		}
+	}
+	body.Res = &types.QueryChangedDiskAreasResponse{Returnval: info}
+	return body
+}
+
+func TestQueryChangedDiskAreas(t *testing.T) {
+	ctx := context.Background()
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(ctx, s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	vm := object.NewVirtualMachine(c.Client, obj.Reference())
+	task, err := vm.CreateSnapshot(ctx, "backup", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := task.WaitForResult(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := result.Result.(types.ManagedObjectReference)
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := devices.SelectByType((*types.VirtualDisk)(nil))[0].(*types.VirtualDisk)
+	diskPath := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName
+	capacity := disk.CapacityInBytes
+
+	areas := []types.DiskChangeExtent{
+		{Start: 0, Length: 65536},
+		{Start: capacity / 2, Length: 1048576},
+		{Start: capacity - 4096, Length: 4096},
+	}
+	simulator.Map.Put(&cbtVM{obj, capacity, areas})
+
+	expected := []dumper.ChangedArea{
+		{Start: 0, Length: 65536},
+		{Start: capacity / 2, Length: 1048576},
+		{Start: capacity - 4096, Length: 4096},
+	}
+	dc, err := dumper.QueryChangedDiskAreas(ctx, c.Client, obj.Self.Value, snapshot.Value, 0, diskPath, dumper.FullChangeId)
+	if err != nil {
+		t.Fatalf("QueryChangedDiskAreas failed: %v", err)
+	}
+	if dc.Length != capacity || !reflect.DeepEqual(dc.ChangedArea, expected) {
+		t.Errorf("QueryChangedDiskAreas returned %+v", dc)
+	}
+
+	// Through the dumper, logging in with the server thumbprint
+	password, _ := s.URL.User.Password()
+	port, _ := strconv.Atoi(s.URL.Port())
+	conn := dumper.ConnParams{
+		VmMoRef:              obj.Self.Value,
+		VsphereHostName:      s.URL.Hostname(),
+		VsphereHostPort:      port,
+		VsphereUsername:      s.URL.User.Username(),
+		VspherePassword:      password,
+		VsphereThumbPrint:    s.CertificateInfo().ThumbprintSHA1,
+		VsphereSnapshotMoRef: snapshot.Value,
+	}
+	vp, _ := dumper.NewVddkParams(conn, dumper.DiskParams{ChangeId: "52 3c 1a-1"})
+	d, _ := dumper.NewVadpDumper(*vp, dumper.DumpBackup)
+	if err := d.QueryChangedDiskAreas(ctx, disk.Key); err != nil {
+		t.Fatalf("VadpDumper.QueryChangedDiskAreas failed: %v", err)
+	}
+	if !reflect.DeepEqual(d.ChangeInfo.ChangedArea, expected) {
+		t.Errorf("VadpDumper.QueryChangedDiskAreas returned %+v", d.ChangeInfo)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+func TestCopyProgress(t *testing.T) {
+	src := newTestDisk(t, 8192)
+	dc := &dumper.DiskChangeInfo{
+		Length: src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{
+			{Start: 0, Length: 1024 * 1024},
+			{Start: 2 * 1024 * 1024, Length: 1024 * 1024},
+		},
+	}
+	var positions []dumper.CopyPosition
+	w := &countingWriter{data: make([]byte, src.Capacity()), writes: make([]int, src.Capacity())}
+	opts := dumper.CopyOptions{
+		Readers:   4,
+		Writers:   4,
+		BlockSize: 64 * 1024,
+		Start:     dumper.CopyPosition{Area: 0, Offset: 512 * 1024},
+		Progress: func(pos dumper.CopyPosition) {
+			positions = append(positions, pos)
+		},
+	}
+	if err := dumper.CopyChangedAreas(context.Background(), w, src, dc, opts); err != nil {
+		t.Fatalf("CopyChangedAreas failed: %v", err)
+	}
+	for i := 1; i < len(positions); i++ {
+		prev, pos := positions[i-1], positions[i]
+		if pos.Area < prev.Area || (pos.Area == prev.Area && pos.Offset <= prev.Offset) {
+			t.Fatalf("Progress went from %+v to %+v", prev, pos)
+		}
+	}
+	if last := positions[len(positions)-1]; last != (dumper.CopyPosition{Area: 1, Offset: 3 * 1024 * 1024}) {
+		t.Errorf("Last progress is %+v", last)
+	}
+	for i, n := range w.writes {
+		inside := (i >= 512*1024 && i < 1024*1024) || (i >= 2*1024*1024 && i < 3*1024*1024)
+		if (inside && n != 1) || (!inside && n != 0) {
+			t.Fatalf("Byte %d written %d times", i, n)
+		}
+	}
+}
+
+func TestResumeCloneDisk(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	checkpointPath := filepath.Join(dir, "clone.checkpoint")
+	capacity := disklib.VixDiskLibSectorType(4 * 2048)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(40)).Read(data)
+	src.WriteAt(data, 0)
+	src.Close()
+	dc := &dumper.DiskChangeInfo{
+		Length: int64(len(data)),
+		ChangedArea: []dumper.ChangedArea{
+			{Start: 0, Length: 1024 * 1024},
+			{Start: 1024 * 1024, Length: 3 * 1024 * 1024},
+		},
+	}
+
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	d.ReadNativeLocalDisk(srcPath)
+	if err := d.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	d.CheckpointPath = checkpointPath
+	d.SnapshotChangeId = "52 de c0 d9 98 9a 7f 6b-8f 4e 1f 14 8b 7e 2a 11/42"
+	err := d.DumpCloneDisk(dc)
+	d.Cleanup()
+	if err != nil {
+		t.Fatalf("DumpCloneDisk failed: %v", err)
+	}
+	cp, err := dumper.LoadCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint failed: %v", err)
+	}
+	if !cp.Done || cp.Target != dstPath || cp.Position != (dumper.CopyPosition{Area: 1, Offset: 4 * 1024 * 1024}) {
+		t.Errorf("Unexpected checkpoint %+v", cp)
+	}
+
+	// Pretend the copy stopped half way into the second area
+	dst, vErr := vmdk.Open(dstPath, false)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	dst.WriteAt(make([]byte, 2*1024*1024), 2*1024*1024)
+	dst.Close()
+	cp.Done = false
+	cp.Position = dumper.CopyPosition{Area: 1, Offset: 2 * 1024 * 1024}
+	cp.Save(checkpointPath)
+
+	resume := func(target string, changeId string, dc *dumper.DiskChangeInfo) (*dumper.VadpDumper, error) {
+		d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+		d.ReadNativeLocalDisk(srcPath)
+		if err := d.OpenNativeLocalDisk(target); err != nil {
+			t.Fatalf("OpenNativeLocalDisk failed: %v", err)
+		}
+		d.CheckpointPath = checkpointPath
+		d.SnapshotChangeId = changeId
+		return d, d.ResumeCloneDisk(dc)
+	}
+	otherDisk := filepath.Join(dir, "other.vmdk")
+	other, _ := vmdk.Create(otherDisk, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	other.Close()
+	for _, c := range []struct {
+		target   string
+		changeId string
+		dc       *dumper.DiskChangeInfo
+	}{
+		{otherDisk, cp.ChangeId, dc},
+		{dstPath, "52 de c0 d9 98 9a 7f 6b-8f 4e 1f 14 8b 7e 2a 11/43", dc},
+		{dstPath, cp.ChangeId, &dumper.DiskChangeInfo{Length: dc.Length, ChangedArea: dc.ChangedArea[1:]}},
+	} {
+		d, err := resume(c.target, c.changeId, c.dc)
+		d.Cleanup()
+		if err == nil {
+			t.Errorf("ResumeCloneDisk(%s, %s) should refuse the checkpoint", c.target, c.changeId)
+		}
+	}
+
+	d, err = resume(dstPath, cp.ChangeId, dc)
+	checksums := d.Checksums
+	d.Cleanup()
+	if err != nil {
+		t.Fatalf("ResumeCloneDisk failed: %v", err)
+	}
+	if len(checksums.Blocks) != 2 {
+		t.Errorf("Resume copied %d blocks, expected 2", len(checksums.Blocks))
+	}
+	dst, vErr = vmdk.Open(dstPath, true)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	got := make([]byte, dst.Capacity())
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Resumed clone does not match the source")
+	}
+	if cp, err := dumper.LoadCheckpoint(checkpointPath); err != nil || !cp.Done {
+		t.Errorf("Checkpoint after resume is %+v, %v", cp, err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+// shortWriter writes one byte less than asked.
+type shortWriter struct{}
+
+func (shortWriter) WriteAt(p []byte, off int64) (int, error) {
+	return len(p) - 1, nil
+}
+
+func TestCopyChecksums(t *testing.T) {
+	src := newTestDisk(t, 8192)
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(30)).Read(data)
+	src.WriteAt(data, 0)
+	dc := &dumper.DiskChangeInfo{
+		Length: src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{
+			{Start: 0, Length: 1024 * 1024},
+			{Start: 2 * 1024 * 1024, Length: 4096},
+		},
+	}
+
+	dst := newTestDisk(t, 8192)
+	checksums := dumper.NewChecksumManifest()
+	opts := dumper.CopyOptions{Readers: 4, Writers: 4, BlockSize: 64 * 1024, Checksums: checksums}
+	if err := dumper.CopyChangedAreas(context.Background(), dst, src, dc, opts); err != nil {
+		t.Fatalf("CopyChangedAreas failed: %v", err)
+	}
+	if len(checksums.Blocks) != 17 {
+		t.Errorf("Checksums of %d blocks, expected 17", len(checksums.Blocks))
+	}
+	mismatched, err := dumper.VerifyChecksums(context.Background(), dst, checksums)
+	if err != nil || len(mismatched) != 0 {
+		t.Errorf("VerifyChecksums returned %v, %v", mismatched, err)
+	}
+
+	// Two adjacent corrupt blocks are reported as one range
+	dst.WriteAt([]byte{data[65535] ^ 1, data[65536] ^ 1}, 65535)
+	dst.WriteAt([]byte{data[2*1024*1024] ^ 1}, 2*1024*1024)
+	expected := []dumper.ChangedArea{{Start: 0, Length: 128 * 1024}, {Start: 2 * 1024 * 1024, Length: 4096}}
+	buf, err := checksums.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	parsed, err := dumper.ParseChecksumManifest(string(buf))
+	if err != nil {
+		t.Fatalf("ParseChecksumManifest failed: %v", err)
+	}
+	mismatched, err = dumper.VerifyChecksums(context.Background(), dst, parsed)
+	if err != nil || !reflect.DeepEqual(mismatched, expected) {
+		t.Errorf("VerifyChecksums returned %v, %v", mismatched, err)
+	}
+
+	if err := dumper.CopyChangedAreas(context.Background(), shortWriter{}, src, dc, dumper.CopyOptions{}); err == nil {
+		t.Errorf("CopyChangedAreas should fail on a short write")
+	}
+}
+
+func TestDumpVerifyDisk(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(2 * 2048)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(31)).Read(data)
+	src.WriteAt(data, 0)
+	src.Close()
+
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	if err := d.ReadNativeLocalDisk(srcPath); err != nil {
+		t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+	}
+	if err := d.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	if _, err := d.DumpVerifyDisk(); err == nil {
+		t.Errorf("DumpVerifyDisk should fail before a copy")
+	}
+	err := d.DumpCloneDisk(&dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{{Start: 0, Length: int64(len(data))}}})
+	if err != nil {
+		t.Fatalf("DumpCloneDisk failed: %v", err)
+	}
+	mismatched, err := d.DumpVerifyDisk()
+	if err != nil || len(mismatched) != 0 {
+		t.Errorf("DumpVerifyDisk returned %v, %v", mismatched, err)
+	}
+	checksums := d.Checksums
+	d.Cleanup()
+
+	// A fresh open of the target sees a corruption
+	dst, vErr := vmdk.Open(dstPath, false)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	dst.WriteAt([]byte{data[3*512*1024] ^ 1}, 3*512*1024)
+	mismatched, err = dumper.VerifyChecksums(context.Background(), dst, checksums)
+	if err != nil || !reflect.DeepEqual(mismatched, []dumper.ChangedArea{{Start: 1024 * 1024, Length: 1024 * 1024}}) {
+		t.Errorf("VerifyChecksums returned %v, %v", mismatched, err)
+	}
+}
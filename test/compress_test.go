@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/compress"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+func TestCompressCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("virtual disk "), 10000)
+	for _, name := range []string{compress.None, compress.Gzip, compress.Zstd, compress.LZ4} {
+		codec, err := compress.Lookup(name)
+		if err != nil {
+			t.Fatalf("Lookup(%s) failed: %v", name, err)
+		}
+		block, err := codec.Encode(nil, data)
+		if err != nil {
+			t.Fatalf("%s: Encode failed: %v", name, err)
+		}
+		if name != compress.None && len(block) >= len(data)/10 {
+			t.Errorf("%s: block of %d bytes did not compress, %d", name, len(data), len(block))
+		}
+		got, err := codec.Decode(block, len(data))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: Decode returned %d bytes, %v", name, len(got), err)
+		}
+		if _, err := codec.Decode(block, len(data)+1); err == nil {
+			t.Errorf("%s: Decode should check the size", name)
+		}
+
+		var stream bytes.Buffer
+		zw, err := compress.NewWriter(&stream, name)
+		if err != nil {
+			t.Fatalf("%s: NewWriter failed: %v", name, err)
+		}
+		zw.Write(data[:1000])
+		zw.Write(data[1000:])
+		if err := zw.Close(); err != nil {
+			t.Fatalf("%s: Close failed: %v", name, err)
+		}
+		zr, err := compress.NewReader(&stream, name)
+		if err != nil {
+			t.Fatalf("%s: NewReader failed: %v", name, err)
+		}
+		got, err = io.ReadAll(zr)
+		zr.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: stream read back %d bytes, %v", name, len(got), err)
+		}
+	}
+	if _, err := compress.Lookup("brotli"); err == nil {
+		t.Errorf("Lookup should fail for an unknown algorithm")
+	}
+}
+
+func TestRepositoryCompression(t *testing.T) {
+	if _, err := repository.Create(t.TempDir(), repository.Config{Compression: "brotli"}, nil); err == nil {
+		t.Errorf("Create should refuse an unknown compression")
+	}
+	root := t.TempDir()
+	repo, err := repository.Create(root, repository.Config{
+		Chunking:    repository.Chunking{ChunkSize: 64 * 1024},
+		Compression: compress.Zstd,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// One chunk of text that compresses and one of random bytes that does not
+	data := make([]byte, 128*1024)
+	copy(data, bytes.Repeat([]byte("virtual disk "), 64*1024/13))
+	rand.New(rand.NewSource(5)).Read(data[64*1024:])
+	m := repository.Manifest{}
+	m.SetInfo(virtual_disks.DefaultInfo(1024))
+	bw, err := repo.NewBackup(m)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	bw.WriteAt(data, 0)
+	stats := bw.Stats()
+	manifest, err := bw.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	chunks := manifest.Extents[0].Chunks
+	if len(chunks) != 2 || chunks[0].Compression != compress.Zstd || chunks[1].Compression != compress.None {
+		t.Errorf("Unexpected chunks %+v", chunks)
+	}
+	if stats.StoredBytes >= stats.NewBytes-32*1024 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	repo, err = repository.Open(root, nil)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	backup, err := repo.OpenBackup(manifest.ID)
+	if err != nil {
+		t.Fatalf("OpenBackup failed: %v", err)
+	}
+	defer backup.Close()
+	got := make([]byte, len(data))
+	if _, err := backup.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Backup reads back wrong data, %v", err)
+	}
+}
+
+func TestDumpCompressedStream(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(2048 + 10)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(6)).Read(data[4096:8192])
+	src.WriteAt(data[4096:8192], 4096)
+	src.Close()
+
+	for _, name := range []string{compress.Gzip, compress.Zstd, compress.LZ4} {
+		backupDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpBackup)
+		if err := backupDumper.ReadNativeLocalDisk(srcPath); err != nil {
+			t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+		}
+		var stream bytes.Buffer
+		err := backupDumper.DumpCompressedStream(&stream, name)
+		backupDumper.Cleanup()
+		if err != nil {
+			t.Fatalf("%s: DumpCompressedStream failed: %v", name, err)
+		}
+		if stream.Len() > len(data)/10 {
+			t.Errorf("%s: stream of %d bytes for a mostly empty disk", name, stream.Len())
+		}
+
+		dstPath := filepath.Join(dir, name+".vmdk")
+		restoreDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpResotre)
+		if err := restoreDumper.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+			t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+		}
+		err = restoreDumper.DumpRestoreCompressedStream(&stream, name)
+		restoreDumper.Cleanup()
+		if err != nil {
+			t.Fatalf("%s: DumpRestoreCompressedStream failed: %v", name, err)
+		}
+		dst, vErr := vmdk.Open(dstPath, true)
+		if vErr != nil {
+			t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+		}
+		got := make([]byte, dst.Capacity())
+		dst.ReadAt(got, 0)
+		dst.Close()
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: restored disk does not match the source", name)
+		}
+	}
+}
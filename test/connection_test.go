@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConnectionKey(t *testing.T) {
+	vmDisk := func(path string, flags uint32, snapshot string) disklib.ConnectParams {
+		return disklib.NewConnectParams("moref=vm-42", "vcenter", "AA:BB", "user", "secret", "", "", "", "", "backup",
+			path, flags, true, snapshot, disklib.NBD)
+	}
+	first := vmDisk("[ds] vm/vm.vmdk", 0, "snapshot-1")
+	second := vmDisk("[ds] vm/vm_1.vmdk", disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY, "snapshot-1")
+	if first.ConnectionKey() != second.ConnectionKey() {
+		t.Errorf("Disks of the same VM snapshot have different keys %s and %s", first.ConnectionKey(), second.ConnectionKey())
+	}
+	for _, other := range []disklib.ConnectParams{vmDisk("[ds] vm/vm.vmdk", 0, "snapshot-2"),
+		disklib.NewConnectParams("moref=vm-43", "vcenter", "AA:BB", "user", "secret", "", "", "", "", "backup",
+			"[ds] vm/vm.vmdk", 0, true, "snapshot-1", disklib.NBD),
+		disklib.NewConnectParams("moref=vm-42", "vcenter", "AA:BB", "user", "secret", "", "", "", "", "backup",
+			"[ds] vm/vm.vmdk", 0, true, "snapshot-1", disklib.HOTADD)} {
+		if first.ConnectionKey() == other.ConnectionKey() {
+			t.Errorf("%s shares the key of %s", other.ConnectionKey(), first.ConnectionKey())
+		}
+	}
+}
+
+func TestConnectionManagerFailedConnect(t *testing.T) {
+	// Nothing listens there, so every open fails to connect
+	params := disklib.NewConnectParams("moref=vm-42", "127.0.0.1", "", "user", "secret", "", "", "", "", "backup",
+		"[ds] vm/vm.vmdk", 0, true, "snapshot-1", disklib.NBD)
+	manager := virtual_disks.NewConnectionManager(logrus.New())
+	var wg sync.WaitGroup
+	errs := make([]disklib.VddkError, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = manager.Open(params, logrus.New())
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Fatalf("Open %d should fail", i)
+		}
+	}
+	if manager.Connections() != 0 {
+		t.Errorf("Manager holds %d connections after failing to connect", manager.Connections())
+	}
+}
+
+func TestConnectionManagerSharesConnection(t *testing.T) {
+	path := os.Getenv("LIBPATH")
+	if path == "" {
+		t.Skip("Skipping testing if environment variables are not set.")
+	}
+	disklib.Init(7, 0, path, nil)
+	params := disklib.NewConnectParams(os.Getenv("VMXSPEC"), os.Getenv("IP"), os.Getenv("THUMBPRINT"), os.Getenv("USERNAME"),
+		os.Getenv("PASSWORD"), "", "", "", "", os.Getenv("IDENTITY"), os.Getenv("DISKPATH"), disklib.VIXDISKLIB_FLAG_OPEN_READ_ONLY,
+		true, os.Getenv("SNAPSHOTREF"), disklib.NBD)
+	manager := virtual_disks.NewConnectionManager(logrus.New())
+	first, err := manager.Open(params, logrus.New())
+	if err != nil {
+		t.Fatalf("Open failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	second, err := manager.Open(params, logrus.New())
+	if err != nil {
+		first.Close()
+		t.Fatalf("Second open failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	if manager.Connections() != 1 {
+		t.Errorf("Two disks of one VM hold %d connections", manager.Connections())
+	}
+	if err := first.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if manager.Connections() != 1 {
+		t.Errorf("Closing the first disk dropped the connection of the second")
+	}
+	if err := second.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if manager.Connections() != 0 {
+		t.Errorf("Manager holds %d connections after the last disk is closed", manager.Connections())
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// orderedWriter records the offsets it is asked to write.
+type orderedWriter struct {
+	mutex   sync.Mutex
+	offsets []int64
+	failAt  int64
+}
+
+func (w *orderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if off == w.failAt {
+		return 0, errors.New("write failed")
+	}
+	w.offsets = append(w.offsets, off)
+	return len(p), nil
+}
+
+func newTestDisk(t *testing.T, capacity disklib.VixDiskLibSectorType) virtual_disks.DiskConnectHandle {
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(virtual_disks.NewMemoryBackend(capacity))
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	return diskHandle
+}
+
+func TestCopyChangedAreas(t *testing.T) {
+	src := newTestDisk(t, 32768)
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(1)).Read(data)
+	src.WriteAt(data, 0)
+
+	dc := &dumper.DiskChangeInfo{
+		Length: src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{
+			{Start: 0, Length: 3 * 1024 * 1024},
+			{Start: 5*1024*1024 + 512, Length: 4096},
+			{Start: 8 * 1024 * 1024, Length: 7*1024*1024 + 512},
+		},
+	}
+	for _, opts := range []dumper.CopyOptions{
+		{},
+		{Readers: 4, Writers: 4, QueueDepth: 2, BlockSize: 256 * 1024},
+		{Readers: 4, QueueDepth: 1, BlockSize: 64 * 1024, Ordered: true},
+	} {
+		dst := newTestDisk(t, 32768)
+		if err := dumper.CopyChangedAreas(context.Background(), dst, src, dc, opts); err != nil {
+			t.Fatalf("CopyChangedAreas(%+v) failed: %v", opts, err)
+		}
+		got := make([]byte, dst.Capacity())
+		dst.ReadAt(got, 0)
+		expected := make([]byte, len(data))
+		for _, area := range dc.ChangedArea {
+			copy(expected[area.Start:area.Start+area.Length], data[area.Start:])
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("CopyChangedAreas(%+v) copied the wrong data", opts)
+		}
+	}
+
+	w := &orderedWriter{failAt: -1}
+	opts := dumper.CopyOptions{Readers: 8, BlockSize: 64 * 1024, Ordered: true}
+	if err := dumper.CopyChangedAreas(context.Background(), w, src, dc, opts); err != nil {
+		t.Fatalf("CopyChangedAreas failed: %v", err)
+	}
+	for i := 1; i < len(w.offsets); i++ {
+		if w.offsets[i] <= w.offsets[i-1] {
+			t.Fatalf("Ordered copy wrote %d after %d", w.offsets[i], w.offsets[i-1])
+		}
+	}
+
+	w = &orderedWriter{failAt: 1024 * 1024}
+	opts = dumper.CopyOptions{Readers: 4, Writers: 4, BlockSize: 64 * 1024}
+	if err := dumper.CopyChangedAreas(context.Background(), w, src, dc, opts); err == nil {
+		t.Errorf("CopyChangedAreas should report the failed write")
+	}
+}
+
+// shortReader returns at most limit bytes from every read, without an error.
+type shortReader struct {
+	io.ReaderAt
+	limit int
+}
+
+func (this shortReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > this.limit {
+		p = p[:this.limit]
+	}
+	return this.ReaderAt.ReadAt(p, off)
+}
+
+func TestCopyChangedAreasShortRead(t *testing.T) {
+	src := newTestDisk(t, 8192)
+	dst := newTestDisk(t, 8192)
+	dc := &dumper.DiskChangeInfo{
+		Length:      src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{{Start: 0, Length: 1024 * 1024}},
+	}
+	opts := dumper.CopyOptions{BlockSize: 64 * 1024}
+	err := dumper.CopyChangedAreas(context.Background(), dst, shortReader{src, 4096}, dc, opts)
+	if err == nil || !strings.Contains(err.Error(), io.ErrUnexpectedEOF.Error()) {
+		t.Errorf("CopyChangedAreas returned %v, expected a short read to fail with %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestCopyChangedAreasCancelReachesBackend(t *testing.T) {
+	src, err := virtual_disks.NewBackendDiskHandle(stallingBackend{virtual_disks.NewMemoryBackend(8192)})
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	dst := newTestDisk(t, 8192)
+	dc := &dumper.DiskChangeInfo{
+		Length:      src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{{Start: 0, Length: src.Capacity()}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dumper.CopyChangedAreas(ctx, dst, src, dc, dumper.CopyOptions{}); err != context.DeadlineExceeded {
+		t.Errorf("CopyChangedAreas returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/encryption"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+func TestKeyProviders(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup.key")
+	keyFile, err := encryption.GenerateKeyFile(path)
+	if err != nil {
+		t.Fatalf("GenerateKeyFile failed: %v", err)
+	}
+	if _, err := encryption.GenerateKeyFile(path); err == nil {
+		t.Errorf("GenerateKeyFile should not overwrite a key")
+	}
+	kms := encryption.NewMemoryKMS()
+	kmsKey, err := kms.CreateKey()
+	if err != nil {
+		t.Fatalf("CreateKey failed: %v", err)
+	}
+
+	dataKey, _ := encryption.NewKey()
+	reopened, err := encryption.OpenKeyFile(path)
+	if err != nil {
+		t.Fatalf("OpenKeyFile failed: %v", err)
+	}
+	otherFile, _ := encryption.GenerateKeyFile(filepath.Join(dir, "other.key"))
+	for _, c := range []struct {
+		wrap   encryption.KeyProvider
+		unwrap encryption.KeyProvider
+		wrong  encryption.KeyProvider
+	}{
+		{keyFile, reopened, otherFile},
+		{encryption.NewKMS(kms, kmsKey), encryption.NewKMS(kms, kmsKey), otherFile},
+	} {
+		wrapped, err := c.wrap.WrapKey(dataKey)
+		if err != nil {
+			t.Fatalf("WrapKey failed: %v", err)
+		}
+		if bytes.Contains(wrapped, dataKey) {
+			t.Errorf("%s: wrapped key holds the key", c.wrap.KeyID())
+		}
+		got, err := c.unwrap.UnwrapKey(c.wrap.KeyID(), wrapped)
+		if err != nil || !bytes.Equal(got, dataKey) {
+			t.Errorf("%s: UnwrapKey returned %v", c.wrap.KeyID(), err)
+		}
+		if _, err := c.wrong.UnwrapKey(c.wrap.KeyID(), wrapped); err == nil {
+			t.Errorf("%s: UnwrapKey with another key should fail", c.wrap.KeyID())
+		}
+	}
+	kms.DeleteKey(kmsKey)
+	if _, err := encryption.NewKMS(kms, kmsKey).WrapKey(dataKey); err == nil {
+		t.Errorf("WrapKey with a deleted KMS key should fail")
+	}
+}
+
+func TestRepositoryEncryption(t *testing.T) {
+	kms := encryption.NewMemoryKMS()
+	kmsKey, _ := kms.CreateKey()
+	keys := encryption.NewKMS(kms, kmsKey)
+	root := t.TempDir()
+	repo, err := repository.Create(root, repository.Config{}, keys)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	secret := bytes.Repeat([]byte("top secret VM disk contents "), 1000)
+	m := repository.Manifest{Metadata: map[string]string{"uuid": "60 00 C2 91"}}
+	m.SetInfo(virtual_disks.DefaultInfo(1024))
+	bw, _ := repo.NewBackup(m)
+	bw.WriteAt(secret, 4096)
+	first, err := bw.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	bw, _ = repo.NewBackup(m)
+	bw.WriteAt(secret, 4096)
+	second, _ := bw.Commit()
+	if stats := bw.Stats(); stats.ReusedBytes != int64(len(secret)) {
+		t.Errorf("Encrypted chunks do not dedup: %+v", stats)
+	}
+
+	// Neither chunks nor manifests hold plaintext
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		buf, _ := os.ReadFile(path)
+		if bytes.Contains(buf, secret[:28]) || bytes.Contains(buf, []byte("60 00 C2 91")) {
+			t.Errorf("%s holds plaintext", path)
+		}
+		return nil
+	})
+
+	if _, err := repository.Open(root, nil); err == nil {
+		t.Errorf("Open without keys should fail")
+	}
+	if _, err := repository.Open(root, encryption.NewKMS(encryption.NewMemoryKMS(), kmsKey)); err == nil {
+		t.Errorf("Open with another KMS should fail")
+	}
+	repo, err = repository.Open(root, keys)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	backup, err := repo.OpenBackup(first.ID)
+	if err != nil {
+		t.Fatalf("OpenBackup failed: %v", err)
+	}
+	if backup.Manifest().Metadata["uuid"] != "60 00 C2 91" {
+		t.Errorf("Unexpected manifest %+v", backup.Manifest())
+	}
+	got := make([]byte, len(secret))
+	if _, err := backup.ReadAt(got, 4096); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("Backup reads back wrong data, %v", err)
+	}
+	backup.Close()
+
+	// A manifest moved to another backup fails authentication
+	buf, _ := os.ReadFile(filepath.Join(root, "backups", first.ID, "manifest.json"))
+	os.WriteFile(filepath.Join(root, "backups", second.ID, "manifest.json"), buf, 0600)
+	if _, err := repo.Manifest(second.ID); err == nil {
+		t.Errorf("Manifest should reject the manifest of another backup")
+	}
+
+	// So does a changed chunk
+	chunk := first.Extents[0].Chunks[0]
+	matches, _ := filepath.Glob(filepath.Join(root, "chunks", chunk.Hash[:2], chunk.Hash+"*"))
+	if len(matches) != 1 {
+		t.Fatalf("Chunk %s not found: %v", chunk.Hash, matches)
+	}
+	buf, _ = os.ReadFile(matches[0])
+	buf[len(buf)-1] ^= 1
+	os.WriteFile(matches[0], buf, 0600)
+	backup, _ = repo.OpenBackup(first.ID)
+	defer backup.Close()
+	if _, err := backup.ReadAt(got, 4096); err == nil {
+		t.Errorf("ReadAt should fail on a changed chunk")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+func TestErrorNames(t *testing.T) {
+	names := map[uint64]string{
+		disklib.VIX_OK:                     "VIX_OK",
+		disklib.VIX_E_FILE_NOT_FOUND:       "VIX_E_FILE_NOT_FOUND",
+		disklib.VIX_E_HOST_CONNECTION_LOST: "VIX_E_HOST_CONNECTION_LOST",
+		disklib.VIX_E_NET_HTTP_GENERIC:     "VIX_E_NET_HTTP_GENERIC",
+		123456789:                          "VIX_E_UNKNOWN(123456789)",
+	}
+	for code, name := range names {
+		if got := disklib.ErrorName(code); got != name {
+			t.Errorf("Code %d is named %s, expected %s", code, got, name)
+		}
+	}
+	err := disklib.NewVddkError(disklib.VIX_E_DISK_OUTOFRANGE, "Read failed.")
+	if err.VixErrorName() != "VIX_E_DISK_OUTOFRANGE" {
+		t.Errorf("Error is named %s", err.VixErrorName())
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	categories := []struct {
+		code uint64
+		kind error
+	}{
+		{disklib.VIX_E_FILE_NOT_FOUND, disklib.ErrNotFound},
+		{disklib.VIX_E_DISK_KEY_NOTFOUND, disklib.ErrNotFound},
+		{disklib.VIX_E_AUTHENTICATION_FAIL, disklib.ErrAuth},
+		{disklib.VIX_E_HOST_TCP_CONN_LOST, disklib.ErrConnectionLost},
+		{disklib.VIX_E_DISK_OUTOFRANGE, disklib.ErrOutOfRange},
+		{disklib.VIX_E_CANCELLED, disklib.ErrCancelled},
+	}
+	for _, category := range categories {
+		err := disklib.NewVddkError(category.code, "failed")
+		if !errors.Is(err, category.kind) {
+			t.Errorf("%s is not %v", disklib.ErrorName(category.code), category.kind)
+		}
+		if errors.Is(err, disklib.ErrAuth) != (category.kind == disklib.ErrAuth) {
+			t.Errorf("%s is wrongly %v", disklib.ErrorName(category.code), disklib.ErrAuth)
+		}
+	}
+	if errors.Is(disklib.NewVddkError(disklib.VIX_E_FAIL, "failed"), disklib.ErrNotFound) {
+		t.Errorf("VIX_E_FAIL has a category")
+	}
+}
+
+func TestOpError(t *testing.T) {
+	cause := disklib.NewVddkError(disklib.VIX_E_HOST_CONNECTION_LOST, "Read failed. The error code is 36.")
+	var vErr disklib.VddkError = &disklib.OpError{Op: "Read", Path: "[ds] vm/vm.vmdk", StartSector: 2048, NumSectors: 128, Transport: disklib.NBD, Err: cause}
+	msg := vErr.Error()
+	for _, part := range []string{"Read", "[ds] vm/vm.vmdk", "sectors 2048-2175", "over nbd", "VIX_E_HOST_CONNECTION_LOST"} {
+		if !strings.Contains(msg, part) {
+			t.Errorf("%q does not mention %q", msg, part)
+		}
+	}
+	if vErr.VixErrorCode() != disklib.VIX_E_HOST_CONNECTION_LOST || !disklib.IsTransient(vErr) {
+		t.Errorf("OpError lost its code")
+	}
+	// Through further wrapping
+	err := fmt.Errorf("backup: %w", vErr)
+	if !errors.Is(err, disklib.ErrConnectionLost) || errors.Is(err, disklib.ErrNotFound) {
+		t.Errorf("errors.Is does not see the category of %v", err)
+	}
+	var opErr *disklib.OpError
+	if !errors.As(err, &opErr) || opErr.Path != "[ds] vm/vm.vmdk" || opErr.StartSector != 2048 {
+		t.Errorf("errors.As does not find the OpError of %v", err)
+	}
+	if disklib.WrapError(nil, "Open", "disk.vmdk", disklib.NBD) != nil {
+		t.Errorf("WrapError of no error is not nil")
+	}
+}
+
+// failingCloseBackend is a memory disk whose Close fails.
+type failingCloseBackend struct {
+	virtual_disks.DiskBackend
+}
+
+func (this failingCloseBackend) Close() disklib.VddkError {
+	return disklib.WrapError(disklib.NewVddkError(disklib.VIX_E_HOST_CONNECTION_LOST, "Disconnect failed."), "Disconnect", "disk.vmdk", disklib.NBD)
+}
+
+func TestCloseKeepsError(t *testing.T) {
+	diskHandle, vErr := virtual_disks.NewBackendDiskHandle(failingCloseBackend{virtual_disks.NewMemoryBackend(2048)})
+	if vErr != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", vErr.Error())
+	}
+	err := diskHandle.Close()
+	var opErr *disklib.OpError
+	if !errors.Is(err, disklib.ErrConnectionLost) || !errors.As(err, &opErr) || opErr.Op != "Disconnect" {
+		t.Errorf("Close returned %v, expected the Disconnect error", err)
+	}
+	if err := newTestDisk(t, 2048).Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	// The dumper keeps the cause as well
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	err = d.ReadNativeLocalDisk(filepath.Join(t.TempDir(), "missing.vmdk"))
+	if !errors.Is(err, disklib.ErrNotFound) {
+		t.Errorf("ReadNativeLocalDisk of a missing disk returned %v", err)
+	}
+}
@@ -16,9 +16,14 @@ limitations under the License.
 package main
 
 import (
-	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"context"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/sirupsen/logrus"
 )
 
 func TestCreate(t *testing.T) {
@@ -27,7 +32,7 @@ func TestCreate(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	res := disklib.Init(7, 0, path)
+	res := disklib.Init(7, 0, path, logrus.New())
 	if res != nil {
 		t.Errorf("Init failed, got error code: %d, error message: %s.", res.VixErrorCode(), res.Error())
 	}
@@ -53,3 +58,71 @@ func TestCreate(t *testing.T) {
 	disklib.Disconnect(conn)
 	disklib.EndAccess(params)
 }
+
+func TestCreateCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 2048)
+	err := disklib.Create(ctx, disklib.VixDiskLibConnection{}, "cancelled.vmdk", createParams, func(percent int) {
+		t.Errorf("Progress reported for a cancelled operation")
+	})
+	if err == nil || err.VixErrorCode() != disklib.VIX_E_CANCELLED {
+		t.Errorf("Create with a cancelled context should fail with VIX_E_CANCELLED, got %v", err)
+	}
+}
+
+// localConnection connects to local disks, which VDDK allows without a server.
+func localConnection(t *testing.T) disklib.VixDiskLibConnection {
+	res := disklib.Init(7, 0, os.Getenv("LIBPATH"), nil)
+	if res != nil {
+		t.Fatalf("Init failed, got error code: %d, error message: %s.", res.VixErrorCode(), res.Error())
+	}
+	params := disklib.NewConnectParams("", "", "", "", "", "", "", "", "", "", "", 0, false, "", "")
+	conn, err := disklib.Connect(params)
+	if err != nil {
+		t.Fatalf("Connect to local disks failed. Error code: %d. Error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	t.Cleanup(func() {
+		disklib.Disconnect(conn)
+	})
+	return conn
+}
+
+func TestCreateProgress(t *testing.T) {
+	conn := localConnection(t)
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 2048)
+	var reported []int
+	err := disklib.Create(context.Background(), conn, filepath.Join(t.TempDir(), "progress.vmdk"), createParams, func(percent int) {
+		reported = append(reported, percent)
+	})
+	if err != nil {
+		t.Fatalf("Create failed. Error code: %d. Error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != 100 {
+		t.Fatalf("Create reported progress %v, expected it to end at 100", reported)
+	}
+	for i, percent := range reported {
+		if percent < 0 || percent > 100 || (i > 0 && percent < reported[i-1]) {
+			t.Errorf("Create reported progress %v", reported)
+			break
+		}
+	}
+}
+
+func TestCreateCancelledFromProgress(t *testing.T) {
+	conn := localConnection(t)
+	createParams := disklib.NewCreateParams(disklib.VIXDISKLIB_DISK_MONOLITHIC_SPARSE, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7, 2048)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	err := disklib.Create(ctx, conn, filepath.Join(t.TempDir(), "cancelled.vmdk"), createParams, func(percent int) {
+		calls++
+		cancel()
+	})
+	if calls != 1 {
+		t.Errorf("Progress was reported %d times, expected the operation to stop after the first", calls)
+	}
+	if err == nil || err.VixErrorCode() != disklib.VIX_E_CANCELLED || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("Create cancelled from its progress callback should fail with VIX_E_CANCELLED, got %v", err)
+	}
+}
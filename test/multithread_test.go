@@ -34,7 +34,7 @@ func TestAligned(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -44,7 +44,7 @@ func TestAligned(t *testing.T) {
 	identity := os.Getenv("IDENTITY")
 	params := disklib.NewConnectParams("", serverName, thumPrint, userName,
 		password, fcdId, ds, "", "", identity, "", disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ,
-		false, disklib.NBD)
+		false, "", disklib.NBD)
 	diskReaderWriter, err := virtual_disks.Open(params, logrus.New())
 	if err != nil {
 		disklib.EndAccess(params)
@@ -98,7 +98,7 @@ func TestMiss1(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -108,7 +108,7 @@ func TestMiss1(t *testing.T) {
 	identity := os.Getenv("IDENTITY")
 	params := disklib.NewConnectParams("", serverName, thumPrint, userName,
 		password, fcdId, ds, "", "", identity, "", disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ,
-		false, disklib.NBD)
+		false, "", disklib.NBD)
 	diskReaderWriter, err := virtual_disks.Open(params, logrus.New())
 	if err != nil {
 		disklib.EndAccess(params)
@@ -162,7 +162,7 @@ func TestMiss2(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -172,7 +172,7 @@ func TestMiss2(t *testing.T) {
 	identity := os.Getenv("IDENTITY")
 	params := disklib.NewConnectParams("", serverName, thumPrint, userName,
 		password, fcdId, ds, "", "", identity, "", disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ,
-		false, disklib.NBD)
+		false, "", disklib.NBD)
 	diskReaderWriter, err := virtual_disks.Open(params, logrus.New())
 	if err != nil {
 		disklib.EndAccess(params)
@@ -226,7 +226,7 @@ func TestMiss3(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -236,7 +236,7 @@ func TestMiss3(t *testing.T) {
 	identity := os.Getenv("IDENTITY")
 	params := disklib.NewConnectParams("", serverName, thumPrint, userName,
 		password, fcdId, ds, "", "", identity, "", disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ,
-		false, disklib.NBD)
+		false, "", disklib.NBD)
 	diskReaderWriter, err := virtual_disks.Open(params, logrus.New())
 	if err != nil {
 		disklib.EndAccess(params)
@@ -290,7 +290,7 @@ func TestMissAlign(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -300,7 +300,7 @@ func TestMissAlign(t *testing.T) {
 	identity := os.Getenv("IDENTITY")
 	params := disklib.NewConnectParams("", serverName, thumPrint, userName,
 		password, fcdId, ds, "", "", identity, "", disklib.VIXDISKLIB_FLAG_OPEN_COMPRESSION_SKIPZ,
-		false, disklib.NBD)
+		false, "", disklib.NBD)
 	diskReaderWriter, err := virtual_disks.Open(params, logrus.New())
 	if err != nil {
 		disklib.EndAccess(params)
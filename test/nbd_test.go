@@ -0,0 +1,240 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/nbd"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNBDServer(t *testing.T) {
+	disk := newTestDisk(t, 8192)
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(50)).Read(data)
+	disk.WriteAt(data[:65536], 0)
+	disk.WriteAt(data[:65536], 3*65536)
+
+	server := nbd.NewServer(logrus.New())
+	if err := server.AddExport("disk", disk, false); err != nil {
+		t.Fatalf("AddExport failed: %v", err)
+	}
+	if err := server.AddExport("ro", newTestDisk(t, 2048), true); err != nil {
+		t.Fatalf("AddExport failed: %v", err)
+	}
+	if err := server.AddExport("disk", disk, false); err == nil {
+		t.Errorf("AddExport should refuse a duplicate name")
+	}
+	sock := filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(l)
+	}()
+	defer func() {
+		server.Close()
+		if err := <-served; err != nbd.ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	}()
+
+	client, err := nbd.Dial("unix", sock, "disk")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	if client.Size() != disk.Capacity() || client.ReadOnly() {
+		t.Errorf("Export has size %d, read only %v", client.Size(), client.ReadOnly())
+	}
+
+	extents, err := client.BlockStatus(0, 6*65536)
+	if err != nil {
+		t.Fatalf("BlockStatus failed: %v", err)
+	}
+	expected := []nbd.Extent{
+		{Offset: 0, Length: 65536},
+		{Offset: 65536, Length: 2 * 65536, Flags: nbd.StateHole | nbd.StateZero},
+		{Offset: 3 * 65536, Length: 65536},
+		{Offset: 4 * 65536, Length: 2 * 65536, Flags: nbd.StateHole | nbd.StateZero},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Errorf("BlockStatus returned %+v", extents)
+	}
+
+	// Unaligned IO goes through to the disk
+	if _, err := client.WriteAt(data[100:100+70000], 1000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, 70000)
+	if _, err := client.ReadAt(got, 1000); err != nil || !bytes.Equal(got, data[100:100+70000]) {
+		t.Errorf("ReadAt returned %v or wrong data", err)
+	}
+	disk.ReadAt(got, 1000)
+	if !bytes.Equal(got, data[100:100+70000]) {
+		t.Errorf("Write did not reach the disk")
+	}
+	if err := client.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+	if err := client.Trim(0, 65536); err != nil {
+		t.Errorf("Trim failed: %v", err)
+	}
+	if _, err := client.ReadAt(got, disk.Capacity()-1000); err == nil {
+		t.Errorf("ReadAt past the end should fail")
+	}
+	// The connection is still usable after an error
+	if _, err := client.ReadAt(got[:10], 0); err != nil {
+		t.Errorf("ReadAt after an error failed: %v", err)
+	}
+
+	ro, err := nbd.Dial("unix", sock, "ro")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ro.Close()
+	if !ro.ReadOnly() {
+		t.Errorf("Export ro is not read only")
+	}
+	if _, err := ro.WriteAt(data[:512], 0); err == nil {
+		t.Errorf("WriteAt to a read only export should fail")
+	}
+
+	if _, err := nbd.Dial("unix", sock, "missing"); err == nil {
+		t.Errorf("Dial of an unknown export should fail")
+	}
+}
+
+// TestNBDExportName speaks the old NBD_OPT_EXPORT_NAME handshake with simple
+// replies, the way older nbd-client versions do.
+func TestNBDExportName(t *testing.T) {
+	disk := newTestDisk(t, 2048)
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(51)).Read(data)
+	disk.WriteAt(data, 4096)
+	server := nbd.NewServer(logrus.New())
+	server.AddExport("disk", disk, false)
+	defer server.Close()
+
+	conn, peer := net.Pipe()
+	go server.ServeConn(peer)
+	defer conn.Close()
+
+	hello := make([]byte, 18)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		t.Fatalf("Read of the greeting failed: %v", err)
+	}
+	if string(hello[:16]) != "NBDMAGICIHAVEOPT" {
+		t.Fatalf("Bad greeting %q", hello)
+	}
+	msg := binary.BigEndian.AppendUint32(nil, 1)
+	msg = append(msg, "IHAVEOPT"...)
+	msg = binary.BigEndian.AppendUint32(msg, 1)
+	// The empty name selects the first export
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	conn.Write(msg)
+	reply := make([]byte, 8+2+124)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read of the export reply failed: %v", err)
+	}
+	if size := binary.BigEndian.Uint64(reply); size != uint64(disk.Capacity()) {
+		t.Errorf("Export size is %d", size)
+	}
+
+	req := binary.BigEndian.AppendUint32(nil, 0x25609513)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint64(req, 42)
+	req = binary.BigEndian.AppendUint64(req, 4096)
+	req = binary.BigEndian.AppendUint32(req, 4096)
+	conn.Write(req)
+	reply = make([]byte, 16+4096)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read of the read reply failed: %v", err)
+	}
+	if binary.BigEndian.Uint32(reply) != 0x67446698 || binary.BigEndian.Uint32(reply[4:]) != 0 || binary.BigEndian.Uint64(reply[8:]) != 42 {
+		t.Errorf("Bad simple reply %x", reply[:16])
+	}
+	if !bytes.Equal(reply[16:], data) {
+		t.Errorf("Read returned wrong data")
+	}
+}
+
+func TestNBDMetaContextIDs(t *testing.T) {
+	server := nbd.NewServer(logrus.New())
+	server.AddExport("disk", newTestDisk(t, 2048), true)
+	defer server.Close()
+
+	conn, peer := net.Pipe()
+	go server.ServeConn(peer)
+	defer conn.Close()
+
+	hello := make([]byte, 18)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		t.Fatalf("Read of the greeting failed: %v", err)
+	}
+	conn.Write(binary.BigEndian.AppendUint32(nil, 1))
+	option := func(option uint32, data []byte) {
+		msg := append([]byte("IHAVEOPT"), binary.BigEndian.AppendUint32(nil, option)...)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(data)))
+		conn.Write(append(msg, data...))
+	}
+	// Returns the type and data of the next option reply
+	reply := func() (uint32, []byte) {
+		header := make([]byte, 20)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatalf("Read of an option reply failed: %v", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[16:]))
+		io.ReadFull(conn, data)
+		return binary.BigEndian.Uint32(header[12:]), data
+	}
+	query := binary.BigEndian.AppendUint32(nil, 4)
+	query = append(query, "disk"...)
+	query = binary.BigEndian.AppendUint32(query, 1)
+	query = binary.BigEndian.AppendUint32(query, uint32(len(nbd.AllocationContext)))
+	query = append(query, nbd.AllocationContext...)
+
+	option(8, nil)
+	if replyType, _ := reply(); replyType != 1 {
+		t.Fatalf("Structured replies refused with %#x", replyType)
+	}
+	for _, opt := range []uint32{9, 10} {
+		option(opt, query)
+		replyType, data := reply()
+		if replyType != 4 || len(data) < 4 || string(data[4:]) != nbd.AllocationContext {
+			t.Fatalf("Option %d replied %#x %q", opt, replyType, data)
+		}
+		// LIST must use id 0, SET gives the context a real one
+		if id := binary.BigEndian.Uint32(data); (opt == 9) != (id == 0) {
+			t.Errorf("Option %d gave the context id %d", opt, id)
+		}
+		if replyType, _ := reply(); replyType != 1 {
+			t.Errorf("Option %d ended with %#x", opt, replyType)
+		}
+	}
+}
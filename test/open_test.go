@@ -33,7 +33,7 @@ func TestOpen(t *testing.T) {
 	if path == "" {
 		t.Skip("Skipping testing if environment variables are not set.")
 	}
-	disklib.Init(majorVersion, minorVersion, path)
+	disklib.Init(majorVersion, minorVersion, path, nil)
 	serverName := os.Getenv("IP")
 	thumPrint := os.Getenv("THUMBPRINT")
 	userName := os.Getenv("USERNAME")
@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/qcow2"
+)
+
+// readQcow2 reads back every guest cluster of a qcow2 image and checks that
+// each cluster of the file is used once and has a refcount of one. It also
+// returns the number of data and zero clusters.
+func readQcow2(t *testing.T, path string) (qcow2.Header, []byte, int, int) {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var header qcow2.Header
+	binary.Read(bytes.NewReader(image), binary.BigEndian, &header)
+	clusterSize := int64(1) << header.ClusterBits
+	used := make(map[int64]int)
+	use := func(offset int64, length int64) {
+		for c := offset / clusterSize; c < (offset+length+clusterSize-1)/clusterSize; c++ {
+			used[c]++
+		}
+	}
+	use(0, clusterSize)
+	use(int64(header.L1TableOffset), int64(header.L1Size)*8)
+	use(int64(header.RefcountTableOffset), int64(header.RefcountTableClusters)*clusterSize)
+
+	data := make([]byte, header.Size)
+	dataClusters, zeroClusters := 0, 0
+	l2Entries := clusterSize / 8
+	for i := int64(0); i < int64(header.L1Size); i++ {
+		l2Offset := int64(binary.BigEndian.Uint64(image[int64(header.L1TableOffset)+i*8:]) & qcow2.OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		use(l2Offset, clusterSize)
+		for j := int64(0); j < l2Entries; j++ {
+			entry := binary.BigEndian.Uint64(image[l2Offset+j*8:])
+			if entry&qcow2.FlagZero != 0 {
+				zeroClusters++
+			}
+			offset := int64(entry & qcow2.OffsetMask)
+			if offset == 0 {
+				continue
+			}
+			use(offset, clusterSize)
+			dataClusters++
+			copy(data[(i*l2Entries+j)*clusterSize:], image[offset:offset+clusterSize])
+		}
+	}
+
+	refcounts := clusterSize * 8 / (1 << header.RefcountOrder)
+	for i := int64(0); i < int64(header.RefcountTableClusters)*l2Entries; i++ {
+		offset := int64(binary.BigEndian.Uint64(image[int64(header.RefcountTableOffset)+i*8:]))
+		if offset == 0 {
+			continue
+		}
+		use(offset, clusterSize)
+		for j := int64(0); j < refcounts; j++ {
+			refcount := binary.BigEndian.Uint16(image[offset+j*2:])
+			cluster := i*refcounts + j
+			if (cluster < int64(len(image))/clusterSize && refcount != 1) || (cluster >= int64(len(image))/clusterSize && refcount != 0) {
+				t.Fatalf("Cluster %d has refcount %d", cluster, refcount)
+			}
+		}
+	}
+	if int64(len(image))%clusterSize != 0 || int64(len(used)) != int64(len(image))/clusterSize {
+		t.Errorf("Image of %d bytes uses %d clusters", len(image), len(used))
+	}
+	for cluster, n := range used {
+		if n != 1 {
+			t.Errorf("Cluster %d is used %d times", cluster, n)
+		}
+	}
+	return header, data, dataClusters, zeroClusters
+}
+
+func TestExportQcow2(t *testing.T) {
+	// Over 1GB, so that two L2 tables are needed, ending in a partial cluster
+	capacity := disklib.VixDiskLibSectorType(2*1024*1024 + 1000)
+	src := newTestDisk(t, capacity)
+	expected := make([]byte, src.Capacity())
+	random := rand.New(rand.NewSource(60))
+	for _, area := range []struct{ off, length int64 }{
+		{0, 100000},
+		{600 * 1024 * 1024, 4096},
+		{src.Capacity() - 1000, 1000},
+	} {
+		random.Read(expected[area.off : area.off+area.length])
+		src.WriteAt(expected[area.off:area.off+area.length], area.off)
+	}
+	// Allocated but all zeros
+	src.WriteAt(make([]byte, 65536), 2*1024*1024)
+
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := qcow2.Export(f, src); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	f.Close()
+
+	header, data, dataClusters, zeroClusters := readQcow2(t, path)
+	if header.Magic != qcow2.Magic || header.Version != 3 || int64(header.Size) != src.Capacity() || header.L1Size != 3 {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	// Two clusters at 0, one at 600MB and the partial last one
+	if dataClusters != 4 || zeroClusters != 1 {
+		t.Errorf("Image holds %d data and %d zero clusters, expected 4 and 1", dataClusters, zeroClusters)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Image does not match the disk")
+	}
+
+	f, err = os.Create(filepath.Join(t.TempDir(), "order.qcow2"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	q, _ := qcow2.NewWriter(f, 1024*1024)
+	if err := q.WriteCluster(65536, make([]byte, 65536)); err != nil {
+		t.Fatalf("WriteCluster failed: %v", err)
+	}
+	if err := q.WriteCluster(0, make([]byte, 65536)); err == nil {
+		t.Errorf("WriteCluster should refuse clusters out of order")
+	}
+}
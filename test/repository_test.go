@@ -0,0 +1,409 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/repository"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+func TestRepositoryBackup(t *testing.T) {
+	root := t.TempDir()
+	repo, err := repository.Create(root, repository.Config{}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := repository.Create(root, repository.Config{}, nil); err == nil {
+		t.Errorf("Create should refuse an existing repository")
+	}
+	repo, err = repository.Open(root, nil)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	m := repository.Manifest{Metadata: map[string]string{"uuid": "60 00 C2 91"}}
+	m.SetInfo(virtual_disks.DefaultInfo(4096))
+	bw, err := repo.NewBackup(m)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	// Out of order, and the first two are adjacent
+	bw.WriteAt(bytes.Repeat([]byte{'b'}, 1000), 1000)
+	bw.WriteAt(bytes.Repeat([]byte{'c'}, 500), 2000)
+	bw.WriteAt(bytes.Repeat([]byte{'a'}, 100), 10)
+	if _, err := bw.WriteAt(make([]byte, 512), 4096*512); err == nil {
+		t.Errorf("WriteAt past the end of the disk should fail")
+	}
+	full, err := bw.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if len(full.Extents) != 2 || full.Extents[0].Offset != 10 || full.Extents[1].Length != 1500 || full.DataSize() != 1600 {
+		t.Errorf("Unexpected extents %+v", full.Extents)
+	}
+
+	// Incrementals must match the capacity of their parent
+	m.Parent = full.ID
+	m.Capacity = 8192
+	if _, err := repo.NewBackup(m); err == nil {
+		t.Errorf("NewBackup should refuse an incremental of another size")
+	}
+	m.Capacity = 4096
+	bw, err = repo.NewBackup(m)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	bw.WriteAt([]byte("abc"), 0)
+	bw.Abort()
+
+	manifests, err := repo.List()
+	if err != nil || len(manifests) != 1 || manifests[0].ID != full.ID {
+		t.Fatalf("List returned %v, %v", manifests, err)
+	}
+
+	backup, err := repo.OpenBackup(full.ID)
+	if err != nil {
+		t.Fatalf("OpenBackup failed: %v", err)
+	}
+	defer backup.Close()
+	got := make([]byte, 3000)
+	if n, err := backup.ReadAt(got, 0); n != len(got) || err != nil {
+		t.Fatalf("ReadAt returned %d, %v", n, err)
+	}
+	expected := make([]byte, 3000)
+	copy(expected[10:], bytes.Repeat([]byte{'a'}, 100))
+	copy(expected[1000:], bytes.Repeat([]byte{'b'}, 1000))
+	copy(expected[2000:], bytes.Repeat([]byte{'c'}, 500))
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Backup reads back wrong data")
+	}
+	blocks, vErr := backup.QueryAllocatedBlocks(0, 4096, 128)
+	if vErr != nil || len(blocks) != 1 || blocks[0].Offset() != 0 || blocks[0].Length() != 128 {
+		t.Errorf("QueryAllocatedBlocks returned %v, %v", blocks, vErr)
+	}
+}
+
+func TestRepositoryInvalidBackupIDs(t *testing.T) {
+	root := t.TempDir()
+	repo, err := repository.Create(root, repository.Config{}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	m := repository.Manifest{}
+	m.SetInfo(virtual_disks.DefaultInfo(4096))
+	bw, err := repo.NewBackup(m)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	bw.WriteAt(bytes.Repeat([]byte{'a'}, 512), 0)
+	full, err := bw.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	for _, id := range []string{"", ".", "..", "../backups", full.ID + "/.."} {
+		if err := repo.Delete(id); err == nil {
+			t.Errorf("Delete(%q) should fail", id)
+		}
+		if _, err := repo.Manifest(id); err == nil {
+			t.Errorf("Manifest(%q) should fail", id)
+		}
+		if _, err := repo.OpenBackup(id); err == nil {
+			t.Errorf("OpenBackup(%q) should fail", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "repository.json")); err != nil {
+		t.Errorf("Delete removed the repository: %v", err)
+	}
+	manifests, err := repo.List()
+	if err != nil || len(manifests) != 1 || manifests[0].ID != full.ID {
+		t.Errorf("List returned %v, %v", manifests, err)
+	}
+}
+
+func TestRepositoryDedup(t *testing.T) {
+	for _, chunking := range []repository.Chunking{
+		{Mode: repository.ChunkingFixed, ChunkSize: 4096},
+		{Mode: repository.ChunkingCDC, ChunkSize: 4096},
+	} {
+		repo, err := repository.Create(t.TempDir(), repository.Config{Chunking: chunking}, nil)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		m := repository.Manifest{}
+		m.SetInfo(virtual_disks.DefaultInfo(2048))
+		data := make([]byte, 256*1024)
+		rand.New(rand.NewSource(4)).Read(data)
+
+		backup := func(p []byte, off int64) (*repository.Manifest, repository.Stats) {
+			bw, err := repo.NewBackup(m)
+			if err != nil {
+				t.Fatalf("NewBackup failed: %v", err)
+			}
+			if _, err := bw.WriteAt(p, off); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			stats := bw.Stats()
+			manifest, err := bw.Commit()
+			if err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			return manifest, stats
+		}
+
+		first, stats := backup(data, 0)
+		if stats.ReusedChunks != 0 || stats.NewBytes != int64(len(data)) {
+			t.Errorf("%s: first backup stats %+v", chunking.Mode, stats)
+		}
+		_, stats = backup(data, 0)
+		if stats.NewChunks != 0 || stats.ReusedBytes != int64(len(data)) {
+			t.Errorf("%s: identical backup stats %+v", chunking.Mode, stats)
+		}
+		// Move the data by less than a chunk: only content defined chunks
+		// still match
+		shifted, stats := backup(data, 1000)
+		if chunking.Mode == repository.ChunkingCDC && stats.ReusedBytes < int64(len(data))/2 {
+			t.Errorf("%s: shifted backup stats %+v", chunking.Mode, stats)
+		}
+		if chunking.Mode == repository.ChunkingFixed && stats.ReusedChunks != 0 {
+			t.Errorf("%s: shifted backup stats %+v", chunking.Mode, stats)
+		}
+
+		b, err := repo.OpenBackup(shifted.ID)
+		if err != nil {
+			t.Fatalf("OpenBackup failed: %v", err)
+		}
+		got := make([]byte, len(data))
+		if _, err := b.ReadAt(got, 1000); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: shifted backup reads back wrong data, %v", chunking.Mode, err)
+		}
+		b.Close()
+
+		// Nothing to prune until backups are deleted
+		if n, err := repo.Prune(); n != 0 || err != nil {
+			t.Errorf("%s: Prune returned %d, %v", chunking.Mode, n, err)
+		}
+		repo.Delete(first.ID)
+		if n, err := repo.Prune(); n != 0 || err != nil {
+			t.Errorf("%s: Prune removed chunks still in use: %d, %v", chunking.Mode, n, err)
+		}
+		repo.Delete(shifted.ID)
+		if n, err := repo.Prune(); err != nil || (chunking.Mode == repository.ChunkingFixed && n == 0) {
+			t.Errorf("%s: Prune returned %d, %v", chunking.Mode, n, err)
+		}
+		manifests, _ := repo.List()
+		b, err = repo.OpenBackup(manifests[0].ID)
+		if err != nil {
+			t.Fatalf("OpenBackup failed: %v", err)
+		}
+		if _, err := b.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: remaining backup reads back wrong data, %v", chunking.Mode, err)
+		}
+		b.Close()
+	}
+
+	if _, err := repository.Create(t.TempDir(), repository.Config{Chunking: repository.Chunking{Mode: repository.ChunkingCDC, ChunkSize: 5000}}, nil); err == nil {
+		t.Errorf("Create should refuse a CDC chunk size that is not a power of two")
+	}
+}
+
+func TestDumpBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(3*2048 + 100)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(2)).Read(data[:300000])
+	rand.New(rand.NewSource(3)).Read(data[len(data)-20000:])
+	src.WriteAt(data[:300000], 0)
+	src.WriteAt(data[len(data)-20000:], int64(len(data)-20000))
+	src.WriteMetadata("uuid", []byte("60 00 C2 91\x00"))
+	src.Close()
+
+	repo, err := repository.Create(filepath.Join(dir, "repo"), repository.Config{}, nil)
+	if err != nil {
+		t.Fatalf("repository.Create failed: %v", err)
+	}
+	backupDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpBackup)
+	if err := backupDumper.ReadNativeLocalDisk(srcPath); err != nil {
+		t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+	}
+	backupDumper.CopyOptions = dumper.CopyOptions{Readers: 2, Writers: 2}
+	manifest, err := backupDumper.DumpBackupDisk(repo, "")
+	backupDumper.Cleanup()
+	if err != nil {
+		t.Fatalf("DumpBackupDisk failed: %v", err)
+	}
+	if manifest.Capacity != capacity || manifest.Metadata["uuid"] != "60 00 C2 91" {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+	// One 1MB block at the start and the partial block at the end
+	if manifest.DataSize() != 1024*1024+100*512 {
+		t.Errorf("Backup holds %d bytes", manifest.DataSize())
+	}
+
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	restoreDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpResotre)
+	if err := restoreDumper.CreateNativeLocalDisk(dstPath, uint64(capacity)*disklib.VIXDISKLIB_SECTOR_SIZE); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	err = restoreDumper.DumpRestoreBackup(repo, manifest.ID)
+	restoreDumper.Cleanup()
+	if err != nil {
+		t.Fatalf("DumpRestoreBackup failed: %v", err)
+	}
+
+	dst, vErr := vmdk.Open(dstPath, true)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	got := make([]byte, dst.Capacity())
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Restored disk does not match the source")
+	}
+	buf := make([]byte, 64)
+	if vErr := dst.ReadMetadata("uuid", buf, uint(len(buf)), nil); vErr != nil || string(buf[:11]) != "60 00 C2 91" {
+		t.Errorf("Restored metadata is %q, %v", buf, vErr)
+	}
+}
+
+func TestDumpIncrementalBackupOfZeroedBlock(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(4 * 2048)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(5)).Read(data[:2*1024*1024])
+	src.WriteAt(data, 0)
+	src.Close()
+
+	repo, err := repository.Create(filepath.Join(dir, "repo"), repository.Config{}, nil)
+	if err != nil {
+		t.Fatalf("repository.Create failed: %v", err)
+	}
+	backup := func(parent string, dc *dumper.DiskChangeInfo) *repository.Manifest {
+		d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpBackup)
+		defer d.Cleanup()
+		if err := d.ReadNativeLocalDisk(srcPath); err != nil {
+			t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+		}
+		d.ChangeInfo = dc
+		d.CopyOptions = dumper.CopyOptions{SkipZeroes: true}
+		manifest, err := d.DumpBackupDisk(repo, parent)
+		if err != nil {
+			t.Fatalf("DumpBackupDisk failed: %v", err)
+		}
+		return manifest
+	}
+	full := backup("", nil)
+
+	// Zero the second megabyte and back up only that block
+	src, vErr = vmdk.Open(srcPath, false)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	copy(data[1024*1024:2*1024*1024], make([]byte, 1024*1024))
+	src.WriteAt(data[1024*1024:2*1024*1024], 1024*1024)
+	src.Close()
+	incremental := backup(full.ID, &dumper.DiskChangeInfo{
+		Length:      int64(len(data)),
+		ChangedArea: []dumper.ChangedArea{{Start: 1024 * 1024, Length: 1024 * 1024}},
+	})
+	if incremental.DataSize() != 1024*1024 {
+		t.Errorf("Incremental backup holds %d bytes, expected the zeroed megabyte", incremental.DataSize())
+	}
+
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	restoreDumper, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpResotre)
+	if err := restoreDumper.CreateNativeLocalDisk(dstPath, uint64(capacity)*disklib.VIXDISKLIB_SECTOR_SIZE); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	err = restoreDumper.DumpRestoreBackup(repo, incremental.ID)
+	restoreDumper.Cleanup()
+	if err != nil {
+		t.Fatalf("DumpRestoreBackup failed: %v", err)
+	}
+	dst, vErr := vmdk.Open(dstPath, true)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	got := make([]byte, dst.Capacity())
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Restored disk still holds the data of the block zeroed by the incremental")
+	}
+}
+
+func TestRepositoryConcurrentNewChunks(t *testing.T) {
+	repo, err := repository.Create(t.TempDir(), repository.Config{Chunking: repository.Chunking{Mode: repository.ChunkingFixed, ChunkSize: 4096}}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	m := repository.Manifest{}
+	m.SetInfo(virtual_disks.DefaultInfo(2048))
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(5)).Read(data)
+
+	// Several backups of the same data at once store every chunk exactly once
+	stats := make([]repository.Stats, 8)
+	var wg sync.WaitGroup
+	for i := range stats {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bw, err := repo.NewBackup(m)
+			if err != nil {
+				t.Errorf("NewBackup failed: %v", err)
+				return
+			}
+			if _, err := bw.WriteAt(data, 0); err != nil {
+				t.Errorf("WriteAt failed: %v", err)
+			}
+			stats[i] = bw.Stats()
+			bw.Abort()
+		}(i)
+	}
+	wg.Wait()
+	newChunks, reusedChunks := 0, 0
+	for _, s := range stats {
+		newChunks += s.NewChunks
+		reusedChunks += s.ReusedChunks
+	}
+	chunks := len(data) / 4096
+	if newChunks != chunks || reusedChunks != chunks*(len(stats)-1) {
+		t.Errorf("%d new and %d reused chunks, expected %d and %d", newChunks, reusedChunks, chunks, chunks*(len(stats)-1))
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+)
+
+func TestTransientErrors(t *testing.T) {
+	for _, code := range []uint64{disklib.VIX_E_HOST_CONNECTION_LOST, disklib.VIX_E_NET_HTTP_OPERATION_TIMEDOUT, disklib.VIX_E_OBJECT_IS_BUSY} {
+		if !disklib.IsTransientCode(code) {
+			t.Errorf("Code %d should be transient", code)
+		}
+	}
+	for _, code := range []uint64{disklib.VIX_OK, disklib.VIX_E_INVALID_ARG, disklib.VIX_E_FILE_NOT_FOUND, disklib.VIX_E_DISK_OUTOFRANGE, disklib.VIX_E_CANCELLED} {
+		if disklib.IsTransientCode(code) {
+			t.Errorf("Code %d should be fatal", code)
+		}
+	}
+	if disklib.IsTransient(nil) {
+		t.Errorf("No error is not transient")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := disklib.RetryPolicy{MaxAttempts: 4, InitialDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond, Jitter: 0.5}
+	lost := disklib.NewVddkError(disklib.VIX_E_HOST_CONNECTION_LOST, "Read failed.")
+	fatal := disklib.NewVddkError(disklib.VIX_E_FILE_NOT_FOUND, "Open failed.")
+
+	// Transient failures are retried until success
+	attempts := 0
+	err := policy.Do(context.Background(), "Read", func() disklib.VddkError {
+		attempts++
+		if attempts < 3 {
+			return lost
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Do returned %v after %d attempts, expected success after 3", err, attempts)
+	}
+
+	// Up to MaxAttempts
+	attempts = 0
+	err = policy.Do(context.Background(), "Read", func() disklib.VddkError {
+		attempts++
+		return lost
+	})
+	if err != lost || attempts != 4 {
+		t.Errorf("Do returned %v after %d attempts, expected the transient error after 4", err, attempts)
+	}
+
+	// Fatal errors are not retried
+	attempts = 0
+	err = policy.Do(context.Background(), "Open", func() disklib.VddkError {
+		attempts++
+		return fatal
+	})
+	if err != fatal || attempts != 1 {
+		t.Errorf("Do returned %v after %d attempts, expected the fatal error after 1", err, attempts)
+	}
+
+	// Nor is anything under NoRetry
+	attempts = 0
+	disklib.NoRetry.Do(context.Background(), "Read", func() disklib.VddkError {
+		attempts++
+		return lost
+	})
+	if attempts != 1 {
+		t.Errorf("NoRetry made %d attempts", attempts)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := disklib.RetryPolicy{MaxAttempts: 5, InitialDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}
+	lost := disklib.NewVddkError(disklib.VIX_E_HOST_TCP_CONN_LOST, "Write failed.")
+	var times []time.Time
+	policy.Do(context.Background(), "Write", func() disklib.VddkError {
+		times = append(times, time.Now())
+		return lost
+	})
+	// Waits of 10, 20, 40 and 40ms
+	for i, min := range []time.Duration{10, 20, 40, 40} {
+		if wait := times[i+1].Sub(times[i]); wait < min*time.Millisecond {
+			t.Errorf("Wait %d was %v, expected at least %v", i, wait, min*time.Millisecond)
+		}
+	}
+
+	// Cancelling stops the waiting
+	policy = disklib.RetryPolicy{MaxAttempts: 5, InitialDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	attempts := 0
+	err := policy.Do(ctx, "Write", func() disklib.VddkError {
+		attempts++
+		return lost
+	})
+	if err != lost || attempts != 1 || time.Since(start) > time.Minute {
+		t.Errorf("Cancelled Do returned %v after %d attempts", err, attempts)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+// allocatedBytes is the space a file takes on disk.
+func allocatedBytes(t *testing.T, path string) int64 {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	return stat.Blocks * 512
+}
+
+func TestExportSparseRaw(t *testing.T) {
+	src := newTestDisk(t, 128*1024)
+	data := make([]byte, src.Capacity())
+	random := rand.New(rand.NewSource(80))
+	random.Read(data[65536 : 2*65536])
+	random.Read(data[40*1024*1024 : 40*1024*1024+4096])
+	src.WriteAt(data[65536:2*65536], 65536)
+	src.WriteAt(data[40*1024*1024:40*1024*1024+4096], 40*1024*1024)
+	// Allocated in the source but all zeros
+	src.WriteAt(make([]byte, 1024*1024), 10*1024*1024)
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := virtual_disks.ExportSparseRaw(path, src); err != nil {
+		t.Fatalf("ExportSparseRaw failed: %v", err)
+	}
+	image, _ := os.ReadFile(path)
+	if !bytes.Equal(image, data) {
+		t.Fatalf("Image does not match the disk")
+	}
+	if allocated := allocatedBytes(t, path); allocated > 1024*1024 {
+		t.Errorf("Image of 64MB takes %d bytes", allocated)
+	}
+
+	// Read back, the image reports its data through SEEK_DATA
+	backend, vErr := virtual_disks.OpenFileBackend(path, true)
+	if vErr != nil {
+		t.Fatalf("OpenFileBackend failed: %s", vErr.Error())
+	}
+	readBack, _ := virtual_disks.NewBackendDiskHandle(backend)
+	defer readBack.Close()
+	extents, vErr := virtual_disks.QueryAllocatedExtents(readBack, disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	if vErr != nil {
+		t.Fatalf("QueryAllocatedExtents failed: %s", vErr.Error())
+	}
+	expected := [][2]disklib.VixDiskLibSectorType{{128, 128}, {40 * 2048, 128}}
+	if len(extents) != len(expected) {
+		t.Fatalf("Image has %d extents, expected %d", len(extents), len(expected))
+	}
+	for i, extent := range extents {
+		if extent.Offset() != expected[i][0] || extent.Length() != expected[i][1] {
+			t.Errorf("Extent %d is (%d, %d), expected %v", i, extent.Offset(), extent.Length(), expected[i])
+		}
+	}
+}
+
+func TestRawLocalDiskPunchHole(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.img")
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(81)).Read(data)
+
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	if err := d.CreateRawLocalDisk(path, uint64(len(data))); err != nil {
+		t.Fatalf("CreateRawLocalDisk failed: %v", err)
+	}
+	if _, err := d.WriteToVmdk(data, 0); err != nil {
+		t.Fatalf("WriteToVmdk failed: %v", err)
+	}
+	before := allocatedBytes(t, path)
+	// Zeros over written data free the blocks, an unaligned edge included
+	copy(data[4096-100:3*1024*1024], make([]byte, 3*1024*1024))
+	if _, err := d.WriteToVmdk(data[:3*1024*1024], 0); err != nil {
+		t.Fatalf("WriteToVmdk failed: %v", err)
+	}
+	d.Cleanup()
+	if after := allocatedBytes(t, path); after > before-2*1024*1024 {
+		t.Errorf("Writing zeros left %d of %d bytes allocated", after, before)
+	}
+	image, _ := os.ReadFile(path)
+	if !bytes.Equal(image, data) {
+		t.Errorf("Image does not match what was written")
+	}
+
+	d, _ = dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	defer d.Cleanup()
+	if err := d.ReadRawLocalDisk(path); err != nil {
+		t.Fatalf("ReadRawLocalDisk failed: %v", err)
+	}
+	got := make([]byte, len(data))
+	if _, err := d.ReadFromVmdk(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFromVmdk returned %v or wrong data", err)
+	}
+}
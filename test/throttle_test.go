@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+)
+
+func TestLimiter(t *testing.T) {
+	// The first operation goes through, the next 10 wait 1/50s each
+	limiter := virtual_disks.NewLimiter(0, 50)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := limiter.Wait(context.Background(), 1024*1024); err != nil {
+			t.Fatalf("Wait failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("11 operations at 50/s took %v", elapsed)
+	}
+
+	// Lifting the limit releases an operation that is already waiting
+	limiter.SetLimits(1024, 0)
+	limiter.Wait(context.Background(), 1024*1024)
+	done := make(chan error)
+	go func() {
+		done <- limiter.Wait(context.Background(), 1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetLimits(0, 0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Wait did not pick up the new limits")
+	}
+	if bytesPerSec, opsPerSec := limiter.Limits(); bytesPerSec != 0 || opsPerSec != 0 {
+		t.Errorf("Limits are %d, %v", bytesPerSec, opsPerSec)
+	}
+
+	limiter.SetLimits(1, 0)
+	limiter.Wait(context.Background(), 1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("Wait returned %v, expected a deadline error", err)
+	}
+
+	var nilLimiter *virtual_disks.Limiter
+	if err := nilLimiter.Wait(context.Background(), 1); err != nil {
+		t.Errorf("Wait on a nil limiter returned %v", err)
+	}
+}
+
+func TestThrottledCopy(t *testing.T) {
+	src := newTestDisk(t, 2048)
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(40)).Read(data)
+	src.WriteAt(data, 0)
+	dc := &dumper.DiskChangeInfo{
+		Length:      src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{{Start: 0, Length: src.Capacity()}},
+	}
+
+	// 16 blocks of 64KB at 4MB/s, all but the first wait 1/64s
+	dst := newTestDisk(t, 2048)
+	opts := dumper.CopyOptions{Readers: 4, Writers: 4, BlockSize: 64 * 1024, Limiter: virtual_disks.NewLimiter(4*1024*1024, 0)}
+	start := time.Now()
+	if err := dumper.CopyChangedAreas(context.Background(), dst, src, dc, opts); err != nil {
+		t.Fatalf("CopyChangedAreas failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Copy of 1MB at 4MB/s took %v", elapsed)
+	}
+	got := make([]byte, dst.Capacity())
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Throttled copy does not match the source")
+	}
+
+	// The handle counts each ReadAt as one operation, an unaligned one too
+	throttled := src.WithLimiter(virtual_disks.NewLimiter(0, 50))
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		throttled.ReadAt(got[:100], int64(i*100))
+	}
+	throttled.ReadAtContext(context.Background(), got, 0)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("7 reads at 50/s took %v", elapsed)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ReadAtContext through the limiter does not match the source")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vhd"
+)
+
+func TestExportFixedVHD(t *testing.T) {
+	// 1.5MB, padded to 2MB in the image
+	src := newTestDisk(t, 3072)
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(70)).Read(data[65536 : 3*65536])
+	src.WriteAt(data[65536:3*65536], 65536)
+
+	path := filepath.Join(t.TempDir(), "disk.vhd")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := vhd.ExportFixed(f, src); err != nil {
+		t.Fatalf("ExportFixed failed: %v", err)
+	}
+	f.Close()
+
+	image, _ := os.ReadFile(path)
+	if len(image) != len(data)+vhd.FooterSize {
+		t.Fatalf("Image is %d bytes", len(image))
+	}
+	if !bytes.Equal(image[:len(data)], data) {
+		t.Errorf("Image does not match the disk")
+	}
+	var footer vhd.Footer
+	binary.Read(bytes.NewReader(image[len(data):]), binary.BigEndian, &footer)
+	if string(footer.Cookie[:]) != vhd.FooterCookie || footer.CurrentSize != uint64(len(data)) || footer.DiskType != vhd.DiskTypeFixed {
+		t.Errorf("Unexpected footer %+v", footer)
+	}
+	var sum uint32
+	for i, b := range image[len(data):] {
+		if i < 64 || i >= 68 {
+			sum += uint32(b)
+		}
+	}
+	if ^sum != footer.Checksum {
+		t.Errorf("Footer checksum is %#x, expected %#x", footer.Checksum, ^sum)
+	}
+	// 2MB at 17 sectors per track and 4 heads
+	if footer.Cylinders != 60 || footer.Heads != 4 || footer.SectorsPerTrack != 17 {
+		t.Errorf("Geometry is %d/%d/%d", footer.Cylinders, footer.Heads, footer.SectorsPerTrack)
+	}
+}
+
+func TestExportVHDX(t *testing.T) {
+	const mb = 1024 * 1024
+	// 1MB blocks give a chunk ratio of 4096, so a sector bitmap entry follows
+	// the BAT entry of block 4095. The disk ends in a partial block.
+	capacity := disklib.VixDiskLibSectorType(5000*2048 + 1000)
+	src := newTestDisk(t, capacity)
+	areas := []struct{ off, length int64 }{
+		{512, 70000},
+		{4100*mb + 4096, 4096},
+		{src.Capacity() - 1000, 1000},
+	}
+	random := rand.New(rand.NewSource(71))
+	for i := range areas {
+		p := make([]byte, areas[i].length)
+		random.Read(p)
+		src.WriteAt(p, areas[i].off)
+	}
+	// Block 10 is allocated but all zeros
+	src.WriteAt(make([]byte, 4096), 10*mb)
+
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := vhd.ExportVHDX(f, src, mb); err != nil {
+		t.Fatalf("ExportVHDX failed: %v", err)
+	}
+	f.Close()
+	image, _ := os.ReadFile(path)
+
+	if string(image[:8]) != vhd.VHDXSignature {
+		t.Fatalf("Bad file identifier %q", image[:8])
+	}
+	crc := func(p []byte) uint32 {
+		p = append([]byte(nil), p...)
+		binary.LittleEndian.PutUint32(p[4:], 0)
+		return crc32.Checksum(p, crc32.MakeTable(crc32.Castagnoli))
+	}
+	for _, offset := range []int{vhd.HeaderOffset1, vhd.HeaderOffset2} {
+		header := image[offset : offset+4096]
+		if string(header[:4]) != "head" || crc(header) != binary.LittleEndian.Uint32(header[4:]) {
+			t.Errorf("Bad header at %d", offset)
+		}
+	}
+	regions := image[vhd.RegionTableOffset1 : vhd.RegionTableOffset1+65536]
+	if string(regions[:4]) != "regi" || crc(regions) != binary.LittleEndian.Uint32(regions[4:]) {
+		t.Fatalf("Bad region table")
+	}
+	var batOffset, metadataOffset int64
+	for i := 0; i < int(binary.LittleEndian.Uint32(regions[8:])); i++ {
+		var entry vhd.RegionTableEntry
+		binary.Read(bytes.NewReader(regions[16+32*i:]), binary.LittleEndian, &entry)
+		switch entry.Guid {
+		case vhd.BATRegionGUID:
+			batOffset = int64(entry.FileOffset)
+		case vhd.MetadataRegionGUID:
+			metadataOffset = int64(entry.FileOffset)
+		}
+	}
+
+	metadata := image[metadataOffset:]
+	if string(metadata[:8]) != "metadata" {
+		t.Fatalf("Bad metadata table")
+	}
+	var blockSize, diskSize int64
+	for i := 0; i < int(binary.LittleEndian.Uint16(metadata[10:])); i++ {
+		var entry vhd.MetadataTableEntry
+		binary.Read(bytes.NewReader(metadata[32+32*i:]), binary.LittleEndian, &entry)
+		switch entry.ItemId {
+		case vhd.FileParametersGUID:
+			blockSize = int64(binary.LittleEndian.Uint32(metadata[entry.Offset:]))
+		case vhd.VirtualDiskSizeGUID:
+			diskSize = int64(binary.LittleEndian.Uint64(metadata[entry.Offset:]))
+		}
+	}
+	if blockSize != mb || diskSize != src.Capacity() {
+		t.Fatalf("Metadata has block size %d and disk size %d", blockSize, diskSize)
+	}
+
+	const chunkRatio = 4096
+	batEntry := func(index int64) uint64 {
+		return binary.LittleEndian.Uint64(image[batOffset+index*8:])
+	}
+	present := 0
+	for i := int64(0); i < (diskSize+blockSize-1)/blockSize+(diskSize/blockSize)/chunkRatio; i++ {
+		if batEntry(i)&7 == vhd.PayloadBlockFullyPresent {
+			present++
+		}
+	}
+	if present != 3 || batEntry(10) != vhd.PayloadBlockZero || batEntry(chunkRatio) != vhd.SBBlockNotPresent || batEntry(4100+1)&7 != vhd.PayloadBlockFullyPresent {
+		t.Errorf("BAT holds %d present blocks", present)
+	}
+	for _, area := range areas {
+		block := area.off / blockSize
+		fileOffset := int64(batEntry(block+block/chunkRatio)>>20) * mb
+		got := image[fileOffset+area.off%blockSize : fileOffset+area.off%blockSize+area.length]
+		expected := make([]byte, area.length)
+		src.ReadAt(expected, area.off)
+		if !bytes.Equal(got, expected) {
+			t.Errorf("Area at %d does not match the disk", area.off)
+		}
+	}
+}
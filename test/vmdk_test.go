@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+func TestSparseHeaderSize(t *testing.T) {
+	if size := binary.Size(vmdk.SparseExtentHeader{}); size != disklib.VIXDISKLIB_SECTOR_SIZE {
+		t.Errorf("SparseExtentHeader is %d bytes, expected one sector", size)
+	}
+}
+
+func TestSparseVmdkRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.vmdk")
+	// 4 grain tables worth of 64KB grains, plus a partial one
+	capacity := disklib.VixDiskLibSectorType(4*512*128 + 100)
+	diskHandle, err := vmdk.Create(path, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if err != nil {
+		t.Fatalf("Create failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	data := bytes.Repeat([]byte("vmdk"), 40000)
+	offsets := []int64{500, 512 * 128 * 700, diskHandle.Capacity() - int64(len(data))}
+	for _, off := range offsets {
+		if n, err := diskHandle.WriteAt(data, off); err != nil || n != len(data) {
+			t.Fatalf("WriteAt(%d) returned %d, %v", off, n, err)
+		}
+	}
+	if err := diskHandle.WriteMetadata("uuid", []byte("60 00 C2 91 5b 4c 21 b7-4f 5f 1c 0e 0b 5c 8e 7a\x00")); err != nil {
+		t.Fatalf("WriteMetadata failed: %s", err.Error())
+	}
+	if err := diskHandle.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	diskHandle, err = vmdk.Open(path, true)
+	if err != nil {
+		t.Fatalf("Open failed, got error code: %d, error message: %s.", err.VixErrorCode(), err.Error())
+	}
+	defer diskHandle.Close()
+	if diskHandle.Capacity() != int64(capacity)*disklib.VIXDISKLIB_SECTOR_SIZE {
+		t.Errorf("Capacity is %d, expected %d sectors", diskHandle.Capacity(), capacity)
+	}
+	got := make([]byte, len(data))
+	for _, off := range offsets {
+		if _, err := diskHandle.ReadAt(got, off); err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Data read back at %d does not match", off)
+		}
+	}
+	// Never written, so reads back as zeros
+	if _, err := diskHandle.ReadAt(got, 512*128*100); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, make([]byte, len(got))) {
+		t.Errorf("Unallocated grains should read as zeros")
+	}
+
+	var requiredLen uint
+	diskHandle.ReadMetadata("uuid", nil, 0, &requiredLen)
+	buf := make([]byte, requiredLen)
+	if err := diskHandle.ReadMetadata("uuid", buf, requiredLen, nil); err != nil {
+		t.Fatalf("ReadMetadata failed: %s", err.Error())
+	}
+	if string(buf[:requiredLen-1]) != "60 00 C2 91 5b 4c 21 b7-4f 5f 1c 0e 0b 5c 8e 7a" {
+		t.Errorf("ReadMetadata returned %q", buf)
+	}
+
+	blocks, err := diskHandle.QueryAllocatedBlocks(0, 4*512*128, 2048)
+	if err != nil {
+		t.Fatalf("QueryAllocatedBlocks failed: %s", err.Error())
+	}
+	// Each write of 160000 bytes falls inside a single 1MB chunk
+	if len(blocks) != 3 || blocks[0].Offset() != 0 || blocks[1].Offset() != 128*700/2048*2048 || blocks[2].Offset() != 4*512*128-2048 {
+		for _, block := range blocks {
+			t.Logf("block %d+%d", block.Offset(), block.Length())
+		}
+		t.Errorf("Unexpected allocated blocks")
+	}
+}
+
+func TestStreamOptimizedExport(t *testing.T) {
+	capacity := disklib.VixDiskLibSectorType(3*512*128 + 64)
+	diskHandle, err := virtual_disks.NewBackendDiskHandle(virtual_disks.NewMemoryBackend(capacity))
+	if err != nil {
+		t.Fatalf("NewBackendDiskHandle failed: %s", err.Error())
+	}
+	expected := make([]byte, diskHandle.Capacity())
+	for i, off := range []int64{0, 70000, 512 * 128 * 600, diskHandle.Capacity() - 1000} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		diskHandle.WriteAt(data, off)
+		copy(expected[off:], data)
+	}
+
+	var stream bytes.Buffer
+	if err := vmdk.ExportStreamOptimized(&stream, diskHandle, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7); err != nil {
+		t.Fatalf("ExportStreamOptimized failed: %v", err)
+	}
+
+	// Follow the footer to the grain directory and the grain tables, and
+	// rebuild the disk from the grains they point at
+	raw := stream.Bytes()
+	header := raw[:disklib.VIXDISKLIB_SECTOR_SIZE]
+	if binary.LittleEndian.Uint32(header) != vmdk.SparseMagicNumber || binary.LittleEndian.Uint64(header[56:]) != vmdk.GDAtEnd {
+		t.Fatalf("Bad stream header")
+	}
+	sectorAt := func(sector uint64) []byte {
+		return raw[sector*disklib.VIXDISKLIB_SECTOR_SIZE:]
+	}
+	checkMarker := func(sector uint64, markerType uint32) uint64 {
+		marker := sectorAt(sector)
+		if binary.LittleEndian.Uint32(marker[8:]) != 0 || binary.LittleEndian.Uint32(marker[12:]) != markerType {
+			t.Fatalf("Expected a marker of type %d at sector %d", markerType, sector)
+		}
+		return binary.LittleEndian.Uint64(marker)
+	}
+	end := uint64(len(raw)) / disklib.VIXDISKLIB_SECTOR_SIZE
+	checkMarker(end-1, vmdk.MarkerEOS)
+	checkMarker(end-3, vmdk.MarkerFooter)
+	footer := sectorAt(end - 2)
+	if binary.LittleEndian.Uint32(footer) != vmdk.SparseMagicNumber {
+		t.Fatalf("Bad footer")
+	}
+	gdOffset := binary.LittleEndian.Uint64(footer[56:])
+	numGTs := (uint64(capacity) + 512*128 - 1) / (512 * 128)
+	if gdSectors := checkMarker(gdOffset-1, vmdk.MarkerGD); gdSectors*disklib.VIXDISKLIB_SECTOR_SIZE < numGTs*4 {
+		t.Fatalf("Grain directory of %d sectors is too small", gdSectors)
+	}
+	got := make([]byte, len(expected))
+	grains := 0
+	for i := uint64(0); i < numGTs; i++ {
+		gtOffset := uint64(binary.LittleEndian.Uint32(sectorAt(gdOffset)[i*4:]))
+		if gtOffset == 0 {
+			continue
+		}
+		if gtSectors := checkMarker(gtOffset-1, vmdk.MarkerGT); gtSectors != 4 {
+			t.Fatalf("Grain table %d is %d sectors long, expected 4", i, gtSectors)
+		}
+		for j := uint64(0); j < 512; j++ {
+			grainOffset := uint64(binary.LittleEndian.Uint32(sectorAt(gtOffset)[j*4:]))
+			if grainOffset == 0 {
+				continue
+			}
+			marker := sectorAt(grainOffset)
+			lba := binary.LittleEndian.Uint64(marker)
+			if lba != (i*512+j)*128 {
+				t.Fatalf("Grain table entry %d of table %d points at the grain for sector %d", j, i, lba)
+			}
+			size := binary.LittleEndian.Uint32(marker[8:])
+			zr, err := zlib.NewReader(bytes.NewReader(marker[12 : 12+size]))
+			if err != nil {
+				t.Fatalf("Grain at sector %d: %v", lba, err)
+			}
+			grain, _ := io.ReadAll(zr)
+			copy(got[lba*disklib.VIXDISKLIB_SECTOR_SIZE:], grain)
+			grains++
+		}
+	}
+	if grains != 4 {
+		t.Errorf("Got %d grains, expected 4", grains)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Disk rebuilt from the grain tables does not match the source")
+	}
+
+	// Read the stream back as a disk
+	path := filepath.Join(t.TempDir(), "stream.vmdk")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, vErr := vmdk.Open(path, false); vErr == nil {
+		t.Errorf("Open should refuse to write to a streamOptimized disk")
+	}
+	disk, vErr := vmdk.Open(path, true)
+	if vErr != nil {
+		t.Fatalf("Open failed: %s", vErr.Error())
+	}
+	defer disk.Close()
+	got = make([]byte, len(expected))
+	if n, err := disk.ReadAt(got, 0); n != len(got) || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt returned %d, %v", n, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("streamOptimized disk reads back wrong data")
+	}
+}
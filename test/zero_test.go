@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2018-2021 the Go Library for Virtual Disk Development Kit contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudsbit/virtual-disks/v2/dumper"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/disklib"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/virtual_disks"
+	"github.com/cloudsbit/virtual-disks/v2/pkg/vmdk"
+)
+
+func TestCopySkipZeroes(t *testing.T) {
+	src := newTestDisk(t, 4096)
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(90)).Read(data)
+	// Two adjacent zero blocks and a zero block at the end
+	copy(data[65536:3*65536], make([]byte, 2*65536))
+	copy(data[len(data)-65536:], make([]byte, 65536))
+	src.WriteAt(data, 0)
+	dc := &dumper.DiskChangeInfo{
+		Length:      src.Capacity(),
+		ChangedArea: []dumper.ChangedArea{{Start: 0, Length: src.Capacity()}},
+	}
+
+	for _, skip := range []bool{false, true} {
+		w := &countingWriter{data: make([]byte, len(data)), writes: make([]int, len(data))}
+		zeroes := dumper.NewZeroExtents()
+		checksums := dumper.NewChecksumManifest()
+		opts := dumper.CopyOptions{Readers: 4, Writers: 4, BlockSize: 65536, Zeroes: zeroes, SkipZeroes: skip, Checksums: checksums}
+		if err := dumper.CopyChangedAreas(context.Background(), w, src, dc, opts); err != nil {
+			t.Fatalf("CopyChangedAreas failed: %v", err)
+		}
+		expected := []dumper.ChangedArea{{Start: 65536, Length: 2 * 65536}, {Start: int64(len(data)) - 65536, Length: 65536}}
+		if !reflect.DeepEqual(zeroes.Areas(), expected) || zeroes.Bytes() != 3*65536 {
+			t.Errorf("Zero extents are %v", zeroes.Areas())
+		}
+		if w.writes[65536] != map[bool]int{false: 1, true: 0}[skip] || w.writes[0] != 1 {
+			t.Errorf("SkipZeroes %v wrote the zero block %d times", skip, w.writes[65536])
+		}
+		if !bytes.Equal(w.data, data) {
+			t.Errorf("Copy does not match the source")
+		}
+		// Skipped blocks are still covered by the checksums
+		if len(checksums.Blocks) != len(data)/65536 {
+			t.Errorf("Checksums of %d blocks", len(checksums.Blocks))
+		}
+	}
+}
+
+func TestDumpCloneDiskSkipsZeroes(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.vmdk")
+	capacity := disklib.VixDiskLibSectorType(4 * 2048)
+	src, vErr := vmdk.Create(srcPath, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+	if vErr != nil {
+		t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+	}
+	data := make([]byte, src.Capacity())
+	rand.New(rand.NewSource(91)).Read(data[:1024*1024])
+	// Allocated in the source, as on a freshly formatted guest
+	src.WriteAt(data, 0)
+	src.Close()
+
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	if err := d.ReadNativeLocalDisk(srcPath); err != nil {
+		t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+	}
+	if err := d.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	err := d.DumpCloneDisk(&dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{{Start: 0, Length: int64(len(data))}}})
+	if err != nil {
+		t.Fatalf("DumpCloneDisk failed: %v", err)
+	}
+	if areas := d.ZeroExtents.Areas(); !reflect.DeepEqual(areas, []dumper.ChangedArea{{Start: 1024 * 1024, Length: 3 * 1024 * 1024}}) {
+		t.Errorf("Zero extents are %v", areas)
+	}
+	if mismatched, err := d.DumpVerifyDisk(); err != nil || len(mismatched) != 0 {
+		t.Errorf("DumpVerifyDisk returned %v, %v", mismatched, err)
+	}
+	d.Cleanup()
+
+	dst, vErr := vmdk.Open(dstPath, true)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	extents, vErr := virtual_disks.QueryAllocatedExtents(dst, disklib.VIXDISKLIB_MIN_CHUNK_SIZE)
+	if vErr != nil || len(extents) != 1 || extents[0].Offset() != 0 || extents[0].Length() != 2048 {
+		t.Errorf("Target has allocated extents %v, %v", extents, vErr)
+	}
+	got := make([]byte, len(data))
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Target does not match the source")
+	}
+}
+
+func TestDumpCloneDiskTwiceWritesZeroes(t *testing.T) {
+	dir := t.TempDir()
+	capacity := disklib.VixDiskLibSectorType(4 * 2048)
+	data := make([]byte, capacity*disklib.VIXDISKLIB_SECTOR_SIZE)
+	rand.New(rand.NewSource(92)).Read(data[:1024*1024])
+	createSource := func(name string, p []byte) string {
+		path := filepath.Join(dir, name)
+		src, vErr := vmdk.Create(path, capacity, disklib.VIXDISKLIB_ADAPTER_SCSI_LSILOGIC, 7)
+		if vErr != nil {
+			t.Fatalf("vmdk.Create failed: %s", vErr.Error())
+		}
+		src.WriteAt(p, 0)
+		src.Close()
+		return path
+	}
+	fullPath := createSource("full.vmdk", data)
+	// The incremental source has a block that was data and is now zeros
+	changed := append([]byte(nil), data...)
+	copy(changed[65536:2*65536], make([]byte, 65536))
+	incrementalPath := createSource("incremental.vmdk", changed)
+
+	dstPath := filepath.Join(dir, "dst.vmdk")
+	d, _ := dumper.NewVadpDumper(dumper.VddkParams{}, dumper.DumpClone)
+	defer d.Cleanup()
+	if err := d.ReadNativeLocalDisk(fullPath); err != nil {
+		t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+	}
+	if err := d.CreateNativeLocalDisk(dstPath, uint64(len(data))); err != nil {
+		t.Fatalf("CreateNativeLocalDisk failed: %v", err)
+	}
+	err := d.DumpCloneDisk(&dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{{Start: 0, Length: int64(len(data))}}})
+	if err != nil {
+		t.Fatalf("DumpCloneDisk of the full copy failed: %v", err)
+	}
+
+	if err := d.ReadNativeLocalDisk(incrementalPath); err != nil {
+		t.Fatalf("ReadNativeLocalDisk failed: %v", err)
+	}
+	err = d.DumpCloneDisk(&dumper.DiskChangeInfo{Length: int64(len(data)), ChangedArea: []dumper.ChangedArea{{Start: 65536, Length: 65536}}})
+	if err != nil {
+		t.Fatalf("DumpCloneDisk of the incremental failed: %v", err)
+	}
+	if areas := d.ZeroExtents.Areas(); !reflect.DeepEqual(areas, []dumper.ChangedArea{{Start: 65536, Length: 65536}}) {
+		t.Errorf("Zero extents are %v", areas)
+	}
+	if mismatched, err := d.DumpVerifyDisk(); err != nil || len(mismatched) != 0 {
+		t.Errorf("DumpVerifyDisk returned %v, %v", mismatched, err)
+	}
+	d.Cleanup()
+
+	dst, vErr := vmdk.Open(dstPath, true)
+	if vErr != nil {
+		t.Fatalf("vmdk.Open failed: %s", vErr.Error())
+	}
+	defer dst.Close()
+	got := make([]byte, len(changed))
+	dst.ReadAt(got, 0)
+	if !bytes.Equal(got, changed) {
+		t.Errorf("Target still holds the data of the block zeroed by the incremental")
+	}
+}